@@ -0,0 +1,441 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// the operations measured, over the in-memory tree or the database file
+type benchStore interface {
+	set(key []byte, val []byte)
+	get(key []byte) ([]byte, bool)
+	del(key []byte) bool
+	scan(lo []byte, n int) int
+	load(n int, val []byte) // insert keys 0..n-1 in one go
+}
+
+type memStore struct{ c *Container }
+
+func (s memStore) set(key []byte, val []byte)    { s.c.tree.Insert(key, val) }
+func (s memStore) get(key []byte) ([]byte, bool) { return s.c.tree.Get(key) }
+func (s memStore) del(key []byte) bool           { return s.c.tree.Delete(key) }
+
+func (s memStore) scan(lo []byte, n int) int {
+	count := 0
+	for iter := s.c.tree.SeekLE(lo); iter.Valid() && count < n; iter.Next() {
+		count++
+	}
+	return count
+}
+
+func (s memStore) load(n int, val []byte) {
+	for i := 0; i < n; i++ {
+		s.set(benchKey(i), val)
+	}
+}
+
+type diskStore struct{ db *KeyValue }
+
+func (s diskStore) set(key []byte, val []byte) {
+	if err := s.db.Set(key, val); err != nil {
+		panic(err)
+	}
+}
+
+func (s diskStore) get(key []byte) ([]byte, bool) { return s.db.Get(key) }
+
+func (s diskStore) del(key []byte) bool {
+	deleted, err := s.db.Del(key)
+	if err != nil {
+		panic(err)
+	}
+	return deleted
+}
+
+func (s diskStore) scan(lo []byte, n int) int {
+	count := 0
+	it := s.db.Scan(lo, nil)
+	defer it.Close()
+	for ; it.Valid() && count < n; it.Next() {
+		count++
+	}
+	return count
+}
+
+func (s diskStore) load(n int, val []byte) {
+	err := s.db.Update(func(tx *Tx) error {
+		for i := 0; i < n; i++ {
+			if err := tx.Set(benchKey(i), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func benchKey(i int) []byte {
+	key := []byte("key:00000000")
+	binary.BigEndian.PutUint64(key[4:], uint64(i))
+	return key
+}
+
+var benchSizes = []struct {
+	name string
+	size int
+}{
+	{"small", 16},
+	{"medium", 256},
+	{"nearmax", BTREE_MAX_VAL_SIZE - 100},
+}
+
+// run fn for every backend and value size
+func benchRun(b *testing.B, fn func(b *testing.B, s benchStore, val []byte)) {
+	backends := []struct {
+		name string
+		open func(b *testing.B) benchStore
+	}{
+		{"mem", func(b *testing.B) benchStore {
+			return memStore{newContainer()}
+		}},
+		{"disk", func(b *testing.B) benchStore {
+			db := &KeyValue{Path: filepath.Join(b.TempDir(), "bench.db")}
+			if err := db.Open(); err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			b.Cleanup(func() { db.Close() })
+			return diskStore{db}
+		}},
+	}
+	for _, backend := range backends {
+		for _, size := range benchSizes {
+			b.Run(backend.name+"/"+size.name, func(b *testing.B) {
+				s := backend.open(b)
+				b.ReportAllocs()
+				b.SetBytes(int64(size.size))
+				fn(b, s, make([]byte, size.size))
+			})
+		}
+	}
+}
+
+// benchmarks below here
+
+func BenchmarkSetSequential(b *testing.B) {
+	benchRun(b, func(b *testing.B, s benchStore, val []byte) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.set(benchKey(i), val)
+		}
+	})
+}
+
+func BenchmarkSetRandom(b *testing.B) {
+	benchRun(b, func(b *testing.B, s benchStore, val []byte) {
+		rng := rand.New(rand.NewSource(1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.set(benchKey(rng.Int()), val)
+		}
+	})
+}
+
+// the same few keys over and over, the path stays in the cache
+func BenchmarkGetHot(b *testing.B) {
+	benchRun(b, func(b *testing.B, s benchStore, val []byte) {
+		s.load(10000, val)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := s.get(benchKey(i % 8)); !ok {
+				b.Fatal("key not found")
+			}
+		}
+	})
+}
+
+// random keys over the whole tree
+func BenchmarkGetCold(b *testing.B) {
+	benchRun(b, func(b *testing.B, s benchStore, val []byte) {
+		const n = 10000
+		s.load(n, val)
+		rng := rand.New(rand.NewSource(1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := s.get(benchKey(rng.Intn(n))); !ok {
+				b.Fatal("key not found")
+			}
+		}
+	})
+}
+
+// 100 keys per op, the bytes are per scanned value
+func BenchmarkScan(b *testing.B) {
+	benchRun(b, func(b *testing.B, s benchStore, val []byte) {
+		const n = 10000
+		s.load(n, val)
+		rng := rand.New(rand.NewSource(1))
+		b.SetBytes(int64(len(val)) * 100)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.scan(benchKey(rng.Intn(n-100)), 100)
+		}
+	})
+}
+
+// deleting every key empties the tree, merging nodes on the way
+func BenchmarkDel(b *testing.B) {
+	benchRun(b, func(b *testing.B, s benchStore, val []byte) {
+		s.load(b.N, val)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if !s.del(benchKey(i)) {
+				b.Fatal("key not found")
+			}
+		}
+	})
+}
+
+// the cost of checking the checksum of every page read
+func BenchmarkGetVerify(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		mode VerifyMode
+	}{{"off", VERIFY_OFF}, {"always", VERIFY_ALWAYS}} {
+		b.Run(mode.name, func(b *testing.B) {
+			db := &KeyValue{
+				Path:    filepath.Join(b.TempDir(), "bench.db"),
+				Options: Options{VerifyChecksums: mode.mode},
+			}
+			if err := db.Open(); err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer db.Close()
+			const n = 10000
+			s := diskStore{db}
+			s.load(n, make([]byte, 256))
+			rng := rand.New(rand.NewSource(1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := s.get(benchKey(rng.Intn(n))); !ok {
+					b.Fatal("key not found")
+				}
+			}
+		})
+	}
+}
+
+// a binary backup against a JSON dump of the same pairs
+func BenchmarkBackup(b *testing.B) {
+	db := &KeyValue{Path: filepath.Join(b.TempDir(), "bench.db")}
+	if err := db.Open(); err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	const n = 10000
+	diskStore{db}.load(n, make([]byte, 256))
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := db.BackupBinary(io.Discard); err != nil {
+				b.Fatalf("BackupBinary: %v", err)
+			}
+		}
+	})
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pairs := map[string][]byte{}
+			for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+				key, val := it.Deref()
+				pairs[string(key)] = val
+			}
+			if err := json.NewEncoder(io.Discard).Encode(pairs); err != nil {
+				b.Fatalf("Encode: %v", err)
+			}
+		}
+	})
+}
+
+// the first reads of keys spread over the file after opening, with and
+// without Warm. the file stays in the OS cache, so this only shows the
+// cost of the page faults.
+func BenchmarkFirstRead(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "bench.db")
+	db := &KeyValue{Path: path}
+	if err := db.Open(); err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	const n = 10000
+	diskStore{db}.load(n, make([]byte, 256))
+	db.Close()
+	for _, warm := range []bool{false, true} {
+		name := map[bool]string{false: "cold", true: "warm"}[warm]
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// verifying on open would read every page already
+				db := &KeyValue{Path: path, Options: Options{VerifyChecksums: VERIFY_OFF}}
+				if err := db.Open(); err != nil {
+					b.Fatalf("Open: %v", err)
+				}
+				if warm {
+					if err := db.Warm(); err != nil {
+						b.Fatalf("Warm: %v", err)
+					}
+				}
+				b.StartTimer()
+				for j := 0; j < n; j += 97 {
+					if _, ok := db.Get(benchKey(j)); !ok {
+						b.Fatal("key not found")
+					}
+				}
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// short scans starting close to each other, with and without the
+// cache of leaf paths
+func BenchmarkScanPathCache(b *testing.B) {
+	for _, size := range []int{0, 16} {
+		b.Run(map[int]string{0: "off", 16: "on"}[size], func(b *testing.B) {
+			db := &KeyValue{
+				Path:    filepath.Join(b.TempDir(), "bench.db"),
+				Options: Options{PathCacheSize: size},
+			}
+			if err := db.Open(); err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer db.Close()
+			const n = 100000
+			s := diskStore{db}
+			s.load(n, make([]byte, 16))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.scan(benchKey(n/2+i%64), 10)
+			}
+		})
+	}
+}
+
+// the page callbacks of an Update freeing 10k pages
+func BenchmarkFreeListUpdate(b *testing.B) {
+	ops := 0
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := newFLContainer()
+		c.fl.Update(0, c.alloc(5000))
+		freed := c.alloc(10000)
+		c.ops = 0
+		b.StartTimer()
+		c.fl.Update(100, freed)
+		ops += c.ops
+	}
+	b.ReportMetric(float64(ops)/float64(b.N), "pageops/op")
+}
+
+// Get of keys that aren't there, with and without the bloom filter
+func BenchmarkGetMissing(b *testing.B) {
+	const n = 100000
+	for _, keys := range []int{0, n} {
+		b.Run(map[int]string{0: "off", n: "on"}[keys], func(b *testing.B) {
+			db := &KeyValue{
+				Path:    filepath.Join(b.TempDir(), "bench.db"),
+				Options: Options{BloomKeys: keys},
+			}
+			if err := db.Open(); err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer db.Close()
+			s := diskStore{db}
+			s.load(n, make([]byte, 16))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := db.Get(benchKey(n + i%n)); ok {
+					b.Fatal("found a missing key")
+				}
+			}
+		})
+	}
+}
+
+// evict the file from the OS cache, the pages must be clean. it has no
+// effect on tmpfs, then the scans only differ by the page faults.
+func dropFileCache(b *testing.B, path string) {
+	fp, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fp.Close()
+	const POSIX_FADV_DONTNEED = 4
+	syscall.Syscall6(syscall.SYS_FADVISE64, fp.Fd(), 0, 0, POSIX_FADV_DONTNEED, 0, 0)
+}
+
+// a full scan of a file just out of the OS cache, with and without
+// reading the leaves ahead
+func BenchmarkColdScan(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "bench.db")
+	db := &KeyValue{Path: path}
+	if err := db.Open(); err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	// random inserts over many commits scatter the leaves over the
+	// file, in order they'd be read ahead by the OS already
+	const n = 100000
+	perm := rand.New(rand.NewSource(1)).Perm(n)
+	for len(perm) > 0 {
+		batch := perm[:min(len(perm), 1000)]
+		perm = perm[len(batch):]
+		err := db.Update(func(tx *Tx) error {
+			for _, i := range batch {
+				if err := tx.Set(benchKey(i), make([]byte, 256)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("Update: %v", err)
+		}
+	}
+	db.Close()
+	for _, ahead := range []int{0, 8} {
+		b.Run(fmt.Sprintf("ahead=%d", ahead), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dropFileCache(b, path)
+				db := &KeyValue{Path: path, Options: Options{
+					VerifyChecksums: VERIFY_OFF,
+					ScanReadAhead:   ahead,
+				}}
+				if err := db.Open(); err != nil {
+					b.Fatalf("Open: %v", err)
+				}
+				b.StartTimer()
+				count := 0
+				for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+					count++
+				}
+				b.StopTimer()
+				if count != n {
+					b.Fatalf("scanned %d keys", count)
+				}
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -4,24 +4,92 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 const (
 	BNODE_NODE = 1 // nodes without values
 	BNODE_LEAF = 2 // leaf nodes with values
 
-	HEADER             = 4 // contains type of node and number of keys
-	BTREE_PAGE_SIZE    = 4096
-	BTREE_MAX_KEY_SIZE = 1000
+	HEADER             = 4    // contains type of node and number of keys
+	BTREE_PAGE_SIZE    = 4096 // the default page size
+	BTREE_MAX_KEY_SIZE = 1000 // limits at the default page size
 	BTREE_MAX_VAL_SIZE = 3000
+
+	// a node being split spans 2 pages and its offsets are uint16,
+	// checkPageSize keeps it addressable
+	BTREE_MIN_PAGE_SIZE = 1024
+	BTREE_MAX_PAGE_SIZE = 32768
+
+	// the top bit of vlen marks a value stored behind a metadata
+	// prefix, the max value size leaves it free at every page size
+	VLEN_META = 0x8000
 )
 
+// check the nodes made by the leaf updates, merges and splits, for
+// tests and debugging. a broken node panics naming the operation.
+var DebugChecks = false
+
 func init() {
+	for _, size := range []int{BTREE_MIN_PAGE_SIZE, BTREE_PAGE_SIZE, BTREE_MAX_PAGE_SIZE} {
+		if err := checkPageSize(size); err != nil {
+			panic(err)
+		}
+	}
+	if maxKeySize(BTREE_PAGE_SIZE) != BTREE_MAX_KEY_SIZE ||
+		maxValSize(BTREE_PAGE_SIZE) != BTREE_MAX_VAL_SIZE {
+		panic("max key/val sizes don't match the default page size")
+	}
+}
+
+// the largest key and value at a page size,
+// a quarter and three quarters of the page less some room for the headers
+func maxKeySize(pageSize int) int {
+	return pageSize/4 - 24
+}
+
+func maxValSize(pageSize int) int {
+	return pageSize/4*3 - 72
+}
+
+// how many entries with the key and value sizes fit in a node, each one
+// takes a pointer, an offset, the two lengths and the KV itself
+func entriesPerNode(nodeSize int, keyLen int, valLen int) int {
+	return (nodeSize - HEADER) / (8 + 2 + 4 + keyLen + valLen)
+}
+
+// entries per page in a new file with the default page size.
+// KeyValue.MaxEntriesPerPage answers it for an open database.
+func MaxEntriesPerPage(keyLen int, valLen int) int {
+	return entriesPerNode(BTREE_PAGE_SIZE-csumSize(CSUM_CRC32C), keyLen, valLen)
+}
+
+// bytes of a page left for the entries after the header and the
+// checksum, in a new file with the default page size.
+// KeyValue.UsableBytesPerPage answers it for an open database.
+func UsableBytesPerPage() int {
+	return BTREE_PAGE_SIZE - csumSize(CSUM_CRC32C) - HEADER
+}
+
+func checkPageSize(pageSize int) error {
+	if pageSize < BTREE_MIN_PAGE_SIZE || pageSize > BTREE_MAX_PAGE_SIZE ||
+		pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("page size %d is not a power of two in [%d, %d]",
+			pageSize, BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE)
+	}
 	// ensures that a node with a single KV-pair will not exceed the size of the page
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	if node1max > BTREE_PAGE_SIZE {
-		panic("Node size exceeds size of page")
+	node1max := HEADER + 8 + 2 + 4 + maxKeySize(pageSize) + maxValSize(pageSize)
+	if node1max > pageSize {
+		return fmt.Errorf("page size %d: node size exceeds size of page", pageSize)
 	}
+	// the positions in a node are uint16, the largest node is a full
+	// one before its split with the largest leaf entry added to it, or
+	// an internal one with a kid replaced by 3
+	grown := max(node1max-HEADER, 2*(8+2+4+maxKeySize(pageSize)))
+	if pageSize+grown > math.MaxUint16 {
+		return fmt.Errorf("page size %d: a node being split overflows its uint16 offsets", pageSize)
+	}
+	return nil
 }
 
 type BNode struct {
@@ -32,12 +100,24 @@ type BNode struct {
 	// offsets: nkeys * 2B
 	// key-values: ...
 	//		klen: 2B
-	//		vlen: 2B
+	//		vlen: 2B, VLEN_META may be set
 	//		key: ...
+	//		mlen: 1B if VLEN_META is set, counted in vlen
+	//		meta: mlen bytes, counted in vlen
 	//		val: ...
 	data []byte // using bytes to dump the value to disk
 }
 
+// a node over the bytes of a page stored by a NewBTree caller
+func NewBNode(data []byte) BNode {
+	return BNode{data: data}
+}
+
+// the bytes to store for the node, at most a page
+func (node BNode) Bytes() []byte {
+	return node.data
+}
+
 func (node BNode) btype() uint16 {
 	return binary.LittleEndian.Uint16(node.data)
 }
@@ -69,7 +149,7 @@ func (node BNode) setPtr(idx uint16, val uint64) {
 			idx, node.nkeys()))
 	}
 	pos := HEADER + 8*idx
-	binary.LittleEndian.AppendUint64(node.data[pos:], val)
+	binary.LittleEndian.PutUint64(node.data[pos:], val)
 }
 
 // offset functions and methods
@@ -90,7 +170,7 @@ func (node BNode) getOffSet(idx uint16) uint16 {
 }
 
 func (node BNode) setOffSet(idx uint16, offset uint16) {
-	binary.LittleEndian.AppendUint16(node.data[offsetPos(node, idx):], offset)
+	binary.LittleEndian.PutUint16(node.data[offsetPos(node, idx):], offset)
 }
 
 // key-values
@@ -115,6 +195,13 @@ func (node BNode) getKey(idx uint16) []byte {
 }
 
 func (node BNode) getVal(idx uint16) []byte {
+	val, _ := node.getValMeta(idx)
+	return val
+}
+
+// the value without the metadata prefix, and the metadata,
+// nil if it has none
+func (node BNode) getValMeta(idx uint16) ([]byte, []byte) {
 	if idx > node.nkeys() {
 		panic(fmt.Sprintf(
 			"getKey: idx (%d) out of range of keys (1 - %d)",
@@ -123,7 +210,12 @@ func (node BNode) getVal(idx uint16) []byte {
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node.data[pos+0:])
 	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
-	return node.data[pos+4+klen:][:vlen]
+	val := node.data[pos+4+klen:][:vlen&^VLEN_META]
+	if vlen&VLEN_META == 0 {
+		return val, nil
+	}
+	mlen := 1 + int(val[0])
+	return val[mlen:], val[1:mlen]
 }
 
 // node size in bytes
@@ -131,6 +223,37 @@ func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
 
+// the invariants of a node built by op: nkeys keys, each offset past
+// the one before by the size of its KV, and the KVs within size bytes
+func nodeCheck(op string, node BNode, nkeys uint16, size int) {
+	if node.nkeys() != nkeys {
+		panic(fmt.Sprintf("%s: %d keys, want %d", op, node.nkeys(), nkeys))
+	}
+	start := HEADER + 10*int(nkeys) // the first KV
+	if start > len(node.data) {
+		panic(fmt.Sprintf("%s: %d keys don't fit in %d bytes", op, nkeys, len(node.data)))
+	}
+	want := 0
+	for i := uint16(0); i < nkeys; i++ {
+		if got := int(node.getOffSet(i)); got != want {
+			panic(fmt.Sprintf("%s: offset %d is %d, want %d", op, i, got, want))
+		}
+		pos := start + want
+		if pos+4 > len(node.data) {
+			panic(fmt.Sprintf("%s: KV %d at %d is past the node", op, i, pos))
+		}
+		klen := int(binary.LittleEndian.Uint16(node.data[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node.data[pos+2:]) &^ VLEN_META)
+		want += 4 + klen + vlen
+	}
+	if got := int(node.getOffSet(nkeys)); got != want {
+		panic(fmt.Sprintf("%s: offset %d is %d, want %d", op, nkeys, got, want))
+	}
+	if start+want > size {
+		panic(fmt.Sprintf("%s: %d bytes in a %d byte node", op, start+want, size))
+	}
+}
+
 // finds the first child node where our key is in the range of the keys of the child
 func nodeLookupLE(node BNode, key []byte) uint16 {
 	nkeys := node.nkeys()
@@ -150,31 +273,53 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 	return found
 }
 
+// the leaf holds the key at idx, from nodeLookupLE. a leaf left empty
+// by PreSplit holds none.
+func leafHas(node BNode, idx uint16, key []byte) bool {
+	return idx < node.nkeys() && bytes.Equal(key, node.getKey(idx))
+}
+
+// the key goes before the first key of the leaf. the parent key of a
+// leaf split by PreSplit may be below its first key, so nodeLookupLE
+// returns 0 for the keys in between too.
+func leafBefore(node BNode, key []byte) bool {
+	return node.nkeys() == 0 || bytes.Compare(key, node.getKey(0)) < 0
+}
+
 // add a new key to a leaf node
 func leafInsert(
-	new BNode, old BNode, idx uint16, key []byte, val []byte,
+	new BNode, old BNode, idx uint16, key []byte, val []byte, flags uint16,
 ) {
 	new.setHeader(BNODE_LEAF, old.nkeys()+1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendKVFlags(new, idx, 0, key, val, flags)
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
+	if DebugChecks {
+		nodeCheck("leafInsert", new, old.nkeys()+1, len(new.data))
+	}
 }
 
 // update an existing key to a leaf node
 func leafUpdate(
-	new BNode, old BNode, idx uint16, key []byte, val []byte,
+	new BNode, old BNode, idx uint16, key []byte, val []byte, flags uint16,
 ) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendKVFlags(new, idx, 0, key, val, flags)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-idx-1)
+	if DebugChecks {
+		nodeCheck("leafUpdate", new, old.nkeys(), len(new.data))
+	}
 }
 
 // remove a key from a leaf node
 func leafDelete(new BNode, old BNode, idx uint16) {
 	new.setHeader(BNODE_LEAF, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-idx+1)
+	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-idx-1)
+	if DebugChecks {
+		nodeCheck("leafDelete", new, old.nkeys()-1, len(new.data))
+	}
 }
 
 // copy KVs into the position
@@ -213,13 +358,20 @@ func nodeAppendRange(
 
 func nodeAppendKV(
 	new BNode, idx uint16, ptr uint64, key []byte, val []byte,
+) {
+	nodeAppendKVFlags(new, idx, ptr, key, val, 0)
+}
+
+// flags are or-ed into vlen, val includes the metadata with VLEN_META
+func nodeAppendKVFlags(
+	new BNode, idx uint16, ptr uint64, key []byte, val []byte, flags uint16,
 ) {
 	// ptrs
 	new.setPtr(idx, ptr)
 	// KVs
 	pos := new.kvPos(idx)
 	binary.LittleEndian.PutUint16(new.data[pos+0:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(new.data[pos+2:], uint16(len(val)))
+	binary.LittleEndian.PutUint16(new.data[pos+2:], uint16(len(val))|flags)
 	copy(new.data[pos+4:], key)
 	copy(new.data[pos+4+uint16(len(key)):], val)
 	// the offset of the next key
@@ -228,30 +380,23 @@ func nodeAppendKV(
 
 // split a bigger-than-allowed node into two
 // the right node always fits on a page
-func splitSingleNode(left BNode, right BNode, old BNode) {
-	// simple example
-	// nKeys := uint16(old.getNumberOfKeys())
-	// left.setHeaders(old.getNodeType(), nKeys/2)
-	// bnodeAppendRange(left, old, 0, 0, nKeys/2)
-	// bnodeAppendRange(right, old, 0, (nKeys/2)+1, nKeys)
-
-	// this method fills up the right node as much as it can
+func splitSingleNode(left BNode, right BNode, old BNode, pageSize int) {
+	// split around the middle by size. filling one side as much as
+	// possible leaves single-key nodes behind on sequential inserts,
+	// which degrade into chains of single-child internal nodes
 	nkeys := old.nkeys()
-	totalBytes := old.nbytes()
-	idx := uint16(0)
-	curBytes := 0
-	for i := uint16(0); i < nkeys; i++ {
-		oldPos := old.kvPos(i)
-		keyLen := binary.LittleEndian.Uint16(old.data[oldPos:])
-		valLen := binary.LittleEndian.Uint16(old.data[oldPos+2:])
-		// 8 for pointer, 2 for offset, 2 for klen, 2 for vlen
-		curBytes += 8 + 2 + 2 + 2 + int(keyLen) + int(valLen)
-
-		// remove 4 from page size since 4 bytes will be used for the header
-		if totalBytes-uint16(curBytes) <= BTREE_PAGE_SIZE-4 {
-			idx = i
-			break
-		}
+	totalBytes := int(old.nbytes())
+	leftBytes := func(n uint16) int {
+		// 8 for pointer, 2 for offset per key
+		return HEADER + 10*int(n) + int(old.getOffSet(n))
+	}
+	idx := uint16(1)
+	for idx < nkeys-1 && leftBytes(idx) < (totalBytes+HEADER)/2 {
+		idx++
+	}
+	// the right node must fit on a page, the left one is split again if not
+	for idx < nkeys-1 && totalBytes-leftBytes(idx)+HEADER > pageSize {
+		idx++
 	}
 
 	left.setHeader(old.btype(), idx)
@@ -262,23 +407,38 @@ func splitSingleNode(left BNode, right BNode, old BNode) {
 }
 
 // splits the node if it's too big, resulting in 1 to 3 nodes
-func splitNode(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old.data = old.data[:BTREE_PAGE_SIZE]
+func splitNode(old BNode, pageSize int) (uint16, [3]BNode) {
+	n, nodes := splitNodes(old, pageSize)
+	if DebugChecks {
+		total := 0
+		for _, node := range nodes[:n] {
+			nodeCheck("splitNode", node, node.nkeys(), pageSize)
+			total += int(node.nkeys())
+		}
+		if total != int(old.nkeys()) {
+			panic(fmt.Sprintf("splitNode: %d keys in %d nodes, want %d", total, n, old.nkeys()))
+		}
+	}
+	return n, nodes
+}
+
+func splitNodes(old BNode, pageSize int) (uint16, [3]BNode) {
+	if int(old.nbytes()) <= pageSize {
+		old.data = old.data[:pageSize]
 		return 1, [3]BNode{old}
 	}
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
-	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	splitSingleNode(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left.data = left.data[:BTREE_PAGE_SIZE]
+	left := BNode{make([]byte, 2*pageSize)} // might be split later
+	right := BNode{make([]byte, pageSize)}
+	splitSingleNode(left, right, old, pageSize)
+	if int(left.nbytes()) <= pageSize {
+		left.data = left.data[:pageSize]
 		return 2, [3]BNode{left, right}
 	}
 	// the left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	splitSingleNode(leftleft, middle, left)
-	if leftleft.nbytes() > BTREE_PAGE_SIZE {
+	leftleft := BNode{make([]byte, pageSize)}
+	middle := BNode{make([]byte, pageSize)}
+	splitSingleNode(leftleft, middle, left, pageSize)
+	if int(leftleft.nbytes()) > pageSize {
 		panic("leftleft page size is still larger than page size")
 	}
 	return 3, [3]BNode{leftleft, middle, right}
@@ -289,6 +449,9 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
+	if DebugChecks {
+		nodeCheck("nodeMerge", new, left.nkeys()+right.nkeys(), len(new.data))
+	}
 }
 
 // replace 2 adjacent links with 1
@@ -6,73 +6,168 @@ import (
 )
 
 type BTree struct {
-	root uint64             // pointer to a page on disk
-	get  func(uint64) BNode // dereferencing a pointer
-	new  func(BNode) uint64 // allocate a new page
-	del  func(uint64)       // deallocate a page
+	root     uint64               // pointer to a page on disk
+	pageSize int                  // page size in bytes, BTREE_PAGE_SIZE if 0
+	reserved int                  // bytes at the end of a page nodes can't use
+	get      func(uint64) BNode   // dereferencing a pointer
+	new      func(BNode) uint64   // allocate a new page
+	del      func(uint64)         // deallocate a page
+	logf     func(string, ...any) // optional, reports changes of the tree height
+	// optional, told of the leaves of a leaf parent an iterator
+	// reads next, ahead of them at a time. a hint, see ScanReadAhead.
+	prefetch func([]uint64)
+	ahead    int
+	// the leaves split where the delta encoding of the storage fills
+	// a page, see SequentialKeys
+	seqKeys bool
+}
+
+// a tree at the default page size over pages kept by the caller. get
+// reads the node at a pointer, new stores a node and returns its
+// pointer, which must not be 0, and del frees a page. the nodes aren't
+// modified after new, so the storage may keep them as they are.
+func NewBTree(get func(uint64) BNode, new func(BNode) uint64, del func(uint64)) *BTree {
+	return &BTree{get: get, new: new, del: del}
+}
+
+// the pointer to the root node, 0 for an empty tree. a tree over
+// stored pages is opened again by passing it to SetRoot.
+func (tree *BTree) Root() uint64 {
+	return tree.root
+}
+
+func (tree *BTree) SetRoot(ptr uint64) {
+	tree.root = ptr
+}
+
+func (tree *BTree) psize() int {
+	if tree.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.pageSize
+}
+
+// node size in bytes
+func (tree *BTree) nsize() int {
+	return tree.psize() - tree.reserved
 }
 
 func (tree *BTree) Get(key []byte) ([]byte, bool) {
 	if len(key) == 0 {
 		panic("Get: key is empty")
 	}
-	if len(key) > BTREE_MAX_KEY_SIZE {
+	if len(key) > maxKeySize(tree.psize()) {
 		panic(fmt.Sprintf("Get: key size {%v} exceeded", key))
 	}
+	if tree.root == 0 {
+		return nil, false
+	}
 
-	node := treeGet(tree, tree.get(tree.root), key)
-	if node.data == nil {
+	_, node, idx := treeLocate(tree, key)
+	if !leafHas(node, idx, key) {
 		return nil, false
 	}
+	return node.getVal(idx), true
+}
+
+// Get that also returns the metadata stored with InsertMeta,
+// nil for a value inserted without it
+func (tree *BTree) GetMeta(key []byte) (val []byte, meta []byte, ok bool) {
+	if len(key) == 0 {
+		panic("GetMeta: key is empty")
+	}
+	if len(key) > maxKeySize(tree.psize()) {
+		panic(fmt.Sprintf("GetMeta: key size {%v} exceeded", key))
+	}
+	if tree.root == 0 {
+		return nil, nil, false
+	}
 
-	return node.getVal(nodeLookupLE(node, key)), true
+	_, node, idx := treeLocate(tree, key)
+	if !leafHas(node, idx, key) {
+		return nil, nil, false
+	}
+	val, meta = node.getValMeta(idx)
+	return val, meta, true
 }
 
 func (tree *BTree) Delete(key []byte) bool {
+	deleted, _ := tree.DeleteStats(key)
+	return deleted
+}
+
+// same as Delete, but also reports the number of node merges
+// that happened on the way down
+func (tree *BTree) DeleteStats(key []byte) (bool, int) {
 	if len(key) == 0 {
 		panic("Delete: key is of size 0")
 	}
-	if len(key) > BTREE_MAX_KEY_SIZE {
+	if len(key) > maxKeySize(tree.psize()) {
 		panic("Delete: key is larger than max key size")
 	}
 	if tree.root == 0 {
-		return false
+		return false, 0
 	}
 
-	updated := treeDelete(tree, tree.get(tree.root), key)
+	merges := 0
+	updated := treeDelete(tree, tree.get(tree.root), key, &merges)
 	if len(updated.data) == 0 {
-		return false
+		return false, 0
 	}
 
 	tree.del(tree.root)
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
 		// remove a level
 		tree.root = updated.getPtr(0)
+		if tree.logf != nil {
+			tree.logf("btree: root merged, removed a level")
+		}
 	} else {
-		tree.root = tree.new(updated)
+		treeNewRoot(tree, updated)
 	}
-	return true
+	return true, merges
 }
 
 func (tree *BTree) Insert(key []byte, val []byte) {
+	treeInsertRoot(tree, key, val, 0)
+}
+
+// insert with up to 255 bytes of metadata stored in front of the
+// value, the value and metaSize(meta) must fit the max value size
+func (tree *BTree) InsertMeta(key []byte, val []byte, meta []byte) {
+	if len(meta) > 255 {
+		panic("InsertMeta: meta is larger than 255 bytes")
+	}
+	stored := make([]byte, 0, metaSize(meta)+len(val))
+	stored = append(stored, byte(len(meta)))
+	stored = append(append(stored, meta...), val...)
+	treeInsertRoot(tree, key, stored, VLEN_META)
+}
+
+// the bytes the metadata takes in front of a value
+func metaSize(meta []byte) int {
+	return 1 + len(meta)
+}
+
+func treeInsertRoot(tree *BTree, key []byte, val []byte, flags uint16) {
 	if len(key) == 0 {
 		panic("Insert: key is of size 0")
 	}
-	if len(key) > BTREE_MAX_KEY_SIZE {
+	if len(key) > maxKeySize(tree.psize()) {
 		panic("Insert: key is larger than max key size")
 	}
-	if len(val) > BTREE_MAX_VAL_SIZE {
+	if len(val) > maxValSize(tree.psize()) {
 		panic("Insert: val is larger than max val size")
 	}
 
 	if tree.root == 0 {
 		// create first node
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		root := BNode{data: make([]byte, tree.nsize())}
 		root.setHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space
 		// thus a lookup can always find a containing node
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		nodeAppendKVFlags(root, 1, 0, key, val, flags)
 		tree.root = tree.new(root)
 		return
 	}
@@ -80,13 +175,20 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	node := tree.get(tree.root)
 	tree.del(tree.root)
 
-	node = treeInsert(tree, node, key, val)
-	nsplit, splitted := splitNode(node)
-	if nsplit > 1 {
+	treeNewRoot(tree, treeInsert(tree, node, key, val, flags))
+}
+
+// store the updated root, splitting it if it outgrew a page
+func treeNewRoot(tree *BTree, node BNode) {
+	splitted := treeSplit(tree, node)
+	if nsplit := len(splitted); nsplit > 1 {
 		// the root split, add a new level
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		root.setHeader(BNODE_NODE, nsplit)
-		for i, knode := range splitted[:nsplit] {
+		if tree.logf != nil {
+			tree.logf("btree: root split into %d nodes", nsplit)
+		}
+		root := BNode{data: make([]byte, tree.nsize())}
+		root.setHeader(BNODE_NODE, uint16(nsplit))
+		for i, knode := range splitted {
 			ptr, key := tree.new(knode), knode.getKey(0)
 			nodeAppendKV(root, uint16(i), ptr, key, nil)
 		}
@@ -96,10 +198,11 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	}
 }
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+func treeInsert(tree *BTree, node BNode, key []byte, val []byte, flags uint16) BNode {
 	// the result node
-	// can be bigger than 1 page, will be split if bigger
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	// can be bigger than 1 page, will be split if bigger. a decoded
+	// leaf may already be, see SequentialKeys.
+	new := BNode{data: make([]byte, max(2*tree.nsize(), int(node.nbytes())+tree.nsize()))}
 
 	// index to insert/update key
 	idx := nodeLookupLE(node, key)
@@ -107,14 +210,16 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
+		if leafBefore(node, key) {
+			leafInsert(new, node, 0, key, val, flags) // see PreSplit
+		} else if bytes.Equal(key, node.getKey(idx)) {
 			// found the key, update it
-			leafUpdate(new, node, idx, key, val)
+			leafUpdate(new, node, idx, key, val, flags)
 		} else {
-			leafInsert(new, node, idx+1, key, val)
+			leafInsert(new, node, idx+1, key, val, flags)
 		}
 	case BNODE_NODE:
-		nodeInsert(tree, new, node, idx, key, val)
+		nodeInsert(tree, new, node, idx, key, val, flags)
 	default:
 		panic("bad node!")
 	}
@@ -124,127 +229,158 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 // KV insertion to an internal node
 func nodeInsert(
 	tree *BTree, new BNode, node BNode, idx uint16, key []byte, val []byte,
+	flags uint16,
 ) {
 	// get and deallocate the kid node
 	kptr := node.getPtr(idx)
 	knode := tree.get(kptr)
 	tree.del(kptr)
 	// recursive insertion to the kid node
-	knode = treeInsert(tree, knode, key, val)
+	knode = treeInsert(tree, knode, key, val, flags)
 	//split the result
-	nsplit, splited := splitNode(knode)
-	// update the kid links
-	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
+	splited := treeSplit(tree, knode)
+	// update the kid links, the first one keeps its key. it's the first
+	// key of the kid unless the kid was an empty leaf, see PreSplit.
+	nodeReplaceKids(tree, new, node, idx, node.getKey(idx), splited)
 }
 
 // replace a link with multiple links
 func nodeReplaceKidN(
 	tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode,
+) {
+	var first []byte
+	if len(kids) > 0 {
+		first = kids[0].getKey(0)
+	}
+	nodeReplaceKids(tree, new, old, idx, first, kids)
+}
+
+// nodeReplaceKidN with the key of the first link
+func nodeReplaceKids(
+	tree *BTree, new BNode, old BNode, idx uint16, first []byte, kids []BNode,
 ) {
 	inc := uint16(len(kids))
 	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		key := node.getKey(0)
+		if i == 0 {
+			key = first
+		}
+		nodeAppendKV(new, idx+uint16(i), tree.new(node), key, nil)
 	}
-	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-idx+1)
+	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-idx-1)
 }
 
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+func treeDelete(tree *BTree, node BNode, key []byte, merges *int) BNode {
 	// find key
 	idx := nodeLookupLE(node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if !leafHas(node, idx, key) {
 			return BNode{}
 		}
 		// delete the key in the leaf
-		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		new := BNode{data: make([]byte, max(tree.nsize(), int(node.nbytes())))}
 		leafDelete(new, node, idx)
 		return new
 	case BNODE_NODE:
-		return nodeDelete(tree, node, idx, key)
+		return nodeDelete(tree, node, idx, key, merges)
 	default:
 		panic("bad node!")
 	}
 }
 
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func nodeDelete(
+	tree *BTree, node BNode, idx uint16, key []byte, merges *int,
+) BNode {
 	// recurse into the child
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.get(kptr), key)
+	updated := treeDelete(tree, tree.get(kptr), key, merges)
 	if len(updated.data) == 0 {
 		return BNode{} // not found
 	}
 	tree.del(kptr)
 
-	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	// the first key of the kid may be a longer one now, the node can
+	// outgrow a page like on an insert and is split by its parent
+	new := BNode{data: make([]byte, 2*tree.nsize())}
 	// check for merging
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0: // left
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		merged := BNode{data: make([]byte, tree.nsize())}
 		nodeMerge(merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(new, node, idx-1, tree.new(merged), mergedKey(merged, node, idx-1))
+		*merges++
 	case mergeDir > 0: // right
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		merged := BNode{data: make([]byte, tree.nsize())}
 		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
-	case mergeDir == 0:
-		if updated.nkeys() <= 0 {
-			panic("Number of keys in updated node is 0 or lower")
-		}
-		nodeReplaceKidN(tree, new, node, idx, updated)
+		nodeReplace2Kid(new, node, idx, tree.new(merged), mergedKey(merged, node, idx))
+		*merges++
+	case updated.nkeys() == 0:
+		// the only kid is empty, so is the node. its parent merges it,
+		// the leftmost leaf holds the dummy key and never empties.
+		nodeReplaceKidN(tree, new, node, idx)
+	default:
+		nodeReplaceKidN(tree, new, node, idx, treeSplit(tree, updated)...)
 	}
 	return new
 }
 
+// the key of the link to a merged node, the key of the left link if
+// two empty leaves of PreSplit were merged
+func mergedKey(merged BNode, node BNode, idx uint16) []byte {
+	if merged.nkeys() == 0 {
+		return node.getKey(idx)
+	}
+	return merged.getKey(0)
+}
+
 // conditions for merging a node
 // 1. node is smaller than 1/4 of a page
 // 2. has sibling and merged result does not exceed one page
 func shouldMerge(
 	tree *BTree, node BNode, idx uint16, updated BNode,
 ) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if int(updated.nbytes()) > tree.nsize()/4 {
 		return 0, BNode{}
 	}
 
 	if idx > 0 {
 		sibling := tree.get(node.getPtr(idx - 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		merged := int(sibling.nbytes()) + int(updated.nbytes()) - HEADER
+		if merged <= tree.nsize() {
 			return -1, sibling
 		}
 	}
 	if idx+1 < node.nkeys() {
 		sibling := tree.get(node.getPtr(idx + 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		merged := int(sibling.nbytes()) + int(updated.nbytes()) - HEADER
+		if merged <= tree.nsize() {
 			return 1, sibling
 		}
 	}
 	return 0, BNode{}
 }
 
-func treeGet(tree *BTree, node BNode, key []byte) BNode {
-	idx := nodeLookupLE(node, key)
-
-	switch node.btype() {
-	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
-			return BNode{}
+// the leaf the key is in or would go into, its pointer and the
+// position of the key or of the last key before it
+func treeLocate(tree *BTree, key []byte) (ptr uint64, node BNode, idx uint16) {
+	ptr = tree.root
+	for {
+		node = tree.get(ptr)
+		idx = nodeLookupLE(node, key)
+		switch node.btype() {
+		case BNODE_LEAF:
+			return ptr, node, idx
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
 		}
-		return node
-
-	case BNODE_NODE:
-		childPtr := node.getPtr(idx)
-		childPage := tree.get(childPtr)
-		return treeGet(tree, childPage, key)
-
-	default:
-		panic("bad node!")
 	}
 }
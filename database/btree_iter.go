@@ -0,0 +1,156 @@
+package database
+
+// B-tree iterator, walks the leaves in key order
+type BIter struct {
+	tree *BTree
+	path []BNode  // nodes from the root to the leaf
+	pos  []uint16 // index into each node of the path
+}
+
+// the empty key the first insert puts in the tree so that every lookup
+// finds a containing leaf. it isn't a user key, the iterations over
+// the user keys skip it with this.
+func isDummyKey(key []byte) bool {
+	return len(key) == 0
+}
+
+// an iterator at the first user key, past the dummy key
+func seekFirst(tree *BTree) *BIter {
+	iter := tree.SeekLE(nil)
+	for iter.Valid() {
+		if key, _ := iter.Deref(); !isDummyKey(key) {
+			break
+		}
+		iter.Next()
+	}
+	return iter
+}
+
+// find the closest position that is less than or equal to the key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := nodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		switch node.btype() {
+		case BNODE_LEAF:
+			ptr = 0
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+	}
+	iterBack(iter, key)
+	return iter
+}
+
+// move from a leaf with no key less than or equal to the key to the
+// last key of the leaves before it, see PreSplit. the first leaf holds
+// the dummy key, so there is one.
+func iterBack(iter *BIter, key []byte) {
+	last := len(iter.path) - 1
+	for last > 0 && iter.pos[last] == 0 && leafBefore(iter.path[last], key) {
+		level := last - 1
+		for level >= 0 && iter.pos[level] == 0 {
+			level--
+		}
+		if level < 0 {
+			return
+		}
+		iter.pos[level]--
+		for ; level < last; level++ {
+			kid := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+			iter.path[level+1] = kid
+			iter.pos[level+1] = max(kid.nkeys(), 1) - 1
+		}
+	}
+}
+
+// the iterator points at a key
+func (iter *BIter) Valid() bool {
+	last := len(iter.path) - 1
+	return last >= 0 && iter.pos[last] < iter.path[last].nkeys()
+}
+
+// get the current KV pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+	last := len(iter.path) - 1
+	node, idx := iter.path[last], iter.pos[last]
+	return node.getKey(idx), node.getVal(idx)
+}
+
+// Deref with the metadata of the value, see BTree.GetMeta
+func (iter *BIter) DerefMeta() ([]byte, []byte, []byte) {
+	last := len(iter.path) - 1
+	node, idx := iter.path[last], iter.pos[last]
+	val, meta := node.getValMeta(idx)
+	return node.getKey(idx), val, meta
+}
+
+// move to the next key
+func (iter *BIter) Next() {
+	if iter.Valid() {
+		iterNext(iter, len(iter.path)-1)
+	}
+}
+
+// returns false once the last key is passed, the levels
+// below are left alone then so the iterator stays at the end
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level > 0 {
+		if !iterNext(iter, level-1) { // move to a sibling node
+			return false
+		}
+	} else {
+		// past the last key
+		iter.pos[len(iter.pos)-1] = iter.path[len(iter.path)-1].nkeys()
+		return false
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		node := iter.path[level]
+		iter.path[level+1] = iter.tree.get(node.getPtr(iter.pos[level]))
+		iter.pos[level+1] = 0
+		if level+2 == len(iter.pos) {
+			iter.readAhead(true)
+			if iter.path[level+1].nkeys() == 0 {
+				return iterNext(iter, level+1) // an empty leaf, see PreSplit
+			}
+		}
+	}
+	return true
+}
+
+// pass the tree the next leaves of the leaf parent, tree.ahead of them
+// at a time so the hints are few. a scan starting in a parent is given
+// the leaves up to the end of the next window, then each leaf starting
+// a window passes the window after it. each leaf is passed once, past
+// the first window at least tree.ahead leaves before it's read.
+func (iter *BIter) readAhead(entered bool) {
+	tree, n := iter.tree, len(iter.path)
+	if tree.prefetch == nil || n < 2 {
+		return
+	}
+	parent, pos, ahead := iter.path[n-2], int(iter.pos[n-2]), tree.ahead
+	from, to := pos+1, (pos/ahead+2)*ahead
+	if entered && pos > 0 {
+		if pos%ahead != 0 {
+			return
+		}
+		from, to = pos+ahead+1, pos+2*ahead
+	}
+	to = min(to, int(parent.nkeys())-1)
+	if from > to {
+		return
+	}
+	ptrs := make([]uint64, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		ptrs = append(ptrs, parent.getPtr(uint16(i)))
+	}
+	tree.prefetch(ptrs)
+}
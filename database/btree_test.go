@@ -1,6 +1,13 @@
 package database
 
-import "unsafe"
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"unsafe"
+)
 
 type Container struct {
 	tree  BTree
@@ -9,9 +16,14 @@ type Container struct {
 }
 
 func newContainer() *Container {
+	return newContainerSize(BTREE_PAGE_SIZE)
+}
+
+func newContainerSize(pageSize int) *Container {
 	pages := map[uint64]BNode{}
 	return &Container{
 		tree: BTree{
+			pageSize: pageSize,
 			get: func(ptr uint64) BNode {
 				node, ok := pages[ptr]
 				if !ok {
@@ -20,7 +32,7 @@ func newContainer() *Container {
 				return node
 			},
 			new: func(node BNode) uint64 {
-				if node.nbytes() > BTREE_PAGE_SIZE {
+				if int(node.nbytes()) > pageSize {
 					panic("node does not fit within page")
 				}
 				key := uint64(uintptr(unsafe.Pointer(&node.data[0])))
@@ -54,3 +66,371 @@ func (c *Container) del(key string) bool {
 }
 
 // test cases below here
+
+func TestIterInOrder(t *testing.T) {
+	c := newContainer()
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%05d", (i*7919)%1000), fmt.Sprintf("val%d", i))
+	}
+
+	keys := make([]string, 0, len(c.ref))
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	iter := c.tree.SeekLE(nil)
+	iter.Next() // skip the dummy key
+	for _, k := range keys {
+		if !iter.Valid() {
+			t.Fatalf("iterator ended before %s", k)
+		}
+		key, val := iter.Deref()
+		if string(key) != k || string(val) != c.ref[k] {
+			t.Fatalf("Deref() = %s, %s, want %s, %s", key, val, k, c.ref[k])
+		}
+		iter.Next()
+	}
+	if iter.Valid() {
+		t.Fatal("iterator did not end")
+	}
+}
+
+// the end of a deep tree has to stop every level, not just the leaves
+func TestIterEndsDeepTree(t *testing.T) {
+	c := newContainer()
+	val := strings.Repeat("v", 1500) // two per leaf
+	const n = 3000
+	for i := 0; i < n; i++ {
+		c.add(fmt.Sprintf("key%05d", i), val)
+	}
+	if height := len(c.tree.SeekLE(nil).path); height < 3 {
+		t.Fatalf("tree height is %d, want at least 3", height)
+	}
+
+	count := 0
+	for iter := c.tree.SeekLE(nil); iter.Valid(); iter.Next() {
+		if count++; count > n+1 {
+			t.Fatal("iterator did not end")
+		}
+	}
+	if count != n+1 { // and the dummy key
+		t.Fatalf("iterated %d keys, want %d", count, n+1)
+	}
+}
+
+func TestDummyOnlyTree(t *testing.T) {
+	for _, n := range []int{1, 3000} {
+		c := newContainer()
+		val := strings.Repeat("v", 100)
+		for i := 0; i < n; i++ {
+			c.add(fmt.Sprintf("key%05d", i), val)
+		}
+		for i := 0; i < n; i++ {
+			if !c.del(fmt.Sprintf("key%05d", i)) {
+				t.Fatalf("Delete key%05d failed", i)
+			}
+		}
+
+		// a leaf holding just the dummy key
+		root := c.tree.get(c.tree.root)
+		if root.btype() != BNODE_LEAF || root.nkeys() != 1 || len(root.getKey(0)) != 0 {
+			t.Fatalf("%d: the root is type %d with %d keys", n, root.btype(), root.nkeys())
+		}
+		if idx := nodeLookupLE(root, []byte("key00000")); idx != 0 {
+			t.Fatalf("%d: nodeLookupLE = %d", n, idx)
+		}
+		if _, ok := c.tree.Get([]byte("key00000")); ok {
+			t.Fatalf("%d: found a deleted key", n)
+		}
+		if c.tree.Delete([]byte("key00000")) {
+			t.Fatalf("%d: deleted a missing key", n)
+		}
+		iter := c.tree.SeekLE([]byte("zzz"))
+		if key, _ := iter.Deref(); !iter.Valid() || len(key) != 0 {
+			t.Fatalf("%d: SeekLE is not at the dummy key", n)
+		}
+		if iter.Next(); iter.Valid() {
+			t.Fatalf("%d: the iterator goes past the dummy key", n)
+		}
+
+		c.add("key00001", "again")
+		if val, ok := c.tree.Get([]byte("key00001")); !ok || string(val) != "again" {
+			t.Fatalf("%d: Get after the insert = %q, %v", n, val, ok)
+		}
+		if root := c.tree.get(c.tree.root); root.nkeys() != 2 {
+			t.Fatalf("%d: the root has %d keys", n, root.nkeys())
+		}
+		if len(c.pages) != 1 {
+			t.Fatalf("%d: %d pages, want 1", n, len(c.pages))
+		}
+	}
+}
+
+func TestMaxEntriesPerPage(t *testing.T) {
+	sizes := [][2]int{{1, 0}, {8, 8}, {16, 100}, {100, 1000}, {BTREE_MAX_KEY_SIZE, BTREE_MAX_VAL_SIZE}}
+	for _, size := range sizes {
+		klen, vlen := size[0], size[1]
+		n := MaxEntriesPerPage(klen, vlen)
+		nodeSize := BTREE_PAGE_SIZE - csumSize(CSUM_CRC32C)
+
+		// n entries fit in a node, n+1 don't
+		fill := func(count int) int {
+			node := BNode{make([]byte, 2*BTREE_PAGE_SIZE)}
+			node.setHeader(BNODE_LEAF, uint16(count))
+			key, val := make([]byte, klen), make([]byte, vlen)
+			for i := 0; i < count; i++ {
+				nodeAppendKV(node, uint16(i), 0, key, val)
+			}
+			return int(node.nbytes())
+		}
+		if full := fill(n); full > nodeSize {
+			t.Fatalf("%d entries of %d+%d bytes take %d bytes", n, klen, vlen, full)
+		}
+		if over := fill(n + 1); over <= nodeSize {
+			t.Fatalf("%d entries of %d+%d bytes fit in %d bytes", n+1, klen, vlen, over)
+		}
+	}
+}
+
+// a free list over in-memory pages, counting the callbacks
+type flContainer struct {
+	fl    FreeList
+	pages map[uint64]BNode
+	next  uint64 // the page the next append gets
+	ops   int
+}
+
+func newFLContainer() *flContainer {
+	c := &flContainer{pages: map[uint64]BNode{}, next: 1}
+	c.fl = FreeList{
+		get: func(ptr uint64) BNode {
+			c.ops++
+			node, ok := c.pages[ptr]
+			if !ok {
+				panic("could not find page")
+			}
+			return node
+		},
+		new: func(node BNode) uint64 {
+			c.ops++
+			c.pages[c.next] = node
+			c.next++
+			return c.next - 1
+		},
+		use: func(ptr uint64, node BNode) {
+			c.ops++
+			c.pages[ptr] = node
+		},
+	}
+	return c
+}
+
+// pages that aren't on the list yet
+func (c *flContainer) alloc(n int) []uint64 {
+	ptrs := []uint64{}
+	for i := 0; i < n; i++ {
+		ptrs = append(ptrs, c.next)
+		c.next++
+	}
+	return ptrs
+}
+
+func TestFreeListUpdate(t *testing.T) {
+	c := newFLContainer()
+	rng := rand.New(rand.NewSource(1))
+	cap := flCap(&c.fl)
+	c.fl.Update(0, c.alloc(cap)) // a full node
+	for round := 0; round < 300; round++ {
+		oldNodes, oldItems := flWalk(&c.fl)
+		// around the multiples of the node capacity
+		popn := rng.Intn(min(len(oldItems), 3*cap) + 1)
+		freed := c.alloc(max(0, rng.Intn(4)*cap+rng.Intn(7)-3))
+		if round == 0 {
+			// the items left fill a node exactly
+			popn, freed = 1, freed[:2]
+		}
+		popped := []uint64{}
+		for i := 0; i < popn; i++ {
+			popped = append(popped, c.fl.Get(i))
+		}
+		appended := c.next
+		c.fl.Update(popn, freed)
+
+		// the pages are the same less the popped ones, each once,
+		// and the appended nodes
+		want := map[uint64]bool{}
+		for _, ptrs := range [][]uint64{oldNodes, oldItems, freed} {
+			for _, ptr := range ptrs {
+				want[ptr] = true
+			}
+		}
+		for _, ptr := range popped {
+			delete(want, ptr)
+		}
+		nodes, items := flWalk(&c.fl)
+		got := map[uint64]bool{}
+		for _, ptr := range append(nodes, items...) {
+			if got[ptr] {
+				t.Fatalf("round %d: page %d is on the list twice", round, ptr)
+			}
+			got[ptr] = true
+		}
+		for ptr := range got {
+			if !want[ptr] && ptr < appended {
+				t.Fatalf("round %d: page %d wasn't free", round, ptr)
+			}
+		}
+		for ptr := range want {
+			if !got[ptr] {
+				t.Fatalf("round %d: page %d is lost", round, ptr)
+			}
+		}
+		if c.fl.Total() != len(items) {
+			t.Fatalf("round %d: Total() = %d, %d items", round, c.fl.Total(), len(items))
+		}
+		top := flTop(&c.fl, len(items))
+		for _, i := range []int{0, len(items) / 2, len(items) - 1} {
+			if i >= 0 && c.fl.Get(i) != top[i] {
+				t.Fatalf("round %d: Get(%d) = %d, want %d", round, i, c.fl.Get(i), top[i])
+			}
+		}
+	}
+}
+
+func TestDebugChecks(t *testing.T) {
+	DebugChecks = true
+	defer func() { DebugChecks = false }()
+
+	// the existing scenarios with the checks on
+	for _, test := range []func(*testing.T){
+		TestIterInOrder, TestIterEndsDeepTree, TestDummyOnlyTree, TestPageSizeLimits,
+	} {
+		test(t)
+	}
+
+	// random inserts, updates and deletes of mixed sizes
+	c := newContainer()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%04d", rng.Intn(2000))
+		if rng.Intn(3) == 0 {
+			c.del(key)
+		} else {
+			c.add(key, strings.Repeat("v", rng.Intn(BTREE_MAX_VAL_SIZE/4)))
+		}
+	}
+	for key, val := range c.ref {
+		if got, ok := c.tree.Get([]byte(key)); !ok || string(got) != val {
+			t.Fatalf("Get(%s) = %d bytes, %v", key, len(got), ok)
+		}
+	}
+
+	// a broken offset, as a bad setOffSet would leave it
+	expectPanic := func(msg string, fn func()) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), msg) {
+				t.Fatalf("panic %v, want %q", r, msg)
+			}
+		}()
+		fn()
+	}
+	old := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	old.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(old, 0, 0, nil, nil)
+	nodeAppendKV(old, 1, 0, []byte("a"), []byte("1"))
+	node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	leafInsert(node, old, 2, []byte("b"), []byte("2"), 0)
+	node.setOffSet(2, node.getOffSet(2)+1)
+	expectPanic("test: offset 2 is", func() { nodeCheck("test", node, 3, BTREE_PAGE_SIZE) })
+	expectPanic("test: 3 keys, want 2", func() { nodeCheck("test", node, 2, BTREE_PAGE_SIZE) })
+
+	// a node past the page
+	big := BNode{make([]byte, 2*BTREE_PAGE_SIZE)}
+	big.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(big, 0, 0, nil, nil)
+	nodeAppendKV(big, 1, 0, []byte("k"), make([]byte, BTREE_PAGE_SIZE))
+	expectPanic("bytes in a 4096 byte node", func() {
+		nodeCheck("test", big, 2, BTREE_PAGE_SIZE)
+	})
+}
+
+func TestMaxPageSizeOffsets(t *testing.T) {
+	DebugChecks = true
+	defer func() { DebugChecks = false }()
+	size := BTREE_MAX_PAGE_SIZE
+	c := newContainerSize(size)
+	// every node stored has offsets that add up, a uint16 that wrapped
+	// in a node being split would leave them short
+	store := c.tree.new
+	c.tree.new = func(node BNode) uint64 {
+		nodeCheck("new", node, node.nkeys(), size)
+		return store(node)
+	}
+
+	// the largest entries next to the smallest ones pack the nodes
+	// before a split as close to 2 pages as they get
+	rng := rand.New(rand.NewSource(1))
+	maxKey, maxVal := maxKeySize(size), maxValSize(size)
+	for i := 0; i < 3000; i++ {
+		n := rng.Intn(400)
+		key := fmt.Sprintf("%04d", n)
+		switch rng.Intn(4) {
+		case 0:
+			c.del(key)
+		case 1:
+			c.add(key+strings.Repeat("k", maxKey-len(key)), strings.Repeat("v", maxVal))
+		default:
+			c.add(key, strings.Repeat("v", rng.Intn(16)))
+		}
+	}
+	for key, val := range c.ref {
+		if got, ok := c.tree.Get([]byte(key)); !ok || string(got) != val {
+			t.Fatalf("Get(%.8s) = %d bytes, %v", key, len(got), ok)
+		}
+	}
+
+	// a full node and the largest entry fit in the uint16 positions
+	if err := checkPageSize(size); err != nil {
+		t.Fatalf("checkPageSize(%d): %v", size, err)
+	}
+	node := BNode{make([]byte, 2*size)}
+	node.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(node, 0, 0, nil, make([]byte, size-HEADER-14)) // a full page
+	nodeAppendKV(node, 1, 0, make([]byte, maxKey), make([]byte, maxVal))
+	nodeCheck("full", node, 2, 2*size)
+	if got, want := int(node.nbytes()), size+14+maxKey+maxVal; got != want {
+		t.Fatalf("nbytes = %d, want %d", got, want)
+	}
+}
+
+func TestDeleteSeparatorGrowth(t *testing.T) {
+	DebugChecks = true
+	defer func() { DebugChecks = false }()
+	// deleting the first key of a kid puts the next one in the parent,
+	// a longer key can push a full parent past a page
+	c := newContainer()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 30000; i++ {
+		n := rng.Intn(3000)
+		key := fmt.Sprintf("%04d", n) + strings.Repeat("k", n*7919%(BTREE_MAX_KEY_SIZE-4))
+		if rng.Intn(2) == 0 {
+			if _, ok := c.ref[key]; c.del(key) != ok {
+				t.Fatalf("Delete(%.8s) = %v", key, !ok)
+			}
+		} else {
+			c.add(key, strings.Repeat("v", rng.Intn(100)))
+		}
+	}
+	n := 0
+	for it := c.tree.SeekLE(nil); it.Valid(); it.Next() {
+		if key, val := it.Deref(); len(key) > 0 && c.ref[string(key)] != string(val) {
+			t.Fatalf("%.8s = %d bytes", key, len(val))
+		}
+		n++
+	}
+	if n != len(c.ref)+1 {
+		t.Fatalf("%d keys, want %d and the dummy", n, len(c.ref))
+	}
+}
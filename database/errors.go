@@ -0,0 +1,41 @@
+package database
+
+import "errors"
+
+var (
+	ErrChecksum           = errors.New("page checksum mismatch")
+	ErrNotOpen            = errors.New("database is not open")
+	ErrClosed             = errors.New("database is closed")
+	ErrBadSignature       = errors.New("file signature doesn't match the expected one")
+	ErrNotDatabase        = errors.New("the file is not a database, no master page has the signature")
+	ErrCorruptMaster      = errors.New("the file is a database but every master page is damaged")
+	ErrEmptyKey           = errors.New("the empty key is reserved")
+	ErrKeyExists          = errors.New("key already exists")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrKeyTooLarge        = errors.New("key exceeds the max key size for the page size")
+	ErrValueTooLarge      = errors.New("value exceeds the max value size for the page size")
+	ErrEntryTooLarge      = errors.New("key and value together don't fit in a page")
+	ErrReadOnly           = errors.New("database is opened read-only")
+	ErrNotReadOnly        = errors.New("database is not opened read-only")
+	ErrTxDone             = errors.New("transaction has already been committed or rolled back")
+	ErrTxReadOnly         = errors.New("transaction is read-only")
+	ErrHistoryTruncated   = errors.New("changes since the sequence number are no longer retained")
+	ErrHistoryUnavailable = errors.New("the commit is no longer retained")
+	ErrVersionMismatch    = errors.New("the stored version doesn't match the expected one")
+	ErrBadBackup          = errors.New("not a backup or an unsupported version")
+	ErrFreeListCorrupt    = errors.New("the free list is corrupted")
+	ErrInternalCorruption = errors.New("internal error, the file is likely corrupted")
+	ErrBadTuple           = errors.New("not a key encoded by EncodeTuple")
+	ErrDatabaseFull       = errors.New("the write would grow the file past MaxSizeBytes")
+	ErrBulkOrder          = errors.New("the keys of a bulk write must be strictly increasing")
+	ErrBadCursor          = errors.New("not a cursor token of this database")
+	ErrBadPattern         = errors.New("malformed glob pattern")
+	ErrByteOrder          = errors.New("the file was written big-endian, the format is little-endian")
+	ErrInconsistent       = errors.New("the tree is inconsistent")
+	ErrBusy               = errors.New("the database is still in use")
+	ErrPageSizeMismatch   = errors.New("the file has another page size than the configured one")
+	ErrChecksumAlgo       = errors.New("the file has another checksum algorithm than the configured one")
+	ErrMetaTooLarge       = errors.New("the metadata exceeds MAX_APP_META bytes")
+	ErrTooManyDirtyPages  = errors.New("the write holds more than MaxDirtyPages pages in memory")
+	ErrCommitFailed       = errors.New("the last commit failed, its write isn't durable")
+)
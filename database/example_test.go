@@ -0,0 +1,52 @@
+package database_test
+
+import (
+	"fmt"
+
+	"github.com/jabran-khan/tree-vault-db/database"
+)
+
+// a B-tree over pages kept in a map
+func ExampleNewBTree() {
+	pages := map[uint64][]byte{}
+	next := uint64(1)
+	get := func(ptr uint64) database.BNode {
+		return database.NewBNode(pages[ptr])
+	}
+	put := func(node database.BNode) uint64 {
+		ptr := next
+		next++
+		pages[ptr] = node.Bytes()
+		return ptr
+	}
+	del := func(ptr uint64) {
+		delete(pages, ptr)
+	}
+
+	tree := database.NewBTree(get, put, del)
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	tree.Delete([]byte("key0500"))
+	val, ok := tree.Get([]byte("key0042"))
+	fmt.Println(string(val), ok)
+
+	// open the tree again over the same pages
+	again := database.NewBTree(get, put, del)
+	again.SetRoot(tree.Root())
+	_, ok = again.Get([]byte("key0500"))
+	fmt.Println(ok)
+	for iter := again.SeekLE([]byte("key0498")); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		fmt.Println(string(key), string(val))
+		if string(key) >= "key0501" {
+			break
+		}
+	}
+	// Output:
+	// 42 true
+	// false
+	// key0498 498
+	// key0499 499
+	// key0501 501
+}
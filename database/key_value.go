@@ -1,52 +1,335 @@
 package database
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math/bits"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const DB_SIG = "TreeVaultDB"
 
+// the file grows by this fraction of its size by default
+const DEFAULT_GROWTH_FACTOR = 0.125
+
+// master page slots at the start of a new file
+const (
+	DEFAULT_MASTER_SLOTS = 2
+	MAX_MASTER_SLOTS     = 8
+)
+
+// tunables, set before calling Open
+type Options struct {
+	// compact the file in Close once the fragmentation ratio
+	// exceeds CompactRatio (defaults to DEFAULT_COMPACT_RATIO)
+	CompactOnClose bool
+	CompactRatio   float64
+	// open the file read-only, writes fail with ErrReadOnly
+	ReadOnly bool
+	// number of values kept in an LRU cache for Get, 0 disables it
+	ValueCacheSize int
+	// keep histograms of the latencies of Set, Get, Del and the
+	// commits for Metrics
+	EnableLatencyMetrics bool
+	// leaves read ahead of the iterators, their pages are advised
+	// MADV_WILLNEED this many at a time before the iterator gets to
+	// them, so the reads of a cold file overlap the scan. 0 disables
+	// it, it doesn't apply with NoMmap.
+	ScanReadAhead int
+	// expected number of keys in the main tree, sizes an in-memory
+	// bloom filter that lets Get skip the lookup of most missing keys.
+	// it's built by scanning the keys on Open. 0 disables it.
+	BloomKeys int
+	// page size of a new file, defaults to BTREE_PAGE_SIZE.
+	// an existing file keeps its page size and fails to open if
+	// this is set to something else. the max key and value sizes
+	// scale with it.
+	PageSize int
+	// number of recent commits kept for ChangesSince in a sidecar
+	// file next to the database, 0 disables the changelog. only the
+	// main tree is logged, not the trees opened with OpenTree.
+	ChangeLogRetention int
+	// number of commits before the last one GetAsOf can read. the
+	// pages they free are held back like those of an open iterator,
+	// so the file grows by what those commits rewrote. only the
+	// commits since Open are kept, 0 keeps none.
+	HistoryCommits int
+	// receives internal events, nothing is logged if nil
+	Logger Logger
+	// keep the mapped file resident with mlock. a failure to lock,
+	// usually the RLIMIT_MEMLOCK limit, is returned from Open and
+	// writes unless LockMemoryBestEffort is set, then it is logged
+	// as a warning and the pages are left unlocked.
+	LockMemory           bool
+	LockMemoryBestEffort bool
+	// when the page checksums are verified, VERIFY_ON_OPEN by default.
+	// with VERIFY_ALWAYS a mismatch on the read path fails the call
+	// with an error wrapping ErrChecksum, see KeyValue.Err for the
+	// reads without an error result and Iter.Err for the iterators.
+	VerifyChecksums VerifyMode
+	// the page checksum of a new file, CSUM_CRC32C by default, or
+	// CSUM_XXHASH or CSUM_SHA256, which take more of each page. an
+	// existing file is verified with the algorithm it was written with
+	// and fails to open with ErrChecksumAlgo if this is set to
+	// another.
+	ChecksumAlgo int
+	// store the leaves of 8 byte keys, such as big-endian integers
+	// added in order, with a base key and a 4 byte delta per key, see
+	// key_value_seqkeys.go. the file keeps the mode once set.
+	SequentialKeys bool
+	// the file grows in steps of GrowthFactor times its size
+	// (defaults to DEFAULT_GROWTH_FACTOR), but by at least
+	// MinGrowthPages and at most MaxGrowthPages if they are set
+	GrowthFactor   float64
+	MinGrowthPages int
+	MaxGrowthPages int
+	// stamped into the master page, a file with a different one fails
+	// to open with ErrBadSignature. at most 16 bytes, defaults to DB_SIG.
+	Signature string
+	// purge the expired keys in the background at this interval,
+	// 0 leaves them until they are read or PurgeExpired is called
+	ExpirySweep time.Duration
+	// let the internal panics on a broken invariant out of the API
+	// for debugging, they are returned as ErrInternalCorruption
+	// otherwise like a checksum mismatch, see KeyValue.Err
+	PanicOnCorruption bool
+	// the file doesn't grow past this size, a write that needs more
+	// pages than are free fails with ErrDatabaseFull and changes
+	// nothing. 0 means no limit.
+	MaxSizeBytes int64
+	// new pages a commit may hold in memory until it's written, 0
+	// means no limit. a write of the main tree past it, such as a
+	// large transaction or DeleteRange, fails with
+	// ErrTooManyDirtyPages and changes nothing. the bulk writer and
+	// PurgeExpired commit early at half of it instead. a single key
+	// needs about two pages per level of the tree.
+	MaxDirtyPages int
+	// master page slots of a new file, 1 to MAX_MASTER_SLOTS, defaults
+	// to DEFAULT_MASTER_SLOTS. commits write them in turn and Open
+	// uses the latest valid one, more slots survive more damaged
+	// masters. past two, the pages freed by the last slots-2 commits
+	// are held back so those commits stay readable. an existing file
+	// keeps its own.
+	MasterSlots int
+	// open the file with O_DIRECT and write the pages from aligned
+	// buffers instead of through the mapping, which stays for reads.
+	// the page size must be a multiple of DIRECT_IO_ALIGN, and Open
+	// fails where the file system doesn't support O_DIRECT.
+	DirectIO bool
+	// number of leaf paths kept for Scan, a scan starting in the leaf
+	// of a recent one skips the descent. 0 disables it.
+	PathCacheSize int
+	// picks the pages for new nodes among the top ALLOC_WINDOW pages
+	// of the free list, such as ContiguousAllocator. nil takes them
+	// in the list order like FirstFitAllocator.
+	Allocator Allocator
+	// put the freed pages on the free list in page order instead of
+	// the order they come out of a map, so the same operations from
+	// the same file always write the same bytes. meant for golden
+	// files in tests.
+	Deterministic bool
+	// audit callbacks, called in order for each change to the main tree
+	// once its commit is durable. they run on the writing goroutine
+	// under the write lock, so they must not call the database. the
+	// arguments are copies, and a panic is recovered and logged.
+	OnSet func(key []byte, val []byte)
+	OnDel func(key []byte)
+	// called by Get with the key and whether it was found, after the
+	// lookup released the read lock
+	OnGet func(key []byte, found bool)
+	// a key holds a list of values, Set appends to it and Del removes
+	// them all. see GetAll and DeleteValue. it isn't stored in the
+	// file, every open must use the same mode.
+	AllowDuplicates bool
+	// read the pages with pread and write them with pwrite instead of
+	// mapping the file, for where mmap isn't available or wanted. the
+	// pages read are kept in a cache of NoMmapCachePages pages,
+	// DEFAULT_NO_MMAP_CACHE_PAGES if it's 0.
+	NoMmap           bool
+	NoMmapCachePages int
+	// signs the cursor tokens with HMAC-SHA256, a token that wasn't
+	// made with the same secret is refused. nil leaves them unsigned.
+	CursorSecret []byte
+	// checks the values written by Set and the other writes before
+	// they change anything, an error fails the write as it is. the
+	// reads don't call it.
+	ValidateValue func(key []byte, val []byte) error
+	// sample the leaf fill at this interval and repack the leaves
+	// when it's below DefragFill, see Defrag. 0 disables it.
+	AutoDefrag time.Duration
+	// the average leaf fill below which the leaves of a parent are
+	// repacked, DEFAULT_DEFRAG_FILL if 0
+	DefragFill float64
+	// run Verify in Open, which fails with its error. it reads the
+	// whole file, VerifyChecksums only checks the checksums.
+	VerifyOnOpen bool
+	// how long Close waits for the open iterators and views to be
+	// closed, a negative value waits as long as it takes. past it
+	// Close fails with ErrBusy and the database stays open. 0 closes
+	// it under them, their reads fail with ErrClosed after that.
+	CloseTimeout time.Duration
+	// retries of an fsync or mmap failing with EINTR or EAGAIN, which
+	// may pass on another try, after a backoff doubling from
+	// IO_RETRY_BACKOFF up to IO_RETRY_MAX_BACKOFF. DEFAULT_IO_RETRIES
+	// if 0, at most MAX_IO_RETRIES, a negative value retries only
+	// EINTR, which always is. the other errors fail at once.
+	IORetries int
+	// called after each durable commit with the pages it wrote and the
+	// size of its changes, under the write lock like OnSet
+	OnFlush func(stats FlushStats)
+	// the values of Get, GetWithMeta, GetVersioned, Tree.Get, Tx.Get
+	// and the keys and values of the iterators alias the mapped file
+	// and the value cache instead of being copies. they must not be
+	// modified, and a write may reuse their pages once the last
+	// iterator or View is released, so they are only valid until then.
+	NoCopyOnRead bool
+}
+
 // file may larger than our mapping
 // so we create a struct which allows us to extend our mapping by using multiple mappings
 type KeyValue struct {
-	Path string
+	Path    string
+	Options Options
 	// internals
-	fp   *os.File
-	tree BTree
-	free FreeList
+	opened bool         // set by a successful Open
+	closed bool         // set by Close
+	mu     sync.RWMutex // writers are exclusive
+	fp     *os.File
+	tree   BTree
+	trees  []BTree // the trees opened with OpenTree besides the main one
+	free   FreeList
+	vcache *valueCache
+	pcache *pathCache
+	bloom  *bloomFilter
+	// the application metadata of the master page, see SetMeta
+	appMeta map[string][]byte
+	history []historyRoot // the commits GetAsOf reads, oldest first
+	latency *latencyMetrics
+	pread   *pageReader // the pages read without the mapping, see NoMmap
+	pinned  pinnedPages // the pages locked by PinPrefix
+	snap    struct {
+		mu   sync.Mutex     // readers pin and unpin under the read lock
+		pins map[uint64]int // open iterators and views by their commit
+		held []heldPages    // freed pages still readable by iterators
+		// closed once the last pin is gone, for a Close waiting on them
+		drained chan struct{}
+		// the snapshot reads hold it for reading, Close takes it to
+		// unmap the file, see snapshotEnter
+		unmap    sync.RWMutex
+		unmapped bool
+	}
+	seq   uint64 // commit sequence number, stored in the master page
+	sweep struct {
+		mu   sync.Mutex
+		stop chan struct{} // closed to stop the expiry sweep
+		done chan struct{} // closed once it stopped
+	}
+	defrag struct {
+		mu   sync.Mutex
+		stop chan struct{} // closed to stop AutoDefrag
+		done chan struct{}
+	}
+	corrupt struct {
+		mu  sync.Mutex // set by readers under the read lock
+		err error      // the first mismatch found with VERIFY_ALWAYS
+	}
+
+	changes struct {
+		fp      *os.File       // the sidecar, nil if no history is kept
+		since   uint64         // the log covers the commits after this one
+		log     []changeRecord // the retained commits in order
+		pending []Change       // mutations of the uncommitted updates
+	}
 
 	mmap struct {
-		file   int      // file size, can be larger than the database size
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
+		file  int // file size, can be larger than the database size
+		total int // mmap size, can be larger than the file size
+		// multiple mmaps, can be non-continuous. each one after the
+		// first is as large as all the ones before it.
+		chunks [][]byte
+		locked int  // bytes from the start locked with LockMemory
+		nolock bool // mlock failed in the best effort mode
+		// the chunk is a slice given to NewFromBytes, there is no file
+		inMemory bool
 	}
 	page struct {
+		size    int    // page size in bytes
+		csum    int    // checksum algorithm, CSUM_*
 		flushed uint64 // database size in number of pages
+		masters int    // master slots at the start of the file
 		nfree   int    // number of pages taken from the free list
 		nappend int    // number of pages to be appended
 		// newly allocated or deallocated pages keyed by the pointer
 		// nil value denotes a deallocated page
 		updates map[uint64][]byte
+		// pages allocated since the last flush, freeing one of them
+		// means it was never written so it can be handed out again
+		fresh    map[uint64]bool
+		recycled []uint64
+		// the next commit writes every master slot, the older
+		// commits they hold are gone
+		allMasters bool
+		// the free list was dropped, Open puts the free pages back
+		reclaim bool
+		// the top of the free list seen by Options.Allocator, the
+		// pages it took and the page allocated last
+		window []uint64
+		taken  []bool
+		prev   uint64
+		// the commit being written, see FlushStats
+		stats FlushStats
+		// the state after the last commit, a failed flush goes back to it
+		committed txState
+		// the leaves are delta encoded, MASTER_SEQ_KEYS
+		seqKeys bool
+		// the master at open had no MASTER_DIRTY, see IsCleanShutdown
+		cleanOpen bool
+		// the master in the file has MASTER_DIRTY, a commit sets it
+		// and Close clears it
+		dirty bool
+		// the last master went to every slot, Close clears the flag
+		// in all of them or Open may pick a dirty copy of the commit
+		spread bool
+		// the last flush failed, Close leaves the master dirty
+		failed bool
 	}
 }
 
 // callback for Btree, allocate a new page
 func (db *KeyValue) pageNew(node BNode) uint64 {
-	if len(node.data) > BTREE_PAGE_SIZE {
+	if node.btype() == BNODE_LEAF && int(node.nbytes()) > nodeSize(db) {
+		// a leaf split for the delta encoding, see SequentialKeys
+		enc, ok := seqEncode(node, nodeSize(db))
+		if !ok {
+			panic("pageNew: node is larger than page size")
+		}
+		node = enc
+	}
+	if len(node.data) > db.page.size {
 		panic("pageNew: node is larger than page size")
 	}
 	ptr := uint64(0)
-	if db.page.nfree < db.free.Total() {
+	if n := len(db.page.recycled); n > 0 {
+		// reuse a page allocated and freed before this flush
+		ptr, db.page.recycled = db.page.recycled[n-1], db.page.recycled[:n-1]
+	} else if db.Options.Allocator != nil {
+		ptr = allocPick(db)
+	} else if db.page.nfree < db.free.Total() {
 		// reuse a deallocated page
 		ptr = db.free.Get(db.page.nfree)
 		db.page.nfree++
-	} else {
+	}
+	if ptr == 0 {
 		// append a new page
 		ptr = db.page.flushed + uint64(db.page.nappend)
 		db.page.nappend++
 	}
+	db.page.prev = ptr
+	db.page.fresh[ptr] = true
 	db.page.updates[ptr] = node.data
 	return ptr
 }
@@ -57,50 +340,160 @@ func (db *KeyValue) pageGet(ptr uint64) BNode {
 		if page == nil {
 			panic("pageGet: page is nil")
 		}
-		return BNode{page} // for new pages
+		return seqRead(page) // for new pages
 	}
-	return pageGetMapped(db, ptr) // for written pages
+	node := pageGetMapped(db, ptr) // for written pages
+	if db.Options.VerifyChecksums == VERIFY_ALWAYS {
+		if err := pageVerify(db, ptr, node.data); err != nil {
+			panic(err) // corruption is found deep in the tree code
+		}
+	}
+	return seqRead(node.data)
 }
 
 func pageGetMapped(db *KeyValue, ptr uint64) BNode {
+	if db.pread != nil {
+		return BNode{db.pread.get(ptr, db.page.size)}
+	}
+	return pageFromChunks(db.mmap.chunks, db.page.size, ptr)
+}
+
+// the chunks double the mapping, chunk i > 0 starts at first << (i-1)
+// pages, so the chunk of a page is found without walking them
+func pageFromChunks(chunks [][]byte, pageSize int, ptr uint64) BNode {
+	idx, offset, ok := chunkOffset(chunks, pageSize, ptr)
+	if !ok {
+		panic("pageGetMapped: bad ptr")
+	}
+	return BNode{chunks[idx][offset : offset+pageSize]}
+}
+
+// the chunk of a page and its offset there, false past the mapping
+func chunkOffset(chunks [][]byte, pageSize int, ptr uint64) (idx int, offset int, ok bool) {
+	if len(chunks) == 0 {
+		return 0, 0, false
+	}
+	first := uint64(len(chunks[0]) / pageSize)
 	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
-		}
-		start = end
+	if ptr >= first {
+		idx = bits.Len64(ptr / first)
+		start = first << (idx - 1)
+	}
+	if idx >= len(chunks) || (ptr-start+1)*uint64(pageSize) > uint64(len(chunks[idx])) {
+		return 0, 0, false
 	}
-	panic("pageGetMapped: bad ptr")
+	return idx, int(ptr-start) * pageSize, true
 }
 
 // callback for Btree, deallocate a page
 func (db *KeyValue) pageDel(ptr uint64) {
+	if db.page.fresh[ptr] {
+		// never written, skip both the write and the free list
+		delete(db.page.fresh, ptr)
+		delete(db.page.updates, ptr)
+		db.page.recycled = append(db.page.recycled, ptr)
+		return
+	}
 	db.page.updates[ptr] = nil
 }
 
 func (db *KeyValue) Open() error {
+	// the page size of a new file, an existing one keeps its own
+	pageSize := db.Options.PageSize
+	if pageSize == 0 {
+		pageSize = BTREE_PAGE_SIZE
+	}
+	if err := checkPageSize(pageSize); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	if db.Options.MasterSlots < 0 || db.Options.MasterSlots > MAX_MASTER_SLOTS {
+		return fmt.Errorf("KV.Open: %d master slots, at most %d",
+			db.Options.MasterSlots, MAX_MASTER_SLOTS)
+	}
+	if len(db.Options.Signature) > 16 {
+		return fmt.Errorf("KV.Open: signature is longer than 16 bytes")
+	}
+	if !csumKnown(db.Options.ChecksumAlgo) {
+		return fmt.Errorf("KV.Open: unknown checksum algorithm %d", db.Options.ChecksumAlgo)
+	}
+	setPageSize(db, pageSize, csumConfigured(db))
+	seqKeysSet(db, db.Options.SequentialKeys)
+
 	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
+	flags := os.O_RDWR | os.O_CREATE
+	if db.Options.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	if db.Options.DirectIO {
+		flags |= syscall.O_DIRECT
+	}
+	fp, err := os.OpenFile(db.Path, flags, 0644)
 	if err != nil {
 		return fmt.Errorf("OpenFile: %w", err)
 	}
 	db.fp = fp
 
-	// create the initial mmap
-	sz, chunk, err := mmapInit(db.fp)
+	// map the file, NoMmap only needs its size
+	if db.Options.NoMmap {
+		err = preadInit(db)
+	} else {
+		err = mmapOpen(db)
+	}
 	if err != nil {
 		goto fail
 	}
+	err = openLoad(db)
+	if err != nil {
+		goto fail
+	}
+	err = changelogOpen(db)
+	if err != nil {
+		goto fail
+	}
+	// done
+	db.snap.unmap.Lock()
+	db.snap.unmapped = false
+	db.snap.unmap.Unlock()
+	db.mu.Lock()
+	db.opened, db.closed = true, false
+	db.mu.Unlock()
+	sweepStart(db)
+	defragStart(db)
+	return nil
+
+fail:
+	_ = closeFile(db)
+	return fmt.Errorf("KV.Open: %w", err)
+}
+
+func mmapOpen(db *KeyValue) error {
+	sz, chunk, err := mmapInit(db, mmapProt(db))
+	if err != nil {
+		return err
+	}
 	db.mmap.file = sz
 	db.mmap.total = len(chunk)
 	db.mmap.chunks = [][]byte{chunk}
+	return nil
+}
+
+// set up a handle over the mapped chunks and read the master page
+func openLoad(db *KeyValue) (err error) {
+	defer recoverCorrupt(db, &err)
+	db.page.updates = make(map[uint64][]byte)
+	db.page.fresh = make(map[uint64]bool)
+	db.vcache = newValueCache(db.Options.ValueCacheSize)
+	db.pcache = newPathCache(db.Options.PathCacheSize)
+	db.latency = newLatencyMetrics(db.Options.EnableLatencyMetrics)
+	if db.Options.NoMmap {
+		db.pread = newPageReader(db)
+	}
 
 	// btree callbacks
 	db.tree.get = db.pageGet
 	db.tree.new = db.pageNew
 	db.tree.del = db.pageDel
+	db.tree.logf = logger(db).Debugf
 
 	// freelist callbacks
 	db.free.get = db.pageGet
@@ -108,50 +501,648 @@ func (db *KeyValue) Open() error {
 	db.free.use = db.pageUse
 
 	// read the master page
-	err = masterLoad(db)
-	if err != nil {
-		goto fail
+	if err := masterLoad(db); err != nil {
+		return err
 	}
-	// done
-	return nil
+	db.page.committed = txSave(db)
+	db.page.cleanOpen = !db.page.dirty
+	db.history = nil
+	if err := checkDirectIO(db); err != nil {
+		return err
+	}
+	if err := mmapLock(db); err != nil {
+		return err
+	}
+	if db.Options.VerifyChecksums != VERIFY_OFF {
+		if err := verifyChecksums(db); err != nil {
+			return err
+		}
+	}
+	if db.Options.VerifyOnOpen {
+		if err := verifyAll(db); err != nil {
+			return fmt.Errorf("Verify: %w", err)
+		}
+	}
+	if db.page.reclaim && !db.Options.ReadOnly {
+		db.page.reclaim = false
+		if _, err := reclaimOrphans(db); err != nil {
+			return err
+		}
+	}
+	return bloomBuild(db)
+}
 
-fail:
-	db.Close()
-	return fmt.Errorf("KV.Open: %w", err)
+// open a database held in memory in the file format, such as the
+// contents of a database file. the handle is read-only, and the slice
+// must not change until Close.
+func NewFromBytes(data []byte) (*KeyValue, error) {
+	return NewFromBytesWithOptions(data, Options{})
+}
+
+// NewFromBytes with the Options that apply to reads, such as the
+// Signature. ReadOnly is implied.
+func NewFromBytesWithOptions(data []byte, opts Options) (*KeyValue, error) {
+	if len(data)%BTREE_MIN_PAGE_SIZE != 0 {
+		return nil, fmt.Errorf("NewFromBytes: %d bytes is not a whole number of pages", len(data))
+	}
+	opts.ReadOnly, opts.LockMemory, opts.ExpirySweep = true, false, 0
+	opts.DirectIO, opts.NoMmap = false, false
+	db := &KeyValue{Options: opts}
+	db.mmap.inMemory = true
+	setPageSize(db, BTREE_PAGE_SIZE, CSUM_CRC32C)
+	db.mmap.file = len(data)
+	db.mmap.total = len(data)
+	db.mmap.chunks = [][]byte{data}
+	if err := openLoad(db); err != nil {
+		return nil, fmt.Errorf("NewFromBytes: %w", err)
+	}
+	db.opened = true
+	return db, nil
 }
 
 // cleanup
-func (db *KeyValue) Close() {
+func (db *KeyValue) Close() error {
+	sweepStop(db)
+	defragStop(db)
+	// readers still running hold the lock, the mapping goes once they're done
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := checkOpen(db); err != nil {
+		return err
+	}
+	if db.Options.CloseTimeout != 0 {
+		if err := snapshotDrain(db, db.Options.CloseTimeout); err != nil {
+			sweepStart(db) // still open
+			defragStart(db)
+			return fmt.Errorf("Close: %w", err)
+		}
+	}
+	// the held pages are free once the iterators are gone,
+	// compacting counts them and can't run while they are held
+	err := snapshotClose(db)
+	if err == nil && db.Options.CompactOnClose && !db.Options.ReadOnly &&
+		fragmentation(db) > compactRatio(db) {
+		err = compact(db, true)
+	}
+	if err == nil {
+		err = masterClean(db)
+	}
+	if cerr := closeFile(db); err == nil {
+		err = cerr
+	}
+	db.opened, db.closed = false, true
+	return err
+}
+
+func closeFile(db *KeyValue) error {
+	// the snapshot reads in progress finish first, the later ones fail
+	db.snap.unmap.Lock()
+	defer db.snap.unmap.Unlock()
+	db.snap.unmapped = true
+	if db.mmap.inMemory {
+		db.mmap.chunks = nil // not ours to unmap
+		return nil
+	}
 	for _, chunk := range db.mmap.chunks {
 		err := syscall.Munmap(chunk)
 		if err != nil {
 			panic("Close: couldn't delete mappings for specified chunk")
 		}
 	}
-	_ = db.fp.Close()
+	db.mmap.chunks = nil
+	db.pinned.count = nil // unlocked with the mapping
+	err := changelogClose(db)
+	if cerr := db.fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-// read the db
+// the handle can be used
+func checkOpen(db *KeyValue) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if !db.opened {
+		return ErrNotOpen
+	}
+	return nil
+}
+
+// the handle can be written to
+func checkWritable(db *KeyValue) error {
+	if err := checkOpen(db); err != nil {
+		return err
+	}
+	if db.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// the empty key is reserved, it's the dummy key that makes the tree
+// cover the whole key space. it is never found and can't be written.
+func checkKey(db *KeyValue, key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > maxKeySize(db.page.size) {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+func checkKV(db *KeyValue, key []byte, val []byte) error {
+	if err := checkKey(db, key); err != nil {
+		return err
+	}
+	if len(val) > maxValSize(db.page.size) {
+		return ErrValueTooLarge
+	}
+	if err := checkEntry(db, len(key), len(val)); err != nil {
+		return err
+	}
+	return checkValue(db, key, val)
+}
+
+// a node must hold the entry on its own, the max key and value sizes
+// leave room for it but they are checked one at a time
+func checkEntry(db *KeyValue, keyLen int, valLen int) error {
+	if entriesPerNode(nodeSize(db), keyLen, valLen) < 1 {
+		return ErrEntryTooLarge
+	}
+	return nil
+}
+
+// the value passes Options.ValidateValue
+func checkValue(db *KeyValue, key []byte, val []byte) error {
+	if db.Options.ValidateValue == nil {
+		return nil
+	}
+	return db.Options.ValidateValue(key, val)
+}
+
+// read the db, an expired key is missing and gets deleted.
+// the value is a copy unless NoCopyOnRead is set.
 func (db *KeyValue) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+	defer db.latency.record(LATENCY_GET, db.latency.start())
+	if db.Options.AllowDuplicates {
+		val, ok := multiGet(db, key) // the first value
+		auditGet(db, key, ok)
+		return readCopy(db, val), ok
+	}
+	val, ok, expired := db.get(key)
+	if expired {
+		expireKey(db, key)
+	}
+	auditGet(db, key, ok)
+	return readCopy(db, val), ok
 }
 
-// update the db
-func (db *KeyValue) Set(key []byte, val []byte) error {
+// a copy of a slice read from the file unless NoCopyOnRead is set
+func readCopy(db *KeyValue, data []byte) []byte {
+	if data == nil || db.Options.NoCopyOnRead {
+		return data
+	}
+	return append([]byte{}, data...)
+}
+
+func (db *KeyValue) get(key []byte) (val []byte, ok bool, expired bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	if checkOpen(db) != nil || checkKey(db, key) != nil {
+		return nil, false, false
+	}
+	if val, ok := db.vcache.get(key); ok {
+		return val, true, false
+	}
+	if !db.bloom.mayContain(key) {
+		return nil, false, false
+	}
+	val, meta, ok := db.tree.GetMeta(key)
+	if ok && metaExpired(meta, time.Now().UnixNano()) {
+		return nil, false, true
+	}
+	// the values that expire aren't cached
+	if ok && decodeMeta(meta).flags&META_EXPIRES == 0 {
+		db.vcache.put(key, val)
+	}
+	return val, ok, false
+}
+
+// read several keys from one committed state, a writer can't commit
+// between the lookups. the values are copies, nil for missing keys
+// and for the keys after a checksum mismatch.
+func (db *KeyValue) GetMulti(keys [][]byte) (vals [][]byte) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	vals = make([][]byte, len(keys))
+	if checkOpen(db) != nil {
+		return vals
+	}
+	for i, key := range keys {
+		if checkKey(db, key) != nil || !db.bloom.mayContain(key) {
+			continue
+		}
+		if val, _, ok := treeGetLive(&db.tree, key); ok {
+			vals[i] = append([]byte{}, val...)
+		}
+	}
+	return vals
+}
+
+// the leaf page holding the key and its index there, or where an
+// insert would put it if it isn't stored. an expired key that hasn't
+// been purged yet is found. ptr is 0 if the tree is empty.
+func (db *KeyValue) Locate(key []byte) (ptr uint64, idx uint16, found bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	if checkOpen(db) != nil || checkKey(db, key) != nil || db.tree.root == 0 {
+		return 0, 0, false
+	}
+	ptr, node, idx := treeLocate(&db.tree, key)
+	if leafBefore(node, key) {
+		return ptr, 0, false // see PreSplit
+	}
+	if !bytes.Equal(key, node.getKey(idx)) {
+		return ptr, idx + 1, false
+	}
+	return ptr, idx, true
+}
+
+// entries with the key and value sizes that fit in a page of the file
+func (db *KeyValue) MaxEntriesPerPage(keyLen int, valLen int) int {
+	return entriesPerNode(nodeSize(db), keyLen, valLen)
+}
+
+// bytes of a page of the file left for the entries, each one takes 14
+// bytes besides its key and value
+func (db *KeyValue) UsableBytesPerPage() int {
+	return nodeSize(db) - HEADER
+}
+
+// the largest key the file takes, it depends on the page size
+func (db *KeyValue) MaxKeySize() int {
+	return maxKeySize(db.page.size)
+}
+
+// the largest value the file takes, the metadata of SetWithTTL,
+// SetWithMeta and SetVersioned comes out of it
+func (db *KeyValue) MaxValSize() int {
+	return maxValSize(db.page.size)
+}
+
+// run the checks of Set on the key and value without writing them,
+// it returns the error Set would: ErrEmptyKey, ErrKeyTooLarge,
+// ErrValueTooLarge, ErrEntryTooLarge or the one of
+// Options.ValidateValue. a nil doesn't promise the write, the disk or
+// MaxSizeBytes may still stop it.
+func (db *KeyValue) ValidateKV(key []byte, val []byte) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return err
+	}
+	if db.Options.AllowDuplicates {
+		_, err := multiCheck(db, key, val) // the key takes a suffix
+		return err
+	}
+	return checkKV(db, key, val)
+}
+
+// the write path shared with transactions, the caller holds the write lock
+func (db *KeyValue) insert(key []byte, val []byte) {
+	db.vcache.del(key)
+	db.bloom.add(key)
 	db.tree.Insert(key, val)
+	changelogRecord(db, key, val, false)
+	statsChange(db, key, val)
+	dirtyCheck(db)
+}
+
+func (db *KeyValue) insertMeta(key []byte, val []byte, meta []byte) {
+	db.vcache.del(key)
+	db.bloom.add(key)
+	db.tree.InsertMeta(key, val, meta)
+	changelogRecord(db, key, val, false)
+	statsChange(db, key, val)
+	dirtyCheck(db)
+}
+
+func (db *KeyValue) delete(key []byte) (bool, int) {
+	db.vcache.del(key)
+	deleted, merges := db.tree.DeleteStats(key)
+	if deleted {
+		changelogRecord(db, key, nil, true)
+		statsChange(db, key, nil)
+	}
+	dirtyCheck(db)
+	return deleted, merges
+}
+
+// the new pages of the commit being built, written by the next flush
+func dirtyPages(db *KeyValue) int {
+	return len(db.page.fresh)
+}
+
+// fail the write once the commit holds more than MaxDirtyPages, the
+// panic is returned by recoverWrite or Tx.recover as an error
+func dirtyCheck(db *KeyValue) {
+	db.page.stats.DirtyPages = max(db.page.stats.DirtyPages, dirtyPages(db))
+	limit := db.Options.MaxDirtyPages
+	if limit > 0 && dirtyPages(db) > limit {
+		panic(fmt.Errorf("%w: %d pages, the limit is %d", ErrTooManyDirtyPages, dirtyPages(db), limit))
+	}
+}
+
+// a batch of writes commits early from half of MaxDirtyPages on, so
+// its next write stays under the limit
+func dirtyHalf(db *KeyValue) bool {
+	limit := db.Options.MaxDirtyPages
+	return limit > 0 && dirtyPages(db) >= limit/2
+}
+
+// update the db
+func (db *KeyValue) Set(key []byte, val []byte) (err error) {
+	defer db.latency.record(LATENCY_SET, db.latency.start())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	if db.Options.AllowDuplicates {
+		if err := multiSet(db, key, val); err != nil {
+			return err
+		}
+		return flushPages(db)
+	}
+	if err := checkKV(db, key, val); err != nil {
+		return err
+	}
+	db.insert(key, val)
 	return flushPages(db)
 }
 
+// Set with the value read from r to its end. the values are stored
+// inline in a leaf, so at most MaxValSize bytes are read and a longer
+// value fails with ErrValueTooLarge without reading the rest of it.
+func (db *KeyValue) SetReader(key []byte, r io.Reader) error {
+	val, err := io.ReadAll(io.LimitReader(r, int64(db.MaxValSize())+1))
+	if err != nil {
+		return fmt.Errorf("SetReader: %w", err)
+	}
+	if len(val) > db.MaxValSize() {
+		return ErrValueTooLarge // like Set
+	}
+	return db.Set(key, val)
+}
+
 // delete from the db
-func (db *KeyValue) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
+func (db *KeyValue) Del(key []byte) (deleted bool, err error) {
+	defer db.latency.record(LATENCY_DEL, db.latency.start())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return false, err
+	}
+	if err := checkKey(db, key); err != nil {
+		return false, err
+	}
+	if db.Options.AllowDuplicates {
+		return multiDel(db, key), flushPages(db)
+	}
+	deleted, _ = db.delete(key)
 	return deleted, flushPages(db)
 }
 
+// delete from the db, also reporting how many node merges the delete caused
+func (db *KeyValue) DelStats(key []byte) (deleted bool, merges int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return false, 0, err
+	}
+	if err := checkKey(db, key); err != nil {
+		return false, 0, err
+	}
+	deleted, merges = db.delete(key)
+	return deleted, merges, flushPages(db)
+}
+
+// delete the keys in [lo, hi) in a single write, a nil hi deletes
+// to the end. returns the number of keys deleted.
+func (db *KeyValue) DeleteRange(lo []byte, hi []byte) (n int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return 0, err
+	}
+
+	// collect first, the iterator doesn't survive the deletes
+	keys := [][]byte{}
+	it := scanTree(db, &db.tree, lo, hi, nil)
+	for ; it.Valid(); it.Next() {
+		key, _ := it.deref()
+		keys = append(keys, append([]byte{}, key...))
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	for _, key := range keys {
+		db.delete(key)
+	}
+	return len(keys), flushPages(db)
+}
+
+// delete every key starting with the prefix in a single write
+func (db *KeyValue) DeletePrefix(prefix []byte) (int, error) {
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// copy every key starting with srcPrefix to dstPrefix followed by the
+// rest of the key, with its value and metadata, in a single write. the
+// keys are read before any is written, so the prefixes may overlap.
+// returns the number of keys copied.
+func (db *KeyValue) CopyPrefix(srcPrefix []byte, dstPrefix []byte) (n int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return 0, err
+	}
+
+	// collect first, the iterator doesn't survive the inserts
+	var keys, vals, metas [][]byte
+	it := scanTree(db, &db.tree, srcPrefix, prefixEnd(srcPrefix), nil)
+	for ; it.Valid(); it.Next() {
+		key, val, meta := it.iter.DerefMeta()
+		key = append(append([]byte{}, dstPrefix...), key[len(srcPrefix):]...)
+		check := checkKV(db, key, val)
+		if meta != nil {
+			check = checkMetaKV(db, key, val, meta)
+			meta = append([]byte{}, meta...)
+		}
+		if check != nil {
+			return 0, fmt.Errorf("CopyPrefix: %q: %w", key, check)
+		}
+		keys = append(keys, key)
+		vals = append(vals, append([]byte{}, val...))
+		metas = append(metas, meta)
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	for i, key := range keys {
+		if metas[i] != nil {
+			db.insertMeta(key, vals[i], metas[i])
+		} else {
+			db.insert(key, vals[i])
+		}
+	}
+	return len(keys), flushPages(db)
+}
+
+// shorten the value to its first newLen bytes in a single write.
+// returns false if the key doesn't exist.
+func (db *KeyValue) TruncateValue(key []byte, newLen int) (ok bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return false, err
+	}
+	if err := checkKey(db, key); err != nil {
+		return false, err
+	}
+	val, meta, ok := treeGetLive(&db.tree, key)
+	if !ok {
+		return false, nil
+	}
+	if newLen < 0 || newLen > len(val) {
+		return false, fmt.Errorf("TruncateValue: length %d out of range [0, %d]", newLen, len(val))
+	}
+	if newLen == len(val) {
+		return true, nil
+	}
+	// the value points into the page that the insert frees
+	val = append([]byte{}, val[:newLen]...)
+	if meta != nil {
+		db.insertMeta(key, val, append([]byte{}, meta...))
+	} else {
+		db.insert(key, val)
+	}
+	return true, flushPages(db)
+}
+
+// move the value of oldKey to newKey in a single commit, so a crash
+// leaves exactly one of them. returns false if oldKey doesn't exist,
+// and ErrKeyExists if newKey does unless overwrite is set.
+func (db *KeyValue) Rename(oldKey []byte, newKey []byte, overwrite bool) (bool, error) {
+	renamed := false
+	err := db.Update(func(tx *Tx) error {
+		val, ok := tx.Get(oldKey)
+		if !ok {
+			return nil
+		}
+		if _, exists := tx.Get(newKey); exists && !overwrite {
+			return ErrKeyExists
+		}
+		// the delete frees the page holding the value
+		val = append([]byte{}, val...)
+		if _, err := tx.Del(oldKey); err != nil {
+			return err
+		}
+		renamed = true
+		return tx.Set(newKey, val)
+	})
+	return renamed && err == nil, err
+}
+
+// exchange the values of two keys in a single commit, so a crash
+// leaves both or neither. fails with ErrKeyNotFound if one is missing.
+func (db *KeyValue) Swap(keyA []byte, keyB []byte) error {
+	return db.Update(func(tx *Tx) error {
+		valA, okA := tx.Get(keyA)
+		valB, okB := tx.Get(keyB)
+		if !okA || !okB {
+			missing := keyA
+			if okA {
+				missing = keyB
+			}
+			return fmt.Errorf("Swap: %w: %q", ErrKeyNotFound, missing)
+		}
+		// the first write frees the pages holding the values
+		valA, valB = append([]byte{}, valA...), append([]byte{}, valB...)
+		if err := tx.Set(keyA, valB); err != nil {
+			return err
+		}
+		return tx.Set(keyB, valA)
+	})
+}
+
+// pick up the changes committed by another handle writing to the file,
+// only for read-only handles. the writer recycles pages, so a reader
+// must refresh before trusting reads made after the writer commits.
+func (db *KeyValue) Refresh() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := checkOpen(db); err != nil {
+		return fmt.Errorf("Refresh: %w", err)
+	}
+	if !db.Options.ReadOnly {
+		return fmt.Errorf("Refresh: %w", ErrNotReadOnly)
+	}
+	if db.mmap.inMemory {
+		return nil // nothing else writes to it
+	}
+
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("Refresh: stat: %w", err)
+	}
+	db.mmap.file = int(fi.Size())
+	for db.pread == nil && db.mmap.total < db.mmap.file {
+		if err := extendMmap(db, db.mmap.file/db.page.size); err != nil {
+			return fmt.Errorf("Refresh: %w", err)
+		}
+	}
+	if err := mmapLock(db); err != nil {
+		return fmt.Errorf("Refresh: %w", err)
+	}
+	if err := masterLoad(db); err != nil {
+		return fmt.Errorf("Refresh: %w", err)
+	}
+	if err := changelogOpen(db); err != nil {
+		return fmt.Errorf("Refresh: %w", err)
+	}
+	db.vcache.clear()
+	if db.pread != nil {
+		db.pread.clear()
+	}
+	if err := bloomBuild(db); err != nil {
+		return fmt.Errorf("Refresh: %w", err)
+	}
+	return nil
+}
+
 // callback for FreeList, allocate a new page
 func (db *KeyValue) pageAppend(node BNode) uint64 {
-	if len(node.data) > BTREE_PAGE_SIZE {
-		panic("pageAppend: node is larger than BTREE_PAGE_SIZE")
+	if len(node.data) > db.page.size {
+		panic("pageAppend: node is larger than page size")
 	}
 	ptr := db.page.flushed + uint64(db.page.nappend)
 	db.page.nappend++
@@ -0,0 +1,97 @@
+package database
+
+import "slices"
+
+// free pages at the top of the list an Allocator chooses from
+const ALLOC_WINDOW = 512
+
+// picks the pages for new nodes, see Options.Allocator
+type Allocator interface {
+	// an index into free, or -1 to append to the file. free holds
+	// the pages near the top of the free list not taken yet by the
+	// commit, prev is the page the commit allocated last, 0 at its
+	// start, and next is the page an append would get.
+	Pick(free []uint64, prev uint64, next uint64) int
+}
+
+// takes the page on the top of the free list and appends once it's
+// empty, what a nil Options.Allocator does
+type FirstFitAllocator struct{}
+
+func (FirstFitAllocator) Pick(free []uint64, prev uint64, next uint64) int {
+	if len(free) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// keeps the pages of a commit together. it continues after the last
+// page, or starts the longest run of adjacent free pages, appending
+// rather than taking a lone page when the last one was appended.
+type ContiguousAllocator struct{}
+
+func (ContiguousAllocator) Pick(free []uint64, prev uint64, next uint64) int {
+	if len(free) == 0 {
+		return -1
+	}
+	if i := slices.Index(free, prev+1); prev != 0 && i >= 0 {
+		return i
+	}
+	sorted := slices.Clone(free)
+	slices.Sort(sorted)
+	best, bestLen := sorted[0], 1
+	for lo := 0; lo < len(sorted); {
+		hi := lo + 1
+		for hi < len(sorted) && sorted[hi] == sorted[hi-1]+1 {
+			hi++
+		}
+		if hi-lo > bestLen {
+			best, bestLen = sorted[lo], hi-lo
+		}
+		lo = hi
+	}
+	if bestLen == 1 && prev != 0 && prev+1 == next {
+		return -1
+	}
+	return slices.Index(free, best)
+}
+
+// a free page chosen by Options.Allocator, 0 to append
+func allocPick(db *KeyValue) uint64 {
+	if db.page.window == nil {
+		db.page.window = flTop(&db.free, ALLOC_WINDOW)
+		db.page.taken = make([]bool, len(db.page.window))
+	}
+	avail, index := []uint64{}, []int{}
+	for i, ptr := range db.page.window {
+		if !db.page.taken[i] {
+			avail, index = append(avail, ptr), append(index, i)
+		}
+	}
+	next := db.page.flushed + uint64(db.page.nappend)
+	i := db.Options.Allocator.Pick(avail, db.page.prev, next)
+	if i < 0 || i >= len(avail) {
+		return 0
+	}
+	db.page.taken[index[i]] = true
+	// the list is popped up to the deepest page taken
+	db.page.nfree = max(db.page.nfree, index[i]+1)
+	return avail[i]
+}
+
+// the pages popped off the free list with the ones taken, but not
+// taken themselves. they go back on it.
+func allocSkipped(db *KeyValue) []uint64 {
+	skipped := []uint64{}
+	for i := 0; i < db.page.nfree && i < len(db.page.taken); i++ {
+		if !db.page.taken[i] {
+			skipped = append(skipped, db.page.window[i])
+		}
+	}
+	return skipped
+}
+
+// forget the choices of the commit
+func allocReset(db *KeyValue) {
+	db.page.window, db.page.taken, db.page.prev = nil, nil, 0
+}
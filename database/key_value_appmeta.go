@@ -0,0 +1,132 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"slices"
+)
+
+/*
+The application metadata is a few named values kept in the master page
+after its fields, so a commit writes them with the roots and a master
+slot that falls back to an older commit falls back to its metadata too.
+
+| crc | size | entries                        |
+| 4B  |  2B  | (klen 1B, vlen 2B, key, val)*  |
+
+The entries are sorted by key and take at most MAX_APP_META bytes. The
+CRC is of the entries, an empty area of zeros is no metadata, as in the
+files written before it.
+*/
+
+const (
+	APP_META_OFFSET = 256 // in the master page, past the fields
+	MAX_APP_META    = 512 // bytes of the encoded entries
+	APP_META_END    = APP_META_OFFSET + 6 + MAX_APP_META
+)
+
+// the encoded size of the entries
+func appMetaSize(meta map[string][]byte) int {
+	size := 0
+	for key, val := range meta {
+		size += 3 + len(key) + len(val)
+	}
+	return size
+}
+
+// write the area into the master page data
+func appMetaEncode(data []byte, meta map[string][]byte) {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	out := data[APP_META_OFFSET+6 : APP_META_OFFSET+6]
+	for _, key := range keys {
+		val := meta[key]
+		out = append(out, byte(len(key)))
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(val)))
+		out = append(out, key...)
+		out = append(out, val...)
+	}
+	binary.LittleEndian.PutUint32(data[APP_META_OFFSET:], crc32.Checksum(out, crc32c))
+	binary.LittleEndian.PutUint16(data[APP_META_OFFSET+4:], uint16(len(out)))
+}
+
+// read the area of the master page data, nil if it's empty
+func appMetaDecode(data []byte) (map[string][]byte, error) {
+	sum := binary.LittleEndian.Uint32(data[APP_META_OFFSET:])
+	size := int(binary.LittleEndian.Uint16(data[APP_META_OFFSET+4:]))
+	if sum == 0 && size == 0 {
+		return nil, nil
+	}
+	if size > MAX_APP_META {
+		return nil, fmt.Errorf("%d bytes of metadata", size)
+	}
+	in := data[APP_META_OFFSET+6 : APP_META_OFFSET+6+size]
+	if crc32.Checksum(in, crc32c) != sum {
+		return nil, fmt.Errorf("metadata: %w", ErrChecksum)
+	}
+	meta := map[string][]byte{}
+	for len(in) > 0 {
+		if len(in) < 3 {
+			return nil, errors.New("truncated metadata")
+		}
+		klen, vlen := int(in[0]), int(binary.LittleEndian.Uint16(in[1:]))
+		if len(in) < 3+klen+vlen {
+			return nil, errors.New("truncated metadata")
+		}
+		key := string(in[3 : 3+klen])
+		meta[key] = append([]byte{}, in[3+klen:3+klen+vlen]...)
+		in = in[3+klen+vlen:]
+	}
+	return meta, nil
+}
+
+// store a named value with the next commit's master page, a nil val
+// removes it. the names are 1 to 255 bytes, and all the names and
+// values together take at most MAX_APP_META bytes less 3 per entry,
+// or the call fails with ErrMetaTooLarge. it commits at once.
+func (db *KeyValue) SetMeta(key string, val []byte) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	if len(key) == 0 || len(key) > 255 {
+		return fmt.Errorf("SetMeta: name of %d bytes", len(key))
+	}
+	// replaced, not changed, a saved state may hold the old one
+	meta := maps.Clone(db.appMeta)
+	if meta == nil {
+		meta = map[string][]byte{}
+	}
+	if val == nil {
+		delete(meta, key)
+	} else {
+		meta[key] = append([]byte{}, val...)
+	}
+	if appMetaSize(meta) > MAX_APP_META {
+		return fmt.Errorf("SetMeta: %w", ErrMetaTooLarge)
+	}
+	db.appMeta = meta
+	return flushPages(db)
+}
+
+// a named value stored by SetMeta, a copy
+func (db *KeyValue) GetMeta(key string) ([]byte, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if checkOpen(db) != nil {
+		return nil, false
+	}
+	val, ok := db.appMeta[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, val...), true
+}
@@ -0,0 +1,33 @@
+package database
+
+// the audit callbacks want the mutations recorded like the changelog
+func auditOn(db *KeyValue) bool {
+	return db.Options.OnSet != nil || db.Options.OnDel != nil
+}
+
+// report the changes of a durable commit, in the order they were made
+func auditCommit(db *KeyValue, changes []Change) {
+	for _, change := range changes {
+		if change.Deleted && db.Options.OnDel != nil {
+			auditCall(db, "OnDel", func() { db.Options.OnDel(change.Key) })
+		} else if !change.Deleted && db.Options.OnSet != nil {
+			auditCall(db, "OnSet", func() { db.Options.OnSet(change.Key, change.Val) })
+		}
+	}
+}
+
+// a panic in a callback is logged, the operation already happened
+func auditCall(db *KeyValue, name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger(db).Warnf("audit: %s panicked: %v", name, r)
+		}
+	}()
+	fn()
+}
+
+func auditGet(db *KeyValue, key []byte, found bool) {
+	if db.Options.OnGet != nil {
+		auditCall(db, "OnGet", func() { db.Options.OnGet(key, found) })
+	}
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+The binary backup format, all integers little-endian:
+
+| magic | version | page_size | nkeys | pairs...
+|  8B   |   4B    |    4B     |  8B   |
+
+each pair is | klen | key | vlen | val | mlen | meta | with the lengths
+as uvarints, in key order. meta is the entry metadata, mlen is 0 for
+none.
+*/
+
+const (
+	BACKUP_MAGIC   = "TVDBBACK"
+	BACKUP_VERSION = 1
+)
+
+// write the main tree as of the last commit in the binary backup
+// format. writers go on meanwhile, like with Scan.
+func (db *KeyValue) BackupBinary(w io.Writer) error {
+	db.mu.RLock()
+	if err := checkOpen(db); err != nil {
+		db.mu.RUnlock()
+		return fmt.Errorf("BackupBinary: %w", err)
+	}
+	// the count comes first, so the snapshot is read twice
+	count := snapshotScan(db, db.tree.root, nil, nil)
+	pairs := snapshotScan(db, db.tree.root, nil, nil)
+	pairs.now = count.now // the same keys expire for both
+	pageSize := db.page.size
+	db.mu.RUnlock()
+	defer pairs.Close()
+
+	nkeys := uint64(0)
+	for ; count.Valid(); count.Next() {
+		nkeys++
+	}
+	if err := count.Err(); err != nil {
+		return fmt.Errorf("BackupBinary: %w", err)
+	}
+
+	out := bufio.NewWriter(w)
+	var header [24]byte
+	copy(header[:8], BACKUP_MAGIC)
+	binary.LittleEndian.PutUint32(header[8:], BACKUP_VERSION)
+	binary.LittleEndian.PutUint32(header[12:], uint32(pageSize))
+	binary.LittleEndian.PutUint64(header[16:], nkeys)
+	out.Write(header[:])
+	if err := backupPairs(out, pairs); err != nil {
+		return fmt.Errorf("BackupBinary: %w", err)
+	}
+	return nil
+}
+
+// write the pairs in [lo, hi) as of the last commit in the binary
+// backup format without the header, a nil hi exports to the end. a
+// BackupBinary is its header followed by the export of the whole tree,
+// so the exports of adjacent ranges, such as from SplitRanges, make up
+// its pairs when they are concatenated in order.
+func (db *KeyValue) ExportRange(w io.Writer, lo []byte, hi []byte) error {
+	db.mu.RLock()
+	if err := checkOpen(db); err != nil {
+		db.mu.RUnlock()
+		return fmt.Errorf("ExportRange: %w", err)
+	}
+	pairs := snapshotScan(db, db.tree.root, lo, hi)
+	db.mu.RUnlock()
+	defer pairs.Close()
+
+	if err := backupPairs(bufio.NewWriter(w), pairs); err != nil {
+		return fmt.Errorf("ExportRange: %w", err)
+	}
+	return nil
+}
+
+// write the pairs of the iterator and flush
+func backupPairs(out *bufio.Writer, pairs *Iter) error {
+	var buf []byte
+	for ; pairs.Valid(); pairs.Next() {
+		key, val, meta := pairs.iter.DerefMeta()
+		buf = buf[:0]
+		for _, field := range [][]byte{key, val, meta} {
+			buf = binary.AppendUvarint(buf, uint64(len(field)))
+			buf = append(buf, field...)
+		}
+		if _, err := out.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := pairs.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// create a database at path from a binary backup, with the page size
+// of the backed up one. path must not exist, and it is removed if the
+// restore fails.
+func RestoreBinary(path string, r io.Reader) error {
+	in := bufio.NewReader(r)
+	var header [24]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return fmt.Errorf("RestoreBinary: header: %w", err)
+	}
+	if string(header[:8]) != BACKUP_MAGIC ||
+		binary.LittleEndian.Uint32(header[8:]) != BACKUP_VERSION {
+		return fmt.Errorf("RestoreBinary: %w", ErrBadBackup)
+	}
+	pageSize := int(binary.LittleEndian.Uint32(header[12:]))
+	nkeys := binary.LittleEndian.Uint64(header[16:])
+	if err := checkPageSize(pageSize); err != nil {
+		return fmt.Errorf("RestoreBinary: %w", err)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("RestoreBinary: %s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("RestoreBinary: %w", err)
+	}
+	db := &KeyValue{Path: path, Options: Options{PageSize: pageSize}}
+	if err := db.Open(); err != nil {
+		return fmt.Errorf("RestoreBinary: %w", err)
+	}
+	err := restoreLoad(db, in, nkeys)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("RestoreBinary: %w", err)
+	}
+	return nil
+}
+
+func restoreLoad(db *KeyValue, in *bufio.Reader, nkeys uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var fields [3][]byte
+	for i := uint64(0); i < nkeys; i++ {
+		for f := range fields {
+			n, err := binary.ReadUvarint(in)
+			if err != nil {
+				return fmt.Errorf("pair %d: %w", i, err)
+			}
+			if n > uint64(db.page.size) {
+				return fmt.Errorf("pair %d: %w", i, ErrBadBackup)
+			}
+			fields[f] = make([]byte, n)
+			if _, err := io.ReadFull(in, fields[f]); err != nil {
+				return fmt.Errorf("pair %d: %w", i, err)
+			}
+		}
+		key, val, meta := fields[0], fields[1], fields[2]
+		if len(meta) == 0 {
+			if err := checkKV(db, key, val); err != nil {
+				return fmt.Errorf("pair %d: %w", i, err)
+			}
+			db.tree.Insert(key, val)
+		} else {
+			if len(meta) > 255 {
+				return fmt.Errorf("pair %d: %w", i, ErrBadBackup)
+			}
+			if err := checkMetaKV(db, key, val, meta); err != nil {
+				return fmt.Errorf("pair %d: %w", i, err)
+			}
+			db.tree.InsertMeta(key, val, meta)
+		}
+		if (i+1)%MIGRATE_BATCH == 0 {
+			if err := flushPages(db); err != nil {
+				return err
+			}
+		}
+	}
+	return flushPages(db)
+}
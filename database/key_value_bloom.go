@@ -0,0 +1,88 @@
+package database
+
+import (
+	"hash/maphash"
+)
+
+const (
+	BLOOM_BITS_PER_KEY = 10 // about 1% false positives at the expected count
+	BLOOM_HASHES       = 7
+)
+
+/*
+The bloom filter holds every key of the main tree since the open, a Get
+of a key it doesn't hold returns without reading the tree. The keys are
+added by the writes and never taken out, a deleted key only costs a
+lookup like the other false positives. It's built by a scan of the tree
+on open and on Refresh, nothing of it is stored in the file.
+
+The size is fixed at open from Options.BloomKeys, past that many keys
+it still holds them all but lets more of the missing ones through.
+*/
+
+// a nil filter is disabled, it may hold any key
+type bloomFilter struct {
+	bits []uint64 // set under the write lock, read under the read lock
+	seed maphash.Seed
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	if keys <= 0 {
+		return nil
+	}
+	words := (keys*BLOOM_BITS_PER_KEY + 63) / 64
+	return &bloomFilter{bits: make([]uint64, words), seed: maphash.MakeSeed()}
+}
+
+// the bit positions of the key, from the two halves of one hash
+func (f *bloomFilter) positions(key []byte, fn func(word int, mask uint64) bool) bool {
+	h := maphash.Bytes(f.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	nbits := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < BLOOM_HASHES; i++ {
+		pos := (h1 + i*h2) % nbits
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+// must be called under the write lock
+func (f *bloomFilter) add(key []byte) {
+	if f == nil {
+		return
+	}
+	f.positions(key, func(word int, mask uint64) bool {
+		f.bits[word] |= mask
+		return true
+	})
+}
+
+// false if the key is certainly not in the tree
+func (f *bloomFilter) mayContain(key []byte) bool {
+	if f == nil {
+		return true
+	}
+	return f.positions(key, func(word int, mask uint64) bool {
+		return f.bits[word]&mask != 0
+	})
+}
+
+// fill a new filter with the keys of the main tree. the filter is
+// left disabled if the scan fails, a partial one would miss keys.
+func bloomBuild(db *KeyValue) (err error) {
+	db.bloom = nil
+	filter := newBloomFilter(db.Options.BloomKeys)
+	if filter == nil {
+		return nil
+	}
+	defer recoverCorrupt(db, &err)
+	iter := seekFirst(&db.tree)
+	for ; iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		filter.add(key)
+	}
+	db.bloom = filter
+	return nil
+}
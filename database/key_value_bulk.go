@@ -0,0 +1,151 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// pages held in memory before the bulk writer commits them
+const BULK_FLUSH_PAGES = 1024
+
+/*
+The bulk writer builds the tree bottom-up from sorted keys. Each level
+collects the entries of one node, a full node is written and its first
+key and pointer go up to the next level. Only a node per level and the
+pages since the last commit are in memory.
+
+The commits before Finish leave the tree empty, the pages written so
+far aren't reachable until the last one sets the root.
+*/
+
+// builds a new database from keys added in increasing order
+type BulkWriter struct {
+	db     *KeyValue
+	levels []bulkLevel // the nodes being filled, leaves first
+	last   []byte      // the last key added
+	err    error       // the first failure, the writer is done after it
+}
+
+// the entries of a node being filled
+type bulkLevel struct {
+	keys  [][]byte
+	vals  [][]byte // the leaves
+	ptrs  []uint64 // the internal nodes
+	size  int      // the node size with the entries
+	nodes int      // nodes written at the level
+}
+
+// open a new or empty database at the path for the bulk writer,
+// it's usable once Finish returns
+func NewBulkWriter(path string, opts Options) (*BulkWriter, error) {
+	db := &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		return nil, fmt.Errorf("NewBulkWriter: %w", err)
+	}
+	if err := checkWritable(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("NewBulkWriter: %w", err)
+	}
+	if db.tree.root != 0 {
+		db.Close()
+		return nil, fmt.Errorf("NewBulkWriter: %s is not empty", path)
+	}
+	w := &BulkWriter{db: db, levels: []bulkLevel{{}}}
+	// the dummy key that starts the first leaf
+	w.levels[0].add(nil, []byte{}, 0)
+	return w, nil
+}
+
+func (lvl *bulkLevel) add(key []byte, val []byte, ptr uint64) {
+	lvl.keys = append(lvl.keys, key)
+	lvl.vals = append(lvl.vals, val)
+	lvl.ptrs = append(lvl.ptrs, ptr)
+	if lvl.size == 0 {
+		lvl.size = HEADER
+	}
+	lvl.size += 8 + 2 + 4 + len(key) + len(val)
+}
+
+// add the next key, it must be greater than the previous one
+func (w *BulkWriter) Add(key []byte, val []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := checkKV(w.db, key, val); err != nil {
+		return err
+	}
+	if w.last != nil && bytes.Compare(key, w.last) <= 0 {
+		return fmt.Errorf("BulkWriter.Add: %w: %q after %q", ErrBulkOrder, key, w.last)
+	}
+	w.last = append(w.last[:0], key...)
+	w.err = w.push(0, append([]byte{}, key...), append([]byte{}, val...), 0)
+	return w.err
+}
+
+// add an entry to a level, writing out its node first if it's full
+func (w *BulkWriter) push(level int, key []byte, val []byte, ptr uint64) error {
+	if level == len(w.levels) {
+		w.levels = append(w.levels, bulkLevel{})
+	}
+	lvl := &w.levels[level]
+	if len(lvl.keys) > 0 && lvl.size+8+2+4+len(key)+len(val) > nodeSize(w.db) {
+		if err := w.emit(level); err != nil {
+			return err
+		}
+	}
+	w.levels[level].add(key, val, ptr) // emit may move the levels
+	return nil
+}
+
+// write the node of a level and add it to the level above
+func (w *BulkWriter) emit(level int) error {
+	lvl := &w.levels[level]
+	node := BNode{data: make([]byte, nodeSize(w.db))}
+	btype := uint16(BNODE_LEAF)
+	if level > 0 {
+		btype = BNODE_NODE
+	}
+	node.setHeader(btype, uint16(len(lvl.keys)))
+	for i := range lvl.keys {
+		nodeAppendKV(node, uint16(i), lvl.ptrs[i], lvl.keys[i], lvl.vals[i])
+	}
+	ptr := w.db.pageNew(node)
+	first := lvl.keys[0]
+	*lvl = bulkLevel{nodes: lvl.nodes + 1}
+
+	// commit the written pages so they don't pile up in memory
+	if len(w.db.page.updates) >= BULK_FLUSH_PAGES || dirtyHalf(w.db) {
+		if err := flushPages(w.db); err != nil {
+			return fmt.Errorf("BulkWriter: %w", err)
+		}
+	}
+	return w.push(level+1, first, nil, ptr)
+}
+
+// write the rest of the tree, commit it and close the database
+func (w *BulkWriter) Finish() error {
+	if w.err != nil {
+		w.db.Close()
+		return w.err
+	}
+	w.err = ErrClosed // done either way
+	db := w.db
+	if w.last != nil {
+		for level := 0; ; level++ {
+			lvl := &w.levels[level]
+			if level > 0 && lvl.nodes == 0 && len(lvl.keys) == 1 {
+				db.tree.root = lvl.ptrs[0] // the only node below
+				break
+			}
+			if err := w.emit(level); err != nil {
+				db.Close()
+				return err
+			}
+		}
+	}
+	if err := flushPages(db); err != nil {
+		db.Close()
+		return fmt.Errorf("BulkWriter.Finish: %w", err)
+	}
+	return db.Close()
+}
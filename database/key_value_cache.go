@@ -0,0 +1,206 @@
+package database
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// LRU cache of values keyed by key, consulted by Get.
+// a nil cache is disabled, every method is a no-op.
+type valueCache struct {
+	mu     sync.Mutex // readers share the db lock
+	size   int
+	order  *list.List // front is the most recently used
+	items  map[string]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key string
+	val []byte
+}
+
+func newValueCache(size int) *valueCache {
+	if size <= 0 {
+		return nil
+	}
+	return &valueCache{
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// the returned value is shared and must not be modified
+func (c *valueCache) get(key []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[string(key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).val, true
+}
+
+func (c *valueCache) full() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len() >= c.size
+}
+
+// cache a copy of the value, evicting the least recently used one if full
+func (c *valueCache) put(key []byte, val []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[string(key)]; ok {
+		elem.Value.(*cacheEntry).val = append([]byte{}, val...)
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+	entry := &cacheEntry{key: string(key), val: append([]byte{}, val...)}
+	c.items[entry.key] = c.order.PushFront(entry)
+}
+
+// must be called under the write lock before the key is updated
+func (c *valueCache) del(key []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[string(key)]; ok {
+		c.order.Remove(elem)
+		delete(c.items, string(key))
+	}
+}
+
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.items = map[string]*list.Element{}
+}
+
+// LRU cache of the leaf paths found by Scan, a Scan starting in a
+// cached leaf skips the descent from the root. the paths are of one
+// commit of the main tree, a write empties the cache on the next use.
+// a nil cache is disabled.
+type pathCache struct {
+	mu     sync.Mutex // readers share the db lock
+	size   int
+	seq    uint64     // the commit of the paths
+	root   uint64     // the main tree root at seq
+	order  *list.List // of *pathEntry, front is the most recently used
+	items  map[uint64]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+type pathEntry struct {
+	leaf uint64
+	lo   []byte // the keys in [lo, hi) descend to the leaf
+	hi   []byte // nil for no bound
+	path []BNode
+	pos  []uint16 // the positions in the internal nodes
+}
+
+func newPathCache(size int) *pathCache {
+	if size <= 0 {
+		return nil
+	}
+	return &pathCache{size: size, order: list.New(), items: map[uint64]*list.Element{}}
+}
+
+// SeekLE on the snapshot of the main tree at the commit seq
+func (c *pathCache) seek(seq uint64, tree *BTree, key []byte) *BIter {
+	if c == nil {
+		return tree.SeekLE(key)
+	}
+	if iter := c.get(seq, tree, key); iter != nil {
+		return iter
+	}
+	iter := tree.SeekLE(key)
+	c.put(iter)
+	return iter
+}
+
+func (c *pathCache) get(seq uint64, tree *BTree, key []byte) *BIter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seq != seq || c.root != tree.root {
+		c.seq, c.root = seq, tree.root
+		c.order.Init()
+		c.items = map[uint64]*list.Element{}
+	}
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*pathEntry)
+		if bytes.Compare(key, entry.lo) < 0 ||
+			(entry.hi != nil && bytes.Compare(key, entry.hi) >= 0) {
+			continue
+		}
+		c.hits++
+		c.order.MoveToFront(elem)
+		leaf := entry.path[len(entry.path)-1]
+		iter := &BIter{tree: tree, path: append([]BNode{}, entry.path...)}
+		iter.pos = append(append(iter.pos, entry.pos...), nodeLookupLE(leaf, key))
+		return iter
+	}
+	c.misses++
+	return nil
+}
+
+// cache the path of an iterator fresh from SeekLE
+func (c *pathCache) put(iter *BIter) {
+	last := len(iter.path) - 1
+	if last < 0 || iter.path[last].nkeys() == 0 {
+		return
+	}
+	entry := &pathEntry{
+		leaf: iter.tree.root,
+		lo:   iter.path[last].getKey(0),
+		path: append([]BNode{}, iter.path...),
+		pos:  append([]uint16{}, iter.pos[:last]...),
+	}
+	if last > 0 {
+		entry.leaf = iter.path[last-1].getPtr(iter.pos[last-1])
+	}
+	// the first key of the next leaf, from the closest ancestor with one
+	for level := last - 1; level >= 0; level-- {
+		if iter.pos[level]+1 < iter.path[level].nkeys() {
+			entry.hi = iter.path[level].getKey(iter.pos[level] + 1)
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[entry.leaf]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*pathEntry).leaf)
+	}
+	c.items[entry.leaf] = c.order.PushFront(entry)
+}
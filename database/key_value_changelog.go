@@ -0,0 +1,278 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+The changelog is a sidecar file next to the database holding the
+mutations of the most recent commits.
+
+| since | record | record | ...
+|  8B   |
+record: | seq | count | change | change | ...
+        |  8B |  4B   |
+change: | deleted | klen | vlen | key | val |
+        |   1B    |  4B  |  4B  | ... | ... |
+
+`since` is the last commit that is no longer kept, the records that
+follow are exactly the commits since+1, since+2, ... A record is
+written and synced before the master page, so the file may run one
+commit ahead of the database, the extra record is dropped on load.
+*/
+
+// a mutation made by a commit
+type Change struct {
+	Seq     uint64 // the commit that made the change
+	Key     []byte
+	Val     []byte // nil for a delete
+	Deleted bool
+}
+
+// the changes of a single commit
+type changeRecord struct {
+	seq     uint64
+	changes []Change
+}
+
+func changelogPath(db *KeyValue) string {
+	return db.Path + ".changes"
+}
+
+// load the retained history and open the sidecar for appending
+func changelogOpen(db *KeyValue) error {
+	db.changes.since = db.seq
+	db.changes.log = nil
+	if db.Options.ChangeLogRetention <= 0 {
+		return nil
+	}
+	data, err := os.ReadFile(changelogPath(db))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read changelog: %w", err)
+	}
+	changelogDecode(db, data)
+	if db.Options.ReadOnly {
+		return nil
+	}
+	return changelogRewrite(db)
+}
+
+func changelogClose(db *KeyValue) error {
+	if db.changes.fp == nil {
+		return nil
+	}
+	err := db.changes.fp.Close()
+	db.changes.fp = nil
+	return err
+}
+
+func changelogDecode(db *KeyValue, data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	since := binary.LittleEndian.Uint64(data)
+	log := []changeRecord{}
+	for rest := data[8:]; ; {
+		rec, n := decodeRecord(rest)
+		if n == 0 || rec.seq != since+uint64(len(log))+1 || rec.seq > db.seq {
+			break // torn write or a commit that never made it to the master
+		}
+		log = append(log, rec)
+		rest = rest[n:]
+	}
+	// commits made without the changelog leave a gap, start over
+	if since+uint64(len(log)) == db.seq {
+		db.changes.since = since
+		db.changes.log = log
+	}
+}
+
+// returns the number of bytes consumed, 0 if the record is incomplete
+func decodeRecord(data []byte) (changeRecord, int) {
+	if len(data) < 12 {
+		return changeRecord{}, 0
+	}
+	rec := changeRecord{seq: binary.LittleEndian.Uint64(data)}
+	count := binary.LittleEndian.Uint32(data[8:])
+	pos := 12
+	for i := uint32(0); i < count; i++ {
+		if len(data) < pos+9 {
+			return changeRecord{}, 0
+		}
+		deleted := data[pos] == 1
+		klen := int(binary.LittleEndian.Uint32(data[pos+1:]))
+		vlen := int(binary.LittleEndian.Uint32(data[pos+5:]))
+		pos += 9
+		if len(data) < pos+klen+vlen {
+			return changeRecord{}, 0
+		}
+		change := Change{Seq: rec.seq, Key: data[pos : pos+klen], Deleted: deleted}
+		if !deleted {
+			change.Val = data[pos+klen : pos+klen+vlen]
+		}
+		rec.changes = append(rec.changes, change)
+		pos += klen + vlen
+	}
+	return rec, pos
+}
+
+func encodeRecord(out []byte, rec changeRecord) []byte {
+	out = binary.LittleEndian.AppendUint64(out, rec.seq)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(rec.changes)))
+	for _, change := range rec.changes {
+		flag := byte(0)
+		if change.Deleted {
+			flag = 1
+		}
+		out = append(out, flag)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(change.Key)))
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(change.Val)))
+		out = append(out, change.Key...)
+		out = append(out, change.Val...)
+	}
+	return out
+}
+
+// drop the commits beyond the retention and replace the sidecar
+func changelogRewrite(db *KeyValue) error {
+	if cut := len(db.changes.log) - db.Options.ChangeLogRetention; cut > 0 {
+		db.changes.since = db.changes.log[cut-1].seq
+		db.changes.log = append([]changeRecord{}, db.changes.log[cut:]...)
+	}
+	data := binary.LittleEndian.AppendUint64(nil, db.changes.since)
+	for _, rec := range db.changes.log {
+		data = encodeRecord(data, rec)
+	}
+
+	// write a new file and rename it over the old one
+	path := changelogPath(db)
+	tmp := path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("write changelog: %w", err)
+	}
+	if _, err = fp.Write(data); err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return fmt.Errorf("write changelog: %w", err)
+	}
+
+	if err := changelogClose(db); err != nil {
+		return fmt.Errorf("close changelog: %w", err)
+	}
+	db.changes.fp, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open changelog: %w", err)
+	}
+	return nil
+}
+
+// remember a mutation until the next commit
+func changelogRecord(db *KeyValue, key []byte, val []byte, deleted bool) {
+	if db.changes.fp == nil && !auditOn(db) {
+		return
+	}
+	change := Change{Key: append([]byte{}, key...), Deleted: deleted}
+	if !deleted {
+		change.Val = append([]byte{}, val...)
+	}
+	db.changes.pending = append(db.changes.pending, change)
+}
+
+// persist the pending mutations as the commit db.seq,
+// must be called before the master page is written
+func changelogAppend(db *KeyValue) error {
+	if db.changes.fp == nil {
+		db.changes.pending = nil
+		db.changes.since = db.seq // no history is kept
+		db.changes.log = nil
+		return nil
+	}
+
+	rec := changeRecord{seq: db.seq, changes: db.changes.pending}
+	for i := range rec.changes {
+		rec.changes[i].Seq = db.seq
+	}
+	if _, err := db.changes.fp.Write(encodeRecord(nil, rec)); err != nil {
+		return fmt.Errorf("append changelog: %w", err)
+	}
+	if err := db.changes.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync changelog: %w", err)
+	}
+	db.changes.pending = nil
+	db.changes.log = append(db.changes.log, rec)
+	// the file is trimmed once it holds twice the retention
+	if len(db.changes.log) > 2*db.Options.ChangeLogRetention {
+		return changelogRewrite(db)
+	}
+	return nil
+}
+
+// forget the record of a commit whose master page wasn't written,
+// its changes go back to pending for the next commit. the sidecar is
+// rewritten without it, if that fails the history is dropped.
+func changelogUndo(db *KeyValue) error {
+	db.changes.since = min(db.changes.since, db.seq)
+	if n := len(db.changes.log); n > 0 && db.changes.log[n-1].seq > db.seq {
+		rec := db.changes.log[n-1]
+		db.changes.pending = append(rec.changes, db.changes.pending...)
+		db.changes.log = db.changes.log[:n-1]
+	}
+	if db.changes.fp == nil {
+		return nil
+	}
+	err := changelogRewrite(db)
+	if err != nil {
+		changelogClose(db)
+		os.Remove(changelogPath(db))
+		db.changes.since = db.seq
+		db.changes.log = nil
+	}
+	return err
+}
+
+// the current commit sequence number
+func (db *KeyValue) Seq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+// the mutations committed after seq in commit order, and the current seq.
+// returns ErrHistoryTruncated if the changelog no longer covers seq.
+// only the main tree is logged.
+func (db *KeyValue) ChangesSince(seq uint64) ([]Change, uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return nil, 0, err
+	}
+
+	if seq >= db.seq {
+		return nil, db.seq, nil
+	}
+	if seq < db.changes.since {
+		return nil, db.seq, ErrHistoryTruncated
+	}
+	changes := []Change{}
+	for _, rec := range db.changes.log[seq-db.changes.since:] {
+		for _, change := range rec.changes {
+			change.Key = append([]byte{}, change.Key...)
+			if !change.Deleted {
+				change.Val = append([]byte{}, change.Val...)
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, db.seq, nil
+}
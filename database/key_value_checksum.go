@@ -0,0 +1,221 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Every page except the master ends with a checksum of the rest of it,
+so a node gets the page size minus the checksum. Files written before
+checksums existed are stored with CSUM_NONE and keep full-size nodes.
+The algorithm of a new file is Options.ChecksumAlgo, it's stored in
+the master page and a file is always verified with its own.
+*/
+
+// the checksum algorithm of a file, stored in the master page
+const (
+	CSUM_NONE   = 0
+	CSUM_CRC32C = 1 // 4B
+	CSUM_XXHASH = 2 // 8B, XXH64
+	CSUM_SHA256 = 3 // 16B, the first half of SHA-256
+)
+
+// the largest checksum of a page
+const CSUM_MAX_SIZE = 16
+
+// when the page checksums are verified
+type VerifyMode int
+
+const (
+	VERIFY_ON_OPEN VerifyMode = iota // walk the trees and the free list in Open
+	VERIFY_OFF                       // never
+	VERIFY_ALWAYS                    // on every page read, and in Open
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// bytes at the end of a page taken by the checksum
+func csumSize(csum int) int {
+	switch csum {
+	case CSUM_NONE:
+		return 0
+	case CSUM_CRC32C:
+		return 4
+	case CSUM_XXHASH:
+		return 8
+	case CSUM_SHA256:
+		return 16
+	}
+	panic("csumSize: unknown checksum algorithm")
+}
+
+func csumKnown(csum int) bool {
+	return csum >= CSUM_NONE && csum <= CSUM_SHA256
+}
+
+// the algorithm of a new file
+func csumConfigured(db *KeyValue) int {
+	if db.Options.ChecksumAlgo == 0 {
+		return CSUM_CRC32C
+	}
+	return db.Options.ChecksumAlgo
+}
+
+// write the checksum of data to out, csumSize bytes
+func csumCompute(csum int, data []byte, out []byte) {
+	switch csum {
+	case CSUM_CRC32C:
+		binary.LittleEndian.PutUint32(out, crc32.Checksum(data, crc32c))
+	case CSUM_XXHASH:
+		binary.LittleEndian.PutUint64(out, xxh64(data))
+	case CSUM_SHA256:
+		sum := sha256.Sum256(data)
+		copy(out, sum[:CSUM_MAX_SIZE])
+	}
+}
+
+// the part of a page available to a node
+func nodeSize(db *KeyValue) int {
+	return db.page.size - csumSize(db.page.csum)
+}
+
+// store the checksum of a written page
+func pageSeal(db *KeyValue, page []byte) {
+	if db.page.csum != CSUM_NONE {
+		n := nodeSize(db)
+		csumCompute(db.page.csum, page[:n], page[n:])
+	}
+}
+
+func pageVerify(db *KeyValue, ptr uint64, page []byte) error {
+	return csumVerify(db, db.page.csum, ptr, page)
+}
+
+// pageVerify for the snapshot readers, they don't hold the lock
+// so the algorithm is captured with the mapping
+func csumVerify(db *KeyValue, csum int, ptr uint64, page []byte) error {
+	if csum != CSUM_NONE {
+		n := len(page) - csumSize(csum)
+		var sum [CSUM_MAX_SIZE]byte
+		csumCompute(csum, page[:n], sum[:])
+		if !bytes.Equal(page[n:], sum[:len(page)-n]) {
+			logger(db).Warnf("checksum mismatch in page %d", ptr)
+			return fmt.Errorf("page %d: %w", ptr, ErrChecksum)
+		}
+	}
+	return nil
+}
+
+// verify every page reachable from the roots and the free list nodes
+func verifyChecksums(db *KeyValue) error {
+	if db.page.csum == CSUM_NONE {
+		return nil
+	}
+	for _, root := range treeRoots(db) {
+		if root == 0 {
+			continue
+		}
+		if err := verifyTree(db, root); err != nil {
+			return err
+		}
+	}
+	nodes, _ := flWalk(&db.free)
+	for _, ptr := range nodes {
+		if err := pageVerify(db, ptr, pageGetMapped(db, ptr).data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyTree(db *KeyValue, ptr uint64) error {
+	node := pageGetMapped(db, ptr)
+	if err := pageVerify(db, ptr, node.data); err != nil {
+		return err
+	}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := verifyTree(db, node.getPtr(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Corruption is found deep in the tree and free list code, a checksum
+mismatch with VERIFY_ALWAYS or a cycle in the free list, which panics
+with the error. The API methods recover it at the boundary: the ones
+with an error result return it, the reads without one report the key
+as missing and keep the error for Err, and the writes drop the updates
+made before it. Any other panic, a failed invariant or an index out of
+range on a page that passed its checksum, becomes ErrInternalCorruption
+the same way unless Options.PanicOnCorruption lets it go on.
+*/
+
+// the error of a recovered panic
+func corruptError(db *KeyValue, r any) error {
+	err, ok := r.(error)
+	if !ok || !(errors.Is(err, ErrChecksum) || errors.Is(err, ErrFreeListCorrupt)) {
+		if db.Options.PanicOnCorruption {
+			panic(r)
+		}
+		err = fmt.Errorf("%w: %v", ErrInternalCorruption, r)
+	}
+	db.corrupt.mu.Lock()
+	defer db.corrupt.mu.Unlock()
+	if db.corrupt.err == nil {
+		db.corrupt.err = err
+	}
+	return err
+}
+
+// the error of a panic in a write, a corruption unless the write was
+// too large for MaxDirtyPages
+func writeError(db *KeyValue, r any) error {
+	if err, ok := r.(error); ok && errors.Is(err, ErrTooManyDirtyPages) {
+		return err
+	}
+	return corruptError(db, r)
+}
+
+// deferred by the methods returning an error
+func recoverCorrupt(db *KeyValue, err *error) {
+	if r := recover(); r != nil {
+		*err = corruptError(db, r)
+	}
+}
+
+// deferred by the reads without an error result
+func recoverRead(db *KeyValue) {
+	if r := recover(); r != nil {
+		corruptError(db, r)
+	}
+}
+
+// deferred by the writes, called with the write lock. a write that
+// didn't fit under MaxSizeBytes is dropped the same way.
+func recoverWrite(db *KeyValue, saved txState, err *error) {
+	if r := recover(); r != nil {
+		*err = writeError(db, r)
+		txRestore(db, saved)
+	} else if errors.Is(*err, ErrDatabaseFull) {
+		txRestore(db, saved)
+	}
+}
+
+// the first corruption met, such as a checksum mismatch with
+// VERIFY_ALWAYS, nil if there was none. Get, GetMulti and Tree.Get
+// report a key they couldn't read as missing, this tells it apart
+// from a key that doesn't exist.
+func (db *KeyValue) Err() error {
+	db.corrupt.mu.Lock()
+	defer db.corrupt.mu.Unlock()
+	return db.corrupt.err
+}
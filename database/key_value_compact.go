@@ -0,0 +1,445 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+)
+
+// default free/total page ratio above which CompactOnClose kicks in
+const DEFAULT_COMPACT_RATIO = 0.25
+
+/*
+Compaction runs as a single flush. New pages are only ever written into
+pages that were free items before it started, so until the master page
+is switched the committed tree and free list are left intact, and a
+crash at any point leaves a valid database.
+*/
+
+// fraction of the pages in the file that sit on the free list
+func fragmentation(db *KeyValue) float64 {
+	if db.page.flushed <= 1 {
+		return 0
+	}
+	return float64(db.free.Total()) / float64(db.page.flushed-1)
+}
+
+func compactRatio(db *KeyValue) float64 {
+	if db.Options.CompactRatio > 0 {
+		return db.Options.CompactRatio
+	}
+	return DEFAULT_COMPACT_RATIO
+}
+
+// the size of the file, 0 if the db isn't open. compared with
+// LogicalSize it tells how much compaction could give back.
+func (db *KeyValue) DiskSize() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if checkOpen(db) != nil {
+		return 0
+	}
+	return int64(db.mmap.file)
+}
+
+// the pages on the free list in increasing order, from the last
+// commit. the nodes of the list itself aren't included.
+func (db *KeyValue) FreePages() (ptrs []uint64, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return nil, err
+	}
+	_, ptrs = flWalk(&db.free)
+	slices.Sort(ptrs)
+	return ptrs, nil
+}
+
+// the key and value bytes of the live entries, a full scan. the
+// page headers, offsets, metadata and free space aren't counted.
+func (db *KeyValue) LogicalSize() (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return 0, err
+	}
+
+	size := uint64(0)
+	it := scanTree(db, &db.tree, nil, nil, nil)
+	for ; it.Valid(); it.Next() {
+		key, val := it.deref()
+		size += uint64(len(key) + len(val))
+	}
+	return size, it.Err()
+}
+
+// rewrite the free list into as few nodes as possible,
+// handing out the lowest pages first
+func (db *KeyValue) CompactFreeList() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return compact(db, false)
+}
+
+// move tree pages from the end of the file into lower free pages,
+// compact the free list and truncate the free pages at the tail
+func (db *KeyValue) Shrink() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return compact(db, true)
+}
+
+// tree pages a Compactor moves per step by default
+const COMPACT_STEP_PAGES = 64
+
+// runs Shrink in steps, see KeyValue.Compactor
+type Compactor struct {
+	db    *KeyValue
+	pages int
+}
+
+// a Shrink split into steps that each move up to COMPACT_STEP_PAGES
+// tree pages in a commit of their own, so writers and readers get in
+// between. a step still walks the whole tree. the database is valid
+// after every step, so the compaction can be abandoned at any point.
+func (db *KeyValue) Compactor() *Compactor {
+	return &Compactor{db: db, pages: COMPACT_STEP_PAGES}
+}
+
+// move the next pages, done is set once nothing is left to move.
+// like Shrink, it fails while iterators are open.
+func (c *Compactor) Step() (done bool, err error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	moved, err := compactPages(c.db, true, c.pages)
+	if err != nil {
+		return false, err
+	}
+	return moved < c.pages, nil
+}
+
+func compact(db *KeyValue, shrink bool) error {
+	_, err := compactPages(db, shrink, -1)
+	return err
+}
+
+// put the pages held only for the master slots back on the free list,
+// with a commit written to every slot
+func compactRelease(db *KeyValue) (err error) {
+	defer recoverWrite(db, txSave(db), &err)
+	db.page.allMasters = true
+	return flushPages(db)
+}
+
+// compact moving at most budget tree pages, -1 for no limit.
+// returns the number of pages moved, their ancestors are not counted.
+func compactPages(db *KeyValue, shrink bool, budget int) (moved int, err error) {
+	if err := checkWritable(db); err != nil {
+		return 0, err
+	}
+	if len(db.page.updates) > 0 {
+		return 0, fmt.Errorf("compact: unflushed updates")
+	}
+	if snapshotCount(db) == 0 && len(snapshotHeld(db)) > 0 {
+		if err := compactRelease(db); err != nil {
+			return 0, fmt.Errorf("compact: %w", err)
+		}
+	}
+	saved := txSave(db)
+	defer recoverWrite(db, saved, &err)
+	if snapshotCount(db) > 0 || len(snapshotHeld(db)) > 0 {
+		return 0, fmt.Errorf("compact: iterators or views are open")
+	}
+	oldNodes, avail := flWalk(&db.free)
+	slices.Sort(avail)
+
+	// the free pages that may end up in the new list,
+	// old list nodes and moved tree pages can't be written to
+	free := append([]uint64{}, oldNodes...)
+	// keep enough pages for the nodes of the new list
+	reserve := int(db.page.flushed)/flCap(&db.free) + 1
+	roots := treeRoots(db)
+	left := budget
+	for i, root := range roots {
+		if shrink && root != 0 {
+			roots[i] = compactRelocate(db, root, reserve, &avail, &free, &left)
+		}
+	}
+	moved = budget - left
+	free = append(free, avail...)
+	slices.Sort(free)
+
+	// the end of the file is the last page of the trees
+	end := uint64(db.page.masters)
+	for _, root := range roots {
+		if root != 0 {
+			end = max(end, compactEnd(db, root)+1)
+		}
+	}
+	if !shrink {
+		end = db.page.flushed
+	}
+
+	// pick the list nodes from the writable pages
+	nodes := []uint64{}
+	var items []uint64
+	for {
+		items = items[:0]
+		for _, ptr := range free {
+			if ptr < end && !slices.Contains(nodes, ptr) {
+				items = append(items, ptr)
+			}
+		}
+		if len(nodes)*flCap(&db.free) >= len(items) {
+			break
+		}
+		if len(avail) == 0 {
+			db.page.updates = make(map[uint64][]byte)
+			return 0, fmt.Errorf("compact: no room for the free list")
+		}
+		nodes = append(nodes, avail[0])
+		end = max(end, avail[0]+1)
+		avail = avail[1:]
+	}
+
+	setTreeRoots(db, roots)
+	flBuild(&db.free, nodes, items)
+	db.page.flushed = end
+	// the pages of the older commits are reused
+	db.page.allMasters = true
+	if err := flushPages(db); err != nil {
+		txRestore(db, saved)
+		return 0, fmt.Errorf("compact: %w", err)
+	}
+
+	// the master no longer references the tail
+	if size := int(end) * db.page.size; shrink && size < db.mmap.file {
+		if err := db.fp.Truncate(int64(size)); err != nil {
+			return moved, fmt.Errorf("truncate: %w", err)
+		}
+		db.mmap.file = size
+		db.mmap.locked = min(db.mmap.locked, size)
+	}
+	return moved, nil
+}
+
+// copy the node into a lower free page if there is one, returns the new ptr.
+// every ancestor must be copied too once a node moves,
+// so `depth` pages are kept in reserve for them on top of the initial one.
+// the moves besides the ancestors are taken from the budget.
+func compactRelocate(
+	db *KeyValue, ptr uint64, depth int, avail *[]uint64, freed *[]uint64,
+	budget *int,
+) uint64 {
+	if *budget == 0 {
+		return ptr
+	}
+	node := db.pageGet(ptr)
+	moved := BNode{}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid := node.getPtr(i)
+			newKid := compactRelocate(db, kid, depth+1, avail, freed, budget)
+			if newKid == kid {
+				continue
+			}
+			if moved.data == nil {
+				moved = BNode{make([]byte, db.page.size)}
+				copy(moved.data, node.data)
+			}
+			moved.setPtr(i, newKid)
+		}
+	}
+
+	lower := *budget != 0 && len(*avail) > depth && (*avail)[0] < ptr
+	if moved.data == nil && !lower {
+		return ptr
+	}
+	if lower && *budget > 0 {
+		*budget--
+	}
+	if moved.data == nil {
+		moved = BNode{make([]byte, db.page.size)}
+		copy(moved.data, node.data)
+	}
+	newPtr := (*avail)[0]
+	*avail = (*avail)[1:]
+	db.page.updates[newPtr] = moved.data
+	*freed = append(*freed, ptr)
+	return newPtr
+}
+
+// the highest page used by the tree
+func compactEnd(db *KeyValue, ptr uint64) uint64 {
+	end := ptr
+	node := db.pageGet(ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			end = max(end, compactEnd(db, node.getPtr(i)))
+		}
+	}
+	return end
+}
+
+// put the pages that are neither reachable from the trees nor on the
+// free list back on the free list, e.g. the pages of a commit that
+// crashed before the master page was written. returns the count.
+func (db *KeyValue) ReclaimOrphans() (orphans int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := checkWritable(db); err != nil {
+		return 0, err
+	}
+	if len(db.page.updates) > 0 {
+		return 0, fmt.Errorf("ReclaimOrphans: unflushed updates")
+	}
+	defer recoverWrite(db, txSave(db), &err)
+	orphans, err = reclaimOrphans(db)
+	if err != nil {
+		return 0, fmt.Errorf("ReclaimOrphans: %w", err)
+	}
+	return orphans, nil
+}
+
+// ReclaimOrphans with the write lock
+func reclaimOrphans(db *KeyValue) (orphans int, err error) {
+	used := make([]bool, db.page.flushed)
+	for slot := 0; slot < db.page.masters; slot++ {
+		used[slot] = true // the master pages
+	}
+	for _, root := range treeRoots(db) {
+		if root != 0 {
+			markTree(db, root, used)
+		}
+	}
+	nodes, items := flWalk(&db.free)
+	for _, ptr := range append(append(nodes, items...), snapshotHeld(db)...) {
+		used[ptr] = true
+	}
+
+	for ptr, ok := range used {
+		if !ok {
+			db.page.updates[uint64(ptr)] = nil // freed by the flush
+			orphans++
+		}
+	}
+	if orphans == 0 {
+		return 0, nil
+	}
+	if err := flushPages(db); err != nil {
+		db.page.updates = make(map[uint64][]byte)
+		return 0, err
+	}
+	logger(db).Debugf("reclaimed %d orphaned pages", orphans)
+	return orphans, nil
+}
+
+// drop the free list and put every page that isn't reachable from the
+// trees back on a new one, for a list that is corrupted or lost. a list
+// that stops Open can be rebuilt after opening with VERIFY_OFF.
+func (db *KeyValue) RebuildFreeList() (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	if len(db.page.updates) > 0 {
+		return fmt.Errorf("RebuildFreeList: unflushed updates")
+	}
+	defer recoverWrite(db, txSave(db), &err)
+	old := db.free.head
+	db.free.head = 0
+	orphans, err := reclaimOrphans(db)
+	if err == nil && orphans == 0 {
+		err = flushPages(db) // the master still points at the old list
+	}
+	if err != nil {
+		db.free.head = old
+		return fmt.Errorf("RebuildFreeList: %w", err)
+	}
+	logger(db).Debugf("rebuilt the free list, %d free pages", db.free.Total())
+	return nil
+}
+
+// the root page of the main tree as of the last commit, for SetRoot
+func (db *KeyValue) Root() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.tree.root
+}
+
+// roll the main tree back to the root of an earlier commit, for
+// recovery. the tree at ptr must be whole, Verify runs on it before
+// anything is written and a failure changes nothing. its pages may
+// have been reused since the commit, a page rewritten into a valid
+// node of the same shape can't be told apart, so the values should be
+// checked afterwards. every page outside the trees goes on a new free
+// list and the commit is written to every master slot. the changelog
+// and GetAsOf history before it are dropped. fails while iterators or
+// views are open.
+func (db *KeyValue) SetRoot(ptr uint64) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := checkWritable(db); err != nil {
+		return fmt.Errorf("SetRoot: %w", err)
+	}
+	if len(db.page.updates) > 0 {
+		return fmt.Errorf("SetRoot: unflushed updates")
+	}
+	if snapshotCount(db) > 0 {
+		return fmt.Errorf("SetRoot: %w: iterators or views are open", ErrBusy)
+	}
+	if ptr != 0 && (ptr < uint64(db.page.masters) || ptr >= db.page.flushed) {
+		return fmt.Errorf("SetRoot: page %d out of bounds (%d pages)", ptr, db.page.flushed)
+	}
+	saved := txSave(db)
+	defer recoverWrite(db, saved, &err)
+
+	// the old list and the held pages may hold pages of the tree
+	db.tree.root = ptr
+	db.free.head = 0
+	if err := verifyAll(db); err != nil {
+		txRestore(db, saved)
+		return fmt.Errorf("SetRoot: %w", err)
+	}
+	snapshotRestore(db, nil)
+	// the older commits share pages with the new free list
+	db.page.allMasters = true
+	orphans, err := reclaimOrphans(db)
+	if err == nil && orphans == 0 {
+		err = flushPages(db)
+	}
+	if err != nil {
+		txRestore(db, saved)
+		return fmt.Errorf("SetRoot: %w", err)
+	}
+
+	// nothing cached of the tree before holds
+	db.vcache.clear()
+	if db.pread != nil {
+		db.pread.clear()
+	}
+	if err := bloomBuild(db); err != nil {
+		return fmt.Errorf("SetRoot: %w", err)
+	}
+	// the rollback isn't a list of changes, the log starts over
+	db.changes.since = db.seq
+	db.changes.log = nil
+	if db.changes.fp != nil {
+		if err := changelogRewrite(db); err != nil {
+			return fmt.Errorf("SetRoot: %w", err)
+		}
+	}
+	logger(db).Warnf("root set to page %d, %d free pages", ptr, db.free.Total())
+	return nil
+}
+
+func markTree(db *KeyValue, ptr uint64, used []bool) {
+	used[ptr] = true
+	node := db.pageGet(ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			markTree(db, node.getPtr(i), used)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+/*
+A cursor walks the keys in order without holding a snapshot, so it can
+be dropped at any point and resumed later from its token, such as by
+the next request of a paged HTTP API. The position is the last key it
+returned. Each refill reads up to CURSOR_BATCH entries from the last
+commit and starts after that key, so the writes made meanwhile show up
+from the next batch on, and a key is never returned twice.
+
+The token is the URL-safe base64 of the format version, the position
+and, with Options.CursorSecret, an HMAC-SHA256 of both. The key is
+readable in an unsigned token.
+*/
+
+// entries a cursor reads per descent
+const CURSOR_BATCH = 64
+
+// the token format
+const CURSOR_TOKEN_V1 = 1
+
+// iterates over the keys in order from the last commit on each refill
+type Cursor struct {
+	db   *KeyValue
+	last []byte   // the stored key returned last, nil before the first
+	keys [][]byte // read ahead, copies
+	vals [][]byte
+	err  error // the first failure, the cursor is done after it
+}
+
+// a cursor at the first key
+func (db *KeyValue) NewCursor() *Cursor {
+	return &Cursor{db: db}
+}
+
+// a cursor after the position saved by Token
+func (db *KeyValue) NewCursorFromToken(tok []byte) (*Cursor, error) {
+	raw := make([]byte, base64.RawURLEncoding.DecodedLen(len(tok)))
+	n, err := base64.RawURLEncoding.Decode(raw, tok)
+	if err != nil || n < 1 || raw[0] != CURSOR_TOKEN_V1 {
+		return nil, fmt.Errorf("NewCursorFromToken: %w", ErrBadCursor)
+	}
+	raw = raw[:n]
+	if secret := db.Options.CursorSecret; secret != nil {
+		if len(raw) < 1+sha256.Size {
+			return nil, fmt.Errorf("NewCursorFromToken: %w", ErrBadCursor)
+		}
+		body, sum := raw[:len(raw)-sha256.Size], raw[len(raw)-sha256.Size:]
+		if !hmac.Equal(sum, cursorSign(secret, body)) {
+			return nil, fmt.Errorf("NewCursorFromToken: %w", ErrBadCursor)
+		}
+		raw = body
+	}
+	c := &Cursor{db: db}
+	if len(raw) > 1 {
+		c.last = append([]byte{}, raw[1:]...) // the empty key is the start
+	}
+	return c, nil
+}
+
+func cursorSign(secret []byte, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// the next entry, copies. ok is false at the end or on a failure, see
+// Err. the cursor can go on once more keys are added after the end.
+func (c *Cursor) Next() (key []byte, val []byte, ok bool) {
+	if len(c.keys) == 0 && c.err == nil {
+		c.err = c.refill()
+	}
+	if len(c.keys) == 0 || c.err != nil {
+		return nil, nil, false
+	}
+	key, val = c.keys[0], c.vals[0]
+	c.keys, c.vals = c.keys[1:], c.vals[1:]
+	c.last = key
+	if c.db.Options.AllowDuplicates {
+		key = multiUnkey(key) // the position keeps the stored key
+	}
+	return key, val, true
+}
+
+// read the entries after the position
+func (c *Cursor) refill() error {
+	db := c.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return err
+	}
+
+	it := scanTree(db, &db.tree, c.last, nil, nil)
+	for ; it.Valid() && len(c.keys) < CURSOR_BATCH; it.Next() {
+		key, val := it.iter.Deref()
+		if c.last != nil && bytes.Equal(key, c.last) {
+			continue
+		}
+		c.keys = append(c.keys, append([]byte{}, key...))
+		c.vals = append(c.vals, append([]byte{}, val...))
+	}
+	return it.Err()
+}
+
+// the failure that stopped the cursor, nil if it ran to the end
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// the position after the last entry returned by Next, for
+// NewCursorFromToken. the token of a new cursor starts at the first key.
+func (c *Cursor) Token() []byte {
+	raw := append([]byte{CURSOR_TOKEN_V1}, c.last...)
+	if secret := c.db.Options.CursorSecret; secret != nil {
+		raw = append(raw, cursorSign(secret, raw)...)
+	}
+	tok := make([]byte, base64.RawURLEncoding.EncodedLen(len(raw)))
+	base64.RawURLEncoding.Encode(tok, raw)
+	return tok
+}
@@ -0,0 +1,341 @@
+package database
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+Deletes only merge a node once it's below a quarter of a page, so a tree
+can end up with many leaves a third full. Defrag repacks the leaves of
+each leaf parent whose children are on average below the fill into as
+few leaves as their entries need, and rewrites the path above them. It
+goes through the main tree in key order, DEFRAG_BATCH leaf parents per
+commit, so the writers get in between and the pass can stop after any
+of them. The entries and the readers are unaffected, the pages are
+copied on write like any other change.
+
+With Options.AutoDefrag a background goroutine samples the fill at
+that interval and runs the pass when it's below Options.DefragFill.
+
+MergeSparseLeaves goes through the tree the same way but only merges
+neighbour leaves of a parent that are each below its threshold, into
+one leaf if they fit. The other leaves aren't rewritten.
+*/
+
+const (
+	DEFRAG_BATCH        = 16  // leaf parents looked at per commit
+	DEFRAG_SAMPLE       = 32  // leaf parents sampled by AutoDefrag
+	DEFAULT_DEFRAG_FILL = 0.5 // the leaves are repacked below this fill
+)
+
+func defragFill(db *KeyValue) float64 {
+	if db.Options.DefragFill > 0 {
+		return db.Options.DefragFill
+	}
+	return DEFAULT_DEFRAG_FILL
+}
+
+// repack the under-filled leaves of the main tree, returns the number
+// of leaves saved
+func (db *KeyValue) Defrag() (int, error) {
+	return defragRun(db, nil, 0)
+}
+
+// merge the neighbour leaves of the main tree filled below the
+// threshold, a fraction of a page in (0, 1], while two of them fit in
+// a page. returns the number of merges.
+func (db *KeyValue) MergeSparseLeaves(threshold float64) (int, error) {
+	if !(threshold > 0 && threshold <= 1) {
+		return 0, fmt.Errorf("MergeSparseLeaves: threshold %v out of range (0, 1]", threshold)
+	}
+	return defragRun(db, nil, threshold)
+}
+
+// the pass, it stops early once stop is closed. with sparse above 0
+// the leaves below it are merged in pairs instead of repacked.
+func defragRun(db *KeyValue, stop <-chan struct{}, sparse float64) (saved int, err error) {
+	var from []byte
+	for {
+		next, n, err := defragStep(db, from, sparse)
+		saved += n
+		if err != nil || next == nil {
+			return saved, err
+		}
+		select {
+		case <-stop:
+			return saved, nil
+		default:
+		}
+		from = next
+	}
+}
+
+// look at up to DEFRAG_BATCH leaf parents from the key on and commit,
+// returns the key to go on from, nil at the end
+func defragStep(db *KeyValue, from []byte, sparse float64) (next []byte, saved int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return nil, 0, err
+	}
+	if db.tree.root == 0 {
+		return nil, 0, nil
+	}
+	root := db.tree.get(db.tree.root)
+	if root.btype() != BNODE_NODE {
+		return nil, 0, nil // a single leaf
+	}
+
+	p := defragPass{tree: &db.tree, fill: defragFill(db), sparse: sparse, budget: DEFRAG_BATCH}
+	if updated := p.node(root, from); len(updated.data) > 0 {
+		db.tree.del(db.tree.root)
+		db.tree.root = db.tree.new(updated)
+	}
+	if p.saved == 0 {
+		return p.next, 0, nil
+	}
+	if err := flushPages(db); err != nil {
+		return nil, 0, err
+	}
+	logger(db).Debugf("defrag: %d leaves saved", p.saved)
+	return p.next, p.saved, nil
+}
+
+type defragPass struct {
+	tree   *BTree
+	fill   float64
+	sparse float64 // merge the leaves below it in pairs, see MergeSparseLeaves
+	budget int     // leaf parents left to look at
+	next   []byte  // the first key of the parent to go on from
+	saved  int     // leaves saved
+}
+
+// the node with its leaves repacked from the kid holding the key on,
+// an empty node if nothing changed
+func (p *defragPass) node(node BNode, from []byte) BNode {
+	if p.tree.get(node.getPtr(0)).btype() == BNODE_LEAF {
+		return p.leaves(node)
+	}
+	n := node.nkeys()
+	keys, ptrs := make([][]byte, n), make([]uint64, n)
+	for i := uint16(0); i < n; i++ {
+		keys[i], ptrs[i] = node.getKey(i), node.getPtr(i)
+	}
+	changed := false
+	for i := nodeLookupLE(node, from); i < n; i++ {
+		if p.budget == 0 {
+			p.next = append([]byte{}, keys[i]...)
+			break
+		}
+		if updated := p.node(p.tree.get(ptrs[i]), from); len(updated.data) > 0 {
+			p.tree.del(ptrs[i])
+			ptrs[i] = p.tree.new(updated)
+			changed = true
+		}
+		from = nil // the kids after it start at their first key
+		if p.next != nil {
+			break
+		}
+	}
+	if !changed {
+		return BNode{}
+	}
+	return defragParent(p.tree, keys, ptrs)
+}
+
+// repack the leaves of a leaf parent if they're below the fill and
+// fewer leaves would hold them
+func (p *defragPass) leaves(node BNode) BNode {
+	p.budget--
+	if p.sparse > 0 {
+		return p.pairs(node)
+	}
+	kids, used := make([]BNode, node.nkeys()), 0
+	for i := range kids {
+		kids[i] = p.tree.get(node.getPtr(uint16(i)))
+		used += int(kids[i].nbytes())
+	}
+	if float64(used) >= p.fill*float64(len(kids)*p.tree.nsize()) {
+		return BNode{}
+	}
+	packed := defragPack(p.tree, kids)
+	if len(packed) >= len(kids) || len(packed) == 0 {
+		return BNode{} // or only empty leaves of PreSplit
+	}
+	for i := range kids {
+		p.tree.del(node.getPtr(uint16(i)))
+	}
+	keys, ptrs := make([][]byte, len(packed)), make([]uint64, len(packed))
+	for i, leaf := range packed {
+		keys[i], ptrs[i] = leaf.getKey(0), p.tree.new(leaf)
+	}
+	keys[0] = node.getKey(0) // the key of the node in its parent
+	p.saved += len(kids) - len(packed)
+	return defragParent(p.tree, keys, ptrs)
+}
+
+// merge each leaf below the sparse fill into the one before it if that
+// one is below it too and they fit in a page
+func (p *defragPass) pairs(node BNode) BNode {
+	below := func(leaf BNode) bool {
+		return float64(leaf.nbytes()) < p.sparse*float64(p.tree.nsize())
+	}
+	n := node.nkeys()
+	keys, ptrs := make([][]byte, 0, n), make([]uint64, 0, n)
+	leaves := make([]BNode, 0, n) // the merged ones, empty for the others
+	prev, merges := p.tree.get(node.getPtr(0)), 0
+	keys, ptrs, leaves = append(keys, node.getKey(0)), append(ptrs, node.getPtr(0)), append(leaves, BNode{})
+	for i := uint16(1); i < n; i++ {
+		kid := p.tree.get(node.getPtr(i))
+		merged := int(prev.nbytes()) + int(kid.nbytes()) - HEADER
+		if !below(prev) || !below(kid) || merged > p.tree.nsize() {
+			keys, ptrs, leaves = append(keys, node.getKey(i)), append(ptrs, node.getPtr(i)), append(leaves, BNode{})
+			prev = kid
+			continue
+		}
+		// the merged leaf takes the place of the one before
+		last := len(ptrs) - 1
+		leaves[last] = BNode{data: make([]byte, p.tree.nsize())}
+		nodeMerge(leaves[last], prev, kid)
+		p.tree.del(node.getPtr(i))
+		prev = leaves[last]
+		merges++
+	}
+	if merges == 0 {
+		return BNode{}
+	}
+	for i, leaf := range leaves {
+		if len(leaf.data) > 0 {
+			p.tree.del(ptrs[i])
+			ptrs[i] = p.tree.new(leaf)
+		}
+	}
+	p.saved += merges
+	return defragParent(p.tree, keys, ptrs)
+}
+
+// the entries of the leaves in order, in as few full leaves as they fit
+func defragPack(tree *BTree, kids []BNode) []BNode {
+	type span struct {
+		kid     int
+		from, n uint16
+	}
+	out := []BNode{}
+	spans, size, count := []span{}, HEADER, uint16(0)
+	flush := func() {
+		leaf := BNode{data: make([]byte, tree.nsize())}
+		leaf.setHeader(BNODE_LEAF, count)
+		dst := uint16(0)
+		for _, s := range spans {
+			nodeAppendRange(leaf, kids[s.kid], dst, s.from, s.n)
+			dst += s.n
+		}
+		out = append(out, leaf)
+		spans, size, count = spans[:0], HEADER, 0
+	}
+	for k, kid := range kids {
+		for i := uint16(0); i < kid.nkeys(); i++ {
+			// the pointer, the offset and the KV
+			entry := 8 + 2 + int(kid.getOffSet(i+1)-kid.getOffSet(i))
+			if count > 0 && size+entry > tree.nsize() {
+				flush()
+			}
+			if last := len(spans) - 1; last >= 0 && spans[last].kid == k {
+				spans[last].n++
+			} else {
+				spans = append(spans, span{k, i, 1})
+			}
+			size += entry
+			count++
+		}
+	}
+	if count > 0 {
+		flush()
+	}
+	return out
+}
+
+// an internal node over the kids
+func defragParent(tree *BTree, keys [][]byte, ptrs []uint64) BNode {
+	node := BNode{data: make([]byte, tree.nsize())}
+	node.setHeader(BNODE_NODE, uint16(len(keys)))
+	for i := range keys {
+		nodeAppendKV(node, uint16(i), ptrs[i], keys[i], nil)
+	}
+	return node
+}
+
+// the average fill of the leaves under DEFRAG_SAMPLE leaf parents
+// reached by random descents, 1 for a tree without them
+func defragSample(db *KeyValue, rng *rand.Rand) (fill float64, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return 0, err
+	}
+	if db.tree.root == 0 || db.tree.get(db.tree.root).btype() != BNODE_NODE {
+		return 1, nil
+	}
+	used, total := 0, 0
+	for s := 0; s < DEFRAG_SAMPLE; s++ {
+		node := db.tree.get(db.tree.root)
+		for {
+			kid := db.tree.get(node.getPtr(uint16(rng.Intn(int(node.nkeys())))))
+			if kid.btype() == BNODE_LEAF {
+				break
+			}
+			node = kid
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			used += int(db.tree.get(node.getPtr(i)).nbytes())
+			total += db.tree.nsize()
+		}
+	}
+	return float64(used) / float64(total), nil
+}
+
+// run the pass every Options.AutoDefrag while the fill is low, until Close
+func defragStart(db *KeyValue) {
+	if db.Options.AutoDefrag <= 0 || db.Options.ReadOnly {
+		return
+	}
+	db.defrag.mu.Lock()
+	defer db.defrag.mu.Unlock()
+	stop, done := make(chan struct{}), make(chan struct{})
+	db.defrag.stop, db.defrag.done = stop, done
+	go func() {
+		defer close(done)
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		ticker := time.NewTicker(db.Options.AutoDefrag)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			fill, err := defragSample(db, rng)
+			if err == nil && fill < defragFill(db) {
+				_, err = defragRun(db, stop, 0)
+			}
+			if err != nil {
+				logger(db).Warnf("defrag: %v", err)
+			}
+		}
+	}()
+}
+
+// called by Close before it takes the lock the pass needs
+func defragStop(db *KeyValue) {
+	db.defrag.mu.Lock()
+	defer db.defrag.mu.Unlock()
+	if db.defrag.stop != nil {
+		close(db.defrag.stop)
+		<-db.defrag.done
+		db.defrag.stop, db.defrag.done = nil, nil
+	}
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/*
+With Options.DirectIO the file is opened with O_DIRECT and the pages
+are written with pwrite from aligned buffers, bypassing the page cache.
+The mapping is read-only and still serves the reads: a direct write
+drops the cached pages it covers, and since the mapping is never
+written to they are clean and the next read faults in the new data.
+The fsyncs stay, O_DIRECT doesn't flush the device cache.
+*/
+
+// the offsets, lengths and buffers of O_DIRECT writes are multiples
+const DIRECT_IO_ALIGN = 4096
+
+// a zeroed buffer of size bytes starting at an aligned address
+func directBuffer(size int) []byte {
+	buf := make([]byte, size+DIRECT_IO_ALIGN)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) % DIRECT_IO_ALIGN)
+	if off != 0 {
+		off = DIRECT_IO_ALIGN - off
+	}
+	return buf[off : off+size]
+}
+
+// the page size must keep the page offsets aligned
+func checkDirectIO(db *KeyValue) error {
+	if db.Options.DirectIO && db.page.size%DIRECT_IO_ALIGN != 0 {
+		return fmt.Errorf("DirectIO needs a page size that is a multiple of %d, not %d",
+			DIRECT_IO_ALIGN, db.page.size)
+	}
+	return nil
+}
+
+// write and seal a page through buf, an aligned page sized buffer
+func directWrite(db *KeyValue, buf []byte, ptr uint64, page []byte) error {
+	copy(buf, page)
+	clear(buf[len(page):])
+	pageSeal(db, buf)
+	if _, err := fileWriteAt(db.fp, buf, int64(ptr)*int64(db.page.size)); err != nil {
+		return fmt.Errorf("direct write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	DOT_MAX_NODES = 1000 // nodes drawn by WriteDOT
+	DOT_KEY_LEN   = 16   // bytes of a key shown in a label
+)
+
+// limits of the graph written by WriteDOTWithOptions, 0 is no limit
+type DOTOptions struct {
+	MaxDepth int // levels below the root
+	MaxNodes int
+}
+
+// write the main tree as a Graphviz DOT graph, a record per node
+// labeled with its keys and an edge per child. at most DOT_MAX_NODES
+// nodes are drawn, the children left out end in a "..." node.
+func (db *KeyValue) WriteDOT(w io.Writer) error {
+	return db.WriteDOTWithOptions(w, DOTOptions{MaxNodes: DOT_MAX_NODES})
+}
+
+func (db *KeyValue) WriteDOTWithOptions(w io.Writer, opts DOTOptions) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "digraph btree {")
+	fmt.Fprintln(out, "\tnode [shape=record];")
+	// breadth first, so a node limit cuts the deepest levels
+	type item struct {
+		ptr   uint64
+		depth int
+	}
+	queue := []item{}
+	if db.tree.root != 0 {
+		queue = append(queue, item{db.tree.root, 0})
+	}
+	drawn, cut := 0, 0
+	for len(queue) > 0 {
+		it := queue[0]
+		queue = queue[1:]
+		node := db.pageGet(it.ptr)
+		fields := []string{}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			fields = append(fields, fmt.Sprintf("<f%d> %s", i, dotLabel(node.getKey(i))))
+		}
+		fmt.Fprintf(out, "\tn%d [label=\"%s\"];\n", it.ptr, strings.Join(fields, "|"))
+		drawn++
+		if node.btype() != BNODE_NODE {
+			continue
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid := node.getPtr(i)
+			full := opts.MaxNodes > 0 && drawn+len(queue) >= opts.MaxNodes
+			deep := opts.MaxDepth > 0 && it.depth >= opts.MaxDepth
+			if full || deep {
+				fmt.Fprintf(out, "\tn%d:f%d -> cut%d;\n", it.ptr, i, cut)
+				fmt.Fprintf(out, "\tcut%d [label=\"...\", shape=plaintext];\n", cut)
+				cut++
+				continue
+			}
+			fmt.Fprintf(out, "\tn%d:f%d -> n%d [label=\"%s\"];\n",
+				it.ptr, i, kid, dotKey(node.getKey(i)))
+			queue = append(queue, item{kid, it.depth + 1})
+		}
+	}
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+// a key quoted for a DOT string, long ones shortened
+func dotKey(key []byte) string {
+	more := ""
+	if len(key) > DOT_KEY_LEN {
+		key, more = key[:DOT_KEY_LEN], "..."
+	}
+	quoted := strconv.Quote(string(key))
+	return quoted[1:len(quoted)-1] + more
+}
+
+// the characters with a meaning in a record label
+var dotRecordEscaper = strings.NewReplacer(
+	"{", `\{`, "}", `\}`, "|", `\|`, "<", `\<`, ">", `\>`)
+
+// dotKey also escaped for the record syntax of a node label
+func dotLabel(key []byte) string {
+	return dotRecordEscaper.Replace(dotKey(key))
+}
@@ -1,11 +1,13 @@
 package database
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 const (
 	BNODE_FREE_LIST  = 3
 	FREE_LIST_HEADER = 4 + 8 + 8
-	FREE_LIST_CAP    = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 )
 
 /*
@@ -15,20 +17,33 @@ const (
 acts like a stack to keep track of unused pages
 */
 type FreeList struct {
-	head uint64
+	head     uint64
+	pageSize int // BTREE_PAGE_SIZE if 0
 	// callbacks for managing on-disk pages
 	get func(uint64) BNode  // dereference a pointer
 	new func(BNode) uint64  // append a new page
 	use func(uint64, BNode) // reuse a page
 }
 
+func (fl *FreeList) psize() int {
+	if fl.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return fl.pageSize
+}
+
+// number of pointers that fit in a node
+func flCap(fl *FreeList) int {
+	return (fl.psize() - FREE_LIST_HEADER) / 8
+}
+
 // number of items in the list
 func (fl *FreeList) Total() int {
 	if fl.head == 0 {
 		return 0
 	}
 	page := fl.get(fl.head)
-	return int(binary.LittleEndian.Uint64(page.data[32:]))
+	return int(binary.LittleEndian.Uint64(page.data[4:]))
 }
 
 // get the nth pointer
@@ -37,30 +52,59 @@ func (fl *FreeList) Get(topn int) uint64 {
 		panic("Get: topn index is out of scope")
 	}
 	node := fl.get(fl.head)
+	walk := newFLWalker(fl)
 	for flnSize(node) <= topn {
 		topn -= flnSize(node)
 		next := flnNext(node)
 		if next == 0 {
-			panic("Get: next is 0")
+			panic(flCorrupt("the total exceeds the items"))
 		}
+		walk.step(next)
 		node = fl.get(next)
 	}
 	return flnPtr(node, flnSize(node)-topn-1)
 }
 
+// a corrupted list panics with an error wrapping ErrFreeListCorrupt,
+// recovered by the API methods like a checksum mismatch
+func flCorrupt(format string, args ...any) error {
+	return fmt.Errorf("free list: %s: %w", fmt.Sprintf(format, args...), ErrFreeListCorrupt)
+}
+
+// detects a cycle in the next pointers so a walk can't spin forever,
+// a second walk at half the speed meets the first one in a cycle. it
+// follows the nodes already read instead of reading them again.
+type flWalker struct {
+	path []uint64 // the nodes from the head
+}
+
+func newFLWalker(fl *FreeList) flWalker {
+	return flWalker{path: []uint64{fl.head}}
+}
+
+// called with each next pointer followed from the head
+func (w *flWalker) step(next uint64) {
+	w.path = append(w.path, next)
+	steps := len(w.path) - 1
+	if next == w.path[steps/2] {
+		panic(flCorrupt("cycle at page %d", next))
+	}
+}
+
 // remove 'popn' pointers and add some new pointers
 func (fl *FreeList) Update(popn int, freed []uint64) {
-	if popn > fl.Total() {
-		panic("Update: popn is larger than the total number of items")
-	}
 	if popn == 0 && len(freed) == 0 {
 		return
 	}
+	total := fl.Total()
+	if popn > total {
+		panic("Update: popn is larger than the total number of items")
+	}
 
 	// prepare to construct the new list
-	total := fl.Total()
 	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
+	walk := newFLWalker(fl)
+	for fl.head != 0 && (popn > 0 || len(reuse)*flCap(fl) < len(freed)) {
 		node := fl.get(fl.head)
 		freed = append(freed, fl.head) // recycle the node itself
 		if popn >= flnSize(node) {
@@ -73,7 +117,7 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 			remain := flnSize(node) - popn
 			popn = 0
 			// reuse pointers from the free list itself
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
+			for remain > 0 && len(reuse)*flCap(fl) < len(freed)+remain {
 				remain--
 				reuse = append(reuse, flnPtr(node, remain))
 			}
@@ -85,33 +129,101 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 		// discard the node and move to the next node
 		total -= flnSize(node)
 		fl.head = flnNext(node)
+		if fl.head != 0 {
+			walk.step(fl.head)
+		}
 	}
 
-	if len(reuse)*FREE_LIST_CAP < len(freed) && fl.head != 0 {
+	if len(reuse)*flCap(fl) < len(freed) && fl.head != 0 {
 		panic("Update: invalid state")
 	}
+	// the last page taken for reuse is one too many when the items
+	// fill the nodes exactly, it goes on the list instead
+	if n := len(reuse); n > 0 && (n-1)*flCap(fl) >= len(freed) {
+		freed, reuse = append(freed, reuse[n-1]), reuse[:n-1]
+	}
 
 	// phase 3: prepend new nodes
-	flPush(fl, freed, reuse)
+	flPush(fl, freed, reuse, total+len(freed))
+}
 
-	// done
-	flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
+// collect the pages holding the list and the pointers stored in them
+func flWalk(fl *FreeList) (nodes []uint64, items []uint64) {
+	walk := newFLWalker(fl)
+	for ptr := fl.head; ptr != 0; {
+		node := fl.get(ptr)
+		nodes = append(nodes, ptr)
+		for i := 0; i < flnSize(node); i++ {
+			items = append(items, flnPtr(node, i))
+		}
+		if ptr = flnNext(node); ptr != 0 {
+			walk.step(ptr)
+		}
+	}
+	return nodes, items
 }
 
-func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
-		new := BNode{make([]byte, BTREE_PAGE_SIZE)}
+// the first n pointers in the order Get hands them out
+func flTop(fl *FreeList, n int) []uint64 {
+	items := []uint64{}
+	walk := newFLWalker(fl)
+	for ptr := fl.head; ptr != 0 && len(items) < n; {
+		node := fl.get(ptr)
+		for i := flnSize(node) - 1; i >= 0 && len(items) < n; i-- {
+			items = append(items, flnPtr(node, i))
+		}
+		if ptr = flnNext(node); ptr != 0 {
+			walk.step(ptr)
+		}
+	}
+	return items
+}
 
-		// construct a new node
-		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
+// build a new list out of `items`, housed in the `nodes` pages.
+// the items are handed out by Get in the order given.
+func flBuild(fl *FreeList, nodes []uint64, items []uint64) {
+	if len(nodes)*flCap(fl) < len(items) {
+		panic("flBuild: not enough nodes for the items")
+	}
+	fl.head = 0
+	// the head is built last, and Get reads each node from the end
+	for i := len(nodes) - 1; i >= 0; i-- {
+		lo := i * flCap(fl)
+		hi := min(lo+flCap(fl), len(items))
+		lo = min(lo, hi)
+		new := BNode{make([]byte, fl.psize())}
+		flnSetHeader(new, uint16(hi-lo), fl.head)
+		for j, ptr := range items[lo:hi] {
+			flnSetPtr(new, hi-lo-j-1, ptr)
 		}
+		if i == 0 {
+			flnSetTotal(new, uint64(len(items)))
+		}
+		fl.use(nodes[i], new)
+		fl.head = nodes[i]
+	}
+}
+
+// prepend the nodes holding freed, housed in the reuse pages and then
+// in appended ones. the head gets the total of the new list.
+func flPush(fl *FreeList, freed []uint64, reuse []uint64, total int) {
+	n := (len(freed) + flCap(fl) - 1) / flCap(fl)
+	if len(reuse) > n {
+		panic("flPush: all pages not reused from the list")
+	}
+	for i := 0; i < n; i++ {
+		new := BNode{make([]byte, fl.psize())}
+
+		// construct a new node
+		size := min(len(freed), flCap(fl))
 		flnSetHeader(new, uint16(size), fl.head)
 		for i, ptr := range freed[:size] {
 			flnSetPtr(new, i, ptr)
 		}
 		freed = freed[size:]
+		if i == n-1 {
+			flnSetTotal(new, uint64(total))
+		}
 
 		if len(reuse) > 0 {
 			// reuse a pionter from the list
@@ -122,9 +234,6 @@ func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
 			fl.head = fl.new(new)
 		}
 	}
-	if len(reuse) != 0 {
-		panic("flPush: all pages not reused from the list")
-	}
 }
 
 /*
@@ -137,36 +246,35 @@ func flnSize(node BNode) int {
 	if node.data == nil {
 		return 0
 	}
-	return int(binary.LittleEndian.Uint16(node.data[16:]))
+	return int(binary.LittleEndian.Uint16(node.data[2:]))
 }
 
 func flnNext(node BNode) uint64 {
 	if node.data == nil {
 		return 0
 	}
-	return binary.LittleEndian.Uint64(node.data[96:])
+	return binary.LittleEndian.Uint64(node.data[12:])
 }
 
 func flnPtr(node BNode, idx int) uint64 {
 	if node.data == nil {
 		return 0
 	}
-	headOffset := FREE_LIST_HEADER * 8
-	ptrOffset := headOffset + idx*8
+	ptrOffset := FREE_LIST_HEADER + idx*8
 	return binary.LittleEndian.Uint64(node.data[ptrOffset:])
 }
 
 func flnSetPtr(node BNode, idx int, ptr uint64) {
-	headOffset := FREE_LIST_HEADER * 8
-	ptrOffset := headOffset + idx*8
+	ptrOffset := FREE_LIST_HEADER + idx*8
 	binary.LittleEndian.PutUint64(node.data[ptrOffset:], ptr)
 }
 
 func flnSetHeader(node BNode, size uint16, next uint64) {
-	binary.LittleEndian.PutUint16(node.data[16:], size) // set size
-	binary.LittleEndian.PutUint64(node.data[96:], next) // set next
+	binary.LittleEndian.PutUint16(node.data[0:], BNODE_FREE_LIST) // set type
+	binary.LittleEndian.PutUint16(node.data[2:], size)            // set size
+	binary.LittleEndian.PutUint64(node.data[12:], next)           // set next
 }
 
 func flnSetTotal(node BNode, total uint64) {
-	binary.LittleEndian.PutUint64(node.data[32:], total)
+	binary.LittleEndian.PutUint64(node.data[4:], total)
 }
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// a quick check for readiness probes. it verifies the master pages and
+// reads the root, its first child and the free list head, so unlike a
+// full walk of the tree the cost doesn't depend on the database size.
+func (db *KeyValue) HealthCheck() (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+
+	if err := checkOpen(db); err != nil {
+		return fmt.Errorf("HealthCheck: %w", err)
+	}
+	if db.mmap.file == 0 {
+		return nil // nothing written yet
+	}
+	// every slot is written by the first commit, a bad one is damage
+	m := masterPage{}
+	for slot := 0; slot < db.page.masters; slot++ {
+		sm, err := masterRead(db, slot, db.page.size)
+		if err != nil {
+			return fmt.Errorf("HealthCheck: %w", err)
+		}
+		if slot == 0 || sm.seq > m.seq {
+			m = sm
+		}
+	}
+	if m.pageSize != db.page.size {
+		return fmt.Errorf("HealthCheck: page size changed from %d to %d",
+			db.page.size, m.pageSize)
+	}
+
+	// the pointers in use, a reader may lag behind the master page
+	for _, root := range treeRoots(db) {
+		if root >= db.page.flushed {
+			return fmt.Errorf("HealthCheck: root %d out of bounds (%d pages)",
+				root, db.page.flushed)
+		}
+	}
+	if db.free.head >= db.page.flushed {
+		return fmt.Errorf("HealthCheck: free list %d out of bounds (%d pages)",
+			db.free.head, db.page.flushed)
+	}
+	if db.tree.root != 0 {
+		root := db.pageGet(db.tree.root)
+		if err := healthCheckNode(root); err != nil {
+			return fmt.Errorf("HealthCheck: root %d: %w", db.tree.root, err)
+		}
+		if root.btype() == BNODE_NODE {
+			kid := root.getPtr(0)
+			if kid == 0 || kid >= db.page.flushed {
+				return fmt.Errorf("HealthCheck: child %d out of bounds", kid)
+			}
+			if err := healthCheckNode(db.pageGet(kid)); err != nil {
+				return fmt.Errorf("HealthCheck: child %d: %w", kid, err)
+			}
+		}
+	}
+	if db.free.head != 0 {
+		head := db.pageGet(db.free.head)
+		btype := binary.LittleEndian.Uint16(head.data)
+		if btype != BNODE_FREE_LIST || flnSize(head) > flCap(&db.free) {
+			return fmt.Errorf("HealthCheck: bad free list head %d", db.free.head)
+		}
+		if next := flnNext(head); next >= db.page.flushed {
+			return fmt.Errorf("HealthCheck: free list next %d out of bounds", next)
+		}
+	}
+	return nil
+}
+
+// the header and the offsets stay within the page
+func healthCheckNode(node BNode) error {
+	btype, nkeys := node.btype(), int(node.nkeys())
+	if btype != BNODE_NODE && btype != BNODE_LEAF {
+		return fmt.Errorf("bad node type %d", btype)
+	}
+	// a leaf may be empty, see PreSplit
+	if (nkeys == 0 && btype == BNODE_NODE) || HEADER+10*nkeys > len(node.data) {
+		return fmt.Errorf("bad number of keys %d", nkeys)
+	}
+	size := HEADER + 10*nkeys + int(node.getOffSet(node.nkeys()))
+	if size > len(node.data) {
+		return fmt.Errorf("node size %d exceeds the page", size)
+	}
+	return nil
+}
+
+// a full check of the trees and the free list, O(size of the file).
+// every node is read and checked for its layout, the order of its keys
+// and the range its parent gives it, the leaves are at the same depth
+// and no page is used twice. the error wraps ErrInconsistent, or
+// ErrChecksum for a page that doesn't match its checksum.
+func (db *KeyValue) Verify() (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return fmt.Errorf("Verify: %w", err)
+	}
+	if err := verifyAll(db); err != nil {
+		return fmt.Errorf("Verify: %w", err)
+	}
+	return nil
+}
+
+func verifyAll(db *KeyValue) (err error) {
+	defer recoverCorrupt(db, &err)
+	v := verifier{db: db, seen: map[uint64]bool{}, depth: -1}
+	for _, root := range treeRoots(db) {
+		v.depth = -1
+		if root != 0 {
+			if err := v.node(root, nil, nil, 0); err != nil {
+				return err
+			}
+		}
+	}
+	nodes, items := flWalk(&db.free)
+	for _, ptr := range append(nodes, items...) {
+		if err := v.page(ptr); err != nil {
+			return fmt.Errorf("free list: %w", err)
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	db    *KeyValue
+	seen  map[uint64]bool // the pages met so far
+	depth int             // of the leaves of the tree, -1 before the first
+}
+
+// the pointer is in the file and not used before
+func (v *verifier) page(ptr uint64) error {
+	if ptr < uint64(v.db.page.masters) || ptr >= v.db.page.flushed {
+		return fmt.Errorf("page %d out of bounds (%d pages): %w", ptr, v.db.page.flushed, ErrInconsistent)
+	}
+	if v.seen[ptr] {
+		return fmt.Errorf("page %d is used twice: %w", ptr, ErrInconsistent)
+	}
+	v.seen[ptr] = true
+	return nil
+}
+
+// the node and its subtree, its keys are in [lo, hi) and the first
+// one is lo, or past it in a leaf split by PreSplit. nil lo is the
+// start of the tree, nil hi the end.
+func (v *verifier) node(ptr uint64, lo []byte, hi []byte, depth int) error {
+	if err := v.page(ptr); err != nil {
+		return err
+	}
+	node := pageGetMapped(v.db, ptr)
+	if err := pageVerify(v.db, ptr, node.data); err != nil {
+		return err
+	}
+	if node.btype() == BNODE_LEAF_SEQ {
+		decoded, err := seqDecode(node.data)
+		if err != nil {
+			return fmt.Errorf("page %d: %v: %w", ptr, err, ErrInconsistent)
+		}
+		node = decoded
+	}
+	if err := healthCheckNode(node); err != nil {
+		return fmt.Errorf("page %d: %v: %w", ptr, err, ErrInconsistent)
+	}
+	for i := uint16(1); i <= node.nkeys(); i++ {
+		if node.getOffSet(i) < node.getOffSet(i-1) {
+			return fmt.Errorf("page %d: offset %d goes back: %w", ptr, i, ErrInconsistent)
+		}
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		key := node.getKey(i)
+		switch {
+		case i == 0 && lo == nil && len(key) != 0:
+			return fmt.Errorf("page %d: the first key isn't the dummy key: %w", ptr, ErrInconsistent)
+		case i == 0 && lo != nil && node.btype() == BNODE_LEAF && bytes.Compare(key, lo) < 0:
+			return fmt.Errorf("page %d: the first key %q is before the parent's %q: %w", ptr, key, lo, ErrInconsistent)
+		case i == 0 && lo != nil && node.btype() == BNODE_NODE && !bytes.Equal(key, lo):
+			return fmt.Errorf("page %d: the first key %q isn't the parent's %q: %w", ptr, key, lo, ErrInconsistent)
+		case i > 0 && bytes.Compare(node.getKey(i-1), key) >= 0:
+			return fmt.Errorf("page %d: key %d is out of order: %w", ptr, i, ErrInconsistent)
+		case hi != nil && bytes.Compare(key, hi) >= 0:
+			return fmt.Errorf("page %d: key %q is past %q: %w", ptr, key, hi, ErrInconsistent)
+		}
+	}
+
+	if node.btype() == BNODE_LEAF {
+		if v.depth >= 0 && v.depth != depth {
+			return fmt.Errorf("page %d: a leaf at depth %d, not %d: %w", ptr, depth, v.depth, ErrInconsistent)
+		}
+		v.depth = depth
+		return nil
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kidHi := hi
+		if i+1 < node.nkeys() {
+			kidHi = node.getKey(i + 1)
+		}
+		kidLo := node.getKey(i)
+		if i == 0 && lo == nil {
+			kidLo = nil
+		}
+		if err := v.node(node.getPtr(i), kidLo, kidHi, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whether the handle that last wrote the file closed it, false after
+// a crash or with a writer still open. it's the state at Open, a
+// false one suggests a ReclaimOrphans for the pages of a commit the
+// crash cut off. a new file counts as closed cleanly.
+func (db *KeyValue) IsCleanShutdown() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.page.cleanOpen
+}
+
+// a copy of a page as it is in the file, to attach to a bug report.
+// the master slots are the first pages. ptr must be below the pages of
+// the last commit, the pages being written aren't in the file yet.
+func (db *KeyValue) PageBytes(ptr uint64) (page []byte, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return nil, fmt.Errorf("PageBytes: %w", err)
+	}
+	// a new file reserves the slots before it has them
+	pages := min(db.page.flushed, uint64(db.mmap.file/db.page.size))
+	if ptr >= pages {
+		return nil, fmt.Errorf("PageBytes: page %d out of bounds (%d pages)", ptr, pages)
+	}
+	return append([]byte{}, pageGetMapped(db, ptr).data...), nil
+}
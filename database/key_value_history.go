@@ -0,0 +1,83 @@
+package database
+
+import (
+	"fmt"
+)
+
+/*
+With Options.HistoryCommits the roots of the last commits are kept, and
+GetAsOf reads a key in the tree of one of them. The pages those commits
+free are held back from the free list like the pages of an open
+iterator, see snapshotFree, so the older trees stay readable until they
+fall out of the window.
+
+Only the commits since Open are kept, the held pages aren't recorded in
+the file. A compaction, and the other commits written to every master
+slot, reuse the pages of the older commits, so they drop the history.
+*/
+
+// the main tree after the commit seq
+type historyRoot struct {
+	seq  uint64
+	root uint64
+}
+
+// record the commit before the one just written, called once the
+// master page is. all is set if the commit went to every master slot.
+func historyCommit(db *KeyValue, prev historyRoot, all bool) {
+	keep := uint64(db.Options.HistoryCommits)
+	if keep == 0 || all {
+		db.history = nil
+		return
+	}
+	history := append(db.history, prev)
+	for len(history) > 0 && history[0].seq+keep < db.seq {
+		history = history[1:]
+	}
+	db.history = history
+}
+
+// the root of the main tree after the commit seq, if it's still kept
+func historyLookup(db *KeyValue, seq uint64) (uint64, bool) {
+	if seq == db.seq {
+		return db.tree.root, true
+	}
+	for _, h := range db.history {
+		if h.seq == seq {
+			return h.root, true
+		}
+	}
+	return 0, false
+}
+
+// the value of the key as of the commit seq, a copy. the commits
+// before the last one are readable for Options.HistoryCommits commits,
+// an older or unknown seq fails with ErrHistoryUnavailable.
+func (db *KeyValue) GetAsOf(seq uint64, key []byte) (val []byte, ok bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return nil, false, err
+	}
+	if err := checkKey(db, key); err != nil {
+		return nil, false, err
+	}
+	root, found := historyLookup(db, seq)
+	if !found {
+		return nil, false, fmt.Errorf("GetAsOf: %w: commit %d, the last is %d",
+			ErrHistoryUnavailable, seq, db.seq)
+	}
+	// the read lock keeps the commits out, the pages are all mapped
+	tree := snapshotTree(db, root)
+	if db.Options.AllowDuplicates {
+		_, vals := multiEntries(tree, key, 1)
+		if len(vals) == 0 {
+			return nil, false, nil
+		}
+		val = vals[0]
+	} else if val, _, ok = treeGetLive(tree, key); !ok {
+		return nil, false, nil
+	}
+	return append([]byte{}, val...), true, nil
+}
@@ -0,0 +1,19 @@
+package database
+
+// receives internal events such as splits, file growth and flush errors
+type Logger interface {
+	Debugf(format string, args ...any)
+	Warnf(format string, args ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...any) {}
+func (nopLogger) Warnf(format string, args ...any)  {}
+
+func logger(db *KeyValue) Logger {
+	if db.Options.Logger == nil {
+		return nopLogger{}
+	}
+	return db.Options.Logger
+}
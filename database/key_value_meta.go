@@ -0,0 +1,122 @@
+package database
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+The metadata of an entry is stored in front of its value, see
+BTree.InsertMeta. It starts with a byte of META_* flags, followed by
+the fields that are set in the order of the flags.
+*/
+
+const (
+	META_USER    = 1 << 0 // 4B, SetWithMeta
+	META_EXPIRES = 1 << 1 // 8B, SetWithTTL
+	META_VERSION = 1 << 2 // 8B, SetVersioned
+)
+
+// the decoded metadata of an entry
+type entryMeta struct {
+	flags   byte
+	user    uint32
+	expires int64 // unix nanoseconds
+	version uint64
+}
+
+func encodeMeta(m entryMeta) []byte {
+	out := []byte{m.flags}
+	if m.flags&META_USER != 0 {
+		out = binary.LittleEndian.AppendUint32(out, m.user)
+	}
+	if m.flags&META_EXPIRES != 0 {
+		out = binary.LittleEndian.AppendUint64(out, uint64(m.expires))
+	}
+	if m.flags&META_VERSION != 0 {
+		out = binary.LittleEndian.AppendUint64(out, m.version)
+	}
+	return out
+}
+
+// nil decodes to no fields
+func decodeMeta(data []byte) entryMeta {
+	if len(data) == 0 {
+		return entryMeta{}
+	}
+	m := entryMeta{flags: data[0]}
+	data = data[1:]
+	if m.flags&META_USER != 0 {
+		m.user, data = binary.LittleEndian.Uint32(data), data[4:]
+	}
+	if m.flags&META_EXPIRES != 0 {
+		m.expires, data = int64(binary.LittleEndian.Uint64(data)), data[8:]
+	}
+	if m.flags&META_VERSION != 0 {
+		m.version, data = binary.LittleEndian.Uint64(data), data[8:]
+	}
+	return m
+}
+
+// the entry with the stored metadata has expired at now
+func metaExpired(meta []byte, now int64) bool {
+	if meta == nil {
+		return false
+	}
+	m := decodeMeta(meta)
+	return m.flags&META_EXPIRES != 0 && m.expires <= now
+}
+
+// a lookup that treats an expired entry as missing
+func treeGetLive(tree *BTree, key []byte) ([]byte, []byte, bool) {
+	val, meta, ok := tree.GetMeta(key)
+	if !ok || metaExpired(meta, time.Now().UnixNano()) {
+		return nil, nil, false
+	}
+	return val, meta, true
+}
+
+// store a metadata word with the value, for flags or timestamps.
+// Get and the iterators see the value as it was given, the metadata
+// takes a few bytes of the max value size. the changelog records the
+// value without it.
+func (db *KeyValue) SetWithMeta(key []byte, val []byte, meta uint32) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	stored := encodeMeta(entryMeta{flags: META_USER, user: meta})
+	if err := checkMetaKV(db, key, val, stored); err != nil {
+		return err
+	}
+	db.insertMeta(key, val, stored)
+	return flushPages(db)
+}
+
+// Get with the metadata word, 0 for a value set without it
+func (db *KeyValue) GetWithMeta(key []byte) (val []byte, meta uint32, ok bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	if checkOpen(db) != nil || checkKey(db, key) != nil {
+		return nil, 0, false
+	}
+	val, stored, ok := treeGetLive(&db.tree, key)
+	return readCopy(db, val), decodeMeta(stored).user, ok
+}
+
+// checkKV for a value stored with the metadata
+func checkMetaKV(db *KeyValue, key []byte, val []byte, meta []byte) error {
+	if err := checkKey(db, key); err != nil {
+		return err
+	}
+	if metaSize(meta)+len(val) > maxValSize(db.page.size) {
+		return ErrValueTooLarge
+	}
+	if err := checkEntry(db, len(key), metaSize(meta)+len(val)); err != nil {
+		return err
+	}
+	return checkValue(db, key, val)
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+/*
+With Options.EnableLatencyMetrics each Set, Get, Del and commit adds its
+latency to a histogram of the operation. The buckets split each power of
+two of nanoseconds in 4, so a percentile is within 25% of the latency it
+stands for. A sample is an atomic add, the readers don't share a lock
+for it.
+*/
+
+const (
+	LATENCY_SUB_BUCKETS = 4 // per power of two
+	LATENCY_BUCKETS     = 64 * LATENCY_SUB_BUCKETS
+)
+
+// the operations with a histogram
+const (
+	LATENCY_SET = iota
+	LATENCY_GET
+	LATENCY_DEL
+	LATENCY_FLUSH
+	LATENCY_OPS
+)
+
+// the latencies of an operation since Open
+type LatencyStats struct {
+	Count uint64
+	P50   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+}
+
+// the latencies recorded with Options.EnableLatencyMetrics
+type Metrics struct {
+	Set   LatencyStats
+	Get   LatencyStats
+	Del   LatencyStats
+	Flush LatencyStats // the commits, the file writes and syncs
+}
+
+type latencyHistogram struct {
+	buckets [LATENCY_BUCKETS]atomic.Uint64
+}
+
+// a nil one is disabled, every method is a no-op
+type latencyMetrics struct {
+	ops [LATENCY_OPS]latencyHistogram
+}
+
+func newLatencyMetrics(enabled bool) *latencyMetrics {
+	if !enabled {
+		return nil
+	}
+	return &latencyMetrics{}
+}
+
+// the start of an operation, for record
+func (m *latencyMetrics) start() time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// add the time since start to the histogram of the operation
+func (m *latencyMetrics) record(op int, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.ops[op].buckets[latencyBucket(uint64(time.Since(start)))].Add(1)
+}
+
+// the exact values below LATENCY_SUB_BUCKETS, then the power of two
+// and the sub-bucket in it
+func latencyBucket(ns uint64) int {
+	if ns < LATENCY_SUB_BUCKETS {
+		return int(ns)
+	}
+	e := bits.Len64(ns) // 3 and up
+	sub := int(ns>>(e-3)) & (LATENCY_SUB_BUCKETS - 1)
+	return (e-2)*LATENCY_SUB_BUCKETS + sub
+}
+
+// the largest latency in the bucket
+func latencyBucketMax(idx int) uint64 {
+	if idx < LATENCY_SUB_BUCKETS {
+		return uint64(idx)
+	}
+	e := idx/LATENCY_SUB_BUCKETS + 2
+	sub := uint64(idx % LATENCY_SUB_BUCKETS)
+	return (LATENCY_SUB_BUCKETS+sub+1)<<(e-3) - 1
+}
+
+func (h *latencyHistogram) stats() LatencyStats {
+	counts := make([]uint64, LATENCY_BUCKETS)
+	total := uint64(0)
+	for i := range counts {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	stats := LatencyStats{Count: total}
+	if total == 0 {
+		return stats
+	}
+	percentile := func(q float64) time.Duration {
+		rank := uint64(q*float64(total-1)) + 1
+		seen := uint64(0)
+		for i, n := range counts {
+			if seen += n; seen >= rank {
+				return time.Duration(latencyBucketMax(i))
+			}
+		}
+		return 0
+	}
+	stats.P50, stats.P99, stats.P999 = percentile(0.50), percentile(0.99), percentile(0.999)
+	return stats
+}
+
+// the latency percentiles of the operations since Open, all zero
+// unless Options.EnableLatencyMetrics is set
+func (db *KeyValue) Metrics() Metrics {
+	m := db.latency
+	if m == nil {
+		return Metrics{}
+	}
+	return Metrics{
+		Set:   m.ops[LATENCY_SET].stats(),
+		Get:   m.ops[LATENCY_GET].stats(),
+		Del:   m.ops[LATENCY_DEL].stats(),
+		Flush: m.ops[LATENCY_FLUSH].stats(),
+	}
+}
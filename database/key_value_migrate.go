@@ -0,0 +1,120 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// entries inserted per commit while loading the new file
+const MIGRATE_BATCH = 1000
+
+// copy every tree of the database at src into a new file at dst with
+// a different page size. src is opened read-only with its stored page
+// size and dst must not exist. fails before creating dst if a key or
+// value of src exceeds the limits of the new page size.
+func Migrate(src string, dst string, newPageSize int) error {
+	return MigrateWithOptions(src, dst, newPageSize, Options{})
+}
+
+// Migrate for a file opened with options, such as a custom Signature.
+// the Signature, Logger and VerifyChecksums apply to both files, the
+// rest of the options is ignored. dst keeps the checksum setting and
+// the master slots of src.
+func MigrateWithOptions(src string, dst string, newPageSize int, opts Options) error {
+	if err := checkPageSize(newPageSize); err != nil {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	opts = Options{
+		Signature:       opts.Signature,
+		Logger:          opts.Logger,
+		VerifyChecksums: opts.VerifyChecksums,
+	}
+	fromOpts := opts
+	fromOpts.ReadOnly = true
+	from := &KeyValue{Path: src, Options: fromOpts}
+	if err := from.Open(); err != nil {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	defer from.Close()
+
+	// the largest key and value decide if the new page size works
+	maxKey, maxVal := 0, 0
+	for id := 0; id < MAX_TREES; id++ {
+		tree, _ := from.OpenTree(id)
+		it := tree.Scan(nil, nil)
+		for ; it.Valid(); it.Next() {
+			key, val, meta := it.iter.DerefMeta()
+			vlen := len(val)
+			if meta != nil {
+				vlen += metaSize(meta)
+			}
+			maxKey = max(maxKey, len(key))
+			maxVal = max(maxVal, vlen)
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("Migrate: %w", err)
+		}
+	}
+	if maxKey > maxKeySize(newPageSize) {
+		return fmt.Errorf("Migrate: page size %d: %w", newPageSize, ErrKeyTooLarge)
+	}
+	if maxVal > maxValSize(newPageSize) {
+		return fmt.Errorf("Migrate: page size %d: %w", newPageSize, ErrValueTooLarge)
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("Migrate: %s already exists", dst)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	toOpts := opts
+	toOpts.PageSize, toOpts.MasterSlots = newPageSize, from.page.masters
+	to := &KeyValue{Path: dst, Options: toOpts}
+	if err := to.Open(); err != nil {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	// the file is empty, nothing is written with the default checksum yet
+	setPageSize(to, newPageSize, from.page.csum)
+	seqKeysSet(to, to.page.seqKeys || from.page.seqKeys)
+	err := migrateLoad(from, to)
+	if cerr := to.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	return nil
+}
+
+// the keys come in order, so the new trees are filled left to right.
+// the metadata of SetMeta goes with the first commit.
+func migrateLoad(from *KeyValue, to *KeyValue) error {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	to.appMeta = from.appMeta // from is read-only
+	for id := 0; id < MAX_TREES; id++ {
+		tree, _ := from.OpenTree(id)
+		count := 0
+		it := tree.Scan(nil, nil)
+		for ; it.Valid(); it.Next() {
+			key, val, meta := it.iter.DerefMeta()
+			if meta != nil {
+				treeAt(to, id).InsertMeta(key, val, meta)
+			} else {
+				treeAt(to, id).Insert(key, val)
+			}
+			if count++; count%MIGRATE_BATCH == 0 {
+				if err := flushPages(to); err != nil {
+					it.Close()
+					return err
+				}
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return flushPages(to)
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+/*
+With Options.AllowDuplicates a key holds a list of values. Each value is
+stored under EncodeTuple(key, seq) where seq is a big-endian counter one
+past the last value of the key, so the values of a key are adjacent and
+sort in insertion order.
+
+Set, Get, GetAll, Del, DeleteValue, Scan and ScanPrefix take the keys as
+given, the iterators return them decoded. The other methods see the
+stored keys. The mode isn't recorded in the file, it must be the same
+on every open.
+*/
+
+// the stored key of the value number seq under the key
+func multiKey(key []byte, seq uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	return EncodeTuple(key, buf[:])
+}
+
+// the key a stored key was made from, the stored key if it isn't one
+func multiUnkey(stored []byte) []byte {
+	fields, err := DecodeTuple(stored)
+	if err != nil || len(fields) != 2 {
+		return stored
+	}
+	return fields[0]
+}
+
+// the stored key for a new value under the key
+func multiNext(tree *BTree, key []byte) []byte {
+	prefix := EncodeTuple(key)
+	iter := tree.SeekLE(multiKey(key, math.MaxUint64))
+	seq := uint64(1)
+	if iter.Valid() {
+		last, _ := iter.Deref()
+		if fields, err := DecodeTuple(last); err == nil && len(fields) == 2 &&
+			bytes.HasPrefix(last, prefix) && len(fields[1]) == 8 {
+			seq = binary.BigEndian.Uint64(fields[1]) + 1
+		}
+	}
+	return multiKey(key, seq)
+}
+
+// the stored keys and values under the key in order, at most limit
+// of them if it's above 0. the expired values are left out.
+func multiEntries(tree *BTree, key []byte, limit int) (keys [][]byte, vals [][]byte) {
+	prefix := EncodeTuple(key)
+	now := time.Now().UnixNano()
+	iter := tree.SeekLE(prefix)
+	for ; iter.Valid(); iter.Next() {
+		stored, val, meta := iter.DerefMeta()
+		if bytes.Compare(stored, prefix) <= 0 {
+			continue // the key before
+		}
+		if !bytes.HasPrefix(stored, prefix) || (limit > 0 && len(keys) >= limit) {
+			break
+		}
+		if !metaExpired(meta, now) {
+			keys, vals = append(keys, stored), append(vals, val)
+		}
+	}
+	return keys, vals
+}
+
+// the scan bounds over the stored keys
+func multiBounds(lo []byte, hi []byte) ([]byte, []byte) {
+	if lo != nil {
+		lo = EncodeTuple(lo)
+	}
+	if hi != nil {
+		hi = EncodeTuple(hi)
+	}
+	return lo, hi
+}
+
+// append a value to the list of the key
+func multiSet(db *KeyValue, key []byte, val []byte) error {
+	stored, err := multiCheck(db, key, val)
+	if err != nil {
+		return err
+	}
+	db.insert(stored, val)
+	return nil
+}
+
+// the checks of multiSet, returns the stored key for the value
+func multiCheck(db *KeyValue, key []byte, val []byte) ([]byte, error) {
+	if err := checkKV(db, key, val); err != nil {
+		return nil, err
+	}
+	stored := multiNext(&db.tree, key)
+	if err := checkKey(db, stored); err != nil {
+		return nil, err // too large with the suffix
+	}
+	if err := checkEntry(db, len(stored), len(val)); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// the first value of the key
+func multiGet(db *KeyValue, key []byte) ([]byte, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	if checkOpen(db) != nil || checkKey(db, key) != nil {
+		return nil, false
+	}
+	_, vals := multiEntries(&db.tree, key, 1)
+	if len(vals) == 0 {
+		return nil, false
+	}
+	return vals[0], true
+}
+
+// delete every value of the key
+func multiDel(db *KeyValue, key []byte) bool {
+	keys, _ := multiEntries(&db.tree, key, 0)
+	for _, stored := range keys {
+		db.delete(append([]byte{}, stored...))
+	}
+	return len(keys) > 0
+}
+
+// the values of the key in insertion order, copies. without
+// AllowDuplicates it's the value of the key if there is one.
+func (db *KeyValue) GetAll(key []byte) [][]byte {
+	if !db.Options.AllowDuplicates {
+		if val, ok := db.Get(key); ok {
+			return [][]byte{append([]byte{}, val...)}
+		}
+		return nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	if checkOpen(db) != nil || checkKey(db, key) != nil {
+		return nil
+	}
+	_, vals := multiEntries(&db.tree, key, 0)
+	out := make([][]byte, len(vals))
+	for i, val := range vals {
+		out[i] = append([]byte{}, val...)
+	}
+	return out
+}
+
+// delete the oldest value of the key equal to val, the other values
+// stay. without AllowDuplicates the key is deleted if it holds val.
+func (db *KeyValue) DeleteValue(key []byte, val []byte) (deleted bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return false, err
+	}
+	if err := checkKey(db, key); err != nil {
+		return false, err
+	}
+	if !db.Options.AllowDuplicates {
+		if cur, _, ok := treeGetLive(&db.tree, key); ok && bytes.Equal(cur, val) {
+			deleted, _ = db.delete(key)
+		}
+		return deleted, flushPages(db)
+	}
+	keys, vals := multiEntries(&db.tree, key, 0)
+	for i := range keys {
+		if bytes.Equal(vals[i], val) {
+			deleted, _ = db.delete(append([]byte{}, keys[i]...))
+			break
+		}
+	}
+	return deleted, flushPages(db)
+}
@@ -5,80 +5,352 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"math"
+	"math/bits"
 	"os"
+	"slices"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B |     8B     |     8B    |
+// | sig | btree_root | page_used | free_list | page_size | seq | ntrees | roots      |
+// | 16B |     8B     |     8B    |     8B    |     8B    |  8B |   8B   | ntrees*8B  |
+// btree_root is the main tree, the roots of the other trees follow.
+// the checksum algorithm, the number of slots and a CRC32C of the
+// rest come after the room for MAX_TREES roots, then BYTE_ORDER_MARK.
+//
+// the integers of the file are little-endian whatever the host byte
+// order, the mark makes a file written the other way fail to open.
+// the flags follow the mark, outside the CRC for the same reason.
+//
+// the first pages are master slots written in turn, commit seq goes to
+// slot (seq-1) % slots and Open uses the valid slot with the highest
+// seq, so a torn or damaged master falls back to the commit before it.
+// the pages freed by a commit are reused from the next one on, which
+// keeps that commit intact. the first commit and a compaction write
+// every slot. files written before the slots have one and no CRC, see
+// MASTER_V1 and MASTER_V2, a commit rewrites the slot in this format.
 func masterLoad(db *KeyValue) error {
 	if db.mmap.file == 0 {
 		// empty file, the master page will be created on the first write
-		db.page.flushed = 1 // reserved for the master page
+		db.page.masters = masterSlots(db)
+		db.page.flushed = uint64(db.page.masters) // reserved for the slots
+		db.page.allMasters = true
 		return nil
 	}
 
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
+	m, damaged, err := masterPick(db)
+	if err != nil {
+		return err
+	}
+	if db.Options.PageSize != 0 && db.Options.PageSize != m.pageSize {
+		return fmt.Errorf("%w: file %d, configured %d",
+			ErrPageSizeMismatch, m.pageSize, db.Options.PageSize)
+	}
+	if db.Options.ChecksumAlgo != 0 && db.Options.ChecksumAlgo != m.csum {
+		return fmt.Errorf("%w: file %d, configured %d",
+			ErrChecksumAlgo, m.csum, db.Options.ChecksumAlgo)
+	}
+	setPageSize(db, m.pageSize, m.csum)
+	seqKeysSet(db, db.Options.SequentialKeys || m.flags&MASTER_SEQ_KEYS != 0)
+
+	setTreeRoots(db, m.roots)
+	db.free.head = m.free
+	db.page.flushed = m.used
+	db.page.masters = m.slots
+	db.seq = m.seq
+	db.page.dirty = m.flags&MASTER_DIRTY != 0
+	db.appMeta = m.appMeta
+	if m.version != MASTER_V3 {
+		logger(db).Debugf("master page format %d, the next commit upgrades it", m.version)
+	}
+	if damaged {
+		logger(db).Warnf("damaged master slots, using commit %d", m.seq)
+		db.page.allMasters = true
+	}
+	// the free list nodes of a commit are reused two commits on, the
+	// list of an older one is dropped and its pages are reclaimed
+	if damaged && m.slots > 2 {
+		db.free.head = 0
+		db.page.reclaim = true
+	}
+	return nil
+}
+
+// the master slots of a new file
+func masterSlots(db *KeyValue) int {
+	if db.Options.MasterSlots == 0 {
+		return DEFAULT_MASTER_SLOTS
+	}
+	return db.Options.MasterSlots
+}
+
+// the master page layouts, Open reads all of them and the first commit
+// writes the latest over an older one
+const (
+	MASTER_V1 = 1 // the signature, the root and the used pages, 32 bytes
+	MASTER_V2 = 2 // the fields up to the checksum algorithm without a CRC
+	MASTER_V3 = 3 // the slots and the CRC
+)
+
+// the size of a MASTER_V1 page, the rest of the page is zeros
+const MASTER_V1_SIZE = 32
+
+// the master page flags. the commits of an open handle are
+// MASTER_DIRTY, Close rewrites the last one without it. the files
+// written before the flags read as closed cleanly.
+const (
+	MASTER_DIRTY    = 1
+	MASTER_SEQ_KEYS = 2 // see SequentialKeys
+)
+
+// after the CRC of the master page, little-endian like the rest. it
+// reads as 0x04030201 from a file written big-endian. it's outside the
+// CRC so the files before it stay valid both ways, and only the
+// swapped value is checked.
+const BYTE_ORDER_MARK = 0x01020304
+
+// the decoded master page
+type masterPage struct {
+	version  int
+	roots    []uint64 // the main tree first
+	used     uint64
+	free     uint64
+	pageSize int
+	seq      uint64
+	csum     int
+	slots    int
+	flags    uint32
+	appMeta  map[string][]byte // see SetMeta
+}
+
+// the expected signature padded to 16 bytes
+func signature(db *KeyValue) [16]byte {
+	var sig [16]byte
+	if db.Options.Signature != "" {
+		copy(sig[:], db.Options.Signature)
+	} else {
+		copy(sig[:], DB_SIG)
+	}
+	return sig
+}
+
+// the valid slot with the highest seq, and whether another one is
+// damaged. slot 0 tells where the others are, without it they are
+// looked for in the first MAX_MASTER_SLOTS pages of Options.PageSize.
+// with no valid slot the error wraps ErrNotDatabase if none of them
+// has the signature, the file is something else, or ErrCorruptMaster
+// if one has, the file is a damaged database.
+func masterPick(db *KeyValue) (best masterPage, damaged bool, err error) {
+	best, err = masterRead(db, 0, 0)
+	slots, pageSize := MAX_MASTER_SLOTS, db.Options.PageSize
+	if err == nil {
+		slots, pageSize = best.slots, best.pageSize
+	}
+	if pageSize == 0 {
+		pageSize = BTREE_PAGE_SIZE
+	}
+	valid := 0
+	if err == nil {
+		valid++
+	}
+	signed := !errors.Is(err, ErrBadSignature)
+	for slot := 1; slot < slots && (slot+1)*pageSize <= db.mmap.file; slot++ {
+		m, serr := masterRead(db, slot, pageSize)
+		signed = signed || !errors.Is(serr, ErrBadSignature)
+		if serr != nil {
+			continue
+		}
+		valid++
+		if err != nil || m.seq > best.seq {
+			best, err = m, nil
+		}
+	}
+	switch {
+	case err == nil:
+	case !signed:
+		err = fmt.Errorf("%w: %w", ErrNotDatabase, err)
+	case !errors.Is(err, ErrByteOrder):
+		err = fmt.Errorf("%w: %w", ErrCorruptMaster, err)
+	}
+	return best, err == nil && valid < best.slots, err
+}
+
+// decode and verify a master slot, the pages are pageSize bytes
+func masterRead(db *KeyValue, slot int, pageSize int) (masterPage, error) {
+	if (slot+1)*pageSize > db.mmap.file {
+		return masterPage{}, fmt.Errorf("bad master page: slot %d is past the end", slot)
+	}
+	data, err := fileBytes(db, slot*pageSize, APP_META_END)
+	if err != nil {
+		return masterPage{}, fmt.Errorf("bad master page: slot %d: %w", slot, err)
+	}
+	m := masterPage{
+		roots:    []uint64{binary.LittleEndian.Uint64(data[16:])},
+		used:     binary.LittleEndian.Uint64(data[24:]),
+		free:     binary.LittleEndian.Uint64(data[32:]),
+		pageSize: int(binary.LittleEndian.Uint64(data[40:])),
+		seq:      binary.LittleEndian.Uint64(data[48:]),
+		csum:     int(binary.LittleEndian.Uint64(data[64+8*(MAX_TREES-1):])),
+		slots:    int(binary.LittleEndian.Uint64(data[72+8*(MAX_TREES-1):])),
+	}
 
 	// verify the page
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-		return errors.New("bad Signature")
+	sig := signature(db)
+	if !bytes.Equal(sig[:], data[:16]) {
+		return m, ErrBadSignature
+	}
+	n := 80 + 8*(MAX_TREES-1)
+	if binary.LittleEndian.Uint32(data[n+4:]) == bits.ReverseBytes32(BYTE_ORDER_MARK) {
+		return m, ErrByteOrder
 	}
-	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
-	bad = bad || !(root < used)
+	switch {
+	case m.slots != 0:
+		m.version = MASTER_V3
+		if binary.LittleEndian.Uint32(data[n:]) != crc32.Checksum(data[:n], crc32c) {
+			return m, fmt.Errorf("bad master page: slot %d: %w", slot, ErrChecksum)
+		}
+		m.flags = binary.LittleEndian.Uint32(data[n+8:])
+		if m.appMeta, err = appMetaDecode(data); err != nil {
+			return m, fmt.Errorf("bad master page: slot %d: %w", slot, err)
+		}
+	case bytes.Count(data[MASTER_V1_SIZE:n+4], []byte{0}) == n+4-MASTER_V1_SIZE:
+		// the zeros read as no free list, the 4K pages of the time,
+		// no checksums and no other trees
+		m.version, m.slots = MASTER_V1, 1
+	default:
+		m.version, m.slots = MASTER_V2, 1
+	}
+	if m.slots > MAX_MASTER_SLOTS || slot >= m.slots {
+		return m, fmt.Errorf("bad master page: %d slots", m.slots)
+	}
+	ntrees := binary.LittleEndian.Uint64(data[56:])
+	if ntrees >= MAX_TREES {
+		return m, errors.New("bad master page: too many trees")
+	}
+	for i := 0; i < int(ntrees); i++ {
+		m.roots = append(m.roots, binary.LittleEndian.Uint64(data[64+8*i:]))
+	}
+	if !csumKnown(m.csum) {
+		return m, fmt.Errorf("bad master page: unknown checksum %d", m.csum)
+	}
+	if m.pageSize == 0 {
+		m.pageSize = BTREE_PAGE_SIZE // written before the page size was stored
+	}
+	if err := checkPageSize(m.pageSize); err != nil {
+		return m, fmt.Errorf("bad master page: %w", err)
+	}
+	if slot > 0 && m.pageSize != pageSize {
+		return m, fmt.Errorf("bad master page: slot %d has page size %d", slot, m.pageSize)
+	}
+	if db.mmap.file%m.pageSize != 0 {
+		return m, errors.New("file size is not a multiple of page size")
+	}
+	bad := !(uint64(m.slots) <= m.used && m.used <= uint64(db.mmap.file/m.pageSize))
+	for _, root := range m.roots {
+		bad = bad || !(root < m.used)
+	}
+	bad = bad || !(m.free < m.used)
 	if bad {
-		return errors.New("bad master page")
+		return m, errors.New("bad master page")
 	}
+	return m, nil
+}
 
-	db.tree.root = root
-	db.page.flushed = used
-	return nil
+// the page size is shared by the tree, the free list and the file,
+// the nodes get what the checksum leaves of it
+func setPageSize(db *KeyValue, pageSize int, csum int) {
+	db.page.size = pageSize
+	db.page.csum = csum
+	db.tree.pageSize, db.tree.reserved = pageSize, csumSize(csum)
+	db.free.pageSize = nodeSize(db)
+	for i := range db.trees {
+		db.trees[i].pageSize, db.trees[i].reserved = pageSize, csumSize(csum)
+	}
 }
 
 // update the master page. it must be atomic
 func masterStore(db *KeyValue) error {
-	var data [32]byte
-	copy(data[:16], []byte(DB_SIG))
+	var data [APP_META_END]byte
+	sig := signature(db)
+	copy(data[:16], sig[:])
 	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	_, err := db.fp.WriteAt(data[:], 0) // writes via mmap are not atomic
-	if err != nil {
-		return fmt.Errorf("write master page: %w", err)
+	binary.LittleEndian.PutUint64(data[32:], db.free.head)
+	binary.LittleEndian.PutUint64(data[40:], uint64(db.page.size))
+	binary.LittleEndian.PutUint64(data[48:], db.seq)
+	binary.LittleEndian.PutUint64(data[56:], uint64(len(db.trees)))
+	for i, tree := range db.trees {
+		binary.LittleEndian.PutUint64(data[64+8*i:], tree.root)
+	}
+	binary.LittleEndian.PutUint64(data[64+8*(MAX_TREES-1):], uint64(db.page.csum))
+	binary.LittleEndian.PutUint64(data[72+8*(MAX_TREES-1):], uint64(db.page.masters))
+	n := 80 + 8*(MAX_TREES-1)
+	binary.LittleEndian.PutUint32(data[n:], crc32.Checksum(data[:n], crc32c))
+	binary.LittleEndian.PutUint32(data[n+4:], BYTE_ORDER_MARK)
+	flags := uint32(0)
+	if db.page.dirty {
+		flags |= MASTER_DIRTY
+	}
+	if db.page.seqKeys {
+		flags |= MASTER_SEQ_KEYS
+	}
+	binary.LittleEndian.PutUint32(data[n+8:], flags)
+	appMetaEncode(data[:], db.appMeta)
+	slots := []int{int((db.seq - 1) % uint64(db.page.masters))}
+	if db.page.allMasters {
+		slots = slots[:0]
+		for slot := 0; slot < db.page.masters; slot++ {
+			slots = append(slots, slot)
+		}
 	}
+	buf := data[:]
+	if db.Options.DirectIO {
+		buf = directBuffer(db.page.size)
+		copy(buf, data[:])
+	}
+	for _, slot := range slots {
+		// writes via mmap are not atomic
+		_, err := fileWriteAt(db.fp, buf, int64(slot*db.page.size))
+		if err != nil {
+			return fmt.Errorf("write master page: %w", err)
+		}
+	}
+	db.page.spread = db.page.allMasters
+	db.page.allMasters = false
 	return nil
 }
 
+// the size of the first mapping, replaced in tests
+var mmapInitSize = 64 << 20
+
 // create initial mmap that covers the whole file
-func mmapInit(fp *os.File) (int, []byte, error) {
+func mmapInit(db *KeyValue, prot int) (int, []byte, error) {
+	fp := db.fp
 	fi, err := fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
 	}
 
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
-		return 0, nil, errors.New("file size is not a multiple of page size")
-	}
-
-	mmapSize := 64 << 20
-	if mmapSize%BTREE_PAGE_SIZE != 0 {
-		panic("mmapInit: mmapSize is not a multiple of BTREE_PAGE_SIZE")
+	// the file size is checked against the page size in masterLoad
+	mmapSize := mmapInitSize
+	if mmapSize%BTREE_MAX_PAGE_SIZE != 0 {
+		panic("mmapInit: mmapSize is not a multiple of BTREE_MAX_PAGE_SIZE")
 	}
 	for mmapSize < int(fi.Size()) {
 		mmapSize *= 2
 	}
 	// mmapSize can be larger than the file
 
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()),
-		0,
-		mmapSize,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED,
-	)
+	var chunk []byte
+	err = ioRetry(db, "mmap", func() (err error) {
+		chunk, err = mmapCall(int(fp.Fd()), 0, mmapSize, prot, syscall.MAP_SHARED)
+		return err
+	})
 	if err != nil {
 		return 0, nil, fmt.Errorf("mmap: %w", err)
 	}
@@ -86,64 +358,321 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 	return int(fi.Size()), chunk, nil
 }
 
-// extend the mmap by adding new mappings
-func extendMmap(db *KeyValue, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
+// replaced in tests
+var (
+	mlock    = syscall.Mlock
+	mmapCall = syscall.Mmap
+	ioSleep  = time.Sleep
+)
+
+// retries of a transient fsync or mmap failure, see Options.IORetries.
+// they run under the write lock, the cap bounds the stall of the
+// writers to about a second.
+const (
+	DEFAULT_IO_RETRIES   = 3
+	MAX_IO_RETRIES       = 12
+	IO_RETRY_BACKOFF     = time.Millisecond // doubled on each retry
+	IO_RETRY_MAX_BACKOFF = 100 * time.Millisecond
+)
+
+// an interrupted call, or one that may succeed once resources free up
+func ioTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// run an fsync or mmap again while it fails with a transient error,
+// the last error once the retries run out. EINTR is retried even
+// with the retries off.
+func ioRetry(db *KeyValue, op string, fn func() error) error {
+	retries := min(db.Options.IORetries, MAX_IO_RETRIES)
+	if retries == 0 {
+		retries = DEFAULT_IO_RETRIES
+	}
+	err := fn()
+	for i := 0; err != nil && ioTransient(err); i++ {
+		limit := retries
+		if errors.Is(err, syscall.EINTR) {
+			limit = max(limit, DEFAULT_IO_RETRIES)
+		}
+		if i >= limit {
+			break
+		}
+		logger(db).Warnf("%s: %v, retry %d of %d", op, err, i+1, limit)
+		ioSleep(min(IO_RETRY_BACKOFF<<i, IO_RETRY_MAX_BACKOFF))
+		err = fn()
+	}
+	return err
+}
+
+// fsync the database file, retrying the transient failures
+func fileSyncRetry(db *KeyValue) error {
+	return ioRetry(db, "fsync", func() error {
+		return fileSync(db.fp)
+	})
+}
+
+// the writes and fsyncs of the database file, the crash tests replace
+// them to inject faults. the writes through the mapping don't go
+// through them, those tests use NoMmap.
+var (
+	fileWriteAt = (*os.File).WriteAt
+	fileSync    = (*os.File).Sync
+	fallocate   = syscall.Fallocate
+)
+
+// lock the part of the mapping backed by the file that isn't locked yet
+func mmapLock(db *KeyValue) error {
+	if !db.Options.LockMemory || db.mmap.nolock {
 		return nil
 	}
+	end := min(db.mmap.file, db.mmap.total)
+	start := 0
+	for _, chunk := range db.mmap.chunks {
+		lo, hi := max(db.mmap.locked, start), min(end, start+len(chunk))
+		if lo < hi {
+			if err := mlock(chunk[lo-start : hi-start]); err != nil {
+				err = fmt.Errorf("mlock %d bytes: %w (is RLIMIT_MEMLOCK too low?)", hi-lo, err)
+				if !db.Options.LockMemoryBestEffort {
+					return err
+				}
+				logger(db).Warnf("%v, continuing with unlocked memory", err)
+				db.mmap.nolock = true
+				return nil
+			}
+		}
+		start += len(chunk)
+	}
+	db.mmap.locked = max(db.mmap.locked, end)
+	return nil
+}
 
-	// double check the address space
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()),
-		int64(db.mmap.total),
-		db.mmap.total,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+// fault in the part of the mapping in use ahead of a latency sensitive
+// workload, and fill the value cache if there is one. the pages can be
+// evicted again under memory pressure, LockMemory keeps them.
+func (db *KeyValue) Warm() (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return err
+	}
+	end := min(int(db.page.flushed)*db.page.size, db.mmap.file, db.mmap.total)
+	start := 0
+	for _, chunk := range db.mmap.chunks {
+		if start >= end {
+			break
+		}
+		chunk = chunk[:min(len(chunk), end-start)]
+		// the advice starts the reads, touching waits for them
+		if !db.mmap.inMemory {
+			if err := syscall.Madvise(chunk, syscall.MADV_WILLNEED); err != nil {
+				return fmt.Errorf("madvise: %w", err)
+			}
+		}
+		mmapTouch(chunk)
+		start += len(chunk)
+	}
+	return warmCache(db)
+}
+
+// start reading pages of the mapping in the background, for the read
+// ahead of the scans. the adjacent pages go in one call. a bad pointer
+// is left to the read to report.
+func mmapAdvise(chunks [][]byte, pageSize int, ptrs []uint64) {
+	advise := func(idx int, start int, end int) {
+		// the advice takes whole OS pages, the chunks start on one
+		start &^= os.Getpagesize() - 1
+		syscall.Madvise(chunks[idx][start:end], syscall.MADV_WILLNEED)
+	}
+	runIdx, runStart, runEnd := -1, 0, 0
+	for _, ptr := range ptrs {
+		idx, offset, ok := chunkOffset(chunks, pageSize, ptr)
+		if !ok {
+			continue
+		}
+		if idx == runIdx && offset == runEnd {
+			runEnd += pageSize
+			continue
+		}
+		if runIdx >= 0 {
+			advise(runIdx, runStart, runEnd)
+		}
+		runIdx, runStart, runEnd = idx, offset, offset+pageSize
 	}
+	if runIdx >= 0 {
+		advise(runIdx, runStart, runEnd)
+	}
+}
+
+// the bytes of a mapped chunk in memory by mincore, 0 if it fails
+func mmapResident(chunk []byte) int {
+	if len(chunk) == 0 {
+		return 0
+	}
+	step := os.Getpagesize()
+	vec := make([]byte, (len(chunk)+step-1)/step)
+	_, _, errno := syscall.Syscall(syscall.SYS_MINCORE,
+		uintptr(unsafe.Pointer(&chunk[0])), uintptr(len(chunk)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return 0
+	}
+	resident := 0
+	for _, b := range vec {
+		resident += int(b & 1)
+	}
+	return min(resident*step, len(chunk))
+}
+
+// read a byte of every OS page
+func mmapTouch(chunk []byte) (sum byte) {
+	step := os.Getpagesize()
+	for i := 0; i < len(chunk); i += step {
+		sum += chunk[i]
+	}
+	return sum
+}
+
+// cache the first values in key order until the cache is full
+func warmCache(db *KeyValue) (err error) {
+	if db.vcache == nil {
+		return nil
+	}
+	defer recoverCorrupt(db, &err)
+	iter := seekFirst(&db.tree)
+	for ; iter.Valid() && !db.vcache.full(); iter.Next() {
+		key, val, meta := iter.DerefMeta()
+		// the values that expire aren't cached
+		if decodeMeta(meta).flags&META_EXPIRES == 0 {
+			db.vcache.put(key, val)
+		}
+	}
+	return nil
+}
+
+func mmapProt(db *KeyValue) int {
+	if db.Options.ReadOnly || db.Options.DirectIO {
+		return syscall.PROT_READ
+	}
+	return syscall.PROT_READ | syscall.PROT_WRITE
+}
 
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+// extend the mmap by adding new mappings, each one doubles it. a large
+// commit may need several.
+func extendMmap(db *KeyValue, npages int) error {
+	for db.pread == nil && db.mmap.total < npages*db.page.size {
+		// double check the address space
+		var chunk []byte
+		err := ioRetry(db, "mmap", func() (err error) {
+			chunk, err = mmapCall(
+				int(db.fp.Fd()),
+				int64(db.mmap.total),
+				db.mmap.total,
+				mmapProt(db),
+				syscall.MAP_SHARED,
+			)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+
+		logger(db).Debugf("extend mmap: %d -> %d bytes", db.mmap.total, 2*db.mmap.total)
+		db.mmap.total += db.mmap.total
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
+	}
 	return nil
 }
 
+// the factor the file grows by, see Options.GrowthFactor
+func growthFactor(db *KeyValue) float64 {
+	if db.Options.GrowthFactor > 0 {
+		return db.Options.GrowthFactor
+	}
+	return DEFAULT_GROWTH_FACTOR
+}
+
 // extend the file to at least npages
 func extendFile(db *KeyValue, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	filePages := db.mmap.file / db.page.size
 	if filePages >= npages {
 		return nil
 	}
+	maxPages := math.MaxInt
+	if db.Options.MaxSizeBytes > 0 {
+		maxPages = int(db.Options.MaxSizeBytes / int64(db.page.size))
+	}
+	if npages > maxPages {
+		return fmt.Errorf("%w: %d pages needed, the limit is %d",
+			ErrDatabaseFull, npages, maxPages)
+	}
 
 	for filePages < npages {
 		// the file size is increased exponentially,
 		// so that we don't have to extend the file for every update
-		inc := filePages / 8
-		if inc < 1 {
-			inc = 1
+		inc := int(float64(filePages) * growthFactor(db))
+		inc = max(inc, db.Options.MinGrowthPages, 1)
+		if db.Options.MaxGrowthPages > 0 {
+			inc = min(inc, db.Options.MaxGrowthPages)
 		}
 		filePages += inc
 	}
+	filePages = min(filePages, maxPages)
 
-	fileSize := filePages * BTREE_PAGE_SIZE
-	err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
+	fileSize := filePages * db.page.size
+	err := fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
 	}
 
+	logger(db).Debugf("extend file: %d -> %d pages", db.mmap.file/db.page.size, filePages)
 	db.mmap.file = fileSize
 	return nil
 }
 
-// persist the newly allocated pages after updates
+// persist the newly allocated pages after updates. if the pages can't
+// be written, such as when extending the file finds the disk full, the
+// updates since the last commit are dropped so the next write starts
+// from the committed tree.
 func flushPages(db *KeyValue) error {
-	if err := writePages(db); err != nil {
-		return err
+	defer db.latency.record(LATENCY_FLUSH, db.latency.start())
+	err := writePages(db)
+	if err != nil {
+		txRestore(db, db.page.committed)
+	} else {
+		err = syncPages(db)
+	}
+	db.page.failed = err != nil
+	if err != nil {
+		logger(db).Warnf("flush failed: %v", err)
+	}
+	return err
+}
+
+// a sync point with the other writers. the writes commit one at a time
+// and return once they are durable, so Barrier waits for the write
+// holding the lock, after which every write that returned or started
+// committing before the call is on disk. a write still waiting for the
+// lock may go after it. fails with ErrCommitFailed if the last commit
+// failed, the write it was for isn't durable.
+func (db *KeyValue) Barrier() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := checkOpen(db); err != nil {
+		return fmt.Errorf("Barrier: %w", err)
+	}
+	if db.page.failed {
+		return fmt.Errorf("Barrier: %w", ErrCommitFailed)
 	}
-	return syncPages(db)
+	return nil
 }
 
+// the free list is updated before the file is extended, since Update
+// may append pages for its nodes and npages must count them. it
+// doesn't hand out any page to the tree, the tree took its pages with
+// pageNew before the flush. the pages freed by this commit only go
+// into the new list, so none of them is written before the next
+// commit and the last commit stays readable until the master is.
+// Update writes its nodes to pages of the old list that were not
+// popped and to appended ones, both outside the last commit's tree.
 func writePages(db *KeyValue) error {
 	// update the free list
 	freed := []uint64{}
@@ -152,7 +681,22 @@ func writePages(db *KeyValue) error {
 			freed = append(freed, ptr)
 		}
 	}
+	if db.Options.Deterministic {
+		slices.Sort(freed) // the map order changes from run to run
+	}
+	// recycled pages that were not handed out again are still allocated,
+	// they were never written so no snapshot reads them
+	freed = snapshotFree(db, freed)
+	freed = append(freed, db.page.recycled...)
+	freed = append(freed, allocSkipped(db)...)
+	head := db.free.head
+	db.page.stats.Pages = statsPages(db)
 	db.free.Update(db.page.nfree, freed)
+	db.page.stats.FreeListPages = statsPages(db) - db.page.stats.Pages
+	if db.free.head != head {
+		logger(db).Debugf("free list: head %d -> %d, %d free pages",
+			head, db.free.head, db.free.Total())
+	}
 
 	// extend the file and mmap if needed
 	npages := int(db.page.flushed) + db.page.nappend
@@ -162,11 +706,28 @@ func writePages(db *KeyValue) error {
 	if err := extendMmap(db, npages); err != nil {
 		return err
 	}
+	if err := mmapLock(db); err != nil {
+		return err
+	}
 
 	// copy data to the file
+	var buf []byte
+	if db.Options.DirectIO {
+		buf = directBuffer(db.page.size)
+	}
 	for ptr, page := range db.page.updates {
-		if page != nil {
-			copy(pageGetMapped(db, ptr).data, page)
+		if page != nil && db.pread != nil {
+			if err := db.pread.write(db, ptr, page); err != nil {
+				return err
+			}
+		} else if page != nil && buf != nil {
+			if err := directWrite(db, buf, ptr, page); err != nil {
+				return err
+			}
+		} else if page != nil {
+			mapped := pageGetMapped(db, ptr).data
+			copy(mapped, page)
+			pageSeal(db, mapped)
 		}
 	}
 	return nil
@@ -174,18 +735,66 @@ func writePages(db *KeyValue) error {
 
 func syncPages(db *KeyValue) error {
 	// flush data to the disk. must be done before updating the master page
-	if err := db.fp.Sync(); err != nil {
+	if err := fileSyncRetry(db); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
 	db.page.flushed += uint64(db.page.nappend)
+	db.page.nfree = 0
+	db.page.nappend = 0
 	db.page.updates = make(map[uint64][]byte)
+	db.page.fresh = make(map[uint64]bool)
+	db.page.recycled = nil
+	allocReset(db)
+
+	// the sequence only advances once the master page is written
+	prev := historyRoot{seq: db.seq, root: db.page.committed.roots[0]}
+	all := db.page.allMasters
+	db.seq++
+	committed := db.changes.pending
+	if err := syncMaster(db); err != nil {
+		db.seq--
+		if uerr := changelogUndo(db); uerr != nil {
+			logger(db).Warnf("changelog disabled: %v", uerr)
+		}
+		return err
+	}
+	historyCommit(db, prev, all)
+	auditCommit(db, committed)
+	statsCommit(db)
+	db.page.committed = txSave(db)
+	return nil
+}
+
+func syncMaster(db *KeyValue) error {
+	// the changelog record goes first, the master page makes it committed
+	if err := changelogAppend(db); err != nil {
+		return err
+	}
 
 	// update & flush the master page
+	db.page.dirty = true
 	if err := masterStore(db); err != nil {
 		return err
 	}
-	if err := db.fp.Sync(); err != nil {
+	if err := fileSyncRetry(db); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
 	return nil
 }
+
+// rewrite the master of the last commit without MASTER_DIRTY in its
+// slot, for Close. a handle whose last commit failed leaves it dirty.
+func masterClean(db *KeyValue) error {
+	if !db.page.dirty || db.page.failed || db.Options.ReadOnly || db.mmap.inMemory {
+		return nil
+	}
+	db.page.dirty = false
+	db.page.allMasters = db.page.spread
+	if err := masterStore(db); err != nil {
+		return fmt.Errorf("Close: %w", err)
+	}
+	if err := fileSyncRetry(db); err != nil {
+		return fmt.Errorf("Close: fsync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"bytes"
+	"sync"
+	"syscall"
+)
+
+/*
+PinPrefix keeps the pages of a hot prefix resident: the path from the
+root and the nodes under it holding the prefix, up to PIN_PREFIX_PAGES
+of them. They are read in and locked in memory until the returned
+function is called. With LockMemory the whole mapping is locked already
+and they are only read in, unlocking them would undo it. Without a
+mapping, NoMmap or NewFromBytes, reading them in fills the caches.
+
+The pages are those of the tree at the call. The writes after it copy
+the nodes they change to other pages, so the caller pins again once the
+prefix has changed much. A page pinned twice stays locked until both
+are unpinned.
+*/
+
+// pages PinPrefix reads and locks at most
+const PIN_PREFIX_PAGES = 256
+
+// replaced in tests
+var munlock = syscall.Munlock
+
+// the pages locked by PinPrefix and how many pins hold each
+type pinnedPages struct {
+	mu    sync.Mutex // taken under the read lock
+	count map[uint64]int
+}
+
+// read in and lock the pages of the keys with the prefix, the returned
+// function unlocks them. failures to lock are logged, the pages are
+// still read in.
+func (db *KeyValue) PinPrefix(prefix []byte) (unpin func()) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if checkOpen(db) != nil || db.tree.root == 0 {
+		return func() {}
+	}
+	var ptrs []uint64
+	func() {
+		defer recoverRead(db)
+		ptrs = pinCollect(db, db.tree.root, prefix, prefixEnd(prefix), nil)
+	}()
+	lock := !db.Options.LockMemory && db.pread == nil && !db.mmap.inMemory
+	if lock {
+		pinLock(db, ptrs)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			db.mu.RLock()
+			defer db.mu.RUnlock()
+			if lock && checkOpen(db) == nil {
+				pinUnlock(db, ptrs)
+			}
+		})
+	}
+}
+
+// the pages from ptr down whose keys may be in [lo, hi), read in as
+// they're found. a nil hi is the end of the keys.
+func pinCollect(db *KeyValue, ptr uint64, lo []byte, hi []byte, ptrs []uint64) []uint64 {
+	if len(ptrs) >= PIN_PREFIX_PAGES {
+		return ptrs
+	}
+	node := db.pageGet(ptr)
+	if db.pread == nil {
+		mmapTouch(node.data)
+	}
+	ptrs = append(ptrs, ptr)
+	if node.btype() != BNODE_NODE {
+		return ptrs
+	}
+	for i := nodeLookupLE(node, lo); i < node.nkeys(); i++ {
+		if hi != nil && i > 0 && bytes.Compare(node.getKey(i), hi) >= 0 {
+			break
+		}
+		ptrs = pinCollect(db, node.getPtr(i), lo, hi, ptrs)
+	}
+	return ptrs
+}
+
+func pinLock(db *KeyValue, ptrs []uint64) {
+	db.pinned.mu.Lock()
+	defer db.pinned.mu.Unlock()
+	if db.pinned.count == nil {
+		db.pinned.count = map[uint64]int{}
+	}
+	for _, ptr := range ptrs {
+		if db.pinned.count[ptr]++; db.pinned.count[ptr] > 1 {
+			continue
+		}
+		if err := mlock(pageGetMapped(db, ptr).data); err != nil {
+			logger(db).Warnf("PinPrefix: mlock page %d: %v", ptr, err)
+		}
+	}
+}
+
+func pinUnlock(db *KeyValue, ptrs []uint64) {
+	db.pinned.mu.Lock()
+	defer db.pinned.mu.Unlock()
+	for _, ptr := range ptrs {
+		if db.pinned.count[ptr]--; db.pinned.count[ptr] > 0 {
+			continue
+		}
+		delete(db.pinned.count, ptr)
+		if err := munlock(pageGetMapped(db, ptr).data); err != nil {
+			logger(db).Warnf("PinPrefix: munlock page %d: %v", ptr, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+With Options.NoMmap the file isn't mapped. The pages are read with
+pread into buffers of their own, kept in an LRU cache, and written with
+pwrite. A buffer isn't changed once it's read, a write puts a new one
+in the cache, so the nodes the readers hold stay valid like the mapped
+pages do. The buffers are aligned so that DirectIO works too.
+*/
+
+// pages cached with NoMmap by default
+const DEFAULT_NO_MMAP_CACHE_PAGES = 1024
+
+// the pages read with pread, the least recently used are dropped
+type pageReader struct {
+	mu    sync.Mutex // readers share the db lock
+	fp    *os.File
+	max   int
+	order *list.List // front is the most recently used
+	items map[uint64]*list.Element
+}
+
+type pageEntry struct {
+	ptr  uint64
+	data []byte
+}
+
+func newPageReader(db *KeyValue) *pageReader {
+	max := db.Options.NoMmapCachePages
+	if max <= 0 {
+		max = DEFAULT_NO_MMAP_CACHE_PAGES
+	}
+	return &pageReader{
+		fp: db.fp, max: max,
+		order: list.New(), items: map[uint64]*list.Element{},
+	}
+}
+
+// the size of the file opened with NoMmap, in place of the mapping
+func preadInit(db *KeyValue) error {
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	db.mmap.file = int(fi.Size())
+	return nil
+}
+
+// a page, read from the file if it isn't cached
+func (r *pageReader) get(ptr uint64, size int) []byte {
+	r.mu.Lock()
+	if e, ok := r.items[ptr]; ok {
+		r.order.MoveToFront(e)
+		r.mu.Unlock()
+		return e.Value.(*pageEntry).data
+	}
+	r.mu.Unlock()
+
+	data := directBuffer(size)
+	if _, err := r.fp.ReadAt(data, int64(ptr)*int64(size)); err != nil {
+		panic(fmt.Errorf("pread page %d: %w", ptr, err))
+	}
+	r.put(ptr, data)
+	return data
+}
+
+func (r *pageReader) put(ptr uint64, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.items[ptr]; ok {
+		e.Value.(*pageEntry).data = data
+		r.order.MoveToFront(e)
+		return
+	}
+	r.items[ptr] = r.order.PushFront(&pageEntry{ptr: ptr, data: data})
+	for r.order.Len() > r.max {
+		e := r.order.Back()
+		r.order.Remove(e)
+		delete(r.items, e.Value.(*pageEntry).ptr)
+	}
+}
+
+// drop the pages another handle may have changed
+func (r *pageReader) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.order.Init()
+	clear(r.items)
+}
+
+// write and seal a page with pwrite, the cache gets the new buffer
+func (r *pageReader) write(db *KeyValue, ptr uint64, page []byte) error {
+	data := directBuffer(db.page.size)
+	copy(data, page)
+	pageSeal(db, data)
+	if _, err := fileWriteAt(r.fp, data, int64(ptr)*int64(db.page.size)); err != nil {
+		return fmt.Errorf("pwrite: %w", err)
+	}
+	r.put(ptr, data)
+	return nil
+}
+
+// the bytes of the file from off, at least n of them
+func fileBytes(db *KeyValue, off int, n int) ([]byte, error) {
+	if db.pread == nil {
+		return db.mmap.chunks[0][off:], nil
+	}
+	// aligned for DirectIO, the callers read from page offsets
+	buf := directBuffer((n + DIRECT_IO_ALIGN - 1) / DIRECT_IO_ALIGN * DIRECT_IO_ALIGN)
+	got, err := db.fp.ReadAt(buf, int64(off))
+	if got < n {
+		return nil, fmt.Errorf("pread: %w", err)
+	}
+	return buf, nil
+}
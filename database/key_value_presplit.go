@@ -0,0 +1,101 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+PreSplit gives an empty tree a leaf per range between the boundaries
+before anything is written, so the first writes go to different leaves
+instead of all splitting the same one. The leaves past the first are
+empty, the first holds the dummy key. The parent keeps the boundary of
+such a leaf as its key when the first key goes in, so the leaf holds
+exactly the keys in its range. The deletes merge a leaf that is still
+empty like any other small leaf, and with it its boundary.
+*/
+
+// partition the empty main tree at the boundaries, in increasing
+// order. with AllowDuplicates each boundary splits at the values of
+// its key. fails if the tree holds a key.
+func (db *KeyValue) PreSplit(boundaries [][]byte) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	for i, key := range boundaries {
+		if err := checkKey(db, key); err != nil {
+			return fmt.Errorf("PreSplit: %w", err)
+		}
+		if i > 0 && bytes.Compare(boundaries[i-1], key) >= 0 {
+			return fmt.Errorf("PreSplit: boundary %q after %q", key, boundaries[i-1])
+		}
+	}
+	if !treeEmpty(&db.tree) {
+		return fmt.Errorf("PreSplit: %s is not empty", db.Path)
+	}
+	if len(boundaries) == 0 {
+		return nil
+	}
+	if db.tree.root != 0 {
+		db.tree.del(db.tree.root) // the leaf with the dummy key
+	}
+	keys := make([][]byte, 0, len(boundaries)+1)
+	keys = append(keys, []byte{})
+	for _, key := range boundaries {
+		if db.Options.AllowDuplicates {
+			key = EncodeTuple(key)
+		}
+		keys = append(keys, append([]byte{}, key...))
+	}
+	db.tree.root = treePreSplit(&db.tree, keys)
+	return flushPages(db)
+}
+
+// only the dummy key, or not even that
+func treeEmpty(tree *BTree) bool {
+	if tree.root == 0 {
+		return true
+	}
+	node := tree.get(tree.root)
+	return node.btype() == BNODE_LEAF && node.nkeys() == 1
+}
+
+// the root of a tree with a leaf starting at each key, the first one
+// is the dummy key
+func treePreSplit(tree *BTree, keys [][]byte) uint64 {
+	ptrs := make([]uint64, len(keys))
+	for i := range keys {
+		leaf := BNode{data: make([]byte, tree.nsize())}
+		if i == 0 {
+			leaf.setHeader(BNODE_LEAF, 1)
+			nodeAppendKV(leaf, 0, 0, nil, nil)
+		} else {
+			leaf.setHeader(BNODE_LEAF, 0)
+		}
+		ptrs[i] = tree.new(leaf)
+	}
+	// the levels above, as many links per node as fit
+	for len(ptrs) > 1 {
+		var upKeys [][]byte
+		var upPtrs []uint64
+		for start := 0; start < len(keys); {
+			end, size := start, HEADER
+			for end < len(keys) && (end == start || size+8+2+4+len(keys[end]) <= tree.nsize()) {
+				size += 8 + 2 + 4 + len(keys[end])
+				end++
+			}
+			node := BNode{data: make([]byte, tree.nsize())}
+			node.setHeader(BNODE_NODE, uint16(end-start))
+			for i := start; i < end; i++ {
+				nodeAppendKV(node, uint16(i-start), ptrs[i], keys[i], nil)
+			}
+			upKeys, upPtrs = append(upKeys, keys[start]), append(upPtrs, tree.new(node))
+			start = end
+		}
+		keys, ptrs = upKeys, upPtrs
+	}
+	return ptrs[0]
+}
@@ -0,0 +1,601 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// kids of a node read by EstimateCount for the fanout of the level below
+const ESTIMATE_SAMPLE = 8
+
+// range iterator over the keys in [lo, hi)
+type Iter struct {
+	iter *BIter
+	hi   []byte // nil means no upper bound
+	err  error  // a checksum mismatch that ended the iteration
+	now  int64  // the expired entries at this time are skipped
+	// the snapshot pinned by the iterator
+	db     *KeyValue
+	seq    uint64
+	pinned bool
+	multi  bool // the keys are stored by AllowDuplicates
+	// the entries it rejects are skipped, see ScanFilter
+	pred func(key []byte, val []byte) bool
+}
+
+// iterate over the keys in [lo, hi), a nil hi scans to the end.
+// the iterator reads a snapshot of the last commit while writes go
+// on, it must be closed unless it is drained. once the database is
+// closed it ends with ErrClosed.
+func (db *KeyValue) Scan(lo []byte, hi []byte) *Iter {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if checkOpen(db) != nil {
+		return &Iter{iter: &BIter{}} // nothing to iterate
+	}
+	if db.Options.AllowDuplicates {
+		lo, hi = multiBounds(lo, hi)
+		it := snapshotScan(db, db.tree.root, lo, hi)
+		it.multi = true
+		return it
+	}
+	return snapshotScan(db, db.tree.root, lo, hi)
+}
+
+// the descent may come from cache, which holds paths of db.seq
+func scanTree(db *KeyValue, tree *BTree, lo []byte, hi []byte, cache *pathCache) (it *Iter) {
+	it = &Iter{iter: &BIter{}, hi: hi, db: db, now: time.Now().UnixNano()}
+	defer it.recover()
+	it.iter = cache.seek(db.seq, tree, lo)
+	it.iter.readAhead(false)
+	// skip the dummy key and the key before lo
+	for it.iter.Valid() {
+		key, _ := it.iter.Deref()
+		if !isDummyKey(key) && bytes.Compare(key, lo) >= 0 {
+			break
+		}
+		it.iter.Next()
+	}
+	it.skip()
+	return it
+}
+
+// move past the expired entries, they are deleted by Get and the
+// sweep, and the ones the filter rejects up to hi
+func (it *Iter) skip() {
+	for it.iter.Valid() {
+		key, val, meta := it.iter.DerefMeta()
+		if !metaExpired(meta, it.now) {
+			if it.pred == nil || (it.hi != nil && bytes.Compare(key, it.hi) >= 0) {
+				return
+			}
+			if it.multi {
+				key = multiUnkey(key)
+			}
+			if it.pred(key, val) {
+				return
+			}
+		}
+		it.iter.Next()
+	}
+}
+
+// Scan that yields only the entries pred returns true for. pred sees
+// the key and value in place before anything is copied, it must not
+// keep them or call the database.
+func (db *KeyValue) ScanFilter(lo []byte, hi []byte, pred func(key []byte, val []byte) bool) (it *Iter) {
+	it = db.Scan(lo, hi)
+	defer it.recover()
+	it.pred = pred
+	it.skip()
+	return it
+}
+
+// iterate over the keys starting with the prefix
+func (db *KeyValue) ScanPrefix(prefix []byte) *Iter {
+	return db.Scan(prefix, prefixEnd(prefix))
+}
+
+// iterate over the keys matching a glob: * matches any run of
+// characters, ? a single one, [abc], [a-z] and [!abc] one of a set and
+// \ escapes the next character. the literal start of the pattern
+// bounds the scan like ScanPrefix, a pattern starting with a wildcard
+// reads every key, and so does any with AllowDuplicates since the
+// stored keys don't share the prefix. fails with ErrBadPattern for a
+// malformed pattern.
+func (db *KeyValue) ScanPattern(pattern string) (*Iter, error) {
+	prefix, re, err := globCompile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("ScanPattern: %w", err)
+	}
+	if db.Options.AllowDuplicates {
+		prefix = nil
+	}
+	return db.ScanFilter(prefix, prefixEnd(prefix), func(key []byte, _ []byte) bool {
+		return re.Match(key)
+	}), nil
+}
+
+// the literal prefix of a glob and the expression matching it whole
+func globCompile(pattern string) ([]byte, *regexp.Regexp, error) {
+	var prefix []byte
+	var expr strings.Builder
+	literal := true // no wildcard yet
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			expr.WriteString(".*")
+			literal = false
+		case '?':
+			expr.WriteString(".")
+			literal = false
+		case '[':
+			end := i + 1
+			if end < len(runes) && (runes[end] == '!' || runes[end] == '^') {
+				end++
+			}
+			if end < len(runes) && runes[end] == ']' {
+				end++ // a leading ] is a member
+			}
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, nil, fmt.Errorf("%w: unterminated [ in %q", ErrBadPattern, pattern)
+			}
+			expr.WriteString("[")
+			for j, c := range runes[i+1 : end] {
+				switch {
+				case j == 0 && (c == '!' || c == '^'):
+					expr.WriteString("^")
+				case c == '-':
+					expr.WriteRune(c)
+				default:
+					expr.WriteString(regexp.QuoteMeta(string(c)))
+				}
+			}
+			expr.WriteString("]")
+			literal, i = false, end
+		case '\\':
+			if i++; i == len(runes) {
+				return nil, nil, fmt.Errorf("%w: trailing \\ in %q", ErrBadPattern, pattern)
+			}
+			fallthrough
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(runes[i])))
+			if literal {
+				prefix = utf8.AppendRune(prefix, runes[i])
+			}
+		}
+	}
+	re, err := regexp.Compile("^(?s:" + expr.String() + ")$")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrBadPattern, err)
+	}
+	return prefix, re, nil
+}
+
+// the smallest key greater than every key with the prefix,
+// nil if there is none (the prefix is all 0xff)
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+// hold the mapping for a step of the iterator, false with ErrClosed
+// once the database is closed
+func (it *Iter) enter() bool {
+	if it.db == nil {
+		return true
+	}
+	if !snapshotEnter(it.db) {
+		if it.err == nil {
+			it.err = ErrClosed
+		}
+		return false
+	}
+	return true
+}
+
+func (it *Iter) leave() {
+	if it.db != nil {
+		snapshotLeave(it.db)
+	}
+}
+
+func (it *Iter) Valid() bool {
+	if !it.enter() {
+		it.Close()
+		return false
+	}
+	defer it.leave()
+	valid := it.err == nil && it.iter.Valid()
+	if valid && it.hi != nil {
+		key, _ := it.iter.Deref()
+		valid = bytes.Compare(key, it.hi) < 0
+	}
+	if !valid {
+		it.Close() // drained
+	}
+	return valid
+}
+
+// the current KV pair, copies unless NoCopyOnRead is set. with it the
+// slices point into the database and are only valid until the iterator
+// is closed, or the next write if it came from a transaction. with
+// AllowDuplicates the key is a copy and a key comes up once for each
+// of its values.
+func (it *Iter) Deref() ([]byte, []byte) {
+	if !it.enter() {
+		return nil, nil
+	}
+	defer it.leave()
+	key, val := it.deref()
+	if it.db == nil {
+		return key, val
+	}
+	return readCopy(it.db, key), readCopy(it.db, val)
+}
+
+// Deref without the copies
+func (it *Iter) deref() ([]byte, []byte) {
+	key, val := it.iter.Deref()
+	if it.multi {
+		key = multiUnkey(key)
+	}
+	return key, val
+}
+
+func (it *Iter) Next() {
+	if !it.enter() {
+		return
+	}
+	defer it.leave()
+	defer it.recover()
+	it.iter.Next()
+	it.skip()
+}
+
+// the checksum mismatch that ended the iteration early with
+// VERIFY_ALWAYS, or ErrClosed if the database was closed under it,
+// nil if it ran to the end
+func (it *Iter) Err() error {
+	return it.err
+}
+
+func (it *Iter) recover() {
+	if r := recover(); r != nil {
+		it.err = corruptError(it.db, r)
+	}
+}
+
+// release the snapshot, the pages it reads can then be reused
+func (it *Iter) Close() {
+	if it.pinned {
+		it.pinned = false
+		snapshotUnpin(it.db, it.seq)
+	}
+}
+
+// up to `limit` keys starting with the prefix, 0 means no limit
+func (db *KeyValue) KeysWithPrefix(prefix []byte, limit int) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return nil, err
+	}
+
+	keys := [][]byte{}
+	it := scanTree(db, &db.tree, prefix, prefixEnd(prefix), nil)
+	for ; it.Valid(); it.Next() {
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+		key, _ := it.deref()
+		keys = append(keys, append([]byte{}, key...))
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// the key of the given rank and its value, copies, rank 0 is the
+// smallest key. it walks the keys before it, O(rank).
+func (db *KeyValue) KeyAt(rank uint64) (key []byte, val []byte, ok bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if checkOpen(db) != nil {
+		return nil, nil, false
+	}
+
+	it := scanTree(db, &db.tree, nil, nil, nil)
+	for ; it.Valid() && rank > 0; it.Next() {
+		rank--
+	}
+	if !it.Valid() {
+		return nil, nil, false
+	}
+	key, val = it.deref()
+	return append([]byte{}, key...), append([]byte{}, val...), true
+}
+
+// whether no key is in [lo, hi), a nil hi means no upper bound. it
+// looks at the first key from lo on, O(height) unless expired keys
+// have to be skipped.
+func (db *KeyValue) RangeEmpty(lo []byte, hi []byte) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return false, err
+	}
+
+	it := scanTree(db, &db.tree, lo, hi, nil)
+	empty := !it.Valid()
+	if err := it.Err(); err != nil {
+		return false, err
+	}
+	return empty, nil
+}
+
+// a hash of the logical content, independent of the physical layout.
+// each key and value is length-prefixed so the pairs can't run together.
+func (db *KeyValue) Fingerprint() ([32]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return [32]byte{}, err
+	}
+
+	h := sha256.New()
+	var size [4]byte
+	it := scanTree(db, &db.tree, nil, nil, nil)
+	for ; it.Valid(); it.Next() {
+		key, val := it.deref()
+		binary.LittleEndian.PutUint32(size[:], uint32(len(key)))
+		h.Write(size[:])
+		h.Write(key)
+		binary.LittleEndian.PutUint32(size[:], uint32(len(val)))
+		h.Write(size[:])
+		h.Write(val)
+	}
+	if err := it.Err(); err != nil {
+		return [32]byte{}, err
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// the lengths of the largest key and the largest value, for sizing
+// pages. it walks every entry, the maxima aren't kept as they can't be
+// lowered on a delete without the same walk.
+func (db *KeyValue) MaxSizes() (maxKeyLen int, maxValLen int, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return 0, 0, err
+	}
+
+	it := scanTree(db, &db.tree, nil, nil, nil)
+	for ; it.Valid(); it.Next() {
+		key, val := it.deref()
+		maxKeyLen, maxValLen = max(maxKeyLen, len(key)), max(maxValLen, len(val))
+	}
+	if err := it.Err(); err != nil {
+		return 0, 0, err
+	}
+	return maxKeyLen, maxValLen, nil
+}
+
+// split the key space into up to n contiguous ranges holding about the
+// same number of keys, for scanning them in parallel. the boundaries are
+// separator keys sampled from the level of the tree with enough of them,
+// so the split costs a few page reads. the first range starts at nil and
+// the last one ends at nil, fewer than n come back if the tree is small.
+func (db *KeyValue) SplitRanges(n int) ([][2][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := checkOpen(db); err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, fmt.Errorf("SplitRanges: %d ranges", n)
+	}
+
+	keys, err := sampleSeparators(db, n)
+	if err != nil {
+		return nil, err
+	}
+	ranges := [][2][]byte{}
+	lo := []byte(nil)
+	for i := 1; i < n; i++ {
+		idx := i * len(keys) / n
+		if idx >= len(keys) {
+			break
+		}
+		key := keys[idx]
+		if isDummyKey(key) || (lo != nil && bytes.Compare(key, lo) <= 0) {
+			continue
+		}
+		ranges = append(ranges, [2][]byte{lo, key})
+		lo = key
+	}
+	return append(ranges, [2][]byte{lo, nil}), nil
+}
+
+// the keys of the highest level of the tree with at least n of them,
+// or of the leaves, in order. they are copies.
+func sampleSeparators(db *KeyValue, n int) (keys [][]byte, err error) {
+	defer recoverCorrupt(db, &err)
+	if db.tree.root == 0 {
+		return nil, nil
+	}
+	level := []BNode{db.tree.get(db.tree.root)}
+	for {
+		keys = keys[:0]
+		for _, node := range level {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				keys = append(keys, node.getKey(i))
+			}
+		}
+		if len(keys) >= n || level[0].btype() == BNODE_LEAF {
+			break
+		}
+		kids := []BNode{}
+		for _, node := range level {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				kids = append(kids, db.tree.get(node.getPtr(i)))
+			}
+		}
+		level = kids
+	}
+	for i, key := range keys {
+		keys[i] = append([]byte{}, key...)
+	}
+	return keys, nil
+}
+
+// the separator keys of the internal nodes at the depth, level 0 being
+// the root, in order and without the dummy key. they are the first keys
+// of the nodes a level down, so they split the keys about evenly
+// without reading the leaves. copies.
+func (db *KeyValue) SeparatorKeys(level int) (keys [][]byte, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return nil, err
+	}
+
+	nodes := []BNode{}
+	if db.tree.root != 0 {
+		nodes = append(nodes, db.tree.get(db.tree.root))
+	}
+	for depth := 0; ; depth++ {
+		if len(nodes) == 0 || nodes[0].btype() != BNODE_NODE || level < 0 {
+			return nil, fmt.Errorf("SeparatorKeys: no internal nodes at level %d", level)
+		}
+		if depth == level {
+			break
+		}
+		kids := []BNode{}
+		for _, node := range nodes {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				kids = append(kids, db.tree.get(node.getPtr(i)))
+			}
+		}
+		nodes = kids
+	}
+	for _, node := range nodes {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if key := node.getKey(i); !isDummyKey(key) {
+				keys = append(keys, append([]byte{}, key...))
+			}
+		}
+	}
+	return keys, nil
+}
+
+// an estimate of the keys in [lo, hi), a nil hi estimating to the end.
+// it follows the paths to lo and hi and counts the subtrees between
+// them, each taken to hold the average fanout of a few sampled nodes
+// per level to the power of its height, so it reads O(height) pages.
+// the leaves at the ends are counted exactly, expired keys are included.
+func (db *KeyValue) EstimateCount(lo []byte, hi []byte) (count uint64, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(db, &err)
+	if err := checkOpen(db); err != nil {
+		return 0, err
+	}
+	if db.tree.root == 0 || (hi != nil && bytes.Compare(lo, hi) >= 0) {
+		return 0, nil
+	}
+	if len(lo) == 0 {
+		lo = []byte{0} // past the dummy key
+	}
+	loPath, loPos := estimatePath(&db.tree, lo)
+	hiPath, hiPos := estimatePath(&db.tree, hi)
+
+	// the keys under a kid of a node at each level
+	leaf := len(loPath) - 1
+	size := make([]float64, len(loPath))
+	size[leaf] = 1
+	for i := leaf - 1; i >= 0; i-- {
+		size[i] = size[i+1] * estimateFanout(&db.tree, loPath[i], hiPath[i])
+	}
+
+	// the paths share the nodes down to the one where they part
+	split := 0
+	for split < leaf && loPos[split] == hiPos[split] {
+		split++
+	}
+	estimate := float64(max(hiPos[split]-loPos[split], 0))
+	if split < leaf {
+		estimate = float64(max(hiPos[split]-loPos[split]-1, 0)) * size[split]
+	}
+	for i := split + 1; i <= leaf; i++ {
+		after := int(loPath[i].nkeys()) - loPos[i]
+		if i < leaf {
+			after-- // the kid holding lo
+		}
+		estimate += float64(after+hiPos[i]) * size[i]
+	}
+	return uint64(estimate + 0.5), nil
+}
+
+// the average keys of the kids sampled evenly from the internal nodes
+func estimateFanout(tree *BTree, parents ...BNode) float64 {
+	total, count := 0, 0
+	for _, node := range parents {
+		n := int(node.nkeys())
+		k := min(n, ESTIMATE_SAMPLE/len(parents))
+		for j := 0; j < k; j++ {
+			kid := tree.get(node.getPtr(uint16(j * n / k)))
+			total, count = total+int(kid.nkeys()), count+1
+		}
+	}
+	return float64(total) / float64(count)
+}
+
+// the nodes from the root to the leaf holding the key, with the kid
+// followed in each, and in the leaf the first key not less than it.
+// a nil key is past the last one.
+func estimatePath(tree *BTree, key []byte) (path []BNode, pos []int) {
+	node := tree.get(tree.root)
+	for {
+		path = append(path, node)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		idx := node.nkeys() - 1
+		if key != nil {
+			idx = nodeLookupLE(node, key)
+		}
+		pos = append(pos, int(idx))
+		node = tree.get(node.getPtr(idx))
+	}
+	idx := int(node.nkeys())
+	if key != nil {
+		idx = int(nodeLookupLE(node, key))
+		if idx < int(node.nkeys()) && bytes.Compare(node.getKey(uint16(idx)), key) < 0 {
+			idx++
+		}
+	}
+	return path, append(pos, idx)
+}
@@ -0,0 +1,200 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+/*
+With Options.SequentialKeys a leaf whose keys are all 8 bytes, such as
+big-endian integers, and within 2^32 of the first one is stored with
+the first key and a delta per key:
+
+| type | nkeys | base | deltas     | (vlen, val)* |
+|  2B  |  2B   |  8B  | nkeys * 4B |              |
+
+An entry takes 6 bytes besides its value instead of 22. The tree works
+on leaves in the usual layout, pageNew encodes a leaf that outgrows the
+page in it and the reads decode it. The leaves split where the encoding
+fills a page, which suits keys added in order. The offsets of a decoded
+leaf are uint16, so it's at most SEQ_MAX_LEAF less the node size and
+the largest page size gains little.
+
+The mode is a flag of the master page, an open with the option sets it
+for good. The encoded leaves are marked by their type, the reads don't
+depend on the mode.
+*/
+
+const (
+	BNODE_LEAF_SEQ   = 4 // a delta encoded leaf
+	SEQ_HEADER       = 4 + 8
+	SEQ_MAX_LEAF     = math.MaxUint16
+	seqKeySize       = 8
+	seqEntryOverhead = 4 + 2 // the delta and vlen
+)
+
+// set the mode for the trees and the next commits
+func seqKeysSet(db *KeyValue, on bool) {
+	db.page.seqKeys = on
+	db.tree.seqKeys = on
+	for i := range db.trees {
+		db.trees[i].seqKeys = on
+	}
+}
+
+// the largest decoded leaf, the inserts and updates add an entry to it
+func seqMaxLeaf(tree *BTree) int {
+	return SEQ_MAX_LEAF - tree.nsize()
+}
+
+// the leaf in the encoded layout in a node of size bytes, false if its
+// keys don't qualify or it doesn't fit
+func seqEncode(node BNode, size int) (BNode, bool) {
+	nkeys := node.nkeys()
+	if node.btype() != BNODE_LEAF || nkeys == 0 {
+		return BNode{}, false
+	}
+	total := SEQ_HEADER
+	for i := uint16(0); i < nkeys; i++ {
+		if len(node.getKey(i)) != seqKeySize || node.getPtr(i) != 0 {
+			return BNode{}, false
+		}
+		total += seqEntryOverhead + len(node.getVal(i))
+	}
+	base := binary.BigEndian.Uint64(node.getKey(0))
+	if binary.BigEndian.Uint64(node.getKey(nkeys-1))-base > math.MaxUint32 || total > size {
+		return BNode{}, false
+	}
+
+	enc := BNode{data: make([]byte, size)}
+	binary.LittleEndian.PutUint16(enc.data[0:], BNODE_LEAF_SEQ)
+	binary.LittleEndian.PutUint16(enc.data[2:], nkeys)
+	binary.BigEndian.PutUint64(enc.data[4:], base)
+	pos := SEQ_HEADER + 4*int(nkeys)
+	for i := uint16(0); i < nkeys; i++ {
+		delta := binary.BigEndian.Uint64(node.getKey(i)) - base
+		binary.LittleEndian.PutUint32(enc.data[SEQ_HEADER+4*int(i):], uint32(delta))
+		// the raw vlen keeps VLEN_META
+		kv := node.kvPos(i)
+		vlen := binary.LittleEndian.Uint16(node.data[kv+2:])
+		binary.LittleEndian.PutUint16(enc.data[pos:], vlen)
+		pos += 2 + copy(enc.data[pos+2:], node.getVal(i))
+	}
+	return enc, true
+}
+
+// the encoded leaf in the usual layout, fails on a page that doesn't
+// hold a whole one
+func seqDecode(page []byte) (BNode, error) {
+	if len(page) < SEQ_HEADER {
+		return BNode{}, fmt.Errorf("encoded leaf: %d bytes", len(page))
+	}
+	nkeys := int(binary.LittleEndian.Uint16(page[2:]))
+	base := binary.BigEndian.Uint64(page[4:])
+	// the sizes first, the page may be damaged
+	start := SEQ_HEADER + 4*nkeys
+	pos, size := start, HEADER+10*nkeys
+	for i := 0; i < nkeys; i++ {
+		if pos+2 > len(page) {
+			return BNode{}, fmt.Errorf("encoded leaf: entry %d is past the page", i)
+		}
+		vlen := int(binary.LittleEndian.Uint16(page[pos:]) &^ VLEN_META)
+		pos += 2 + vlen
+		size += 4 + seqKeySize + vlen
+	}
+	if pos > len(page) || size > SEQ_MAX_LEAF {
+		return BNode{}, fmt.Errorf("encoded leaf: %d keys don't fit", nkeys)
+	}
+
+	node := BNode{data: make([]byte, size)}
+	node.setHeader(BNODE_LEAF, uint16(nkeys))
+	var key [seqKeySize]byte
+	pos = start
+	for i := 0; i < nkeys; i++ {
+		delta := binary.LittleEndian.Uint32(page[SEQ_HEADER+4*i:])
+		binary.BigEndian.PutUint64(key[:], base+uint64(delta))
+		vlen := binary.LittleEndian.Uint16(page[pos:])
+		val := page[pos+2 : pos+2+int(vlen&^VLEN_META)]
+		nodeAppendKVFlags(node, uint16(i), 0, key[:], val, vlen&VLEN_META)
+		pos += 2 + len(val)
+	}
+	return node, nil
+}
+
+// a page read from the file or the updates as a node, an encoded leaf
+// is decoded
+func seqRead(page []byte) BNode {
+	node := BNode{page}
+	if node.btype() != BNODE_LEAF_SEQ {
+		return node
+	}
+	node, err := seqDecode(page)
+	if err != nil {
+		panic(err)
+	}
+	return node
+}
+
+// split a leaf into pages filled left to right, a page holds as many
+// entries as fit in either layout
+func seqSplit(tree *BTree, old BNode) []BNode {
+	nsize := tree.nsize()
+	var kids []BNode
+	// the range [start, i) of the next kid and its sizes in both layouts
+	start, std, enc := uint16(0), HEADER, SEQ_HEADER
+	seq, base := tree.seqKeys, uint64(0)
+	cut := func(end uint16) {
+		node := BNode{data: make([]byte, max(std, nsize))}
+		node.setHeader(BNODE_LEAF, end-start)
+		nodeAppendRange(node, old, 0, start, end-start)
+		if std <= nsize {
+			node.data = node.data[:nsize]
+		}
+		kids = append(kids, node)
+	}
+	for i := uint16(0); i < old.nkeys(); i++ {
+		key, entry := old.getKey(i), int(old.getOffSet(i+1)-old.getOffSet(i))
+		if i == start {
+			seq = tree.seqKeys && len(key) == seqKeySize
+			if seq {
+				base = binary.BigEndian.Uint64(key)
+			}
+		} else {
+			seq = seq && len(key) == seqKeySize &&
+				binary.BigEndian.Uint64(key)-base <= math.MaxUint32
+		}
+		vlen := entry - 4 - len(key)
+		nstd, nenc := std+10+entry, enc+seqEntryOverhead+vlen
+		fits := nstd <= nsize || (seq && nenc <= nsize && nstd <= seqMaxLeaf(tree))
+		if !fits && i > start {
+			cut(i)
+			start, std, enc = i, HEADER, SEQ_HEADER
+			i-- // again as the first of the next kid
+			continue
+		}
+		std, enc = nstd, nenc
+	}
+	cut(old.nkeys())
+	if DebugChecks {
+		total := 0
+		for _, node := range kids {
+			nodeCheck("seqSplit", node, node.nkeys(), len(node.data))
+			total += int(node.nkeys())
+		}
+		if total != int(old.nkeys()) {
+			panic(fmt.Sprintf("seqSplit: %d keys in %d nodes, want %d", total, len(kids), old.nkeys()))
+		}
+	}
+	return kids
+}
+
+// split an updated node into the nodes that are stored for it. a leaf
+// decoded from the encoded layout may be larger than splitNode takes.
+func treeSplit(tree *BTree, node BNode) []BNode {
+	if node.btype() == BNODE_LEAF && (tree.seqKeys || int(node.nbytes()) > 2*tree.nsize()) {
+		return seqSplit(tree, node)
+	}
+	n, split := splitNode(node, tree.nsize())
+	return split[:n]
+}
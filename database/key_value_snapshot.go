@@ -0,0 +1,234 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+An iterator from Scan reads the tree of the commit it was created at
+while writers go on. Its pages stay readable because a commit that
+frees pages while snapshots are pinned holds them back from the free
+list, and releases them in a later commit once every snapshot that
+could reach them is closed. The held pages are in neither the tree nor
+the free list, so a crash leaks them until ReclaimOrphans.
+
+The commits in the master slots past the last two are kept readable
+the same way, so Open can fall back to any of them, and so are the
+commits of Options.HistoryCommits for GetAsOf.
+*/
+
+// pages freed by a commit while snapshots may still read them
+type heldPages struct {
+	seq  uint64 // the commit that freed them
+	ptrs []uint64
+}
+
+// pin the state after the commit seq
+func snapshotPin(db *KeyValue, seq uint64) {
+	db.snap.mu.Lock()
+	defer db.snap.mu.Unlock()
+	if db.snap.pins == nil {
+		db.snap.pins = map[uint64]int{}
+	}
+	db.snap.pins[seq]++
+}
+
+func snapshotUnpin(db *KeyValue, seq uint64) {
+	db.snap.mu.Lock()
+	defer db.snap.mu.Unlock()
+	if db.snap.pins[seq] == 0 {
+		return // dropped by Close
+	}
+	if db.snap.pins[seq]--; db.snap.pins[seq] <= 0 {
+		delete(db.snap.pins, seq)
+	}
+	if len(db.snap.pins) == 0 && db.snap.drained != nil {
+		close(db.snap.drained)
+		db.snap.drained = nil
+	}
+}
+
+// wait up to timeout for the iterators and views to be closed, a
+// negative timeout waits as long as it takes. called by Close with the
+// write lock, which keeps new ones from being opened.
+func snapshotDrain(db *KeyValue, timeout time.Duration) error {
+	db.snap.mu.Lock()
+	if len(db.snap.pins) == 0 {
+		db.snap.mu.Unlock()
+		return nil
+	}
+	if db.snap.drained == nil {
+		db.snap.drained = make(chan struct{})
+	}
+	drained := db.snap.drained
+	db.snap.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-expired:
+		return fmt.Errorf("%w: %d iterators or views are open", ErrBusy, snapshotCount(db))
+	}
+}
+
+func snapshotCount(db *KeyValue) int {
+	db.snap.mu.Lock()
+	defer db.snap.mu.Unlock()
+	n := 0
+	for _, count := range db.snap.pins {
+		n += count
+	}
+	return n
+}
+
+// hold the mapping for a read of a snapshot that doesn't take the
+// database lock, false once Close unmapped it. snapshotLeave ends the
+// read, Close waits for it.
+func snapshotEnter(db *KeyValue) bool {
+	db.snap.unmap.RLock()
+	if db.snap.unmapped {
+		db.snap.unmap.RUnlock()
+		return false
+	}
+	return true
+}
+
+func snapshotLeave(db *KeyValue) {
+	db.snap.unmap.RUnlock()
+}
+
+// called by the commit db.seq+1 with the pages it frees, returns the
+// pages that can go on the free list. the rest is held for snapshots.
+func snapshotFree(db *KeyValue, freed []uint64) []uint64 {
+	db.snap.mu.Lock()
+	defer db.snap.mu.Unlock()
+
+	// a page freed by commit c was reachable by the snapshots before c
+	oldest := ^uint64(0)
+	for seq := range db.snap.pins {
+		oldest = min(oldest, seq)
+	}
+	// the free list keeps the commit before this one intact, the
+	// older ones in a master slot or the history need their pages held
+	keep := uint64(0)
+	if !db.page.allMasters {
+		if db.page.masters > 2 {
+			keep = uint64(db.page.masters - 2)
+		}
+		keep = max(keep, uint64(db.Options.HistoryCommits))
+	}
+	if keep > 0 {
+		oldest = min(oldest, db.seq+1-min(keep, db.seq+1))
+	}
+	var release []uint64
+	held := db.snap.held[:0]
+	for _, h := range db.snap.held {
+		if h.seq <= oldest {
+			release = append(release, h.ptrs...)
+		} else {
+			held = append(held, h)
+		}
+	}
+	db.snap.held = held
+	if (len(db.snap.pins) > 0 || keep > 0) && len(freed) > 0 {
+		ptrs := append([]uint64{}, freed...)
+		db.snap.held = append(db.snap.held, heldPages{seq: db.seq + 1, ptrs: ptrs})
+		return release
+	}
+	return append(freed, release...)
+}
+
+// drop the pins of the iterators left open, they can't be used after
+// Close anyway, and put the held pages on the free list. the commit
+// goes to every master slot, so none of them is needed for the slots.
+func snapshotClose(db *KeyValue) error {
+	db.snap.mu.Lock()
+	db.snap.pins = nil
+	held := len(db.snap.held) > 0
+	db.snap.mu.Unlock()
+	if !held || db.Options.ReadOnly {
+		return nil
+	}
+	db.page.allMasters = true // nothing older is needed
+	return flushPages(db)
+}
+
+// the held pages as of now, a rollback restores them since the
+// pages freed by a failed commit are part of the tree again
+func snapshotSave(db *KeyValue) []heldPages {
+	db.snap.mu.Lock()
+	defer db.snap.mu.Unlock()
+	return append([]heldPages{}, db.snap.held...)
+}
+
+func snapshotRestore(db *KeyValue, held []heldPages) {
+	db.snap.mu.Lock()
+	defer db.snap.mu.Unlock()
+	db.snap.held = held
+}
+
+// the pages held back for snapshots
+func snapshotHeld(db *KeyValue) []uint64 {
+	db.snap.mu.Lock()
+	defer db.snap.mu.Unlock()
+	var ptrs []uint64
+	for _, h := range db.snap.held {
+		ptrs = append(ptrs, h.ptrs...)
+	}
+	return ptrs
+}
+
+// a read-only copy of the tree at root that reads the mapped pages
+// directly, it doesn't touch the state the writer changes
+func snapshotTree(db *KeyValue, root uint64) *BTree {
+	chunks, pread := append([][]byte{}, db.mmap.chunks...), db.pread
+	size, csum := db.page.size, db.page.csum
+	verify := db.Options.VerifyChecksums == VERIFY_ALWAYS
+	tree := &BTree{
+		root:     root,
+		pageSize: size,
+		reserved: csumSize(csum),
+		get: func(ptr uint64) BNode {
+			var node BNode
+			if pread != nil {
+				node = BNode{pread.get(ptr, size)}
+			} else {
+				node = pageFromChunks(chunks, size, ptr)
+			}
+			if verify {
+				if err := csumVerify(db, csum, ptr, node.data); err != nil {
+					panic(err) // recovered by the iterator
+				}
+			}
+			return seqRead(node.data)
+		},
+	}
+	if db.Options.ScanReadAhead > 0 && pread == nil && !db.mmap.inMemory {
+		tree.ahead = db.Options.ScanReadAhead
+		tree.prefetch = func(ptrs []uint64) { mmapAdvise(chunks, size, ptrs) }
+	}
+	return tree
+}
+
+// iterate over a snapshot of the tree at root. called with the read
+// lock, which keeps the commits out, so root and the pin are of the
+// same commit and none of its pages is freed before the pin is taken.
+// the pin goes first all the same, nothing is read without it.
+func snapshotScan(db *KeyValue, root uint64, lo []byte, hi []byte) *Iter {
+	seq := db.seq
+	snapshotPin(db, seq)
+	cache := db.pcache
+	if root != db.tree.root {
+		cache = nil // another tree
+	}
+	it := scanTree(db, snapshotTree(db, root), lo, hi, cache)
+	it.seq, it.pinned = seq, true
+	return it
+}
@@ -0,0 +1,97 @@
+package database
+
+// what a commit wrote against what changed, for Options.OnFlush. the
+// copy on write rewrites the path from each changed leaf to the root,
+// so a small change costs about a page per level of the tree.
+type FlushStats struct {
+	Pages         int // the tree pages written
+	FreeListPages int // the free list nodes written
+	PageSize      int
+	Changes       int // the inserts and deletes in the commit
+	Bytes         int // the key and value bytes of the changes
+	// the most new pages held in memory by the commit, see MaxDirtyPages
+	DirtyPages int
+}
+
+// the bytes written per byte changed, 0 for a commit without changes
+func (s FlushStats) Amplification() float64 {
+	if s.Bytes == 0 {
+		return 0
+	}
+	return float64((s.Pages+s.FreeListPages)*s.PageSize) / float64(s.Bytes)
+}
+
+// a change to the tree for the next commit
+func statsChange(db *KeyValue, key []byte, val []byte) {
+	db.page.stats.Changes++
+	db.page.stats.Bytes += len(key) + len(val)
+}
+
+// the pages written by the commit so far
+func statsPages(db *KeyValue) int {
+	n := 0
+	for _, page := range db.page.updates {
+		if page != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// report a durable commit and start counting the next one
+func statsCommit(db *KeyValue) {
+	stats := db.page.stats
+	db.page.stats = FlushStats{}
+	if db.Options.OnFlush != nil {
+		stats.PageSize = db.page.size
+		auditCall(db, "OnFlush", func() { db.Options.OnFlush(stats) })
+	}
+}
+
+// the memory of the handle, see KeyValue.Stats
+type Stats struct {
+	FileBytes int // the file size
+	// the address space mapped, which covers the pages in use. the file
+	// may be larger after growing ahead of them, see GrowthFactor.
+	MmapTotalBytes int
+	MmapChunkCount int
+	// the mapped bytes in memory, the pages read or written and not
+	// evicted since
+	MmapResidentBytes int
+}
+
+// the mapping of the file, usually larger than it. the first chunk
+// maps at least 64 MiB and each one after it doubles the total. nothing
+// is mapped with NoMmap, and a handle of NewFromBytes maps nothing
+// itself.
+func (db *KeyValue) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if checkOpen(db) != nil {
+		return Stats{}
+	}
+	stats := Stats{
+		FileBytes:      db.mmap.file,
+		MmapTotalBytes: db.mmap.total,
+		MmapChunkCount: len(db.mmap.chunks),
+	}
+	if db.mmap.inMemory {
+		stats.MmapTotalBytes, stats.MmapChunkCount = 0, 0
+		return stats
+	}
+	for _, chunk := range db.mmap.chunks {
+		stats.MmapResidentBytes += mmapResident(chunk)
+	}
+	return stats
+}
+
+// the new pages of the commit being built, held in memory until it's
+// written, see Options.MaxDirtyPages. the writes hold the write lock
+// until they commit, so it's 0 when it gets the lock. see
+// Tx.DirtyPages for a transaction, and FlushStats.DirtyPages for the
+// peak of a commit.
+func (db *KeyValue) DirtyPages() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return dirtyPages(db)
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"sync"
+)
+
+// an entry streamed by All, copies
+type KV struct {
+	Key []byte
+	Val []byte
+}
+
+// stream every entry in key order over a channel, read from a snapshot
+// of the last commit by a goroutine. the channel is closed after the
+// last entry. stop ends the stream early, waits for the goroutine to
+// exit and releases the snapshot, it must be called unless the channel
+// is drained. it returns the checksum mismatch that ended the stream
+// early, nil if there was none.
+func (db *KeyValue) All() (entries <-chan KV, stop func() error) {
+	it := db.Scan(nil, nil)
+	out := make(chan KV)
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(out)
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			if !it.enter() {
+				return // closed since Valid
+			}
+			key, val := it.deref()
+			kv := KV{Key: append([]byte{}, key...), Val: append([]byte{}, val...)}
+			it.leave()
+			select {
+			case out <- kv:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return out, func() error {
+		once.Do(func() { close(quit) })
+		<-done
+		return it.Err()
+	}
+}
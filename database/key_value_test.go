@@ -0,0 +1,7041 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unsafe"
+)
+
+func openTestDB(t *testing.T, path string) *KeyValue {
+	t.Helper()
+	db := &KeyValue{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return db
+}
+
+func newTestDB(t *testing.T) *KeyValue {
+	t.Helper()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// test cases below here
+
+func TestDelStatsMerge(t *testing.T) {
+	db := newTestDB(t)
+
+	// 1017B per entry, the 5th key splits the root leaf into
+	// [dummy, k0, k1, k2] and [k3, k4]
+	val := make([]byte, 1000)
+	for i := 0; i < 5; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if db.tree.get(db.tree.root).btype() != BNODE_NODE {
+		t.Fatal("expected the root to be split")
+	}
+
+	// removing k0 leaves the left leaf above the merge threshold
+	deleted, merges, err := db.DelStats([]byte("k00"))
+	if err != nil || !deleted || merges != 0 {
+		t.Fatalf("DelStats(k00) = %v, %d, %v", deleted, merges, err)
+	}
+
+	// removing k3 leaves a single key in the right leaf
+	deleted, merges, err = db.DelStats([]byte("k03"))
+	if err != nil || !deleted || merges != 1 {
+		t.Fatalf("DelStats(k03) = %v, %d, %v", deleted, merges, err)
+	}
+	if db.tree.get(db.tree.root).btype() != BNODE_LEAF {
+		t.Fatal("expected the merge to remove a level")
+	}
+
+	// missing keys don't merge
+	deleted, merges, err = db.DelStats([]byte("k03"))
+	if err != nil || deleted || merges != 0 {
+		t.Fatalf("DelStats(missing) = %v, %d, %v", deleted, merges, err)
+	}
+
+	for _, k := range []string{"k01", "k02", "k04"} {
+		if _, ok := db.Get([]byte(k)); !ok {
+			t.Fatalf("Get(%s): key lost after merge", k)
+		}
+	}
+}
+
+func TestSetGetDelReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+
+	ref := map[string]string{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%04d", rng.Intn(500))
+		if rng.Intn(3) == 0 {
+			deleted, err := db.Del([]byte(key))
+			if err != nil {
+				t.Fatalf("Del: %v", err)
+			}
+			if _, ok := ref[key]; ok != deleted {
+				t.Fatalf("Del(%s) = %v, want %v", key, deleted, ok)
+			}
+			delete(ref, key)
+		} else {
+			val := strings.Repeat("v", rng.Intn(200))
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			ref[key] = val
+		}
+	}
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		val, ok := db.Get([]byte(key))
+		want, exists := ref[key]
+		if ok != exists || string(val) != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q, %v", key, val, ok, want, exists)
+		}
+	}
+}
+
+func TestBatchSkipsFreshPages(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	flushed := db.page.flushed
+
+	// set then delete a new key within one batch
+	db.tree.Insert([]byte("b"), []byte("2"))
+	db.tree.Delete([]byte("b"))
+
+	// naively the batch appends one page per operation,
+	// but the page created by the insert is reused by the delete
+	if db.page.nappend != 1 {
+		t.Fatalf("nappend = %d, want 1", db.page.nappend)
+	}
+	written := 0
+	for _, page := range db.page.updates {
+		if page != nil {
+			written++
+		}
+	}
+	if written != 1 {
+		t.Fatalf("written = %d, want 1", written)
+	}
+
+	if err := flushPages(db); err != nil {
+		t.Fatalf("flushPages: %v", err)
+	}
+	// the new root plus one free-list node
+	if got := db.page.flushed - flushed; got != 2 {
+		t.Fatalf("flush appended %d pages, want 2", got)
+	}
+	if val, ok := db.Get([]byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("Get(a) = %q, %v", val, ok)
+	}
+	if _, ok := db.Get([]byte("b")); ok {
+		t.Fatal("Get(b): deleted key found")
+	}
+}
+
+func TestCompactOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	db.Options.CompactOnClose = true
+
+	ref := map[string][]byte{}
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		val := bytes.Repeat([]byte{byte(i)}, 200)
+		if err := db.Set(key, val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		ref[string(key)] = val
+	}
+	// an iterator left open doesn't keep Close from compacting
+	it := db.Scan(nil, nil)
+	defer it.Close()
+	// keep every 10th key
+	for i := 0; i < 2000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		key := fmt.Sprintf("key%05d", i)
+		if _, err := db.Del([]byte(key)); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+		delete(ref, key)
+	}
+	held := len(snapshotHeld(db))
+	if held == 0 {
+		t.Fatal("no pages are held for the iterator")
+	}
+	// the held pages count once they are released
+	frag := float64(db.free.Total()+held) / float64(db.page.flushed-1)
+	if frag <= DEFAULT_COMPACT_RATIO {
+		t.Fatalf("fragmentation = %f, expected a fragmented file", frag)
+	}
+
+	before, _ := os.Stat(path)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("file size %d -> %d, expected it to shrink", before.Size(), after.Size())
+	}
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val, ok := db.Get([]byte(key))
+		if want, exists := ref[key]; ok != exists || !bytes.Equal(val, want) {
+			t.Fatalf("Get(%s) = %v, want %v", key, ok, exists)
+		}
+	}
+	// the rebuilt free list is still usable
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("new%05d", i)), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+}
+
+func TestKeysWithPrefix(t *testing.T) {
+	db := newTestDB(t)
+	for _, k := range []string{
+		"config", "config/a", "config/b", "config/c", "config0", "configz", "conf", "user/a",
+	} {
+		if err := db.Set([]byte(k), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	keys, err := db.KeysWithPrefix([]byte("config/"), 0)
+	if err != nil {
+		t.Fatalf("KeysWithPrefix: %v", err)
+	}
+	if want := "config/a config/b config/c"; string(bytes.Join(keys, []byte(" "))) != want {
+		t.Fatalf("KeysWithPrefix = %q, want %q", keys, want)
+	}
+
+	keys, _ = db.KeysWithPrefix([]byte("config"), 2)
+	if want := "config config/a"; string(bytes.Join(keys, []byte(" "))) != want {
+		t.Fatalf("KeysWithPrefix(limit 2) = %q, want %q", keys, want)
+	}
+
+	keys, _ = db.KeysWithPrefix([]byte("missing"), 0)
+	if len(keys) != 0 {
+		t.Fatalf("KeysWithPrefix(missing) = %q", keys)
+	}
+}
+
+func TestUpdateView(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// rolled back on error
+	errFail := errors.New("fail")
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 200; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("x")); err != nil {
+				return err
+			}
+		}
+		tx.Del([]byte("a"))
+		return errFail
+	})
+	if err != errFail {
+		t.Fatalf("Update = %v, want %v", err, errFail)
+	}
+
+	// rolled back on panic
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the panic to be re-raised")
+			}
+		}()
+		db.Update(func(tx *Tx) error {
+			tx.Set([]byte("b"), []byte("2"))
+			panic("boom")
+		})
+	}()
+
+	check := func(key string, want string, exists bool) {
+		t.Helper()
+		db.View(func(tx *Tx) error {
+			val, ok := tx.Get([]byte(key))
+			if ok != exists || string(val) != want {
+				t.Fatalf("Get(%s) = %q, %v, want %q, %v", key, val, ok, want, exists)
+			}
+			return nil
+		})
+	}
+	check("a", "1", true)
+	check("b", "", false)
+	check("k000", "", false)
+
+	// committed on success
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Set([]byte("c"), []byte("3")); err != nil {
+			return err
+		}
+		_, err := tx.Del([]byte("a"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := db.View(func(tx *Tx) error { return tx.Set([]byte("d"), nil) }); err != ErrTxReadOnly {
+		t.Fatalf("Set in View = %v, want %v", err, ErrTxReadOnly)
+	}
+
+	db.Close()
+	db = openTestDB(t, path)
+	defer db.Close()
+	check("a", "", false)
+	check("b", "", false)
+	check("c", "3", true)
+	check("k199", "", false)
+}
+
+func TestTxCoalesce(t *testing.T) {
+	// the stats of the commit after filling the db
+	commit := func(fn func(tx *Tx) error) FlushStats {
+		var stats FlushStats
+		db := &KeyValue{
+			Path:    filepath.Join(t.TempDir(), "test.db"),
+			Options: Options{OnFlush: func(s FlushStats) { stats = s }},
+		}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		for i := 0; i < 500; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), make([]byte, 100)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := db.Update(fn); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if val, ok := db.Get([]byte("k250")); !ok || string(val) != "last" {
+			t.Fatalf("Get = %q, %v", val, ok)
+		}
+		return stats
+	}
+	once := commit(func(tx *Tx) error {
+		return tx.Set([]byte("k250"), []byte("last"))
+	})
+	many := commit(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			if err := tx.Set([]byte("k250"), []byte(fmt.Sprint(i))); err != nil {
+				return err
+			}
+			if val, ok := tx.Get([]byte("k250")); !ok || string(val) != fmt.Sprint(i) {
+				t.Fatalf("Get in the transaction = %q, %v", val, ok)
+			}
+		}
+		if deleted, err := tx.Del([]byte("k250")); !deleted || err != nil {
+			t.Fatalf("Del = %v, %v", deleted, err)
+		}
+		if deleted, _ := tx.Del([]byte("k250")); deleted {
+			t.Fatal("deleted a key twice")
+		}
+		if _, ok := tx.Get([]byte("k250")); ok {
+			t.Fatal("Get found a deleted key")
+		}
+		return tx.Set([]byte("k250"), []byte("last"))
+	})
+	if many.Changes != 1 || many.Pages != once.Pages {
+		t.Fatalf("1000 writes made %d changes and wrote %d pages, one wrote %d",
+			many.Changes, many.Pages, once.Pages)
+	}
+}
+
+func TestTxCommitFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{ChangeLogRetention: 10}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { db.Close() }()
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	flushed, seq := db.page.flushed, db.seq
+
+	// the changelog fails after the pages are written
+	tx := db.Begin(true)
+	for i := 0; i < 200; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("k%03d", i)), make([]byte, 100)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	tx.Del([]byte("a"))
+	db.changes.fp.Close()
+	if err := tx.Commit(); err == nil {
+		t.Fatal("Commit succeeded with a closed changelog")
+	}
+	if db.page.flushed != flushed || db.seq != seq {
+		t.Fatalf("flushed %d -> %d, seq %d -> %d after a failed commit",
+			flushed, db.page.flushed, seq, db.seq)
+	}
+	if _, ok := db.Get([]byte("a")); !ok {
+		t.Fatal("the failed commit deleted a")
+	}
+
+	// the next commit starts from the old state
+	db.changes.fp, _ = os.OpenFile(changelogPath(db), os.O_WRONLY|os.O_APPEND, 0644)
+	if err := db.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if db.seq != seq+1 || db.page.flushed < flushed {
+		t.Fatalf("seq %d, flushed %d after the next commit", db.seq, db.page.flushed)
+	}
+	db.Close()
+	db = openTestDB(t, path)
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	for key, want := range map[string]bool{"a": true, "b": true, "k000": false} {
+		if _, ok := db.Get([]byte(key)); ok != want {
+			t.Fatalf("Get(%s) = %v after reopen", key, ok)
+		}
+	}
+}
+
+func TestPageFromChunks(t *testing.T) {
+	// chunks doubling the mapping like extendMmap does
+	const pageSize = 1024
+	chunks := [][]byte{make([]byte, 3*pageSize)}
+	total := 3
+	for len(chunks) < 10 {
+		chunks = append(chunks, make([]byte, total*pageSize))
+		total *= 2
+	}
+	ptr := uint64(0)
+	for _, chunk := range chunks {
+		for off := 0; off < len(chunk); off += pageSize {
+			binary.LittleEndian.PutUint64(chunk[off:], ptr)
+			ptr++
+		}
+	}
+	for ptr := uint64(0); ptr < uint64(total); ptr++ {
+		node := pageFromChunks(chunks, pageSize, ptr)
+		if got := binary.LittleEndian.Uint64(node.data); got != ptr || len(node.data) != pageSize {
+			t.Fatalf("page %d reads page %d", ptr, got)
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("a page past the mapping didn't panic")
+			}
+		}()
+		pageFromChunks(chunks, pageSize, uint64(total))
+	}()
+
+	// a file mapped in many chunks
+	defer func(size int) { mmapInitSize = size }(mmapInitSize)
+	mmapInitSize = 4 * BTREE_MAX_PAGE_SIZE
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	val := make([]byte, 1000)
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 3000; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("k%04d", i)), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if len(db.mmap.chunks) < 6 {
+		t.Fatalf("the file is mapped in %d chunks", len(db.mmap.chunks))
+	}
+	for i := 0; i < 3000; i++ {
+		if _, ok := db.Get([]byte(fmt.Sprintf("k%04d", i))); !ok {
+			t.Fatalf("k%04d is missing", i)
+		}
+	}
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	db.Close()
+}
+
+func TestRefreshReadOnly(t *testing.T) {
+	// a small first mapping, so the reader has to extend it
+	defer func(size int) { mmapInitSize = size }(mmapInitSize)
+	mmapInitSize = 1 << 20
+	path := filepath.Join(t.TempDir(), "test.db")
+	writer := openTestDB(t, path)
+	defer writer.Close()
+	if err := writer.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	reader := &KeyValue{Path: path, Options: Options{ReadOnly: true}}
+	if err := reader.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer reader.Close()
+	if err := reader.Set([]byte("b"), nil); err != ErrReadOnly {
+		t.Fatalf("Set on a read-only handle = %v, want %v", err, ErrReadOnly)
+	}
+	if err := writer.Refresh(); !errors.Is(err, ErrNotReadOnly) {
+		t.Fatalf("Refresh on a writer = %v, want %v", err, ErrNotReadOnly)
+	}
+
+	// grow the file well past the first mapping
+	val := make([]byte, 3000)
+	for i := 0; i < 500; i++ {
+		if err := writer.Set([]byte(fmt.Sprintf("k%04d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if writer.mmap.file <= mmapInitSize {
+		t.Fatalf("file size %d is within the first mapping", writer.mmap.file)
+	}
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if len(reader.mmap.chunks) < 2 || reader.mmap.total < writer.mmap.file {
+		t.Fatalf("reader maps %d bytes in %d chunks, the file has %d",
+			reader.mmap.total, len(reader.mmap.chunks), writer.mmap.file)
+	}
+	for i := 0; i < 500; i++ {
+		if _, ok := reader.Get([]byte(fmt.Sprintf("k%04d", i))); !ok {
+			t.Fatalf("reader missing k%04d after Refresh", i)
+		}
+	}
+	if val, ok := reader.Get([]byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("Get(a) = %q, %v", val, ok)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	db1, db2 := newTestDB(t), newTestDB(t)
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		if err := db1.Set(key, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	// a different insertion order and some churn in the second db
+	for i := 299; i >= 0; i-- {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		if err := db2.Set(key, []byte("tmp")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := db2.Set(key, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db2.Set([]byte("extra"), nil)
+	db2.Del([]byte("extra"))
+
+	fp1, err := db1.Fingerprint()
+	if err != nil {
+		t.Fatalf("Fingerprint: %v", err)
+	}
+	fp2, _ := db2.Fingerprint()
+	if fp1 != fp2 {
+		t.Fatal("fingerprints differ for identical contents")
+	}
+
+	db2.Set([]byte("k150"), []byte("changed"))
+	if fp2, _ = db2.Fingerprint(); fp1 == fp2 {
+		t.Fatal("fingerprint unchanged after a value changed")
+	}
+}
+
+func TestEmptyKeyReserved(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if err := db.Set([]byte{}, []byte("default")); err != ErrEmptyKey {
+		t.Fatalf("Set(empty) = %v, want %v", err, ErrEmptyKey)
+	}
+	if _, err := db.Del(nil); err != ErrEmptyKey {
+		t.Fatalf("Del(empty) = %v, want %v", err, ErrEmptyKey)
+	}
+	if _, ok := db.Get([]byte{}); ok {
+		t.Fatal("Get(empty) found the dummy key")
+	}
+	err := db.Update(func(tx *Tx) error { return tx.Set(nil, nil) })
+	if err != ErrEmptyKey {
+		t.Fatalf("tx.Set(empty) = %v, want %v", err, ErrEmptyKey)
+	}
+
+	if val, ok := db.Get([]byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("Get(a) = %q, %v", val, ok)
+	}
+	keys, _ := db.KeysWithPrefix(nil, 0)
+	if len(keys) != 1 || string(keys[0]) != "a" {
+		t.Fatalf("keys = %q, want [a]", keys)
+	}
+}
+
+func TestValueCache(t *testing.T) {
+	db := &KeyValue{
+		Path:    filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{ValueCacheSize: 2},
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Set([]byte(k), []byte(k+"1")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	db.Get([]byte("a"))
+	if val, ok := db.Get([]byte("a")); !ok || string(val) != "a1" || db.vcache.hits != 1 {
+		t.Fatalf("Get(a) = %q, %v, hits = %d, want a cache hit", val, ok, db.vcache.hits)
+	}
+
+	// a write invalidates the cached value
+	if err := db.Set([]byte("a"), []byte("a2")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if val, ok := db.Get([]byte("a")); !ok || string(val) != "a2" {
+		t.Fatalf("Get(a) after Set = %q, %v, want a2", val, ok)
+	}
+	db.Del([]byte("a"))
+	if _, ok := db.Get([]byte("a")); ok {
+		t.Fatal("Get(a) after Del served a stale value")
+	}
+	db.Update(func(tx *Tx) error { return tx.Set([]byte("a"), []byte("a3")) })
+	if val, _ := db.Get([]byte("a")); string(val) != "a3" {
+		t.Fatalf("Get(a) after a transaction = %q, want a3", val)
+	}
+
+	// the least recently used value is evicted
+	db.Get([]byte("b"))
+	db.Get([]byte("c"))
+	if _, ok := db.vcache.items["a"]; ok {
+		t.Fatal("expected a to be evicted")
+	}
+}
+
+func TestRename(t *testing.T) {
+	db := newTestDB(t)
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+
+	renamed, err := db.Rename([]byte("a"), []byte("c"), false)
+	if err != nil || !renamed {
+		t.Fatalf("Rename(a, c) = %v, %v", renamed, err)
+	}
+	if _, ok := db.Get([]byte("a")); ok {
+		t.Fatal("a still exists after the rename")
+	}
+	if val, ok := db.Get([]byte("c")); !ok || string(val) != "1" {
+		t.Fatalf("Get(c) = %q, %v, want 1", val, ok)
+	}
+
+	// missing source
+	renamed, err = db.Rename([]byte("a"), []byte("d"), false)
+	if err != nil || renamed {
+		t.Fatalf("Rename(missing) = %v, %v", renamed, err)
+	}
+	if _, ok := db.Get([]byte("d")); ok {
+		t.Fatal("rename of a missing key created the destination")
+	}
+
+	// existing destination
+	renamed, err = db.Rename([]byte("b"), []byte("c"), false)
+	if err != ErrKeyExists || renamed {
+		t.Fatalf("Rename(b, c) = %v, %v, want %v", renamed, err, ErrKeyExists)
+	}
+	if val, _ := db.Get([]byte("b")); string(val) != "2" {
+		t.Fatal("a failed rename changed the source")
+	}
+	if val, _ := db.Get([]byte("c")); string(val) != "1" {
+		t.Fatal("a failed rename changed the destination")
+	}
+
+	renamed, err = db.Rename([]byte("b"), []byte("c"), true)
+	if err != nil || !renamed {
+		t.Fatalf("Rename(b, c, overwrite) = %v, %v", renamed, err)
+	}
+	if val, _ := db.Get([]byte("c")); string(val) != "2" {
+		t.Fatalf("Get(c) = %q, want 2", val)
+	}
+	if _, ok := db.Get([]byte("b")); ok {
+		t.Fatal("b still exists after the rename")
+	}
+}
+
+func TestPageSizeLimits(t *testing.T) {
+	for _, pageSize := range []int{1024, 4096, 16384, BTREE_MAX_PAGE_SIZE} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KeyValue{Path: path, Options: Options{PageSize: pageSize}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open(%d): %v", pageSize, err)
+		}
+
+		key := bytes.Repeat([]byte("k"), maxKeySize(pageSize))
+		val := bytes.Repeat([]byte("v"), maxValSize(pageSize))
+		if err := db.Set(key, val); err != nil {
+			t.Fatalf("page %d: Set(max key, max val) = %v", pageSize, err)
+		}
+		if err := db.Set([]byte("k"), append(val, 'v')); err != ErrValueTooLarge {
+			t.Fatalf("page %d: Set(val+1) = %v, want %v", pageSize, err, ErrValueTooLarge)
+		}
+		if err := db.Set(append(key, 'k'), nil); err != ErrKeyTooLarge {
+			t.Fatalf("page %d: Set(key+1) = %v, want %v", pageSize, err, ErrKeyTooLarge)
+		}
+		// fill a few levels
+		for i := 0; i < 50; i++ {
+			k := append([]byte(fmt.Sprintf("%03d", i)), key[3:]...)
+			if err := db.Set(k, val); err != nil {
+				t.Fatalf("page %d: Set: %v", pageSize, err)
+			}
+		}
+		db.Close()
+
+		// reopened with the page size stored in the file
+		db = openTestDB(t, path)
+		if db.page.size != pageSize {
+			t.Fatalf("reopened page size = %d, want %d", db.page.size, pageSize)
+		}
+		if got, ok := db.Get(key); !ok || !bytes.Equal(got, val) {
+			t.Fatalf("page %d: Get(max key) after reopen failed", pageSize)
+		}
+		db.Close()
+
+		// reopened with another page size, nothing is read as a node
+		otherSize := 2 * pageSize
+		if otherSize > BTREE_MAX_PAGE_SIZE {
+			otherSize = pageSize / 2
+		}
+		other := &KeyValue{Path: path, Options: Options{PageSize: otherSize}}
+		if err := other.Open(); !errors.Is(err, ErrPageSizeMismatch) ||
+			!strings.Contains(err.Error(), fmt.Sprintf("file %d, configured %d", pageSize, otherSize)) {
+			t.Fatalf("page %d: Open with another page size = %v", pageSize, err)
+		}
+	}
+
+	db := &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{PageSize: 3000}}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatal("Open with a page size that is not a power of two succeeded")
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{ChangeLogRetention: 4}
+	db := &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	seq := db.Seq()
+
+	if err := db.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	err := db.Update(func(tx *Tx) error {
+		if _, err := tx.Del([]byte("a")); err != nil {
+			return err
+		}
+		return tx.Set([]byte("c"), []byte("3"))
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	// a rolled back transaction leaves no changes
+	db.Update(func(tx *Tx) error {
+		tx.Set([]byte("d"), []byte("4"))
+		return errors.New("abort")
+	})
+
+	want := []Change{
+		{Seq: seq + 1, Key: []byte("b"), Val: []byte("2")},
+		{Seq: seq + 2, Key: []byte("a"), Deleted: true},
+		{Seq: seq + 2, Key: []byte("c"), Val: []byte("3")},
+	}
+	check := func(db *KeyValue) {
+		t.Helper()
+		changes, cur, err := db.ChangesSince(seq)
+		if err != nil {
+			t.Fatalf("ChangesSince: %v", err)
+		}
+		if cur != seq+2 {
+			t.Fatalf("current seq = %d, want %d", cur, seq+2)
+		}
+		if len(changes) != len(want) {
+			t.Fatalf("got %d changes, want %d", len(changes), len(want))
+		}
+		for i, c := range changes {
+			w := want[i]
+			if c.Seq != w.Seq || c.Deleted != w.Deleted ||
+				!bytes.Equal(c.Key, w.Key) || !bytes.Equal(c.Val, w.Val) {
+				t.Fatalf("change %d = %+v, want %+v", i, c, w)
+			}
+		}
+		if changes, _, err := db.ChangesSince(cur); err != nil || len(changes) != 0 {
+			t.Fatalf("ChangesSince(current) = %v, %v", changes, err)
+		}
+	}
+	check(db)
+	db.Close()
+
+	// the history survives a reopen
+	db = &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	check(db)
+
+	// push seq out of the retained history
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte("e"), []byte{byte(i)}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if _, _, err := db.ChangesSince(seq); !errors.Is(err, ErrHistoryTruncated) {
+		t.Fatalf("ChangesSince(old) = %v, want %v", err, ErrHistoryTruncated)
+	}
+	changes, cur, err := db.ChangesSince(db.Seq() - 4)
+	if err != nil || len(changes) != 4 || cur != db.Seq() {
+		t.Fatalf("ChangesSince(last 4) = %d changes, %v", len(changes), err)
+	}
+}
+
+// collects the formatted log lines
+// a commit that fails to land doesn't leave a gap in the sequence
+func TestChangesSinceFailedCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{ChangeLogRetention: 4}
+	db := &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { db.Close() }()
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	seq := db.Seq()
+
+	// writes to a read-only handle fail
+	db.changes.fp.Close()
+	db.changes.fp, _ = os.Open(changelogPath(db))
+	if err := db.Set([]byte("b"), []byte("2")); err == nil {
+		t.Fatal("Set succeeded with a closed changelog")
+	}
+	if db.Seq() != seq {
+		t.Fatalf("Seq = %d after a failed commit, want %d", db.Seq(), seq)
+	}
+
+	// the sidecar was rewritten and reopened, the next commit
+	// carries the change that didn't land
+	if err := db.Set([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	want := []Change{
+		{Seq: seq, Key: []byte("a"), Val: []byte("1")},
+		{Seq: seq + 1, Key: []byte("b"), Val: []byte("2")},
+		{Seq: seq + 1, Key: []byte("c"), Val: []byte("3")},
+	}
+	check := func(db *KeyValue) {
+		t.Helper()
+		changes, cur, err := db.ChangesSince(seq - 1)
+		if err != nil || cur != seq+1 || len(changes) != len(want) {
+			t.Fatalf("ChangesSince = %d changes, %d, %v", len(changes), cur, err)
+		}
+		for i, c := range changes {
+			w := want[i]
+			if c.Seq != w.Seq || string(c.Key) != string(w.Key) || string(c.Val) != string(w.Val) {
+				t.Fatalf("change %d = %+v, want %+v", i, c, w)
+			}
+		}
+	}
+	check(db)
+	db.Close()
+	db = &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	check(db)
+}
+
+type captureLogger struct {
+	lines []string
+}
+
+func (l *captureLogger) Debugf(format string, args ...any) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Warnf(format string, args ...any) {
+	l.lines = append(l.lines, "WARN "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) has(prefix string) bool {
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	log := &captureLogger{}
+	db := &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{Logger: log}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for _, event := range []string{"btree: root split", "extend file", "free list: head"} {
+		if !log.has(event) {
+			t.Errorf("no %q event in %q", event, log.lines)
+		}
+	}
+	if log.has("WARN") {
+		t.Errorf("unexpected warning in %q", log.lines)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck on an empty db: %v", err)
+	}
+	val := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := db.Del([]byte(fmt.Sprintf("k%02d", i))); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+	}
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+
+	// point the master page past the end of the file
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer fp.Close()
+	var used [8]byte
+	used[7] = 0xff
+	if _, err := fp.WriteAt(used[:], 24); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if err := db.HealthCheck(); err == nil {
+		t.Fatal("HealthCheck passed with a corrupted master page")
+	}
+}
+
+func TestLockMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	locked := 0
+	mlock = func(b []byte) error {
+		locked += len(b)
+		return nil
+	}
+	defer func() { mlock = syscall.Mlock }()
+
+	db := &KeyValue{Path: path, Options: Options{LockMemory: true}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	val := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	// every extension of the file is locked exactly once
+	if locked != db.mmap.file {
+		t.Fatalf("locked %d bytes, file is %d bytes", locked, db.mmap.file)
+	}
+	db.Close()
+
+	// a failure is returned unless running in the best effort mode
+	mlock = func(b []byte) error { return syscall.ENOMEM }
+	db = &KeyValue{Path: path, Options: Options{LockMemory: true}}
+	if err := db.Open(); !errors.Is(err, syscall.ENOMEM) {
+		db.Close()
+		t.Fatalf("Open with a failing mlock = %v, want %v", err, syscall.ENOMEM)
+	}
+	log := &captureLogger{}
+	db = &KeyValue{Path: path, Options: Options{
+		LockMemory: true, LockMemoryBestEffort: true, Logger: log,
+	}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open in the best effort mode: %v", err)
+	}
+	db.Close()
+	if !log.has("WARN mlock") {
+		t.Fatalf("no mlock warning in %q", log.lines)
+	}
+
+	// the real thing, if the limits allow it
+	mlock = syscall.Mlock
+	db = &KeyValue{Path: path, Options: Options{LockMemory: true}}
+	if err := db.Open(); err != nil {
+		t.Skipf("mlock is unavailable: %v", err)
+	}
+	db.Close()
+}
+
+func TestOpenTree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+
+	data, err := db.OpenTree(1)
+	if err != nil {
+		t.Fatalf("OpenTree: %v", err)
+	}
+	index, err := db.OpenTree(3)
+	if err != nil {
+		t.Fatalf("OpenTree: %v", err)
+	}
+	if _, err := db.OpenTree(MAX_TREES); err == nil {
+		t.Fatal("OpenTree(MAX_TREES) succeeded")
+	}
+
+	val := make([]byte, 500)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		if err := data.Set(key, val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if i%2 == 0 {
+			if err := index.Set(key, []byte("idx")); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+	if _, err := data.Del([]byte("k000")); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if err := db.Set([]byte("main"), []byte("m")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	data, _ = db.OpenTree(1)
+	index, _ = db.OpenTree(3)
+	unused, _ := db.OpenTree(2)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		if _, ok := data.Get(key); ok != (i != 0) {
+			t.Fatalf("data tree: Get(%s) = %v", key, ok)
+		}
+		if _, ok := index.Get(key); ok != (i%2 == 0) {
+			t.Fatalf("index tree: Get(%s) = %v", key, ok)
+		}
+		if _, ok := unused.Get(key); ok {
+			t.Fatalf("unused tree has %s", key)
+		}
+		if _, ok := db.Get(key); ok {
+			t.Fatalf("main tree has %s", key)
+		}
+	}
+	count := 0
+	for it := index.Scan(nil, nil); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 50 {
+		t.Fatalf("index tree has %d keys, want 50", count)
+	}
+	if val, ok := db.Get([]byte("main")); !ok || string(val) != "m" {
+		t.Fatal("main tree lost its key")
+	}
+
+	// shrinking relocates the pages of every tree
+	for i := 0; i < 100; i++ {
+		index.Del([]byte(fmt.Sprintf("k%03d", i)))
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatalf("Shrink: %v", err)
+	}
+	if _, ok := data.Get([]byte("k099")); !ok {
+		t.Fatal("data tree lost a key after Shrink")
+	}
+}
+
+func TestSignature(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{Signature: "AppIndexV1"}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	db.Close()
+
+	for _, sig := range []string{"", "AppDataV1"} {
+		db = &KeyValue{Path: path, Options: Options{Signature: sig}}
+		if err := db.Open(); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("Open with signature %q = %v, want %v", sig, err, ErrBadSignature)
+		}
+	}
+	db = &KeyValue{Path: path, Options: Options{Signature: "AppIndexV1"}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open with the right signature: %v", err)
+	}
+	db.Close()
+
+	db = &KeyValue{Path: path, Options: Options{Signature: strings.Repeat("x", 17)}}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatal("Open with a 17 byte signature succeeded")
+	}
+}
+
+func TestTruncateValue(t *testing.T) {
+	db := newTestDB(t)
+	val := []byte("0123456789")
+	if err := db.Set([]byte("k"), val); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	for _, n := range []int{10, 4, 0} {
+		ok, err := db.TruncateValue([]byte("k"), n)
+		if !ok || err != nil {
+			t.Fatalf("TruncateValue(%d) = %v, %v", n, ok, err)
+		}
+		got, _ := db.Get([]byte("k"))
+		if !bytes.Equal(got, val[:n]) {
+			t.Fatalf("after TruncateValue(%d) Get = %q, want %q", n, got, val[:n])
+		}
+	}
+	if _, err := db.TruncateValue([]byte("k"), 1); err == nil {
+		t.Fatal("TruncateValue past the end succeeded")
+	}
+	if ok, err := db.TruncateValue([]byte("missing"), 0); ok || err != nil {
+		t.Fatalf("TruncateValue(missing) = %v, %v", ok, err)
+	}
+
+	// a large value in a tree of several levels
+	big := bytes.Repeat([]byte("x"), 3000)
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("big%02d", i)), big); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if ok, err := db.TruncateValue([]byte("big07"), 100); !ok || err != nil {
+		t.Fatalf("TruncateValue(big) = %v, %v", ok, err)
+	}
+	if got, _ := db.Get([]byte("big07")); !bytes.Equal(got, big[:100]) {
+		t.Fatalf("big value is %d bytes after truncating, want 100", len(got))
+	}
+}
+
+// readers racing with Close either finish first or see a closed handle
+func TestCloseConcurrentReads(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				db.Get([]byte(fmt.Sprintf("k%03d", i%100)))
+				db.GetMulti([][]byte{[]byte("k000"), []byte("k099")})
+				db.Scan(nil, nil).Close()
+				if _, err := db.KeysWithPrefix([]byte("k"), 1); errors.Is(err, ErrClosed) {
+					return
+				}
+			}
+		}()
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	wg.Wait()
+}
+
+func TestNotOpen(t *testing.T) {
+	db := &KeyValue{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Set([]byte("k"), []byte("v")); !errors.Is(err, ErrNotOpen) {
+		t.Fatalf("Set before Open = %v, want %v", err, ErrNotOpen)
+	}
+	if _, ok := db.Get([]byte("k")); ok {
+		t.Fatal("Get before Open found a key")
+	}
+	if err := db.Close(); !errors.Is(err, ErrNotOpen) {
+		t.Fatalf("Close before Open = %v, want %v", err, ErrNotOpen)
+	}
+
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := db.Set([]byte("k"), []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Set after Close = %v, want %v", err, ErrClosed)
+	}
+	if _, err := db.Del([]byte("k")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Del after Close = %v, want %v", err, ErrClosed)
+	}
+	if _, ok := db.Get([]byte("k")); ok {
+		t.Fatal("Get after Close found a key")
+	}
+	if db.Scan(nil, nil).Valid() {
+		t.Fatal("Scan after Close returned a key")
+	}
+	err := db.Update(func(tx *Tx) error { return tx.Set([]byte("k"), []byte("v")) })
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("Update after Close = %v, want %v", err, ErrClosed)
+	}
+	if err := db.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("second Close = %v, want %v", err, ErrClosed)
+	}
+
+	// an Open that fails halfway leaves the handle unusable
+	if err := os.WriteFile(db.Path, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db = &KeyValue{Path: db.Path}
+	if err := db.Open(); err == nil {
+		t.Fatal("Open of a zeroed file succeeded")
+	}
+	if err := db.Set([]byte("k"), []byte("v")); !errors.Is(err, ErrNotOpen) {
+		t.Fatalf("Set after a failed Open = %v, want %v", err, ErrNotOpen)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	val := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db.Close()
+
+	onOpen := openTestDB(t, path)
+	defer onOpen.Close()
+	always := &KeyValue{Path: path, Options: Options{VerifyChecksums: VERIFY_ALWAYS}}
+	if err := always.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer always.Close()
+
+	// flip a byte of the value in the leaf holding k050
+	key := []byte("k050")
+	node := onOpen.pageGet(onOpen.tree.root)
+	for node.btype() == BNODE_NODE {
+		node = onOpen.pageGet(node.getPtr(nodeLookupLE(node, key)))
+	}
+	got := node.getVal(nodeLookupLE(node, key))
+	offset := uintptr(unsafe.Pointer(&got[0])) - uintptr(unsafe.Pointer(&onOpen.mmap.chunks[0][0]))
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := fp.WriteAt([]byte("X"), int64(offset)); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	fp.Close()
+
+	// the handle opened before the corruption only checks in Open
+	if got, ok := onOpen.Get(key); !ok || bytes.Equal(got, val) {
+		t.Fatalf("Get = %q, %v, expected the corrupted value", got, ok)
+	}
+	// with VERIFY_ALWAYS every read path fails instead
+	if got, ok := always.Get(key); ok || got != nil {
+		t.Fatalf("Get with VERIFY_ALWAYS = %q, %v, want nothing", got, ok)
+	}
+	if err := always.Err(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Err = %v, want %v", err, ErrChecksum)
+	}
+	n := 0
+	it := always.Scan(nil, nil)
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	if err := it.Err(); !errors.Is(err, ErrChecksum) || n >= 100 {
+		t.Fatalf("Scan read %d keys, Err = %v, want %v", n, err, ErrChecksum)
+	}
+	if snapshotCount(always) != 0 {
+		t.Fatal("the failed iterator is still pinned")
+	}
+	if _, err := always.KeysWithPrefix([]byte("k"), 0); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("KeysWithPrefix = %v, want %v", err, ErrChecksum)
+	}
+	if err := always.Set(key, val); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Set = %v, want %v", err, ErrChecksum)
+	}
+	err = always.Update(func(tx *Tx) error {
+		tx.Set([]byte("k000"), nil)
+		tx.Set(key, nil)
+		return nil
+	})
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Update = %v, want %v", err, ErrChecksum)
+	}
+	// the failed writes left nothing behind
+	if len(always.page.updates) != 0 {
+		t.Fatalf("%d pending updates after the failed writes", len(always.page.updates))
+	}
+	if got, ok := always.Get([]byte("k000")); !ok || !bytes.Equal(got, val) {
+		t.Fatalf("Get(k000) = %q, %v after the failed writes", got, ok)
+	}
+
+	// and a new handle refuses the file
+	db = &KeyValue{Path: path}
+	if err := db.Open(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Open of a corrupted file = %v, want %v", err, ErrChecksum)
+	}
+	db = &KeyValue{Path: path, Options: Options{VerifyChecksums: VERIFY_OFF}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open with VERIFY_OFF: %v", err)
+	}
+	db.Close()
+}
+
+// files written before checksums keep full-size nodes and aren't verified
+func TestNoChecksumFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	setPageSize(db, BTREE_PAGE_SIZE, CSUM_NONE)
+	val := make([]byte, BTREE_MAX_VAL_SIZE)
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db.Close()
+
+	db = &KeyValue{Path: path, Options: Options{VerifyChecksums: VERIFY_ALWAYS}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if db.page.csum != CSUM_NONE || db.tree.nsize() != BTREE_PAGE_SIZE {
+		t.Fatalf("checksum %d, node size %d", db.page.csum, db.tree.nsize())
+	}
+	for i := 0; i < 20; i++ {
+		if _, ok := db.Get([]byte(fmt.Sprintf("k%02d", i))); !ok {
+			t.Fatalf("k%02d is missing", i)
+		}
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	db := newTestDB(t)
+	val := make([]byte, 200)
+	for i := 0; i < 200; i++ {
+		for _, prefix := range []string{"user:", "users", "item:"} {
+			if err := db.Set([]byte(fmt.Sprintf("%s%03d", prefix, i)), val); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+	seq := db.Seq()
+	n, err := db.DeletePrefix([]byte("user:"))
+	if err != nil || n != 200 {
+		t.Fatalf("DeletePrefix = %d, %v, want 200", n, err)
+	}
+	if db.Seq() != seq+1 {
+		t.Fatalf("DeletePrefix took %d commits, want 1", db.Seq()-seq)
+	}
+	if keys, _ := db.KeysWithPrefix([]byte("user:"), 0); len(keys) != 0 {
+		t.Fatalf("%d keys left under the prefix", len(keys))
+	}
+	for _, prefix := range []string{"users", "item:"} {
+		if keys, _ := db.KeysWithPrefix([]byte(prefix), 0); len(keys) != 200 {
+			t.Fatalf("%d keys left under %q, want 200", len(keys), prefix)
+		}
+	}
+	if n, err := db.DeletePrefix([]byte("user:")); n != 0 || err != nil {
+		t.Fatalf("second DeletePrefix = %d, %v", n, err)
+	}
+
+	n, err = db.DeleteRange([]byte("item:100"), []byte("item:150"))
+	if err != nil || n != 50 {
+		t.Fatalf("DeleteRange = %d, %v, want 50", n, err)
+	}
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+}
+
+func TestReclaimOrphans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+	// a single leaf, the free list is empty
+	val := make([]byte, 1000)
+	if err := db.Set([]byte("k00"), val); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if n, err := db.ReclaimOrphans(); n != 0 || err != nil {
+		t.Fatalf("ReclaimOrphans on a clean db = %d, %v", n, err)
+	}
+
+	// a commit that wrote its pages and crashed before switching the
+	// root, the master only counts the appended pages as used
+	root, head := db.tree.root, db.free.head
+	for i := 1; i < 40; i++ {
+		db.tree.Insert([]byte(fmt.Sprintf("k%02d", i)), val)
+	}
+	if db.page.nfree != 0 {
+		t.Fatal("the commit reused free pages")
+	}
+	if err := writePages(db); err != nil {
+		t.Fatalf("writePages: %v", err)
+	}
+	written := db.page.nappend
+	db.page.flushed += uint64(written)
+	db.page.nappend = 0
+	db.page.updates = make(map[uint64][]byte)
+	db.page.fresh = make(map[uint64]bool)
+	db.page.recycled = nil
+	db.tree.root, db.free.head = root, head
+	if err := masterStore(db); err != nil {
+		t.Fatalf("masterStore: %v", err)
+	}
+
+	free := db.free.Total()
+	n, err := db.ReclaimOrphans()
+	if err != nil || n != written {
+		t.Fatalf("ReclaimOrphans = %d, %v, want %d", n, err, written)
+	}
+	if db.free.Total() != free+written {
+		t.Fatalf("free list has %d pages, want %d", db.free.Total(), free+written)
+	}
+	if _, ok := db.Get([]byte("k25")); ok {
+		t.Fatal("the crashed commit is visible")
+	}
+	if n, err := db.ReclaimOrphans(); n != 0 || err != nil {
+		t.Fatalf("second ReclaimOrphans = %d, %v", n, err)
+	}
+	if err := db.Set([]byte("k50"), val); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+}
+
+func TestFreePages(t *testing.T) {
+	db := newTestDB(t)
+	if ptrs, err := db.FreePages(); len(ptrs) != 0 || err != nil {
+		t.Fatalf("FreePages on an empty db = %v, %v", ptrs, err)
+	}
+	val := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		if _, err := db.Del([]byte(fmt.Sprintf("k%02d", i))); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+	}
+
+	// the pages neither in the tree nor holding the list
+	used := make([]bool, db.page.flushed)
+	markTree(db, db.tree.root, used)
+	nodes, _ := flWalk(&db.free)
+	for _, ptr := range nodes {
+		used[ptr] = true
+	}
+	want := []uint64{}
+	for ptr := db.page.masters; ptr < len(used); ptr++ {
+		if !used[ptr] {
+			want = append(want, uint64(ptr))
+		}
+	}
+	ptrs, err := db.FreePages()
+	if err != nil || !slices.Equal(ptrs, want) {
+		t.Fatalf("FreePages = %v, %v, want %v", ptrs, err, want)
+	}
+	if len(ptrs) != db.free.Total() || len(ptrs) == 0 {
+		t.Fatalf("%d free pages, the list has %d", len(ptrs), db.free.Total())
+	}
+	db.Close()
+	if _, err := db.FreePages(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("FreePages after Close = %v", err)
+	}
+}
+
+func TestRebuildFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	val := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		if _, err := db.Del([]byte(fmt.Sprintf("k%02d", i))); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+	}
+	// a head that points at itself
+	head := pageGetMapped(db, db.free.head)
+	flnSetHeader(head, uint16(flnSize(head)), db.free.head)
+	pageSeal(db, head.data)
+	db.Close()
+
+	db = &KeyValue{Path: path}
+	if err := db.Open(); !errors.Is(err, ErrFreeListCorrupt) {
+		t.Fatalf("Open = %v, want %v", err, ErrFreeListCorrupt)
+	}
+	db = &KeyValue{Path: path, Options: Options{VerifyChecksums: VERIFY_OFF}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.RebuildFreeList(); err != nil {
+		t.Fatalf("RebuildFreeList: %v", err)
+	}
+
+	// every page is either used or free, once
+	check := func() {
+		t.Helper()
+		used := make([]bool, db.page.flushed)
+		markTree(db, db.tree.root, used)
+		nodes, items := flWalk(&db.free)
+		for _, ptr := range append(nodes, items...) {
+			if used[ptr] {
+				t.Fatalf("page %d is used twice", ptr)
+			}
+			used[ptr] = true
+		}
+		for ptr := db.page.masters; ptr < len(used); ptr++ {
+			if !used[ptr] {
+				t.Fatalf("page %d is lost", ptr)
+			}
+		}
+	}
+	check()
+	if db.free.Total() == 0 {
+		t.Fatal("the rebuilt free list is empty")
+	}
+	size := db.page.flushed
+	for i := 0; i < 40; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("n%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	check()
+	if db.page.flushed > size+10 {
+		t.Fatalf("the file grew from %d to %d pages", size, db.page.flushed)
+	}
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	for i := 40; i < 50; i++ {
+		if _, ok := db.Get([]byte(fmt.Sprintf("k%02d", i))); !ok {
+			t.Fatalf("k%02d is missing", i)
+		}
+	}
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+}
+
+func TestExtendFailure(t *testing.T) {
+	defer func(f func(int, uint32, int64, int64) error) { fallocate = f }(fallocate)
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	defer func() { db.Close() }()
+	val := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	root, head, flushed, seq := db.tree.root, db.free.head, db.page.flushed, db.seq
+
+	// the disk is full when the file has to grow
+	fallocate = func(fd int, mode uint32, off int64, size int64) error {
+		return syscall.ENOSPC
+	}
+	err := error(nil)
+	for i := 20; i < 1000 && err == nil; i++ {
+		err = db.Set([]byte(fmt.Sprintf("k%03d", i)), val)
+		if err == nil {
+			root, head, flushed, seq = db.tree.root, db.free.head, db.page.flushed, db.seq
+		}
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Set = %v, want %v", err, syscall.ENOSPC)
+	}
+	if db.tree.root != root || db.free.head != head || db.page.flushed != flushed ||
+		db.seq != seq || len(db.page.updates) != 0 {
+		t.Fatal("the failed Set left its updates behind")
+	}
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	n := 0
+	for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+		n++
+	}
+
+	// the writes go on once there is space
+	fallocate = syscall.Fallocate
+	if err := db.Set([]byte("after"), val); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	db.Close()
+	db = openTestDB(t, path)
+	m := 0
+	for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+		m++
+	}
+	if m != n+1 {
+		t.Fatalf("%d keys after reopening, want %d", m, n+1)
+	}
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+}
+
+func TestGrowthPolicy(t *testing.T) {
+	// grow a file to at least 800 pages, then by one more page
+	grow := func(opts Options) (before int, after int) {
+		t.Helper()
+		db := &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: opts}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		if err := extendFile(db, 800); err != nil {
+			t.Fatalf("extendFile: %v", err)
+		}
+		before = db.mmap.file / db.page.size
+		if before < 800 {
+			t.Fatalf("file has %d pages, want at least 800", before)
+		}
+		if err := extendFile(db, before+1); err != nil {
+			t.Fatalf("extendFile: %v", err)
+		}
+		return before, db.mmap.file / db.page.size
+	}
+
+	if before, after := grow(Options{}); after-before != before/8 {
+		t.Fatalf("default growth from %d pages = %d, want %d", before, after-before, before/8)
+	}
+	if before, after := grow(Options{MaxGrowthPages: 4}); after-before != 4 {
+		t.Fatalf("growth capped at 4 pages = %d", after-before)
+	}
+	if before, after := grow(Options{GrowthFactor: 1}); after != 2*before {
+		t.Fatalf("growth with factor 1 from %d pages to %d", before, after)
+	}
+	if before, after := grow(Options{MinGrowthPages: 1000}); after-before != 1000 {
+		t.Fatalf("growth of at least 1000 pages = %d", after-before)
+	}
+
+	// many bounded steps still reach the target
+	db := &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{MaxGrowthPages: 4}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if err := extendFile(db, 1001); err != nil {
+		t.Fatalf("extendFile: %v", err)
+	}
+	if pages := db.mmap.file / db.page.size; pages < 1001 || pages >= 1001+4 {
+		t.Fatalf("file has %d pages, want [1001, 1005)", pages)
+	}
+}
+
+func TestGetMultiConsistent(t *testing.T) {
+	db := newTestDB(t)
+	keys := [][]byte{}
+	for i := 0; i < 50; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("k%02d", i)))
+	}
+	flip := func(val []byte) error {
+		return db.Update(func(tx *Tx) error {
+			for _, key := range keys {
+				if err := tx.Set(key, val); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := flip([]byte("old")); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i++ {
+			val := []byte("new")
+			if i%2 == 1 {
+				val = []byte("old")
+			}
+			if err := flip(val); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			running = false
+		default:
+		}
+		vals := db.GetMulti(keys)
+		for i, val := range vals {
+			if !bytes.Equal(val, vals[0]) {
+				t.Fatalf("mixed batch: %s=%q but %s=%q", keys[0], vals[0], keys[i], val)
+			}
+		}
+	}
+	if vals := db.GetMulti([][]byte{[]byte("missing"), keys[0]}); vals[0] != nil || vals[1] == nil {
+		t.Fatalf("GetMulti with a missing key = %q", vals)
+	}
+}
+
+func TestScanSnapshot(t *testing.T) {
+	db := newTestDB(t)
+	val := make([]byte, 100)
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	it := db.Scan(nil, nil)
+	// rewrite everything while the iterator is open
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		if i%2 == 0 {
+			if _, err := db.Del(key); err != nil {
+				t.Fatalf("Del: %v", err)
+			}
+		} else if err := db.Set(key, bytes.Repeat([]byte("x"), 300)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := db.Set([]byte(fmt.Sprintf("n%04d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	held := len(snapshotHeld(db))
+	if held == 0 {
+		t.Fatal("no pages are held for the iterator")
+	}
+
+	count := 0
+	for ; it.Valid(); it.Next() {
+		key, got := it.Deref()
+		if want := fmt.Sprintf("k%04d", count); string(key) != want || !bytes.Equal(got, val) {
+			t.Fatalf("snapshot key %d = %s (%d bytes), want %s", count, key, len(got), want)
+		}
+		count++
+	}
+	if count != 1000 {
+		t.Fatalf("snapshot has %d keys, want 1000", count)
+	}
+	if snapshotCount(db) != 0 {
+		t.Fatal("the drained iterator is still pinned")
+	}
+
+	// the next commit puts the held pages on the free list
+	free := db.free.Total()
+	if err := db.Set([]byte("z"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if len(snapshotHeld(db)) != 0 || db.free.Total() < free+held-10 {
+		t.Fatalf("held pages were not released: %d held, %d -> %d free",
+			len(snapshotHeld(db)), free, db.free.Total())
+	}
+
+	// an iterator closed early
+	it = db.Scan([]byte("n"), nil)
+	if !it.Valid() {
+		t.Fatal("empty scan")
+	}
+	if err := db.Shrink(); err == nil {
+		t.Fatal("Shrink with an open iterator succeeded")
+	}
+	it.Close()
+	if snapshotCount(db) != 0 {
+		t.Fatal("the closed iterator is still pinned")
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatalf("Shrink: %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.db"), filepath.Join(dir, "dst.db")
+	db := openTestDB(t, src)
+	val := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, i%2000) }
+	for i := 0; i < 3000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), val(i)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	tree, _ := db.OpenTree(3)
+	if err := tree.Set([]byte("other"), []byte("tree")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	db.Close()
+
+	// the values don't fit 2 KiB pages
+	if err := Migrate(src, dst, 2048); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Migrate to 2048 = %v", err)
+	}
+	if _, err := os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a failed Migrate created the destination")
+	}
+	if err := Migrate(src, dst, 5000); err == nil {
+		t.Fatal("Migrate to 5000 succeeded")
+	}
+
+	if err := Migrate(src, dst, 16384); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if err := Migrate(src, dst, 16384); err == nil {
+		t.Fatal("Migrate over an existing file succeeded")
+	}
+	db = openTestDB(t, dst)
+	defer db.Close()
+	if db.page.size != 16384 {
+		t.Fatalf("page size is %d", db.page.size)
+	}
+	for i := 0; i < 3000; i++ {
+		got, ok := db.Get([]byte(fmt.Sprintf("k%05d", i)))
+		if !ok || !bytes.Equal(got, val(i)) {
+			t.Fatalf("Get(k%05d) = %d bytes, %v", i, len(got), ok)
+		}
+	}
+	tree, _ = db.OpenTree(3)
+	if got, ok := tree.Get([]byte("other")); !ok || string(got) != "tree" {
+		t.Fatalf("tree 3 Get = %q, %v", got, ok)
+	}
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+
+	// the signature is needed to open src and carries over with the
+	// checksum setting
+	src, dst = filepath.Join(dir, "custom.db"), filepath.Join(dir, "custom2.db")
+	opts := Options{Signature: "custom"}
+	db = &KeyValue{Path: src, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	setPageSize(db, BTREE_PAGE_SIZE, CSUM_NONE)
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), val(i)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db.Close()
+	if err := Migrate(src, dst, 16384); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("Migrate without the signature = %v, want %v", err, ErrBadSignature)
+	}
+	if err := MigrateWithOptions(src, dst, 16384, opts); err != nil {
+		t.Fatalf("MigrateWithOptions: %v", err)
+	}
+	db = &KeyValue{Path: dst, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if db.page.size != 16384 || db.page.csum != CSUM_NONE {
+		t.Fatalf("page size %d, checksum %d", db.page.size, db.page.csum)
+	}
+	for i := 0; i < 100; i++ {
+		got, ok := db.Get([]byte(fmt.Sprintf("k%05d", i)))
+		if !ok || !bytes.Equal(got, val(i)) {
+			t.Fatalf("Get(k%05d) = %d bytes, %v", i, len(got), ok)
+		}
+	}
+}
+
+func TestSetWithMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	metas := []uint32{0, 1, 0x8000, 0xdeadbeef, ^uint32(0)}
+	overhead := metaSize(encodeMeta(entryMeta{flags: META_USER}))
+	vals := [][]byte{{}, []byte("v"), bytes.Repeat([]byte("x"), BTREE_MAX_VAL_SIZE-overhead)}
+	key := func(i, j int) []byte { return []byte(fmt.Sprintf("k%d-%d", i, j)) }
+	for i, meta := range metas {
+		for j, val := range vals {
+			if err := db.SetWithMeta(key(i, j), val, meta); err != nil {
+				t.Fatalf("SetWithMeta: %v", err)
+			}
+		}
+	}
+	if err := db.Set([]byte("plain"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	// the metadata counts against the max value size
+	big := make([]byte, BTREE_MAX_VAL_SIZE-overhead+1)
+	if err := db.SetWithMeta([]byte("big"), big, 1); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("SetWithMeta of %d bytes = %v, want %v", len(big), err, ErrValueTooLarge)
+	}
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	for i, meta := range metas {
+		for j, val := range vals {
+			got, ok := db.Get(key(i, j))
+			if !ok || !bytes.Equal(got, val) {
+				t.Fatalf("Get(%s) = %d bytes, %v", key(i, j), len(got), ok)
+			}
+			got, gotMeta, ok := db.GetWithMeta(key(i, j))
+			if !ok || !bytes.Equal(got, val) || gotMeta != meta {
+				t.Fatalf("GetWithMeta(%s) = %d bytes, %#x, %v", key(i, j), len(got), gotMeta, ok)
+			}
+		}
+	}
+	if val, meta, ok := db.GetWithMeta([]byte("plain")); !ok || string(val) != "v" || meta != 0 {
+		t.Fatalf("GetWithMeta(plain) = %q, %d, %v", val, meta, ok)
+	}
+	for it := db.Scan([]byte("k1-1"), []byte("k1-2")); it.Valid(); it.Next() {
+		if _, val := it.Deref(); string(val) != "v" {
+			t.Fatalf("Scan value = %q", val)
+		}
+	}
+
+	// a truncate keeps the metadata, a Set drops it
+	if ok, err := db.TruncateValue(key(3, 2), 10); !ok || err != nil {
+		t.Fatalf("TruncateValue = %v, %v", ok, err)
+	}
+	if val, meta, _ := db.GetWithMeta(key(3, 2)); len(val) != 10 || meta != 0xdeadbeef {
+		t.Fatalf("after TruncateValue: %d bytes, %#x", len(val), meta)
+	}
+	if err := db.Set(key(3, 2), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if val, meta, _ := db.GetWithMeta(key(3, 2)); string(val) != "v" || meta != 0 {
+		t.Fatalf("after Set: %q, %#x", val, meta)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.SetWithTTL([]byte("short"), []byte("v"), 50*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	if err := db.SetWithTTL([]byte("scan"), []byte("v"), 50*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	if err := db.SetWithTTL([]byte("long"), []byte("v"), time.Hour); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	if err := db.Set([]byte("plain"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, ok := db.Get([]byte("short")); !ok {
+		t.Fatal("the key expired early")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// missing for every read, and Get deletes it
+	if _, _, ok := db.GetWithMeta([]byte("scan")); ok {
+		t.Fatal("GetWithMeta returned an expired key")
+	}
+	if vals := db.GetMulti([][]byte{[]byte("scan")}); vals[0] != nil {
+		t.Fatal("GetMulti returned an expired key")
+	}
+	keys := []string{}
+	for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+		key, _ := it.Deref()
+		keys = append(keys, string(key))
+	}
+	if strings.Join(keys, ",") != "long,plain" {
+		t.Fatalf("Scan = %v", keys)
+	}
+	if _, _, ok := db.tree.GetMeta([]byte("scan")); !ok {
+		t.Fatal("a read other than Get deleted the key")
+	}
+	if _, ok := db.Get([]byte("short")); ok {
+		t.Fatal("Get returned an expired key")
+	}
+	if _, _, ok := db.tree.GetMeta([]byte("short")); ok {
+		t.Fatal("Get didn't delete the expired key")
+	}
+	if n, err := db.PurgeExpired(); n != 1 || err != nil {
+		t.Fatalf("PurgeExpired = %d, %v", n, err)
+	}
+
+	// the background sweep reclaims the pages
+	db = &KeyValue{
+		Path:    filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{ExpirySweep: 10 * time.Millisecond},
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	val := make([]byte, 500)
+	for i := 0; i < 200; i++ {
+		if err := db.SetWithTTL([]byte(fmt.Sprintf("k%03d", i)), val, 50*time.Millisecond); err != nil {
+			t.Fatalf("SetWithTTL: %v", err)
+		}
+	}
+	if err := db.Set([]byte("plain"), val); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mu.RLock()
+		n, free := 0, db.free.Total()
+		for iter := db.tree.SeekLE(nil); iter.Valid(); iter.Next() {
+			n++
+		}
+		db.mu.RUnlock()
+		if n == 2 { // the dummy key and plain
+			if free < 20 {
+				t.Fatalf("%d free pages after the sweep", free)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d keys left after the sweep", n-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetVersioned(t *testing.T) {
+	db := newTestDB(t)
+	key := []byte("k")
+
+	// 0 creates the key only if it's absent
+	if v, err := db.SetVersioned(key, []byte("a"), 0); v != 1 || err != nil {
+		t.Fatalf("SetVersioned(create) = %d, %v", v, err)
+	}
+	if _, err := db.SetVersioned(key, []byte("b"), 0); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("SetVersioned(create existing) = %v, want %v", err, ErrVersionMismatch)
+	}
+	if v, err := db.SetVersioned(key, []byte("b"), 1); v != 2 || err != nil {
+		t.Fatalf("SetVersioned(1) = %d, %v", v, err)
+	}
+	// a stale version doesn't write
+	if _, err := db.SetVersioned(key, []byte("c"), 1); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("SetVersioned(stale) = %v, want %v", err, ErrVersionMismatch)
+	}
+	if val, v, ok := db.GetVersioned(key); !ok || string(val) != "b" || v != 2 {
+		t.Fatalf("GetVersioned = %q, %d, %v", val, v, ok)
+	}
+	if val, ok := db.Get(key); !ok || string(val) != "b" {
+		t.Fatalf("Get = %q, %v", val, ok)
+	}
+	if _, err := db.SetVersioned([]byte("missing"), nil, 1); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("SetVersioned(missing) = %v, want %v", err, ErrVersionMismatch)
+	}
+
+	// a plain Set drops the version
+	if err := db.Set(key, []byte("d")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, v, ok := db.GetVersioned(key); !ok || v != 0 {
+		t.Fatalf("GetVersioned after Set = %d, %v", v, ok)
+	}
+	if _, err := db.SetVersioned(key, []byte("e"), 2); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("SetVersioned after Set = %v, want %v", err, ErrVersionMismatch)
+	}
+	// a deleted key can be created again
+	if _, err := db.Del(key); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if v, err := db.SetVersioned(key, []byte("f"), 0); v != 1 || err != nil {
+		t.Fatalf("SetVersioned(recreate) = %d, %v", v, err)
+	}
+}
+
+func TestBackupBinary(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, filepath.Join(dir, "src.db"))
+	defer db.Close()
+	pairs := map[string][]byte{}
+	for i := 0; i < 3000; i++ {
+		key, val := fmt.Sprintf("k%05d", i), bytes.Repeat([]byte{byte(i)}, i%500)
+		if err := db.Set([]byte(key), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		pairs[key] = val
+	}
+	if err := db.SetWithMeta([]byte("meta"), []byte("v"), 7); err != nil {
+		t.Fatalf("SetWithMeta: %v", err)
+	}
+	pairs["meta"] = []byte("v")
+
+	var backup bytes.Buffer
+	if err := db.BackupBinary(&backup); err != nil {
+		t.Fatalf("BackupBinary: %v", err)
+	}
+	dump, err := json.Marshal(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.Len() >= len(dump) {
+		t.Fatalf("the backup takes %d bytes, JSON %d", backup.Len(), len(dump))
+	}
+
+	dst := filepath.Join(dir, "dst.db")
+	if err := RestoreBinary(dst, bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatalf("RestoreBinary: %v", err)
+	}
+	restored := openTestDB(t, dst)
+	defer restored.Close()
+	want, _ := db.Fingerprint()
+	if got, _ := restored.Fingerprint(); got != want {
+		t.Fatal("the restored database differs")
+	}
+	if _, meta, ok := restored.GetWithMeta([]byte("meta")); !ok || meta != 7 {
+		t.Fatalf("GetWithMeta = %d, %v", meta, ok)
+	}
+
+	// bad input leaves nothing behind
+	if err := RestoreBinary(dst, bytes.NewReader(backup.Bytes())); err == nil {
+		t.Fatal("RestoreBinary over an existing file succeeded")
+	}
+	bad := filepath.Join(dir, "bad.db")
+	if err := RestoreBinary(bad, strings.NewReader(strings.Repeat("not a backup", 4))); !errors.Is(err, ErrBadBackup) {
+		t.Fatalf("RestoreBinary of garbage = %v, want %v", err, ErrBadBackup)
+	}
+	if err := RestoreBinary(bad, bytes.NewReader(backup.Bytes()[:backup.Len()/2])); err == nil {
+		t.Fatal("RestoreBinary of a truncated backup succeeded")
+	}
+	if _, err := os.Stat(bad); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a failed restore left the file")
+	}
+}
+
+func TestExportRange(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 3000; i++ {
+		key, val := fmt.Sprintf("k%05d", i), bytes.Repeat([]byte{byte(i)}, i%500)
+		if err := db.Set([]byte(key), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	var full bytes.Buffer
+	if err := db.BackupBinary(&full); err != nil {
+		t.Fatalf("BackupBinary: %v", err)
+	}
+
+	var parts bytes.Buffer
+	bounds := [][]byte{nil, []byte("k01000"), []byte("k02000"), nil}
+	for i := 0; i+1 < len(bounds); i++ {
+		var part bytes.Buffer
+		if err := db.ExportRange(&part, bounds[i], bounds[i+1]); err != nil {
+			t.Fatalf("ExportRange: %v", err)
+		}
+		if part.Len() == 0 {
+			t.Fatalf("range %d is empty", i)
+		}
+		parts.Write(part.Bytes())
+	}
+	if !bytes.Equal(parts.Bytes(), full.Bytes()[24:]) {
+		t.Fatal("the ranges differ from the backup")
+	}
+
+	var empty bytes.Buffer
+	if err := db.ExportRange(&empty, []byte("x"), nil); err != nil || empty.Len() != 0 {
+		t.Fatalf("ExportRange past the keys = %d bytes, %v", empty.Len(), err)
+	}
+	db.Close()
+	if err := db.ExportRange(&empty, nil, nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("ExportRange after Close = %v", err)
+	}
+}
+
+func TestNewFromBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{byte(i)}, i%300)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	want, _ := db.Fingerprint()
+	db.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := NewFromBytes(data)
+	if err != nil {
+		t.Fatalf("NewFromBytes: %v", err)
+	}
+	if got, err := mem.Fingerprint(); err != nil || got != want {
+		t.Fatalf("Fingerprint = %v, it differs from the file", err)
+	}
+	db = openTestDB(t, path)
+	defer db.Close()
+	for i := 0; i < 2000; i += 7 {
+		key := []byte(fmt.Sprintf("k%05d", i))
+		got, ok := mem.Get(key)
+		want, _ := db.Get(key)
+		if !ok || !bytes.Equal(got, want) {
+			t.Fatalf("Get(%s) = %d bytes, %v", key, len(got), ok)
+		}
+	}
+	if err := mem.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	if err := mem.Set([]byte("k"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Set = %v, want %v", err, ErrReadOnly)
+	}
+	if err := mem.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// the bytes are checked like a file, every master slot
+	for slot := 0; slot < DEFAULT_MASTER_SLOTS; slot++ {
+		data[slot*BTREE_PAGE_SIZE] ^= 0xff
+	}
+	if _, err := NewFromBytes(data); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("NewFromBytes of a corrupted signature = %v, want %v", err, ErrBadSignature)
+	}
+	if _, err := NewFromBytes(data[:100]); err == nil {
+		t.Fatal("NewFromBytes of a partial page succeeded")
+	}
+}
+
+func TestCompactorSteps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+	ref := map[string][]byte{}
+	for i := 0; i < 3000; i++ {
+		key, val := fmt.Sprintf("k%05d", i), bytes.Repeat([]byte{byte(i)}, 200)
+		if err := db.Set([]byte(key), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		ref[key] = val
+	}
+	for i := 0; i < 3000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		key := fmt.Sprintf("k%05d", i)
+		if _, err := db.Del([]byte(key)); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+		delete(ref, key)
+	}
+	check := func(db *KeyValue) {
+		t.Helper()
+		n := 0
+		for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+			key, val := it.Deref()
+			if !bytes.Equal(val, ref[string(key)]) {
+				t.Fatalf("%s has the wrong value", key)
+			}
+			n++
+		}
+		if n != len(ref) {
+			t.Fatalf("%d keys, want %d", n, len(ref))
+		}
+	}
+	before, _ := os.Stat(path)
+
+	c := db.Compactor()
+	c.pages = 4
+	steps := 0
+	for {
+		done, err := c.Step()
+		if err != nil {
+			t.Fatalf("Step: %v", err)
+		}
+		steps++
+		if done {
+			break
+		}
+		// writes go on between the steps
+		key := fmt.Sprintf("new%05d", steps)
+		if err := db.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		ref[key] = []byte("v")
+		if steps == 1 {
+			// the file is valid at every step
+			db.mu.RLock()
+			reader := &KeyValue{Path: path, Options: Options{ReadOnly: true}}
+			if err := reader.Open(); err != nil {
+				t.Fatalf("Open after a step: %v", err)
+			}
+			check(reader)
+			reader.Close()
+			db.mu.RUnlock()
+		}
+	}
+	if steps < 3 {
+		t.Fatalf("compacted in %d steps", steps)
+	}
+	check(db)
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("file size %d -> %d, expected it to shrink", before.Size(), after.Size())
+	}
+}
+
+func TestFreeListCycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	val := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		if _, err := db.Del([]byte(fmt.Sprintf("k%02d", i))); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+	}
+
+	// point the head back at itself and claim more items than it holds
+	head := pageGetMapped(db, db.free.head)
+	size := flnSize(head)
+	flnSetHeader(head, uint16(size), db.free.head)
+	flnSetTotal(head, uint64(size+10))
+	pageSeal(db, head.data)
+
+	err := error(nil)
+	for i := 0; i < 100 && err == nil; i++ {
+		err = db.Set([]byte(fmt.Sprintf("n%02d", i)), val)
+	}
+	if !errors.Is(err, ErrFreeListCorrupt) {
+		t.Fatalf("Set = %v, want %v", err, ErrFreeListCorrupt)
+	}
+	if !errors.Is(db.Err(), ErrFreeListCorrupt) {
+		t.Fatalf("Err = %v, want %v", db.Err(), ErrFreeListCorrupt)
+	}
+	db.Close()
+
+	db = &KeyValue{Path: path}
+	if err := db.Open(); !errors.Is(err, ErrFreeListCorrupt) {
+		t.Fatalf("Open = %v, want %v", err, ErrFreeListCorrupt)
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.SplitRanges(0); err == nil {
+		t.Fatalf("SplitRanges(0) succeeded")
+	}
+	ranges, err := db.SplitRanges(4)
+	if err != nil || len(ranges) != 1 || ranges[0][0] != nil || ranges[0][1] != nil {
+		t.Fatalf("empty SplitRanges = %q, %v", ranges, err)
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("k%05d", i))
+		if err := db.Set(key, make([]byte, 100)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	ranges, err = db.SplitRanges(8)
+	if err != nil {
+		t.Fatalf("SplitRanges: %v", err)
+	}
+	if len(ranges) != 8 || ranges[0][0] != nil || ranges[7][1] != nil {
+		t.Fatalf("ranges = %q", ranges)
+	}
+	for i := 1; i < len(ranges); i++ {
+		if !bytes.Equal(ranges[i-1][1], ranges[i][0]) {
+			t.Fatalf("gap between %q and %q", ranges[i-1], ranges[i])
+		}
+	}
+
+	// scan the ranges in parallel, they must add up to the whole
+	counts := make([][]string, len(ranges))
+	wg := sync.WaitGroup{}
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, lo, hi []byte) {
+			defer wg.Done()
+			it := db.Scan(lo, hi)
+			defer it.Close()
+			for ; it.Valid(); it.Next() {
+				key, _ := it.Deref()
+				counts[i] = append(counts[i], string(key))
+			}
+		}(i, r[0], r[1])
+	}
+	wg.Wait()
+	all := []string{}
+	for i, keys := range counts {
+		if len(keys) == 0 {
+			t.Fatalf("range %d is empty", i)
+		}
+		all = append(all, keys...)
+	}
+	if len(all) != 5000 {
+		t.Fatalf("%d keys, want 5000", len(all))
+	}
+	for i, key := range all {
+		if key != fmt.Sprintf("k%05d", i) {
+			t.Fatalf("key %d = %q", i, key)
+		}
+	}
+}
+
+func TestInternalCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	for i := 0; i < 3; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	// a root leaf claiming more keys than fit, with a valid checksum
+	root := pageGetMapped(db, db.tree.root)
+	root.setHeader(BNODE_LEAF, 0xffff)
+	pageSeal(db, root.data)
+
+	if val, ok := db.Get([]byte("k1")); ok || val != nil {
+		t.Fatalf("Get = %q, %v", val, ok)
+	}
+	if !errors.Is(db.Err(), ErrInternalCorruption) {
+		t.Fatalf("Err = %v, want %v", db.Err(), ErrInternalCorruption)
+	}
+	if err := db.Set([]byte("k9"), []byte("v")); !errors.Is(err, ErrInternalCorruption) {
+		t.Fatalf("Set = %v, want %v", err, ErrInternalCorruption)
+	}
+	if _, err := db.Del([]byte("k1")); !errors.Is(err, ErrInternalCorruption) {
+		t.Fatalf("Del = %v, want %v", err, ErrInternalCorruption)
+	}
+	it := db.Scan(nil, nil)
+	for ; it.Valid(); it.Next() {
+	}
+	it.Close()
+	if !errors.Is(it.Err(), ErrInternalCorruption) {
+		t.Fatalf("Scan Err = %v, want %v", it.Err(), ErrInternalCorruption)
+	}
+	if !strings.Contains(db.Err().Error(), "out of range") {
+		t.Fatalf("Err = %v, want the original panic message", db.Err())
+	}
+
+	// the option lets the panic out
+	db.Options.PanicOnCorruption = true
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected Get to panic")
+			}
+		}()
+		db.Get([]byte("k1"))
+	}()
+	db.Close()
+}
+
+func TestWarm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{ValueCacheSize: 10}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if err := db.Warm(); err != nil {
+		t.Fatalf("Warm on an empty database: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		if err := db.Set(key, key); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := db.SetWithTTL([]byte("k0000"), []byte("x"), time.Hour); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	db.vcache.clear()
+	if err := db.Warm(); err != nil {
+		t.Fatalf("Warm: %v", err)
+	}
+	// filled with the first values without an expiry
+	if n := db.vcache.order.Len(); n != 10 {
+		t.Fatalf("%d values cached, want 10", n)
+	}
+	if _, ok := db.vcache.items["k0000"]; ok {
+		t.Fatalf("the value with an expiry was cached")
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		if val, ok := db.Get(key); !ok || (i > 0 && !bytes.Equal(val, key)) {
+			t.Fatalf("Get(%s) = %q, %v", key, val, ok)
+		}
+	}
+	if db.vcache.hits != 10 {
+		t.Fatalf("%d cache hits, want 10", db.vcache.hits)
+	}
+
+	db.Close()
+	if err := db.Warm(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Warm after Close = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTupleOrder(t *testing.T) {
+	atoms := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x00\xff", "\x01",
+		"\xff", "\xff\x00", "a", "a\x00", "a\x00b", "a\x01", "ab"}
+	tuples := [][][]byte{{}}
+	for _, a := range atoms {
+		tuples = append(tuples, [][]byte{[]byte(a)})
+		for _, b := range atoms {
+			tuples = append(tuples, [][]byte{[]byte(a), []byte(b)})
+		}
+	}
+	// field by field, a prefix of a tuple sorts first
+	compare := func(a, b [][]byte) int {
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := bytes.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	}
+	sign := func(c int) int { return min(max(c, -1), 1) }
+	for _, a := range tuples {
+		key := EncodeTuple(a...)
+		fields, err := DecodeTuple(key)
+		if err != nil || compare(fields, a) != 0 || len(fields) != len(a) {
+			t.Fatalf("DecodeTuple(EncodeTuple(%q)) = %q, %v", a, fields, err)
+		}
+		for _, b := range tuples {
+			want := sign(compare(a, b))
+			if got := bytes.Compare(key, EncodeTuple(b...)); got != want {
+				t.Fatalf("%q vs %q: keys compare %d, want %d", a, b, got, want)
+			}
+		}
+	}
+
+	for _, bad := range []string{"a", "a\x00", "a\x00\x02", "\x00\xff", "a\x00\x01b"} {
+		if _, err := DecodeTuple([]byte(bad)); !errors.Is(err, ErrBadTuple) {
+			t.Fatalf("DecodeTuple(%q) = %v, want %v", bad, err, ErrBadTuple)
+		}
+	}
+}
+
+func TestMaxSizeBytes(t *testing.T) {
+	const limit = 64 * BTREE_PAGE_SIZE
+	db := &KeyValue{
+		Path:    filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{MaxSizeBytes: limit},
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	count := func() int {
+		n := 0
+		for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+			n++
+		}
+		return n
+	}
+	val := make([]byte, 1000)
+	n := 0
+	err := error(nil)
+	for ; n < 1000; n++ {
+		if err = db.Set([]byte(fmt.Sprintf("k%04d", n)), val); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrDatabaseFull) || n < 100 {
+		t.Fatalf("Set = %v after %d keys, want %v", err, n, ErrDatabaseFull)
+	}
+	if db.mmap.file > limit {
+		t.Fatalf("file is %d bytes, the limit is %d", db.mmap.file, limit)
+	}
+	// the failed write left nothing behind
+	if _, ok := db.Get([]byte(fmt.Sprintf("k%04d", n))); ok {
+		t.Fatalf("the key of the failed Set exists")
+	}
+	if got := count(); got != n {
+		t.Fatalf("%d keys, want %d", got, n)
+	}
+
+	// freeing pages makes room again
+	deleted, err := db.DeleteRange([]byte("k0000"), []byte(fmt.Sprintf("k%04d", n/2)))
+	if err != nil || deleted != n/2 {
+		t.Fatalf("DeleteRange = %d, %v", deleted, err)
+	}
+	if err := db.Set([]byte(fmt.Sprintf("k%04d", n)), val); err != nil {
+		t.Fatalf("Set after freeing pages: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := count(); got != n-n/2+1 {
+		t.Fatalf("%d keys after reopen, want %d", got, n-n/2+1)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	db := newTestDB(t)
+	// big keys, a few per node give a tree of three levels
+	val := make([]byte, 1000)
+	pad := strings.Repeat("x", 400)
+	for i := 0; i < 200; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k|%03d%s", i, pad)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	// the expected counts from a walk of the tree
+	nodes, edges, height := 0, 0, 0
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		node := db.pageGet(ptr)
+		nodes++
+		height = max(height, depth+1)
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				edges++
+				walk(node.getPtr(i), depth+1)
+			}
+		}
+	}
+	walk(db.tree.root, 0)
+	if height < 3 {
+		t.Fatalf("tree height %d, want at least 3", height)
+	}
+
+	buf := bytes.Buffer{}
+	if err := db.WriteDOT(&buf); err != nil {
+		t.Fatalf("WriteDOT: %v", err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph btree {") || !strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("not a digraph:\n%s", dot)
+	}
+	if got := strings.Count(dot, "[label=\"<f0>"); got != nodes {
+		t.Fatalf("%d nodes, want %d", got, nodes)
+	}
+	if got := strings.Count(dot, " -> "); got != edges {
+		t.Fatalf("%d edges, want %d", got, edges)
+	}
+	if !strings.Contains(dot, `k\|100`) {
+		t.Fatalf("the | in the keys isn't escaped:\n%s", dot)
+	}
+
+	// only the root and its children
+	buf.Reset()
+	if err := db.WriteDOTWithOptions(&buf, DOTOptions{MaxDepth: 1}); err != nil {
+		t.Fatalf("WriteDOTWithOptions: %v", err)
+	}
+	root := db.pageGet(db.tree.root)
+	if got, want := strings.Count(buf.String(), "[label=\"<f0>"), 1+int(root.nkeys()); got != want {
+		t.Fatalf("%d nodes with MaxDepth 1, want %d", got, want)
+	}
+	buf.Reset()
+	if err := db.WriteDOTWithOptions(&buf, DOTOptions{MaxNodes: 5}); err != nil {
+		t.Fatalf("WriteDOTWithOptions: %v", err)
+	}
+	if got := strings.Count(buf.String(), "[label=\"<f0>"); got != 5 {
+		t.Fatalf("%d nodes with MaxNodes 5, want 5", got)
+	}
+}
+
+// run with -race: snapshots and backups taken and released while every
+// commit rewrites all the keys, each must see a single commit
+func TestSnapshotBackupConcurrent(t *testing.T) {
+	db := newTestDB(t)
+	const nkeys = 300
+	gen := func(g int) error {
+		return db.Update(func(tx *Tx) error {
+			for i := 0; i < nkeys; i++ {
+				key := []byte(fmt.Sprintf("k%03d", i))
+				// odd commits drop a key, freeing and splitting pages
+				if g%2 == 1 && i == g%nkeys {
+					if _, err := tx.Del(key); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := tx.Set(key, []byte(fmt.Sprintf("gen%08d", g))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := gen(0); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	// the values of one commit are all the same
+	consistent := func(vals [][]byte) error {
+		if len(vals) < nkeys-1 {
+			return fmt.Errorf("%d keys", len(vals))
+		}
+		for _, val := range vals {
+			if !bytes.Equal(val, vals[0]) {
+				return fmt.Errorf("%q and %q in one snapshot", vals[0], val)
+			}
+		}
+		return nil
+	}
+
+	stop := make(chan struct{})
+	writer := make(chan error, 1)
+	go func() {
+		for g := 1; ; g++ {
+			select {
+			case <-stop:
+				writer <- nil
+				return
+			default:
+			}
+			if err := gen(g); err != nil {
+				writer <- err
+				return
+			}
+		}
+	}()
+
+	dir := t.TempDir()
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 16)
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if r%2 == 0 {
+					// a snapshot, sometimes released halfway
+					it := db.Scan(nil, nil)
+					vals := [][]byte{}
+					for ; it.Valid() && !(i%3 == 0 && len(vals) == nkeys/2); it.Next() {
+						_, val := it.Deref()
+						vals = append(vals, append([]byte{}, val...))
+					}
+					it.Close()
+					if len(vals) == nkeys/2 {
+						continue
+					}
+					if err := consistent(vals); err != nil {
+						errs <- fmt.Errorf("snapshot: %w", err)
+						return
+					}
+					continue
+				}
+				buf := bytes.Buffer{}
+				if err := db.BackupBinary(&buf); err != nil {
+					errs <- err
+					return
+				}
+				if i%5 != 0 {
+					continue
+				}
+				path := filepath.Join(dir, fmt.Sprintf("restore%d-%d.db", r, i))
+				if err := RestoreBinary(path, &buf); err != nil {
+					errs <- err
+					return
+				}
+				restored := &KeyValue{Path: path}
+				if err := restored.Open(); err != nil {
+					errs <- err
+					return
+				}
+				vals := [][]byte{}
+				for it := restored.Scan(nil, nil); it.Valid(); it.Next() {
+					_, val := it.Deref()
+					vals = append(vals, append([]byte{}, val...))
+				}
+				restored.Close()
+				if err := consistent(vals); err != nil {
+					errs <- fmt.Errorf("backup: %w", err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(stop)
+	if err := <-writer; err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := snapshotCount(db); n != 0 {
+		t.Fatalf("%d snapshots still pinned", n)
+	}
+}
+
+func TestGetView(t *testing.T) {
+	db := newTestDB(t)
+	want := bytes.Repeat([]byte("v"), 2000)
+	if err := db.Set([]byte("k"), want); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if view, ok := db.GetView([]byte("missing")); ok || view != nil {
+		t.Fatalf("GetView(missing) = %v, %v", view, ok)
+	}
+	view, ok := db.GetView([]byte("k"))
+	if !ok || !bytes.Equal(view.Bytes(), want) {
+		t.Fatalf("GetView = %v, want the stored value", ok)
+	}
+	// the bytes are the mapped page, not a copy
+	val, _ := db.tree.Get([]byte("k"))
+	if &val[0] != &view.Bytes()[0] {
+		t.Fatalf("the view is a copy")
+	}
+
+	// the overwrites hold the page back instead of reusing it
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte("k"), bytes.Repeat([]byte{byte(i)}, 2000)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if !bytes.Equal(view.Bytes(), want) {
+		t.Fatalf("the view changed under a write")
+	}
+	if len(snapshotHeld(db)) == 0 {
+		t.Fatalf("no pages held for the view")
+	}
+	if err := db.Shrink(); err == nil {
+		t.Fatalf("Shrink succeeded with a view held")
+	}
+
+	view.Release()
+	view.Release()
+	if n := snapshotCount(db); n != 0 {
+		t.Fatalf("%d pins after Release", n)
+	}
+	// the next commit frees the held pages
+	if err := db.Set([]byte("k"), want); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if held := snapshotHeld(db); len(held) != 0 {
+		t.Fatalf("%d pages still held after Release", len(held))
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatalf("Shrink after Release: %v", err)
+	}
+}
+
+func TestGetReader(t *testing.T) {
+	db := newTestDB(t)
+	want := make([]byte, db.MaxValSize())
+	rand.New(rand.NewSource(1)).Read(want)
+	if err := db.Set([]byte("k"), want); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if r, ok := db.GetReader([]byte("missing")); ok || r != nil {
+		t.Fatalf("GetReader(missing) = %v, %v", r, ok)
+	}
+	r, ok := db.GetReader([]byte("k"))
+	if !ok {
+		t.Fatalf("GetReader: not found")
+	}
+	// a write meanwhile doesn't change what's read
+	if err := db.Set([]byte("k"), []byte("new")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	got, buf := []byte{}, make([]byte, 7)
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, not the stored %d", len(got), len(want))
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	r.Close()
+	if n := snapshotCount(db); n != 0 {
+		t.Fatalf("%d pins after Close", n)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("Read after Close = %d, %v", n, err)
+	}
+}
+
+func TestSetReader(t *testing.T) {
+	db := newTestDB(t)
+	want := make([]byte, db.MaxValSize())
+	rand.New(rand.NewSource(1)).Read(want)
+	// a reader handing out a few bytes at a time
+	if err := db.SetReader([]byte("k"), iotest.OneByteReader(bytes.NewReader(want))); err != nil {
+		t.Fatalf("SetReader: %v", err)
+	}
+	r, ok := db.GetReader([]byte("k"))
+	if !ok {
+		t.Fatalf("GetReader: not found")
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+
+	// a longer value is rejected after MaxValSize+1 bytes
+	long := &countingReader{r: bytes.NewReader(make([]byte, 3*db.MaxValSize()))}
+	if err := db.SetReader([]byte("long"), long); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("SetReader of a long value = %v", err)
+	}
+	if long.n > db.MaxValSize()+1 {
+		t.Fatalf("read %d bytes of a long value", long.n)
+	}
+	if _, ok := db.Get([]byte("long")); ok {
+		t.Fatalf("the long value was stored")
+	}
+	// a read error fails it
+	if err := db.SetReader([]byte("e"), iotest.ErrReader(io.ErrUnexpectedEOF)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("SetReader with a failing reader = %v", err)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestMasterSlots(t *testing.T) {
+	dir := t.TempDir()
+	for _, slots := range []int{0, 1, 4} {
+		path := filepath.Join(dir, fmt.Sprintf("slots%d.db", slots))
+		db := &KeyValue{Path: path, Options: Options{MasterSlots: slots}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if slots == 0 {
+			slots = DEFAULT_MASTER_SLOTS
+		}
+		// every commit rewrites all the keys with its generation
+		gens := map[uint64]string{}
+		for g := 0; g < 10; g++ {
+			err := db.Update(func(tx *Tx) error {
+				for i := 0; i < 100; i++ {
+					val := []byte(fmt.Sprintf("gen%d", g))
+					if err := tx.Set([]byte(fmt.Sprintf("k%03d", i)), val); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			gens[db.seq] = fmt.Sprintf("gen%d", g)
+		}
+		if err := db.HealthCheck(); err != nil {
+			t.Fatalf("HealthCheck: %v", err)
+		}
+		// a copy of the file as a crash would leave it
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := db.seq
+		db.Close()
+
+		// damage every slot but the one of commit seq
+		open := func(seq uint64, opts Options) (*KeyValue, error) {
+			damaged := append([]byte{}, data...)
+			keep := int((seq - 1) % uint64(slots))
+			for slot := 0; slot < slots; slot++ {
+				if slot != keep {
+					damaged[slot*BTREE_PAGE_SIZE+24] ^= 0xff
+				}
+			}
+			copyPath := filepath.Join(dir, "copy.db")
+			os.Remove(copyPath)
+			if err := os.WriteFile(copyPath, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+			copyDB := &KeyValue{Path: copyPath, Options: opts}
+			return copyDB, copyDB.Open()
+		}
+		for back := uint64(0); back < uint64(slots); back++ {
+			seq := last - back
+			copyDB, err := open(seq, Options{})
+			if err != nil {
+				t.Fatalf("%d slots, commit %d: Open: %v", slots, seq, err)
+			}
+			n := 0
+			for it := copyDB.Scan(nil, nil); it.Valid(); it.Next() {
+				if _, val := it.Deref(); string(val) != gens[seq] {
+					t.Fatalf("%d slots, commit %d: %q, want %q", slots, seq, val, gens[seq])
+				}
+				n++
+			}
+			if n != 100 {
+				t.Fatalf("%d slots, commit %d: %d keys", slots, seq, n)
+			}
+			// the next commit repairs the damaged slots
+			for i := 0; i < 100; i++ {
+				if err := copyDB.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("new")); err != nil {
+					t.Fatalf("%d slots, commit %d: Set: %v", slots, seq, err)
+				}
+			}
+			if err := copyDB.HealthCheck(); err != nil {
+				t.Fatalf("HealthCheck after the repair: %v", err)
+			}
+			if err := copyDB.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if err := copyDB.Open(); err != nil {
+				t.Fatalf("reopen after the repair: %v", err)
+			}
+			if err := copyDB.HealthCheck(); err != nil {
+				t.Fatalf("HealthCheck after reopening: %v", err)
+			}
+			copyDB.Close()
+		}
+	}
+
+	// no valid slot left
+	path := filepath.Join(dir, "broken.db")
+	db := openTestDB(t, path)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	db.Close()
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := 0; slot < DEFAULT_MASTER_SLOTS; slot++ {
+		fp.WriteAt([]byte{0xff}, int64(slot*BTREE_PAGE_SIZE+24))
+	}
+	fp.Close()
+	if err := db.Open(); err == nil {
+		t.Fatalf("Open succeeded with every master slot damaged")
+	}
+	if err := (&KeyValue{Path: path, Options: Options{MasterSlots: MAX_MASTER_SLOTS + 1}}).Open(); err == nil {
+		t.Fatalf("Open accepted %d master slots", MAX_MASTER_SLOTS+1)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{DirectIO: true}}
+	if err := db.Open(); errors.Is(err, syscall.EINVAL) {
+		t.Skipf("O_DIRECT is not supported here: %v", err)
+	} else if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// the writes go around the mapping, the reads must see them
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		if err := db.Set(key, bytes.Repeat(key, 10)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if val, ok := db.Get(key); !ok || !bytes.Equal(val, bytes.Repeat(key, 10)) {
+			t.Fatalf("Get(%s) right after Set = %q, %v", key, val, ok)
+		}
+	}
+	for i := 0; i < 2000; i += 2 {
+		if _, err := db.Del([]byte(fmt.Sprintf("k%04d", i))); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+	}
+	check := func(db *KeyValue) {
+		t.Helper()
+		n := 0
+		for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+			key, val := it.Deref()
+			if !bytes.Equal(val, bytes.Repeat(key, 10)) {
+				t.Fatalf("%s = %q", key, val)
+			}
+			n++
+		}
+		if n != 1000 {
+			t.Fatalf("%d keys, want 1000", n)
+		}
+		if err := db.HealthCheck(); err != nil {
+			t.Fatalf("HealthCheck: %v", err)
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// the file is the same without O_DIRECT
+	plain := openTestDB(t, path)
+	check(plain)
+	plain.Close()
+	if err := db.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	check(db)
+	db.Close()
+
+	small := &KeyValue{
+		Path:    filepath.Join(t.TempDir(), "small.db"),
+		Options: Options{DirectIO: true, PageSize: BTREE_MIN_PAGE_SIZE},
+	}
+	if err := small.Open(); err == nil {
+		small.Close()
+		t.Fatalf("DirectIO accepted a page size of %d", BTREE_MIN_PAGE_SIZE)
+	}
+}
+
+func TestPathCache(t *testing.T) {
+	db := &KeyValue{
+		Path:    filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{PathCacheSize: 4},
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	scan := func(lo string, n int) []string {
+		t.Helper()
+		out := []string{}
+		it := db.Scan([]byte(lo), nil)
+		defer it.Close()
+		for ; it.Valid() && len(out) < n; it.Next() {
+			key, val := it.Deref()
+			out = append(out, string(key)+"="+string(val))
+		}
+		return out
+	}
+	// the same results as the plain descent
+	plain := func(lo string, n int) []string {
+		out := []string{}
+		for iter := db.tree.SeekLE([]byte(lo)); iter.Valid() && len(out) < n; iter.Next() {
+			if key, val := iter.Deref(); len(key) > 0 && string(key) >= lo {
+				out = append(out, string(key)+"="+string(val))
+			}
+		}
+		return out
+	}
+	for _, lo := range []string{"", "k0500", "k0501", "k0500x", "k0499", "k1999", "k2"} {
+		for i := 0; i < 2; i++ {
+			if got, want := scan(lo, 30), plain(lo, 30); !slices.Equal(got, want) {
+				t.Fatalf("Scan(%q) = %v, want %v", lo, got, want)
+			}
+		}
+	}
+	if db.pcache.hits == 0 {
+		t.Fatalf("no cache hits")
+	}
+	if n := db.pcache.order.Len(); n > 4 {
+		t.Fatalf("%d paths cached, the size is 4", n)
+	}
+
+	// a write changes the leaf, the cached path must not be used
+	scan("k0500", 1)
+	if err := db.Set([]byte("k0500"), []byte("new")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	hits := db.pcache.hits
+	if got := scan("k0500", 1); got[0] != "k0500=new" {
+		t.Fatalf("Scan after a write = %v", got)
+	}
+	if db.pcache.hits != hits {
+		t.Fatalf("a path of the previous commit was used")
+	}
+	if got := scan("k0500", 1); got[0] != "k0500=new" || db.pcache.hits != hits+1 {
+		t.Fatalf("Scan = %v, %d hits, want a hit on the new path", got, db.pcache.hits-hits)
+	}
+}
+
+func TestAllowDuplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{AllowDuplicates: true}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	// "a\x00" sorts right after "a", its values must stay apart
+	for _, kv := range [][2]string{
+		{"a", "3"}, {"b", "x"}, {"a", "1"}, {"a\x00", "y"}, {"a", "2"}, {"a", "1"},
+	} {
+		if err := db.Set([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	all := func(key string) []string {
+		out := []string{}
+		for _, val := range db.GetAll([]byte(key)) {
+			out = append(out, string(val))
+		}
+		return out
+	}
+	if got := all("a"); !slices.Equal(got, []string{"3", "1", "2", "1"}) {
+		t.Fatalf("GetAll = %v", got)
+	}
+	if val, ok := db.Get([]byte("a")); !ok || string(val) != "3" {
+		t.Fatalf("Get = %q %v, want the first value", val, ok)
+	}
+	scanned := []string{}
+	for it := db.ScanPrefix([]byte("a")); it.Valid(); it.Next() {
+		key, val := it.Deref()
+		scanned = append(scanned, string(key)+"="+string(val))
+	}
+	if want := []string{"a=3", "a=1", "a=2", "a=1", "a\x00=y"}; !slices.Equal(scanned, want) {
+		t.Fatalf("ScanPrefix = %q, want %q", scanned, want)
+	}
+
+	// one value, then all of them
+	if deleted, err := db.DeleteValue([]byte("a"), []byte("1")); err != nil || !deleted {
+		t.Fatalf("DeleteValue = %v %v", deleted, err)
+	}
+	if got := all("a"); !slices.Equal(got, []string{"3", "2", "1"}) {
+		t.Fatalf("GetAll after DeleteValue = %v", got)
+	}
+	// the order survives a reopen and new values go last
+	db.Close()
+	db = &KeyValue{Path: path, Options: Options{AllowDuplicates: true}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.Set([]byte("a"), []byte("4")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if got := all("a"); !slices.Equal(got, []string{"3", "2", "1", "4"}) {
+		t.Fatalf("GetAll after reopen = %v", got)
+	}
+	if deleted, err := db.Del([]byte("a")); err != nil || !deleted {
+		t.Fatalf("Del = %v %v", deleted, err)
+	}
+	if got := all("a"); len(got) != 0 {
+		t.Fatalf("GetAll after Del = %v", got)
+	}
+	if got := all("a\x00"); !slices.Equal(got, []string{"y"}) {
+		t.Fatalf("Del removed another key: %v", got)
+	}
+}
+
+func TestKeyAt(t *testing.T) {
+	db := newTestDB(t)
+	if _, _, ok := db.KeyAt(0); ok {
+		t.Fatalf("KeyAt(0) found a key in an empty db")
+	}
+	ref := []string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("k%d", i*7919%1000)
+		ref = append(ref, key)
+		if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	slices.Sort(ref)
+	for _, rank := range []int{0, 1, 2, 499, 500, 998, 999} {
+		key, val, ok := db.KeyAt(uint64(rank))
+		if !ok || string(key) != ref[rank] || string(val) != "v"+ref[rank] {
+			t.Fatalf("KeyAt(%d) = %q %q %v, want %q", rank, key, val, ok, ref[rank])
+		}
+	}
+	if _, _, ok := db.KeyAt(1000); ok {
+		t.Fatalf("KeyAt past the last key found one")
+	}
+}
+
+func TestLogicalSize(t *testing.T) {
+	db := newTestDB(t)
+	if size, err := db.LogicalSize(); err != nil || size != 0 {
+		t.Fatalf("LogicalSize of an empty db = %d %v", size, err)
+	}
+	want := uint64(0)
+	for i := 0; i < 2000; i++ {
+		key, val := fmt.Sprintf("key%d", i), strings.Repeat("v", i%300)
+		want += uint64(len(key) + len(val))
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	// an overwrite and a delete
+	if err := db.Set([]byte("key1"), []byte("xy")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := db.Del([]byte("key2")); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	want = want + 1 - uint64(len("key2")+2) // "v" -> "xy", "key2"="vv"
+	if size, err := db.LogicalSize(); err != nil || size != want {
+		t.Fatalf("LogicalSize = %d %v, want %d", size, err, want)
+	}
+
+	fi, err := os.Stat(db.Path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got := db.DiskSize(); got != fi.Size() || got < int64(want) {
+		t.Fatalf("DiskSize = %d, the file is %d bytes", got, fi.Size())
+	}
+}
+
+func TestBulkWriter(t *testing.T) {
+	n := 1000000
+	if testing.Short() {
+		n = 100000
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	w, err := NewBulkWriter(path, Options{})
+	if err != nil {
+		t.Fatalf("NewBulkWriter: %v", err)
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%08d", i)) }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val%d", i*31)) }
+	for i := 0; i < n; i++ {
+		if err := w.Add(key(i), val(i)); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		// memory stays bounded, the pages are committed as they fill up
+		if pending := len(w.db.page.updates); pending > BULK_FLUSH_PAGES {
+			t.Fatalf("%d pages in memory", pending)
+		}
+	}
+	if err := w.Add(key(n-1), nil); !errors.Is(err, ErrBulkOrder) {
+		t.Fatalf("Add out of order = %v, want ErrBulkOrder", err)
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	db := openTestDB(t, path)
+	defer db.Close()
+	if err := db.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	i := 0
+	for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+		k, v := it.Deref()
+		if !bytes.Equal(k, key(i)) || !bytes.Equal(v, val(i)) {
+			t.Fatalf("entry %d = %q %q", i, k, v)
+		}
+		i++
+	}
+	if i != n {
+		t.Fatalf("scanned %d keys, want %d", i, n)
+	}
+	for _, i := range []int{0, 1, n / 2, n - 1} {
+		if v, ok := db.Get(key(i)); !ok || !bytes.Equal(v, val(i)) {
+			t.Fatalf("Get(%q) = %q %v", key(i), v, ok)
+		}
+	}
+	// the tree takes updates like any other
+	for i := 0; i < n; i += n / 100 {
+		if _, err := db.Del(key(i)); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+		if err := db.Set(append(key(i), 'x'), val(i)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if v, ok := db.Get(append(key(n/2), 'x')); !ok || !bytes.Equal(v, val(n/2)) {
+		t.Fatalf("Get after updates = %q %v", v, ok)
+	}
+	if _, ok := db.Get(key(0)); ok {
+		t.Fatalf("deleted key found")
+	}
+}
+
+func TestContiguousAllocator(t *testing.T) {
+	// the runs of adjacent pages a burst of inserts writes
+	burst := func(alloc Allocator) int {
+		db := &KeyValue{
+			Path:    filepath.Join(t.TempDir(), "test.db"),
+			Options: Options{Allocator: alloc},
+		}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		val := bytes.Repeat([]byte("v"), 200)
+		for i := 0; i < 3000; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), val); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		// scatter free pages over the file
+		rng := rand.New(rand.NewSource(1))
+		for _, i := range rng.Perm(3000)[:1500] {
+			if _, err := db.Del([]byte(fmt.Sprintf("k%05d", i))); err != nil {
+				t.Fatalf("Del: %v", err)
+			}
+		}
+		runs := 0
+		added := rng.Perm(3000)[:300]
+		err := db.Update(func(tx *Tx) error {
+			for _, i := range added {
+				if err := tx.Set([]byte(fmt.Sprintf("k%05dx", i)), val); err != nil {
+					return err
+				}
+			}
+			tx.Scan(nil, nil) // applies the writes
+			pages := []uint64{}
+			for ptr, page := range db.page.updates {
+				if page != nil && db.page.fresh[ptr] {
+					pages = append(pages, ptr)
+				}
+			}
+			slices.Sort(pages)
+			for i, ptr := range pages {
+				if i == 0 || ptr != pages[i-1]+1 {
+					runs++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		// the tree is intact and no page was lost
+		for _, i := range added {
+			if v, ok := db.Get([]byte(fmt.Sprintf("k%05dx", i))); !ok || !bytes.Equal(v, val) {
+				t.Fatalf("Get after the burst = %q %v", v, ok)
+			}
+		}
+		if n, err := db.ReclaimOrphans(); err != nil || n != 0 {
+			t.Fatalf("ReclaimOrphans = %d %v", n, err)
+		}
+		return runs
+	}
+	first, contiguous := burst(nil), burst(ContiguousAllocator{})
+	t.Logf("runs of new pages: first fit %d, contiguous %d", first, contiguous)
+	if contiguous >= first {
+		t.Fatalf("contiguous allocator wrote %d runs, first fit %d", contiguous, first)
+	}
+}
+
+func TestNoDummyKey(t *testing.T) {
+	db := &KeyValue{
+		Path:    filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{ValueCacheSize: 8},
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	// the empty db has the dummy key once a key was added and deleted
+	for _, want := range [][]string{nil, {"a"}} {
+		if _, err := db.Del([]byte("x")); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+		for _, key := range want {
+			if err := db.Set([]byte(key), []byte("1")); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := db.Set([]byte("x"), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if _, err := db.Del([]byte("x")); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+
+		keys := []string{}
+		for it := db.Scan(nil, nil); it.Valid(); it.Next() {
+			key, _ := it.Deref()
+			keys = append(keys, string(key))
+		}
+		if !slices.Equal(keys, want) {
+			t.Fatalf("Scan = %q, want %q", keys, want)
+		}
+		prefixed, err := db.KeysWithPrefix(nil, 0)
+		if err != nil || len(prefixed) != len(want) {
+			t.Fatalf("KeysWithPrefix = %q %v, want %q", prefixed, err, want)
+		}
+		if key, _, ok := db.KeyAt(0); ok != (len(want) > 0) || (ok && string(key) != want[0]) {
+			t.Fatalf("KeyAt(0) = %q %v", key, ok)
+		}
+		if _, _, ok := db.KeyAt(uint64(len(want))); ok {
+			t.Fatalf("KeyAt past the keys found one")
+		}
+		if size, err := db.LogicalSize(); err != nil || size != uint64(2*len(want)) {
+			t.Fatalf("LogicalSize = %d %v", size, err)
+		}
+
+		// the hash of the length-prefixed pairs
+		h := sha256.New()
+		for range want {
+			h.Write([]byte{1, 0, 0, 0, 'a', 1, 0, 0, 0, '1'})
+		}
+		if sum, err := db.Fingerprint(); err != nil || !bytes.Equal(sum[:], h.Sum(nil)) {
+			t.Fatalf("Fingerprint = %x %v, want %x", sum, err, h.Sum(nil))
+		}
+		ranges, err := db.SplitRanges(4)
+		if err != nil || ranges[0][0] != nil || ranges[len(ranges)-1][1] != nil {
+			t.Fatalf("SplitRanges = %q %v, want the whole key space", ranges, err)
+		}
+		for _, r := range ranges[1:] {
+			if len(r[0]) == 0 {
+				t.Fatalf("SplitRanges = %q, split at the dummy key", ranges)
+			}
+		}
+
+		// the backup counts the keys in its header
+		var buf bytes.Buffer
+		if err := db.BackupBinary(&buf); err != nil {
+			t.Fatalf("BackupBinary: %v", err)
+		}
+		if n := binary.LittleEndian.Uint64(buf.Bytes()[16:]); n != uint64(len(want)) {
+			t.Fatalf("the backup has %d keys, want %d", n, len(want))
+		}
+		db.vcache.clear()
+		if err := db.Warm(); err != nil {
+			t.Fatalf("Warm: %v", err)
+		}
+		if n := len(db.vcache.items); n != len(want) {
+			t.Fatalf("Warm cached %d values, want %d", n, len(want))
+		}
+	}
+}
+
+func TestSwap(t *testing.T) {
+	db := newTestDB(t)
+	for _, kv := range [][2]string{{"active", "config-1"}, {"standby", "config-2"}} {
+		if err := db.Set([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	check := func(want map[string]string) {
+		t.Helper()
+		for key, wantVal := range want {
+			if val, ok := db.Get([]byte(key)); !ok || string(val) != wantVal {
+				t.Fatalf("Get(%q) = %q %v, want %q", key, val, ok, wantVal)
+			}
+		}
+	}
+	seq := db.Seq()
+	if err := db.Swap([]byte("active"), []byte("standby")); err != nil {
+		t.Fatalf("Swap: %v", err)
+	}
+	check(map[string]string{"active": "config-2", "standby": "config-1"})
+	if db.Seq() != seq+1 {
+		t.Fatalf("Swap took %d commits, want 1", db.Seq()-seq)
+	}
+
+	// a missing key changes nothing
+	for _, pair := range [][2]string{{"active", "none"}, {"none", "standby"}} {
+		if err := db.Swap([]byte(pair[0]), []byte(pair[1])); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Swap(%q, %q) = %v, want ErrKeyNotFound", pair[0], pair[1], err)
+		}
+	}
+	check(map[string]string{"active": "config-2", "standby": "config-1"})
+	if _, ok := db.Get([]byte("none")); ok {
+		t.Fatalf("Swap created the missing key")
+	}
+}
+
+func TestLegacyMaster(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{MasterSlots: 1}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	setPageSize(db, BTREE_PAGE_SIZE, CSUM_NONE)
+	for i := 0; i < 300; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db.Close()
+
+	// cut the master down to the 32 byte layout, the free pages leak
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	clear(data[MASTER_V1_SIZE:BTREE_PAGE_SIZE])
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	check := func(db *KeyValue) {
+		t.Helper()
+		for i := 0; i < 300; i++ {
+			val, ok := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+			if !ok || string(val) != fmt.Sprintf("v%d", i) {
+				t.Fatalf("Get(k%03d) = %q %v", i, val, ok)
+			}
+		}
+	}
+	unchanged := func() {
+		t.Helper()
+		if now, _ := os.ReadFile(path); !bytes.Equal(now, data) {
+			t.Fatalf("the file changed without a write")
+		}
+	}
+
+	// read-only and read-write without writes leave the file alone
+	for _, readOnly := range []bool{true, false} {
+		db = &KeyValue{Path: path, Options: Options{ReadOnly: readOnly}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if m, _, err := masterPick(db); err != nil || m.version != MASTER_V1 {
+			t.Fatalf("master format %d, %v, want %d", m.version, err, MASTER_V1)
+		}
+		check(db)
+		db.Close()
+		unchanged()
+	}
+
+	// the first write upgrades it
+	db = openTestDB(t, path)
+	if err := db.Set([]byte("new"), []byte("1")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	db.Close()
+	db = openTestDB(t, path)
+	defer db.Close()
+	m, _, err := masterPick(db)
+	if err != nil || m.version != MASTER_V3 || m.slots != 1 || m.seq != 1 {
+		t.Fatalf("master %+v, %v after the write", m, err)
+	}
+	check(db)
+	if val, ok := db.Get([]byte("new")); !ok || string(val) != "1" {
+		t.Fatalf("Get(new) = %q %v", val, ok)
+	}
+}
+
+func TestAuditCallbacks(t *testing.T) {
+	events := []string{}
+	db := &KeyValue{
+		Path: filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{
+			OnSet: func(key []byte, val []byte) {
+				events = append(events, "set "+string(key)+"="+string(val))
+				if string(key) == "boom" {
+					panic("audit failure")
+				}
+			},
+			OnDel: func(key []byte) { events = append(events, "del "+string(key)) },
+			OnGet: func(key []byte, found bool) {
+				events = append(events, fmt.Sprintf("get %s %v", key, found))
+			},
+		},
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	must(db.Set([]byte("a"), []byte("1")))
+	must(db.Set([]byte("b"), []byte("2")))
+	must(db.Set([]byte("a"), []byte("3")))
+	_, err := db.Del([]byte("missing")) // no change, no event
+	must(err)
+	db.Get([]byte("a"))
+	must(db.Update(func(tx *Tx) error {
+		must(tx.Set([]byte("c"), []byte("4")))
+		_, err := tx.Del([]byte("b"))
+		return err
+	}))
+	// a rolled back transaction isn't reported
+	tx := db.Begin(true)
+	must(tx.Set([]byte("d"), []byte("5")))
+	tx.Rollback()
+	db.Get([]byte("b"))
+	// a panic is recovered, the write stands
+	must(db.Set([]byte("boom"), []byte("6")))
+	if _, ok := db.Get([]byte("boom")); !ok {
+		t.Fatalf("the write with a panicking callback is missing")
+	}
+
+	want := []string{
+		"set a=1", "set b=2", "set a=3", "get a true",
+		"set c=4", "del b", "get b false", "set boom=6", "get boom true",
+	}
+	if !slices.Equal(events, want) {
+		t.Fatalf("events = %q, want %q", events, want)
+	}
+}
+
+func TestRangeEmpty(t *testing.T) {
+	db := newTestDB(t)
+	if empty, err := db.RangeEmpty(nil, nil); err != nil || !empty {
+		t.Fatalf("RangeEmpty of an empty db = %v %v", empty, err)
+	}
+	val := make([]byte, 100)
+	for i := 0; i < 1000; i += 2 {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	// a hole over several leaves
+	if _, err := db.DeleteRange([]byte("k0200"), []byte("k0600")); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	for _, c := range []struct {
+		lo, hi string
+		empty  bool
+	}{
+		{"k0001", "k0002", true},  // between two keys
+		{"k0001", "k0003", false}, // one key
+		{"k0002", "k0003", false}, // one key at lo
+		{"k0002", "k0002", true},  // no interval
+		{"a", "k0000", true},      // before the first key
+		{"k0199", "k0600", true},  // the hole
+		{"k0199", "k0601", false}, // its end
+		{"k0100", "k0900", false}, // many leaves
+		{"k0999", "", true},       // past the last key
+		{"k0998", "", false},
+		{"", "", false},
+	} {
+		var hi []byte
+		if c.hi != "" {
+			hi = []byte(c.hi)
+		}
+		if empty, err := db.RangeEmpty([]byte(c.lo), hi); err != nil || empty != c.empty {
+			t.Fatalf("RangeEmpty(%q, %q) = %v %v, want %v", c.lo, c.hi, empty, err, c.empty)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	run := func(path string) []byte {
+		db := &KeyValue{Path: path, Options: Options{Deterministic: true}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		rng := rand.New(rand.NewSource(7))
+		for i := 0; i < 3000; i++ {
+			key := []byte(fmt.Sprintf("k%04d", rng.Intn(1000)))
+			var err error
+			if rng.Intn(3) == 0 {
+				_, err = db.Del(key)
+			} else {
+				err = db.Set(key, bytes.Repeat([]byte{byte(i)}, rng.Intn(500)))
+			}
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		err := db.Update(func(tx *Tx) error {
+			for i := 0; i < 200; i++ {
+				if _, err := tx.Del([]byte(fmt.Sprintf("k%04d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		db.Close()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		return data
+	}
+	dir := t.TempDir()
+	a, b := run(filepath.Join(dir, "a.db")), run(filepath.Join(dir, "b.db"))
+	if !bytes.Equal(a, b) {
+		t.Fatalf("the files differ (%d and %d bytes)", len(a), len(b))
+	}
+}
+
+func TestLocate(t *testing.T) {
+	db := newTestDB(t)
+	if ptr, _, found := db.Locate([]byte("k")); ptr != 0 || found {
+		t.Fatalf("Locate in an empty db = %d %v", ptr, found)
+	}
+	val := make([]byte, 100)
+	for i := 0; i < 500; i += 2 {
+		if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	leaves := map[uint64]bool{}
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		ptr, idx, found := db.Locate(key)
+		if ptr < uint64(db.page.masters) || ptr >= db.page.flushed || found != (i%2 == 0) {
+			t.Fatalf("Locate(%s) = %d %d %v, %d pages", key, ptr, idx, found, db.page.flushed)
+		}
+		node := db.pageGet(ptr)
+		if node.btype() != BNODE_LEAF {
+			t.Fatalf("Locate(%s) = %d, not a leaf", key, ptr)
+		}
+		leaves[ptr] = true
+		if found && !bytes.Equal(node.getKey(idx), key) {
+			t.Fatalf("Locate(%s) = %d %d, the key there is %q", key, ptr, idx, node.getKey(idx))
+		}
+		// a missing key goes after the key before it
+		if !found && bytes.Compare(node.getKey(idx-1), key) >= 0 {
+			t.Fatalf("Locate(%s) = %d %d, after %q", key, ptr, idx, node.getKey(idx-1))
+		}
+	}
+	if len(leaves) < 2 {
+		t.Fatalf("the keys are in %d leaves", len(leaves))
+	}
+}
+
+func TestNoMmap(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string, opts Options) *KeyValue {
+		opts.Deterministic = true
+		db := &KeyValue{Path: filepath.Join(dir, name), Options: opts}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return db
+	}
+	mapped := open("mmap.db", Options{})
+	direct := open("pread.db", Options{NoMmap: true, NoMmapCachePages: 16})
+	if mapped.pread != nil || direct.pread == nil || len(direct.mmap.chunks) != 0 {
+		t.Fatalf("the backends aren't set up")
+	}
+
+	ref := map[string][]byte{}
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 4000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", rng.Intn(800)))
+		switch rng.Intn(4) {
+		case 0:
+			d1, err1 := mapped.Del(key)
+			d2, err2 := direct.Del(key)
+			if err1 != nil || err2 != nil || d1 != d2 {
+				t.Fatalf("Del(%s) = %v %v, %v %v", key, d1, err1, d2, err2)
+			}
+			delete(ref, string(key))
+		case 1:
+			v1, ok1 := mapped.Get(key)
+			v2, ok2 := direct.Get(key)
+			want, ok := ref[string(key)]
+			if ok1 != ok || ok2 != ok || !bytes.Equal(v1, want) || !bytes.Equal(v2, want) {
+				t.Fatalf("Get(%s) = %v %v, want %v", key, ok1, ok2, ok)
+			}
+		default:
+			val := bytes.Repeat([]byte{byte(i)}, rng.Intn(600))
+			if err := mapped.Set(key, val); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			if err := direct.Set(key, val); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			ref[string(key)] = val
+		}
+	}
+
+	// an iterator keeps its pages while the writes go on, on both so
+	// the files stay the same
+	iter, other := direct.Scan(nil, nil), mapped.Scan(nil, nil)
+	for i := 0; i < 50; i++ {
+		for _, db := range []*KeyValue{mapped, direct} {
+			if _, err := db.Del([]byte(fmt.Sprintf("k%04d", i))); err != nil {
+				t.Fatalf("Del: %v", err)
+			}
+		}
+	}
+	n := 0
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if !bytes.Equal(val, ref[string(key)]) {
+			t.Fatalf("the iterator has %s = %d bytes", key, len(val))
+		}
+		n++
+	}
+	iter.Close()
+	other.Close()
+	if n != len(ref) {
+		t.Fatalf("the iterator saw %d keys, want %d", n, len(ref))
+	}
+	for i := 0; i < 50; i++ {
+		delete(ref, fmt.Sprintf("k%04d", i))
+	}
+
+	fp1, err1 := mapped.Fingerprint()
+	fp2, err2 := direct.Fingerprint()
+	if err1 != nil || err2 != nil || fp1 != fp2 {
+		t.Fatalf("the fingerprints differ: %v %v", err1, err2)
+	}
+	mapped.Close()
+	direct.Close()
+	a, _ := os.ReadFile(mapped.Path)
+	b, _ := os.ReadFile(direct.Path)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("the files differ (%d and %d bytes)", len(a), len(b))
+	}
+
+	direct = open("pread.db", Options{NoMmap: true, NoMmapCachePages: 16})
+	defer direct.Close()
+	if err := direct.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	for key, want := range ref {
+		if val, ok := direct.Get([]byte(key)); !ok || !bytes.Equal(val, want) {
+			t.Fatalf("Get(%s) after reopening = %v", key, ok)
+		}
+	}
+	if direct.pread.order.Len() > 16 {
+		t.Fatalf("%d pages cached", direct.pread.order.Len())
+	}
+}
+
+var errInjected = errors.New("injected fault")
+
+// stands in for the disk under the database file to crash it at a given
+// write or fsync. the disk keeps what was synced, the writes since are
+// in the page cache and may or may not survive the crash.
+type faultDisk struct {
+	synced   []byte       // the contents as of the last fsync
+	pending  []faultWrite // the writes since
+	inflight faultWrite   // the write that crashed, if it was one
+	ops      int          // the writes and fsyncs so far
+	crashAt  int          // the op that fails, -1 for none
+	crashed  bool         // everything fails from the crash on
+}
+
+type faultWrite struct {
+	off  int64
+	data []byte
+}
+
+// route the writes and fsyncs of the database file through the disk
+func (d *faultDisk) install(t *testing.T) {
+	fileWriteAt = func(fp *os.File, b []byte, off int64) (int, error) {
+		w := faultWrite{off, append([]byte{}, b...)}
+		if d.fault() {
+			if d.ops == d.crashAt+1 {
+				d.inflight = w
+			}
+			return 0, errInjected
+		}
+		d.pending = append(d.pending, w)
+		return fp.WriteAt(b, off)
+	}
+	fileSync = func(fp *os.File) error {
+		if d.fault() {
+			return errInjected
+		}
+		d.synced = faultApply(d.synced, d.pending...)
+		d.pending = nil
+		return fp.Sync()
+	}
+	t.Cleanup(func() {
+		fileWriteAt, fileSync = (*os.File).WriteAt, (*os.File).Sync
+	})
+}
+
+func (d *faultDisk) fault() bool {
+	if !d.crashed && d.ops == d.crashAt {
+		d.crashed = true
+	}
+	d.ops++
+	return d.crashed
+}
+
+// the writes over the contents, growing them as needed
+func faultApply(data []byte, writes ...faultWrite) []byte {
+	data = append([]byte{}, data...)
+	for _, w := range writes {
+		if end := int(w.off) + len(w.data); end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[w.off:], w.data)
+	}
+	return data
+}
+
+// what the disk may hold after the crash, by the name of the fault
+func (d *faultDisk) images() map[string][]byte {
+	out := map[string][]byte{
+		"lost": d.synced,                           // none of the pending writes
+		"kept": faultApply(d.synced, d.pending...), // all of them
+	}
+	// the later writes reach the disk before the earlier ones
+	for _, k := range []int{1, len(d.pending) / 2, len(d.pending) - 1} {
+		if k < 1 || k >= len(d.pending) {
+			continue
+		}
+		out[fmt.Sprintf("reordered %d", k)] = faultApply(d.synced, d.pending[len(d.pending)-k:]...)
+	}
+	// the write that crashed is torn after some bytes
+	if w := d.inflight; w.data != nil {
+		for _, n := range []int{1, len(w.data) / 2, len(w.data) - 1, len(w.data)} {
+			torn := faultWrite{w.off, w.data[:n]}
+			out[fmt.Sprintf("torn at %d", n)] = faultApply(d.synced, append(d.pending, torn)...)
+		}
+	}
+	return out
+}
+
+func TestCrashConsistency(t *testing.T) {
+	scan := func(db *KeyValue) map[string]string {
+		out := map[string]string{}
+		iter := db.Scan(nil, nil)
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			key, val := iter.Deref()
+			out[string(key)] = string(val)
+		}
+		return out
+	}
+	writes := []struct {
+		name string
+		fn   func(db *KeyValue) error
+	}{
+		{"set", func(db *KeyValue) error {
+			return db.Set([]byte("k0050"), bytes.Repeat([]byte("n"), 900))
+		}},
+		{"insert", func(db *KeyValue) error {
+			return db.Set([]byte("k0050x"), bytes.Repeat([]byte("x"), 2000))
+		}},
+		{"tx", func(db *KeyValue) error {
+			return db.Update(func(tx *Tx) error {
+				for i := 0; i < 300; i += 10 {
+					if _, err := tx.Del([]byte(fmt.Sprintf("k%04d", i))); err != nil {
+						return err
+					}
+					if err := tx.Set([]byte(fmt.Sprintf("t%04d", i)), []byte("v")); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}},
+	}
+
+	for _, slots := range []int{2, 4} {
+		dir := t.TempDir()
+		base := filepath.Join(dir, "base.db")
+		db := &KeyValue{Path: base, Options: Options{MasterSlots: slots}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		for i := 0; i < 300; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), bytes.Repeat([]byte{'a' + byte(i%26)}, 300)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		pre := scan(db)
+		db.Close()
+		orig, err := os.ReadFile(base)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		for _, w := range writes {
+			// the state after the write, from a run without faults
+			path := filepath.Join(dir, "run.db")
+			open := func(data []byte, opts Options) *KeyValue {
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+				db := &KeyValue{Path: path, Options: opts}
+				if err := db.Open(); err != nil {
+					t.Fatalf("%d slots, %s: Open: %v", slots, w.name, err)
+				}
+				return db
+			}
+			db := open(orig, Options{})
+			if err := w.fn(db); err != nil {
+				t.Fatalf("%s: %v", w.name, err)
+			}
+			post := scan(db)
+			db.Close()
+
+			crashes := 0
+			for at := 0; ; at++ {
+				db := open(orig, Options{NoMmap: true})
+				disk := &faultDisk{synced: orig, crashAt: at}
+				disk.install(t)
+				err := w.fn(db)
+				crashed := disk.crashed
+				disk.crashed = true // nothing from Close reaches the disk
+				db.Close()
+				fileWriteAt, fileSync = (*os.File).WriteAt, (*os.File).Sync
+				if !crashed {
+					if err != nil {
+						t.Fatalf("%s without a fault: %v", w.name, err)
+					}
+					break // past the last write and fsync
+				}
+				if !errors.Is(err, errInjected) {
+					t.Fatalf("%s crashed at op %d = %v, want %v", w.name, at, err, errInjected)
+				}
+				crashes++
+
+				for fault, data := range disk.images() {
+					name := fmt.Sprintf("%d slots, %s, op %d, %s", slots, w.name, at, fault)
+					// the size of the file, it was extended before the writes
+					size := max(len(orig), len(data))
+					if fi, err := os.Stat(path); err == nil {
+						size = max(size, int(fi.Size()))
+					}
+					data = append(data, make([]byte, size-len(data))...)
+					if err := os.WriteFile(path, data, 0644); err != nil {
+						t.Fatalf("WriteFile: %v", err)
+					}
+					db := &KeyValue{Path: path}
+					if err := db.Open(); err != nil {
+						t.Fatalf("%s: Open: %v", name, err)
+					}
+					got := scan(db)
+					if !maps.Equal(got, pre) && !maps.Equal(got, post) {
+						t.Fatalf("%s: %d keys, neither the %d before nor the %d after",
+							name, len(got), len(pre), len(post))
+					}
+					// still writable, and the pages it reuses weren't in use.
+					// the commit rewrites a torn master slot.
+					if err := w.fn(db); err != nil {
+						t.Fatalf("%s: the write again: %v", name, err)
+					}
+					if got := scan(db); !maps.Equal(got, post) {
+						t.Fatalf("%s: %d keys after the write again, want %d", name, len(got), len(post))
+					}
+					if err := db.HealthCheck(); err != nil {
+						t.Fatalf("%s: HealthCheck: %v", name, err)
+					}
+					db.Close()
+				}
+			}
+			if crashes < 4 {
+				t.Fatalf("%s: %d crash points", w.name, crashes)
+			}
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	db := newTestDB(t)
+	db.Options.CursorSecret = []byte("secret")
+	for i := 0; i < 500; i += 2 {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	seen := []string{}
+	c := db.NewCursor()
+	for len(seen) < 100 {
+		key, val, ok := c.Next()
+		if !ok || string(val) != fmt.Sprint(2*len(seen)) {
+			t.Fatalf("Next = %q %q %v", key, val, ok)
+		}
+		seen = append(seen, string(key))
+	}
+	tok := c.Token()
+
+	// the writes before the resume show up, behind and ahead of it
+	for _, i := range []int{1, 301, 499} {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	c, err := db.NewCursorFromToken(tok)
+	if err != nil {
+		t.Fatalf("NewCursorFromToken: %v", err)
+	}
+	for {
+		key, _, ok := c.Next()
+		if !ok {
+			break
+		}
+		seen = append(seen, string(key))
+	}
+	if c.Err() != nil {
+		t.Fatalf("Err: %v", c.Err())
+	}
+	want := []string{}
+	for i := 0; i < 500; i++ {
+		if i%2 == 0 || i == 301 || i == 499 {
+			want = append(want, fmt.Sprintf("k%04d", i))
+		}
+	}
+	if !slices.Equal(seen, want) {
+		t.Fatalf("the cursors returned %d keys, want %d", len(seen), len(want))
+	}
+
+	// a drained cursor picks up the keys added after the end
+	if err := db.Set([]byte("k9999"), []byte("9999")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if key, _, ok := c.Next(); !ok || string(key) != "k9999" {
+		t.Fatalf("Next after the end = %q %v", key, ok)
+	}
+
+	// the token of a new cursor starts at the first key
+	c, err = db.NewCursorFromToken(db.NewCursor().Token())
+	if key, _, ok := c.Next(); err != nil || !ok || string(key) != "k0000" {
+		t.Fatalf("resumed a new cursor = %q %v %v", key, ok, err)
+	}
+
+	// tampered and foreign tokens are refused
+	bad := append([]byte{}, tok...)
+	bad[3] ^= 1
+	other := &KeyValue{Options: Options{CursorSecret: []byte("other")}}
+	for _, tok := range [][]byte{bad, other.NewCursor().Token(), nil, []byte("!!")} {
+		if _, err := db.NewCursorFromToken(tok); !errors.Is(err, ErrBadCursor) {
+			t.Fatalf("NewCursorFromToken(%q) = %v, want %v", tok, err, ErrBadCursor)
+		}
+	}
+	db.Options.CursorSecret = nil
+	if _, err := db.NewCursorFromToken(db.NewCursor().Token()); err != nil {
+		t.Fatalf("NewCursorFromToken without a secret: %v", err)
+	}
+}
+
+func TestMaxSizes(t *testing.T) {
+	db := newTestDB(t)
+	if k, v, err := db.MaxSizes(); k != 0 || v != 0 || err != nil {
+		t.Fatalf("MaxSizes of an empty db = %d %d %v", k, v, err)
+	}
+	for i := 1; i <= 50; i++ {
+		key := bytes.Repeat([]byte("k"), i)
+		if err := db.Set(key, make([]byte, 3*i)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := db.Set([]byte("big"), make([]byte, 1000)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if k, v, err := db.MaxSizes(); k != 50 || v != 1000 || err != nil {
+		t.Fatalf("MaxSizes = %d %d %v, want 50 1000", k, v, err)
+	}
+	// deleting the largest ones brings up the next
+	db.Del([]byte("big"))
+	db.Del(bytes.Repeat([]byte("k"), 50))
+	if k, v, err := db.MaxSizes(); k != 49 || v != 147 || err != nil {
+		t.Fatalf("MaxSizes after the deletes = %d %d %v, want 49 147", k, v, err)
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	db := newTestDB(t)
+	errTooBig := errors.New("too big")
+	calls := 0
+	db.Options.ValidateValue = func(key []byte, val []byte) error {
+		calls++
+		if len(val) > 100 {
+			return errTooBig
+		}
+		if !json.Valid(val) {
+			return fmt.Errorf("%s: not JSON", key)
+		}
+		return nil
+	}
+	if err := db.Set([]byte("a"), []byte(`{"n": 1}`)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	seq, pages := db.seq, db.page.flushed
+	bad := []func() error{
+		func() error { return db.Set([]byte("a"), []byte(`{"n": `)) },
+		func() error { return db.Set([]byte("b"), []byte(`[`+strings.Repeat("1,", 100)+`1]`)) },
+		func() error { return db.SetWithTTL([]byte("b"), []byte("x"), time.Hour) },
+		func() error {
+			return db.Update(func(tx *Tx) error {
+				if err := tx.Set([]byte("c"), []byte("1")); err != nil {
+					return err
+				}
+				return tx.Set([]byte("d"), []byte("nope"))
+			})
+		},
+	}
+	for i, fn := range bad {
+		if err := fn(); err == nil || (i == 1) != errors.Is(err, errTooBig) {
+			t.Fatalf("bad write %d = %v", i, err)
+		}
+	}
+	if db.seq != seq || db.page.flushed != pages {
+		t.Fatalf("the rejected writes were committed")
+	}
+	if val, _ := db.Get([]byte("a")); string(val) != `{"n": 1}` {
+		t.Fatalf("Get = %q", val)
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if _, ok := db.Get([]byte(key)); ok {
+			t.Fatalf("%s was written", key)
+		}
+	}
+	// the reads don't validate
+	calls = 0
+	db.Get([]byte("a"))
+	db.Scan(nil, nil).Close()
+	if calls != 0 {
+		t.Fatalf("the reads called the validator %d times", calls)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	db.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	off := 84 + 8*(MAX_TREES-1)
+	for slot := 0; slot < DEFAULT_MASTER_SLOTS; slot++ {
+		if mark := binary.LittleEndian.Uint32(data[slot*BTREE_PAGE_SIZE+off:]); mark != BYTE_ORDER_MARK {
+			t.Fatalf("slot %d has the mark %#x", slot, mark)
+		}
+	}
+
+	stamp := func(mark uint32) {
+		for slot := 0; slot < DEFAULT_MASTER_SLOTS; slot++ {
+			binary.BigEndian.PutUint32(data[slot*BTREE_PAGE_SIZE+off:], mark)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	// the mark written big-endian
+	stamp(BYTE_ORDER_MARK)
+	db = &KeyValue{Path: path}
+	if err := db.Open(); !errors.Is(err, ErrByteOrder) {
+		t.Fatalf("Open = %v, want %v", err, ErrByteOrder)
+	}
+	// the files from before the mark open
+	stamp(0)
+	db = openTestDB(t, path)
+	defer db.Close()
+	if val, ok := db.Get([]byte("k")); !ok || string(val) != "v" {
+		t.Fatalf("Get = %q %v", val, ok)
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i%7))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	seen := map[string]string{}
+	iter := db.ScanFilter([]byte("k0100"), []byte("k0900"), func(key []byte, val []byte) bool {
+		if string(key) >= "k0900" {
+			t.Errorf("the filter saw %s past hi", key)
+		}
+		seen[string(key)] = string(val)
+		return string(val) == "3"
+	})
+	got := []string{}
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if string(val) != "3" {
+			t.Fatalf("ScanFilter yielded %s = %s", key, val)
+		}
+		got = append(got, string(key))
+	}
+	want := []string{}
+	for i := 100; i < 900; i++ {
+		if i%7 == 3 {
+			want = append(want, fmt.Sprintf("k%04d", i))
+		}
+		if key := fmt.Sprintf("k%04d", i); seen[key] != fmt.Sprint(i%7) {
+			t.Fatalf("the filter saw %s = %q", key, seen[key])
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("ScanFilter yielded %d keys, want %d", len(got), len(want))
+	}
+	if len(seen) != 800 {
+		t.Fatalf("the filter saw %d entries, want 800", len(seen))
+	}
+
+	// none match
+	iter = db.ScanFilter(nil, nil, func([]byte, []byte) bool { return false })
+	if iter.Valid() {
+		t.Fatalf("ScanFilter rejecting everything is valid")
+	}
+}
+
+func TestCopyOnRead(t *testing.T) {
+	for _, noCopy := range []bool{false, true} {
+		db := &KeyValue{
+			Path:    filepath.Join(t.TempDir(), "test.db"),
+			Options: Options{NoCopyOnRead: noCopy, ValueCacheSize: 16},
+		}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := db.Set([]byte("k"), []byte("old")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		val, ok := db.Get([]byte("k"))
+		it := db.Scan(nil, nil)
+		key, ival := it.Deref()
+		if !ok || string(val) != "old" || string(key) != "k" || string(ival) != "old" {
+			t.Fatalf("%v: read %q %q %q", noCopy, val, key, ival)
+		}
+		if noCopy {
+			// the same bytes as the cached value
+			cached, _ := db.Get([]byte("k"))
+			if again, _ := db.Get([]byte("k")); &again[0] != &cached[0] {
+				t.Fatal("NoCopyOnRead: Get copied the value")
+			}
+			it.Close()
+			db.Close()
+			continue
+		}
+		it.Close()
+
+		// the copies are the caller's, overwrites and reused pages don't
+		// reach them and changing them changes nothing stored
+		for i := 0; i < 100; i++ {
+			if err := db.Set([]byte("k"), []byte(fmt.Sprintf("new%02d", i))); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if string(val) != "old" || string(key) != "k" || string(ival) != "old" {
+			t.Fatalf("the reads changed to %q %q %q", val, key, ival)
+		}
+		got, _ := db.Get([]byte("k"))
+		copy(got, "xxxxx")
+		if got, _ := db.Get([]byte("k")); string(got) != "new99" {
+			t.Fatalf("Get = %q after changing a returned value", got)
+		}
+		db.Close()
+	}
+}
+
+func TestPageLimits(t *testing.T) {
+	if UsableBytesPerPage() != BTREE_PAGE_SIZE-4-HEADER {
+		t.Fatalf("UsableBytesPerPage = %d", UsableBytesPerPage())
+	}
+	for _, pageSize := range []int{BTREE_MIN_PAGE_SIZE, BTREE_PAGE_SIZE, 4 * BTREE_PAGE_SIZE} {
+		db := &KeyValue{
+			Path:    filepath.Join(t.TempDir(), "test.db"),
+			Options: Options{PageSize: pageSize},
+		}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		usable, maxKey, maxVal := db.UsableBytesPerPage(), db.MaxKeySize(), db.MaxValSize()
+		if pageSize == BTREE_PAGE_SIZE && (usable != UsableBytesPerPage() ||
+			maxKey != BTREE_MAX_KEY_SIZE || maxVal != BTREE_MAX_VAL_SIZE) {
+			t.Fatalf("the limits of the default page size are %d %d %d", usable, maxKey, maxVal)
+		}
+		if n := db.MaxEntriesPerPage(8, 8); n != usable/(14+16) {
+			t.Fatalf("%d: %d entries in %d bytes", pageSize, n, usable)
+		}
+		// the largest entry fits in a node
+		if 14+maxKey+maxVal > usable {
+			t.Fatalf("%d: a %d byte key and a %d byte value don't fit", pageSize, maxKey, maxVal)
+		}
+		key := bytes.Repeat([]byte("k"), maxKey)
+		if err := db.Set(key, make([]byte, maxVal)); err != nil {
+			t.Fatalf("%d: Set at the limits: %v", pageSize, err)
+		}
+		if err := db.Set(append(key, 'k'), nil); !errors.Is(err, ErrKeyTooLarge) {
+			t.Fatalf("%d: Set past the key limit = %v", pageSize, err)
+		}
+		if err := db.Set(key, make([]byte, maxVal+1)); !errors.Is(err, ErrValueTooLarge) {
+			t.Fatalf("%d: Set past the value limit = %v", pageSize, err)
+		}
+		// an entry filling a node exactly, and a byte over
+		if err := checkEntry(db, maxKey, usable-14-maxKey); err != nil {
+			t.Fatalf("%d: an entry filling the node: %v", pageSize, err)
+		}
+		if err := checkEntry(db, maxKey, usable-13-maxKey); !errors.Is(err, ErrEntryTooLarge) {
+			t.Fatalf("%d: an entry past the node = %v", pageSize, err)
+		}
+		db.Close()
+	}
+}
+
+func TestDefrag(t *testing.T) {
+	// the fill and the number of the leaves, a full walk
+	leaves := func(db *KeyValue) (float64, int) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		used, n := 0, 0
+		var walk func(ptr uint64)
+		walk = func(ptr uint64) {
+			node := db.tree.get(ptr)
+			if node.btype() == BNODE_LEAF {
+				used += int(node.nbytes())
+				n++
+				return
+			}
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i))
+			}
+		}
+		walk(db.tree.root)
+		return float64(used) / float64(n*db.tree.nsize()), n
+	}
+	fill := func(db *KeyValue) {
+		t.Helper()
+		for i := 0; i < 6000; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		// the inserts in order leave the leaves half full, the
+		// scattered deletes bring them under that, above the merges
+		for i := 0; i < 6000; i++ {
+			if i%4 == 0 {
+				if _, err := db.Del([]byte(fmt.Sprintf("k%05d", i))); err != nil {
+					t.Fatalf("Del: %v", err)
+				}
+			}
+		}
+	}
+
+	db := newTestDB(t)
+	fill(db)
+	before, n := leaves(db)
+	if before > 0.45 {
+		t.Fatalf("the leaves are %.2f full after the deletes", before)
+	}
+	sum, _ := db.Fingerprint()
+	iter := db.Scan(nil, nil) // reads the pages from before
+	saved, err := db.Defrag()
+	if err != nil {
+		t.Fatalf("Defrag: %v", err)
+	}
+	after, m := leaves(db)
+	if saved != n-m || after < 0.8 || m*2 > n {
+		t.Fatalf("Defrag saved %d of %d leaves, %d left, the fill went from %.2f to %.2f",
+			saved, n, m, before, after)
+	}
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	if count != 4500 {
+		t.Fatalf("the iterator saw %d keys", count)
+	}
+	if got, _ := db.Fingerprint(); got != sum {
+		t.Fatalf("Defrag changed the data")
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify after Defrag: %v", err)
+	}
+	if saved, err := db.Defrag(); saved != 0 || err != nil {
+		t.Fatalf("Defrag again = %d, %v", saved, err)
+	}
+	// the tree still takes writes
+	for i := 0; i < 6000; i += 4 {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("x")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 1; i < 6000; i += 4 {
+		if val, ok := db.Get([]byte(fmt.Sprintf("k%05d", i))); !ok || !bytes.Equal(val, bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Fatalf("Get(k%05d) = %v", i, ok)
+		}
+	}
+
+	// in the background
+	path := filepath.Join(t.TempDir(), "auto.db")
+	db = openTestDB(t, path)
+	fill(db)
+	db.Close()
+	db = &KeyValue{Path: path, Options: Options{AutoDefrag: 5 * time.Millisecond}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		if f, _ := leaves(db); f > 0.8 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("AutoDefrag didn't run")
+		}
+	}
+}
+
+func TestVerifyOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 50)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 2000; i += 3 {
+		db.Del([]byte(fmt.Sprintf("k%05d", i)))
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	ptr, _, _ := db.Locate([]byte("k01000"))
+	db.Close()
+
+	db = &KeyValue{Path: path, Options: Options{VerifyOnOpen: true}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open a healthy file: %v", err)
+	}
+	db.Close()
+
+	// keys out of order in a leaf with a valid checksum
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	page := data[int(ptr)*BTREE_PAGE_SIZE:][:BTREE_PAGE_SIZE]
+	leaf := BNode{page}
+	copy(leaf.getKey(2), leaf.getKey(0))
+	pageSeal(db, page)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	db = &KeyValue{Path: path, Options: Options{VerifyOnOpen: true}}
+	if err := db.Open(); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Open a broken file = %v, want %v", err, ErrInconsistent)
+	}
+	// found by Verify without the option
+	db = openTestDB(t, path)
+	defer db.Close()
+	if err := db.Verify(); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Verify = %v, want %v", err, ErrInconsistent)
+	}
+}
+
+func TestCloseWaitsForReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{CloseTimeout: 20 * time.Millisecond}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	// the timeout leaves the database open
+	iter := db.Scan(nil, nil)
+	if err := db.Close(); !errors.Is(err, ErrBusy) {
+		t.Fatalf("Close with an open iterator = %v, want %v", err, ErrBusy)
+	}
+	if _, ok := db.Get([]byte("k000")); !ok {
+		t.Fatalf("Get after the timeout failed")
+	}
+	iter.Close()
+
+	// Close waits for a slow reader to finish
+	db.Options.CloseTimeout = -1
+	iter = db.Scan(nil, nil)
+	var read atomic.Int32
+	go func() {
+		for ; iter.Valid(); iter.Next() {
+			iter.Deref()
+			read.Add(1)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := read.Load(); n != 100 {
+		t.Fatalf("Close returned after the iterator read %d keys", n)
+	}
+}
+
+func TestSeparatorKeys(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.SeparatorKeys(0); err == nil {
+		t.Fatalf("SeparatorKeys of an empty tree succeeded")
+	}
+	const n = 20000
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < n; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("k%06d", i*7919%n)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	for level := 0; level < 2; level++ {
+		keys, err := db.SeparatorKeys(level)
+		if err != nil || len(keys) < 2 {
+			t.Fatalf("SeparatorKeys(%d) = %d keys, %v", level, len(keys), err)
+		}
+		// the ranges between them hold about the same number of keys
+		counts := []int{}
+		bounds := append(append([][]byte{nil}, keys...), nil)
+		for i := 0; i+1 < len(bounds); i++ {
+			if i > 0 && i+1 < len(bounds)-1 && bytes.Compare(bounds[i], bounds[i+1]) >= 0 {
+				t.Fatalf("level %d: separator %d is out of order", level, i)
+			}
+			count := 0
+			for iter := db.Scan(bounds[i], bounds[i+1]); iter.Valid(); iter.Next() {
+				count++
+			}
+			counts = append(counts, count)
+		}
+		avg := n / len(counts)
+		for i, count := range counts {
+			if count == 0 || count > 3*avg {
+				t.Fatalf("level %d: range %d has %d keys, %d on average", level, i, count, avg)
+			}
+		}
+	}
+	if _, err := db.SeparatorKeys(2); err == nil {
+		t.Fatalf("SeparatorKeys of the leaves succeeded")
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	db := newTestDB(t)
+	if n, err := db.EstimateCount(nil, nil); n != 0 || err != nil {
+		t.Fatalf("EstimateCount on an empty db = %d, %v", n, err)
+	}
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 20000; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, i%100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	exact := func(lo []byte, hi []byte) int {
+		n := 0
+		for it := db.Scan(lo, hi); it.Valid(); it.Next() {
+			n++
+		}
+		return n
+	}
+	ranges := [][2]string{
+		{"", ""}, {"k00000", "k10000"}, {"k05000", "k05100"},
+		{"k12345", "k19000"}, {"k19990", ""}, {"k07000", "k07000"},
+		{"k08000", "k01000"}, {"z", ""},
+	}
+	for _, r := range ranges {
+		lo, hi := []byte(r[0]), []byte(r[1])
+		if r[1] == "" {
+			hi = nil
+		}
+		got, err := db.EstimateCount(lo, hi)
+		if err != nil {
+			t.Fatalf("EstimateCount(%q, %q): %v", lo, hi, err)
+		}
+		want := exact(lo, hi)
+		// within a fifth, or about a leaf for the short ranges
+		if diff := max(int(got)-want, want-int(got)); diff > want/5+50 {
+			t.Fatalf("EstimateCount(%q, %q) = %d, want about %d", lo, hi, got, want)
+		}
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	var stats []FlushStats
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{OnFlush: func(s FlushStats) {
+		stats = append(stats, s)
+	}}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 5000; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	height := 1
+	for node := db.tree.get(db.tree.root); node.btype() == BNODE_NODE; node = db.tree.get(node.getPtr(0)) {
+		height++
+	}
+	if height < 3 {
+		t.Fatalf("the tree has %d levels", height)
+	}
+
+	// a Set rewrites the path from its leaf to the root
+	stats = nil
+	if err := db.Set([]byte("k02500"), make([]byte, 100)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("%d flushes reported", len(stats))
+	}
+	s := stats[0]
+	if s.Pages != height || s.Changes != 1 || s.Bytes != 106 || s.PageSize != BTREE_PAGE_SIZE {
+		t.Fatalf("Set reported %+v, the tree has %d levels", s, height)
+	}
+	if want := float64((s.Pages+s.FreeListPages)*BTREE_PAGE_SIZE) / 106; s.Amplification() != want {
+		t.Fatalf("Amplification = %v, want %v", s.Amplification(), want)
+	}
+
+	// nothing for a failed write, and the next commit starts over
+	stats = nil
+	db.Update(func(tx *Tx) error {
+		tx.Set([]byte("x"), []byte("y"))
+		return errors.New("rollback")
+	})
+	if _, err := db.Del([]byte("k00001")); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Changes != 1 || stats[0].Bytes != 6 {
+		t.Fatalf("Del reported %+v", stats)
+	}
+}
+
+func TestPinPrefix(t *testing.T) {
+	locked := map[uintptr]int{}
+	addr := func(b []byte) uintptr { return uintptr(unsafe.Pointer(&b[0])) }
+	mlock = func(b []byte) error {
+		locked[addr(b)]++
+		return nil
+	}
+	munlock = func(b []byte) error {
+		if locked[addr(b)]--; locked[addr(b)] == 0 {
+			delete(locked, addr(b))
+		}
+		return nil
+	}
+	defer func() { mlock, munlock = syscall.Mlock, syscall.Munlock }()
+
+	db := newTestDB(t)
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 500; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("%s%03d", prefix, i)), make([]byte, 100)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+	unpin := db.PinPrefix([]byte("b"))
+	pinned := len(locked)
+	// the root and the leaves of the prefix, each locked once
+	if db.pinned.count[db.tree.root] != 1 {
+		t.Fatalf("the root isn't pinned")
+	}
+	for i := 0; i < 500; i++ {
+		ptr, _, _ := db.Locate([]byte(fmt.Sprintf("b%03d", i)))
+		if db.pinned.count[ptr] != 1 {
+			t.Fatalf("the leaf of b%03d isn't pinned", i)
+		}
+	}
+	if ptr, _, _ := db.Locate([]byte("a100")); db.pinned.count[ptr] != 0 {
+		t.Fatalf("a leaf outside the prefix is pinned")
+	}
+	if pinned != len(db.pinned.count) || pinned > 30 {
+		t.Fatalf("%d pages locked for %d pinned", pinned, len(db.pinned.count))
+	}
+
+	// pinned twice, locked until both are gone
+	again := db.PinPrefix([]byte("b"))
+	unpin()
+	unpin()
+	if len(locked) != pinned {
+		t.Fatalf("%d pages locked after one unpin, want %d", len(locked), pinned)
+	}
+	again()
+	if len(locked) != 0 || len(db.pinned.count) != 0 {
+		t.Fatalf("%d pages locked after the unpins", len(locked))
+	}
+
+	// LockMemory has them locked already
+	db.Options.LockMemory = true
+	db.PinPrefix([]byte("c"))()
+	if len(locked) != 0 {
+		t.Fatalf("PinPrefix locked pages with LockMemory")
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{BloomKeys: 1000}
+	db := &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	// past the expected count, the filter only gets less selective
+	for i := 0; i < 2000; i += 2 {
+		if err := db.Set(key(i), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	tx := db.Begin(true)
+	tx.Set(key(2001), []byte("v"))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if _, err := db.Del(key(0)); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+
+	check := func(db *KeyValue, when string) {
+		t.Helper()
+		passed := 0
+		for i := 0; i < 2002; i++ {
+			present := i%2 == 0 && i != 0 && i < 2000 || i == 2001
+			if db.bloom.mayContain(key(i)) {
+				passed++
+			} else if present {
+				t.Fatalf("%s: the filter misses %s", when, key(i))
+			}
+			if _, ok := db.Get(key(i)); ok != present {
+				t.Fatalf("%s: Get(%s) found %v", when, key(i), ok)
+			}
+		}
+		// the 1000 keys and a share of the 1002 others
+		if passed > 1600 {
+			t.Fatalf("%s: %d of 2002 keys pass the filter", when, passed)
+		}
+		vals := db.GetMulti([][]byte{key(2), key(3)})
+		if vals[0] == nil || vals[1] != nil {
+			t.Fatalf("%s: GetMulti = %q", when, vals)
+		}
+	}
+	check(db, "written")
+	db.Close()
+
+	// rebuilt from the keys on open
+	db = &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	check(db, "reopened")
+
+	// and on Refresh for the keys of another writer
+	ro := opts
+	ro.ReadOnly = true
+	reader := &KeyValue{Path: path, Options: ro}
+	if err := reader.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer reader.Close()
+	if err := db.Set([]byte("new"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if _, ok := reader.Get([]byte("new")); !ok {
+		t.Fatalf("the reader misses the key after Refresh")
+	}
+
+	// disabled, everything may be there
+	if (&KeyValue{}).bloom.mayContain([]byte("x")) != true {
+		t.Fatalf("a nil filter rejects a key")
+	}
+}
+
+func TestMergeSparseLeaves(t *testing.T) {
+	db := newTestDB(t)
+	// the fill and the number of the leaves
+	leaves := func() (float64, int) {
+		used, n := 0, 0
+		var walk func(ptr uint64)
+		walk = func(ptr uint64) {
+			node := db.tree.get(ptr)
+			if node.btype() == BNODE_LEAF {
+				used, n = used+int(node.nbytes()), n+1
+				return
+			}
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i))
+			}
+		}
+		walk(db.tree.root)
+		return float64(used) / float64(n*db.tree.nsize()), n
+	}
+	// in order the leaves are left half full, 2 deletes out of 5
+	// bring them to 30%, above the merges of Del
+	for i := 0; i < 5000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		if i%5 < 2 {
+			if _, err := db.Del([]byte(fmt.Sprintf("k%05d", i))); err != nil {
+				t.Fatalf("Del: %v", err)
+			}
+		}
+	}
+	before, n := leaves()
+	if before < 0.25 || before > 0.35 {
+		t.Fatalf("the leaves are %.2f full after the deletes", before)
+	}
+	sum, _ := db.Fingerprint()
+
+	if _, err := db.MergeSparseLeaves(0); err == nil {
+		t.Fatalf("MergeSparseLeaves took a threshold of 0")
+	}
+	// above the fill of the leaves, below that of two merged
+	merges, err := db.MergeSparseLeaves(0.4)
+	if err != nil {
+		t.Fatalf("MergeSparseLeaves: %v", err)
+	}
+	after, m := leaves()
+	if merges != n-m || m*10 > n*6 || after < 0.5 {
+		t.Fatalf("%d merges, %d leaves of %d left, the fill went from %.2f to %.2f",
+			merges, m, n, before, after)
+	}
+	if got, _ := db.Fingerprint(); got != sum {
+		t.Fatalf("the contents changed")
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	// the merged leaves are above it now
+	if merges, err := db.MergeSparseLeaves(0.4); err != nil || merges != 0 {
+		t.Fatalf("MergeSparseLeaves again = %d, %v", merges, err)
+	}
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KeyValue{Path: path, Options: Options{EnableLatencyMetrics: true}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		for j := 0; j < 3; j++ {
+			db.Get([]byte(fmt.Sprintf("k%03d", i*j)))
+		}
+		if i%2 == 0 {
+			if _, err := db.Del([]byte(fmt.Sprintf("k%03d", i/2))); err != nil {
+				t.Fatalf("Del: %v", err)
+			}
+		}
+	}
+	m := db.Metrics()
+	for _, c := range []struct {
+		name  string
+		stats LatencyStats
+		want  uint64
+	}{
+		{"Set", m.Set, 100}, {"Get", m.Get, 300}, {"Del", m.Del, 50},
+		{"Flush", m.Flush, 150}, // a commit per Set and Del
+	} {
+		s := c.stats
+		if s.Count != c.want {
+			t.Fatalf("%s: %d samples, want %d", c.name, s.Count, c.want)
+		}
+		if s.P50 <= 0 || s.P50 > s.P99 || s.P99 > s.P999 || s.P999 > time.Second {
+			t.Fatalf("%s: percentiles %v %v %v", c.name, s.P50, s.P99, s.P999)
+		}
+	}
+
+	// each latency is in its bucket, within 25% of the bucket's top
+	for _, ns := range []uint64{0, 1, 3, 4, 7, 8, 9, 10, 1000, 12345, 1 << 40, 1<<64 - 1} {
+		idx := latencyBucket(ns)
+		top := latencyBucketMax(idx)
+		if idx >= LATENCY_BUCKETS || ns > top || float64(top-ns) > 0.25*float64(ns) {
+			t.Fatalf("%d ns in bucket %d up to %d", ns, idx, top)
+		}
+		if idx > 0 && latencyBucketMax(idx-1) >= ns {
+			t.Fatalf("%d ns in bucket %d, the one before goes up to %d",
+				ns, idx, latencyBucketMax(idx-1))
+		}
+	}
+
+	// off by default
+	if (newTestDB(t).Metrics() != Metrics{}) {
+		t.Fatalf("metrics without EnableLatencyMetrics")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	db := newTestDB(t)
+	get := func(key string) string {
+		val, ok := db.Get([]byte(key))
+		if !ok {
+			return "<missing>"
+		}
+		return string(val)
+	}
+
+	// a lock taken only if nobody holds it
+	acquire := func(owner string) bool {
+		t.Helper()
+		ok, err := db.Txn(
+			[]Condition{{Key: []byte("lock"), Absent: true}},
+			[]Op{{Key: []byte("lock"), Value: []byte(owner)}},
+			nil,
+		)
+		if err != nil {
+			t.Fatalf("Txn: %v", err)
+		}
+		return ok
+	}
+	if !acquire("a") || acquire("b") || get("lock") != "a" {
+		t.Fatalf("the lock is held by %s", get("lock"))
+	}
+	// released by its owner only
+	release := func(owner string) (bool, error) {
+		return db.Txn(
+			[]Condition{{Key: []byte("lock"), Value: []byte(owner)}},
+			[]Op{{Key: []byte("lock"), Delete: true}},
+			nil,
+		)
+	}
+	if ok, err := release("b"); ok || err != nil || get("lock") != "a" {
+		t.Fatalf("release by b = %v, %v", ok, err)
+	}
+	if ok, err := release("a"); !ok || err != nil || get("lock") != "<missing>" {
+		t.Fatalf("release by a = %v, %v", ok, err)
+	}
+
+	// one winner among the writers racing for it
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := db.Txn(
+				[]Condition{{Key: []byte("lock"), Absent: true}},
+				[]Op{{Key: []byte("lock"), Value: []byte(fmt.Sprint(i))}},
+				nil,
+			)
+			if err != nil {
+				t.Errorf("Txn: %v", err)
+			}
+			if ok {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("%d writers took the lock", winners)
+	}
+
+	// swap two values if both are as expected, else record it
+	db.Set([]byte("x"), []byte("1"))
+	db.Set([]byte("y"), []byte("2"))
+	swap := func(x, y string) bool {
+		t.Helper()
+		ok, err := db.Txn(
+			[]Condition{{Key: []byte("x"), Value: []byte(x)}, {Key: []byte("y"), Value: []byte(y)}},
+			[]Op{{Key: []byte("x"), Value: []byte(y)}, {Key: []byte("y"), Value: []byte(x)}},
+			[]Op{{Key: []byte("failed"), Value: []byte(x + y)}},
+		)
+		if err != nil {
+			t.Fatalf("Txn: %v", err)
+		}
+		return ok
+	}
+	if !swap("1", "2") || get("x") != "2" || get("y") != "1" || get("failed") != "<missing>" {
+		t.Fatalf("after the swap x=%s y=%s failed=%s", get("x"), get("y"), get("failed"))
+	}
+	if swap("1", "2") || get("x") != "2" || get("y") != "1" || get("failed") != "12" {
+		t.Fatalf("after the failed swap x=%s y=%s failed=%s", get("x"), get("y"), get("failed"))
+	}
+
+	// a bad op undoes the ones before it
+	ok, err := db.Txn(nil, []Op{{Key: []byte("x"), Value: []byte("3")}, {Key: nil}}, nil)
+	if ok || !errors.Is(err, ErrEmptyKey) || get("x") != "2" {
+		t.Fatalf("Txn with a bad op = %v, %v, x=%s", ok, err, get("x"))
+	}
+}
+
+func TestCleanShutdown(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	open := func(path string) *KeyValue {
+		t.Helper()
+		db := openTestDB(t, path)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	db := open(path)
+	if !db.IsCleanShutdown() {
+		t.Fatalf("a new file isn't clean")
+	}
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	// a copy of the file as a crash would leave it
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a reader sees the writer still open
+	reader := &KeyValue{Path: path, Options: Options{ReadOnly: true}}
+	if err := reader.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if reader.IsCleanShutdown() {
+		t.Fatalf("clean with the writer open")
+	}
+	reader.Close()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db = open(path)
+	if !db.IsCleanShutdown() {
+		t.Fatalf("not clean after Close")
+	}
+	if val, ok := db.Get([]byte("k")); !ok || string(val) != "v" {
+		t.Fatalf("Get = %q, %v", val, ok)
+	}
+	db.Close()
+
+	crashed := filepath.Join(dir, "crashed.db")
+	if err := os.WriteFile(crashed, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db = open(crashed)
+	if db.IsCleanShutdown() {
+		t.Fatalf("clean after a crash")
+	}
+	if val, ok := db.Get([]byte("k")); !ok || string(val) != "v" {
+		t.Fatalf("Get after the crash = %q, %v", val, ok)
+	}
+	// closing it marks it clean, writes or not
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if db = open(crashed); !db.IsCleanShutdown() {
+		t.Fatalf("not clean after closing the crashed file")
+	}
+
+	// a failed last commit leaves it dirty
+	if err := db.Set([]byte("k"), []byte("v2")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	fileSync = func(*os.File) error { return errInjected }
+	err = db.Set([]byte("k"), []byte("v3"))
+	fileSync = (*os.File).Sync
+	if err == nil {
+		t.Fatalf("Set with a failing fsync succeeded")
+	}
+	db.Close()
+	if db = open(crashed); db.IsCleanShutdown() {
+		t.Fatalf("clean after a failed commit")
+	}
+}
+
+func TestScanReadAhead(t *testing.T) {
+	db := &KeyValue{
+		Path:    filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{ScanReadAhead: 4},
+	}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 5000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{byte(i)}, 200)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	scan := func(lo, hi []byte) (out []string) {
+		it := db.Scan(lo, hi)
+		for ; it.Valid(); it.Next() {
+			key, val := it.Deref()
+			out = append(out, fmt.Sprintf("%s=%x", key, val[:1]))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		return out
+	}
+	all, part := scan(nil, nil), scan([]byte("k01234"), []byte("k03456"))
+	db.Options.ScanReadAhead = 0
+	if !slices.Equal(all, scan(nil, nil)) || !slices.Equal(part, scan([]byte("k01234"), []byte("k03456"))) {
+		t.Fatalf("the scans differ with the read ahead")
+	}
+	if len(all) != 5000 || len(part) != 2222 {
+		t.Fatalf("scanned %d and %d keys", len(all), len(part))
+	}
+
+	// each leaf after the first of its parent is hinted once before
+	// the iterator gets to it
+	db.mu.RLock()
+	tree := snapshotTree(db, db.tree.root)
+	db.mu.RUnlock()
+	tree.ahead = 4
+	hinted := map[uint64]int{}
+	tree.prefetch = func(ptrs []uint64) {
+		for _, ptr := range ptrs {
+			hinted[ptr]++
+		}
+	}
+	iter := tree.SeekLE([]byte("k00500"))
+	iter.readAhead(false)
+	n := len(iter.path)
+	if n < 3 {
+		t.Fatalf("a tree of height %d", n)
+	}
+	leaves := 0
+	for prev := uint64(0); iter.Valid(); iter.Next() {
+		pos := iter.pos[n-2]
+		leaf := iter.path[n-2].getPtr(pos)
+		if leaf == prev {
+			continue
+		}
+		prev = leaf
+		if leaves++; leaves > 1 && pos > 0 && hinted[leaf] != 1 {
+			t.Fatalf("leaf %d hinted %d times", leaf, hinted[leaf])
+		}
+	}
+	if leaves < 100 || len(hinted) < leaves*3/4 {
+		t.Fatalf("%d of %d leaves hinted", len(hinted), leaves)
+	}
+}
+
+func TestAppMeta(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := openTestDB(t, path)
+	if val, ok := db.GetMeta("schema"); ok || val != nil {
+		t.Fatalf("GetMeta on a new file = %q, %v", val, ok)
+	}
+	meta := map[string]string{"schema": "3", "app": "inventory", "migrated": "2024-01-02"}
+	for key, val := range meta {
+		if err := db.SetMeta(key, []byte(val)); err != nil {
+			t.Fatalf("SetMeta: %v", err)
+		}
+	}
+	if err := db.Set([]byte("schema"), []byte("a user key")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := db.SetMeta("gone", []byte("x")); err != nil {
+		t.Fatalf("SetMeta: %v", err)
+	}
+	if err := db.SetMeta("gone", nil); err != nil {
+		t.Fatalf("SetMeta to remove: %v", err)
+	}
+
+	// bounded, a failed one changes nothing
+	if err := db.SetMeta("big", make([]byte, MAX_APP_META)); !errors.Is(err, ErrMetaTooLarge) {
+		t.Fatalf("SetMeta past MAX_APP_META = %v", err)
+	}
+	if err := db.SetMeta("", []byte("x")); err == nil {
+		t.Fatalf("SetMeta took an empty name")
+	}
+	seq := db.Seq()
+	db.Close()
+
+	check := func(db *KeyValue) {
+		t.Helper()
+		for key, want := range meta {
+			if val, ok := db.GetMeta(key); !ok || string(val) != want {
+				t.Fatalf("GetMeta(%s) = %q, %v, want %q", key, val, ok, want)
+			}
+		}
+		for _, key := range []string{"gone", "big"} {
+			if _, ok := db.GetMeta(key); ok {
+				t.Fatalf("GetMeta(%s) found", key)
+			}
+		}
+		// apart from the keys
+		if val, _ := db.Get([]byte("schema")); string(val) != "a user key" {
+			t.Fatalf("Get(schema) = %q", val)
+		}
+	}
+	db = openTestDB(t, path)
+	check(db)
+	if db.Seq() != seq {
+		t.Fatalf("seq %d, want %d", db.Seq(), seq)
+	}
+	// kept by the writes and a compaction of the file
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("k%03d", i)), make([]byte, 500))
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatalf("Shrink: %v", err)
+	}
+	check(db)
+	db.Close()
+
+	// and by Migrate
+	moved := filepath.Join(dir, "moved.db")
+	if err := Migrate(path, moved, 8192); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	db = openTestDB(t, moved)
+	defer db.Close()
+	check(db)
+
+	// a damaged area fails the slot like the rest of the master
+	data := make([]byte, APP_META_END)
+	appMetaEncode(data, map[string][]byte{"k": []byte("v")})
+	if got, err := appMetaDecode(data); err != nil || string(got["k"]) != "v" {
+		t.Fatalf("appMetaDecode = %v, %v", got, err)
+	}
+	data[APP_META_OFFSET+8] ^= 1
+	if _, err := appMetaDecode(data); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("appMetaDecode of a damaged area = %v", err)
+	}
+}
+
+func TestMaxDirtyPages(t *testing.T) {
+	const limit = 16
+	dir := t.TempDir()
+	peak := 0 // of the commits
+	db := &KeyValue{Path: filepath.Join(dir, "test.db"), Options: Options{
+		MaxDirtyPages: limit,
+		OnFlush:       func(s FlushStats) { peak = max(peak, s.DirtyPages) },
+	}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("k%05d", (i*7919)%2000)) }
+	for i := 0; i < 2000; i++ {
+		if err := db.Set(key(i), make([]byte, 100)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	sum, err := db.Fingerprint()
+	if err != nil {
+		t.Fatalf("Fingerprint: %v", err)
+	}
+	unchanged := func() {
+		t.Helper()
+		if got, _ := db.Fingerprint(); got != sum {
+			t.Fatal("the failed write changed the data")
+		}
+		if n := db.DirtyPages(); n != 0 {
+			t.Fatalf("%d dirty pages after the failed write", n)
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+
+	// a transaction over many leaves fails whole
+	err = db.Update(func(tx *Tx) error {
+		for i := 0; i < 2000; i += 10 {
+			tx.Set(key(i), []byte("new"))
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrTooManyDirtyPages) {
+		t.Fatalf("large transaction = %v, want ErrTooManyDirtyPages", err)
+	}
+	unchanged()
+	err = db.Update(func(tx *Tx) error {
+		for i := 0; i < 2000; i += 10 {
+			tx.Del(key(i))
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrTooManyDirtyPages) {
+		t.Fatalf("large delete = %v, want ErrTooManyDirtyPages", err)
+	}
+	unchanged()
+	// a range deleted in order frees its pages as it goes
+	if n, err := db.DeleteRange([]byte("k00000"), []byte("k01000")); err != nil || n != 1000 {
+		t.Fatalf("DeleteRange = %d, %v", n, err)
+	}
+
+	// a small one goes through
+	if err := db.Update(func(tx *Tx) error {
+		return tx.Set(key(0), []byte("new"))
+	}); err != nil {
+		t.Fatalf("small transaction: %v", err)
+	}
+
+	// the pages of a transaction are counted as its writes are applied
+	peak = 0
+	if err := db.Update(func(tx *Tx) error {
+		for i := 1000; i < 1003; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("mid")); err != nil {
+				return err
+			}
+		}
+		if n := tx.DirtyPages(); n != 0 {
+			t.Fatalf("%d dirty pages before the writes are applied", n)
+		}
+		tx.Scan(nil, nil).Close()
+		if n := tx.DirtyPages(); n == 0 || n > limit {
+			t.Fatalf("%d dirty pages in the transaction, the limit is %d", n, limit)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+	if peak == 0 || peak > limit {
+		t.Fatalf("the commit held %d dirty pages, the limit is %d", peak, limit)
+	}
+
+	// the purge commits in batches under the limit
+	for i := 0; i < 2000; i++ {
+		if err := db.SetWithTTL(key(i), []byte("v"), time.Millisecond); err != nil {
+			t.Fatalf("SetWithTTL: %v", err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n, err := db.PurgeExpired(); err != nil || n != 2000 {
+		t.Fatalf("PurgeExpired = %d, %v", n, err)
+	}
+	if peak > limit {
+		t.Fatalf("a commit held %d dirty pages, the limit is %d", peak, limit)
+	}
+
+	// and so does the bulk writer
+	path := filepath.Join(dir, "bulk.db")
+	w, err := NewBulkWriter(path, Options{MaxDirtyPages: limit})
+	if err != nil {
+		t.Fatalf("NewBulkWriter: %v", err)
+	}
+	for i := 0; i < 20000; i++ {
+		if err := w.Add([]byte(fmt.Sprintf("k%06d", i)), make([]byte, 100)); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		if n := dirtyPages(w.db); n > limit {
+			t.Fatalf("%d dirty pages in the bulk writer", n)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	bulk := openTestDB(t, path)
+	defer bulk.Close()
+	if err := bulk.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+}
+
+func TestGetAsOf(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := &KeyValue{Path: path, Options: Options{HistoryCommits: 8}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	filler := make([]byte, 500)
+	key := []byte("key")
+
+	// other keys in the commits so the pages are reused
+	seqs := []uint64{}
+	for i := 0; i < 6; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			for j := 0; j < 20; j++ {
+				tx.Set([]byte(fmt.Sprintf("k%02d", j)), filler)
+			}
+			if i == 3 {
+				_, err := tx.Del(key)
+				return err
+			}
+			return tx.Set(key, []byte(fmt.Sprintf("v%d", i)))
+		}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		seqs = append(seqs, db.Seq())
+	}
+	check := func(i int) {
+		t.Helper()
+		val, ok, err := db.GetAsOf(seqs[i], key)
+		if err != nil {
+			t.Fatalf("GetAsOf(%d): %v", seqs[i], err)
+		}
+		if i == 3 {
+			if ok {
+				t.Fatalf("GetAsOf(%d) found the deleted key", seqs[i])
+			}
+		} else if want := fmt.Sprintf("v%d", i); !ok || string(val) != want {
+			t.Fatalf("GetAsOf(%d) = %q, %v, want %q", seqs[i], val, ok, want)
+		}
+	}
+	for i := range seqs {
+		check(i)
+	}
+	if _, _, err := db.GetAsOf(db.Seq()+1, key); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("GetAsOf of a future commit = %v", err)
+	}
+
+	// the window moves on with the commits
+	for i := 0; i < 5; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), filler); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := range seqs {
+		if seqs[i]+8 < db.Seq() {
+			if _, _, err := db.GetAsOf(seqs[i], key); !errors.Is(err, ErrHistoryUnavailable) {
+				t.Fatalf("GetAsOf(%d) past the window = %v", seqs[i], err)
+			}
+		} else {
+			check(i)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// a compaction reuses the pages, only the last commit is left
+	if err := db.Shrink(); err != nil {
+		t.Fatalf("Shrink: %v", err)
+	}
+	if _, _, err := db.GetAsOf(seqs[5], key); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("GetAsOf after Shrink = %v", err)
+	}
+	if val, ok, err := db.GetAsOf(db.Seq(), key); err != nil || !ok || string(val) != "v5" {
+		t.Fatalf("GetAsOf of the last commit = %q, %v, %v", val, ok, err)
+	}
+}
+
+func TestFlushFreeListOrder(t *testing.T) {
+	db := &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{PageSize: 1024}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("k%05d", (i*7919)%5000)) }
+	for i := 0; i < 5000; i++ {
+		db.tree.Insert(key(i), make([]byte, 50))
+		if i%500 == 499 {
+			if err := flushPages(db); err != nil {
+				t.Fatalf("flushPages: %v", err)
+			}
+		}
+	}
+
+	// the times each page is in the tree, the list nodes, the masters
+	// and, with items, the free pages
+	count := func(items bool) []int {
+		counts := make([]int, db.page.flushed)
+		var walk func(ptr uint64)
+		walk = func(ptr uint64) {
+			counts[ptr]++
+			node := db.pageGet(ptr)
+			if node.btype() == BNODE_NODE {
+				for i := uint16(0); i < node.nkeys(); i++ {
+					walk(node.getPtr(i))
+				}
+			}
+		}
+		walk(db.tree.root)
+		nodes, free := flWalk(&db.free)
+		if items {
+			nodes = append(append(nodes, free...), snapshotHeld(db)...)
+		}
+		for _, ptr := range nodes {
+			counts[ptr]++
+		}
+		for slot := 0; slot < db.page.masters; slot++ {
+			counts[slot]++
+		}
+		return counts
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		live := count(false)
+		// frees and allocations interleaved in one flush, the tree
+		// takes pages from the free list the deletes refill
+		for i := 0; i < 300; i++ {
+			k := key(rng.Intn(5000))
+			if rng.Intn(2) == 0 {
+				db.tree.Delete(k)
+			} else {
+				db.tree.Insert(k, make([]byte, rng.Intn(100)))
+			}
+		}
+		if db.page.nfree == 0 {
+			t.Fatalf("round %d took no page from the free list", round)
+		}
+		if err := writePages(db); err != nil {
+			t.Fatalf("writePages: %v", err)
+		}
+		// nothing the last commit reads is written over
+		for ptr, page := range db.page.updates {
+			if page != nil && ptr < uint64(len(live)) && live[ptr] > 0 {
+				t.Fatalf("round %d: page %d of the last commit is written", round, ptr)
+			}
+		}
+		if err := syncPages(db); err != nil {
+			t.Fatalf("syncPages: %v", err)
+		}
+		// and every page is in exactly one place
+		for ptr, n := range count(true) {
+			if n != 1 {
+				t.Fatalf("round %d: page %d is used %d times", round, ptr, n)
+			}
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+func TestSetRoot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	defer func() { db.Close() }()
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	root := db.Root()
+	sum, _ := db.Fingerprint()
+
+	// keep the old pages around as a recovery tool would have to, an
+	// iterator holds them back from the free list
+	it := db.Scan(nil, nil)
+	for i := 0; i < 500; i += 2 {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("new"))
+		db.Del([]byte(fmt.Sprintf("k%04d", i+1)))
+	}
+	db.Set([]byte("added"), []byte("x"))
+	if err := db.SetRoot(root); !errors.Is(err, ErrBusy) {
+		t.Fatalf("SetRoot with an iterator open = %v", err)
+	}
+	it.Close()
+
+	if err := db.SetRoot(db.page.flushed); err == nil {
+		t.Fatal("SetRoot took a page past the end")
+	}
+	// a free list node isn't a tree
+	if db.free.head != 0 {
+		if err := db.SetRoot(db.free.head); err == nil {
+			t.Fatal("SetRoot took a free list node")
+		}
+		if got := db.Root(); got == root {
+			t.Fatal("the failed SetRoot changed the root")
+		}
+	}
+	if err := db.SetRoot(root); err != nil {
+		t.Fatalf("SetRoot: %v", err)
+	}
+	check := func() {
+		t.Helper()
+		if got, _ := db.Fingerprint(); got != sum {
+			t.Fatal("the data isn't as of the old root")
+		}
+		if _, ok := db.Get([]byte("added")); ok {
+			t.Fatal("a key added after the root is found")
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+	check()
+	// the pages of the newer tree are free and reused
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("z%04d", i)), []byte("more"))
+	}
+	for i := 0; i < 100; i++ {
+		db.Del([]byte(fmt.Sprintf("z%04d", i)))
+	}
+	check()
+	db.Close()
+	db = openTestDB(t, path)
+	check()
+}
+
+func TestValidateKV(t *testing.T) {
+	errOdd := errors.New("odd value")
+	dir := t.TempDir()
+	db := &KeyValue{Path: filepath.Join(dir, "test.db"), Options: Options{
+		ValidateValue: func(key []byte, val []byte) error {
+			if len(val)%2 == 1 {
+				return errOdd
+			}
+			return nil
+		},
+	}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	maxKey, maxVal := db.MaxKeySize(), db.MaxValSize()
+	key := func(n int) []byte { return bytes.Repeat([]byte("k"), n) }
+	val := func(n int) []byte { return make([]byte, n) }
+	cases := []struct {
+		key, val []byte
+		want     error
+	}{
+		{nil, val(2), ErrEmptyKey},
+		{key(maxKey + 1), val(2), ErrKeyTooLarge},
+		{key(1), val(maxVal + 2), ErrValueTooLarge},
+		// the max sizes leave room for both, ErrEntryTooLarge is a
+		// safeguard a key and value under them don't reach
+		{key(maxKey), val(maxVal &^ 1), nil},
+		{key(1), val(3), errOdd},
+		{key(maxKey), val(2), nil},
+		{key(1), val(maxVal &^ 1), nil},
+	}
+	check := func(db *KeyValue) {
+		t.Helper()
+		for _, c := range cases {
+			seq := db.Seq()
+			err := db.ValidateKV(c.key, c.val)
+			if !errors.Is(err, c.want) || (c.want == nil && err != nil) {
+				t.Fatalf("ValidateKV(%d, %d) = %v, want %v", len(c.key), len(c.val), err, c.want)
+			}
+			if db.Seq() != seq {
+				t.Fatal("ValidateKV wrote")
+			}
+			// the same as the write
+			if serr := db.Set(c.key, c.val); !errors.Is(serr, c.want) || (c.want == nil && serr != nil) {
+				t.Fatalf("Set(%d, %d) = %v, ValidateKV %v", len(c.key), len(c.val), serr, err)
+			}
+		}
+	}
+	check(db)
+
+	// with AllowDuplicates the key takes a suffix
+	multi := &KeyValue{Path: filepath.Join(dir, "multi.db"), Options: Options{AllowDuplicates: true}}
+	if err := multi.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer multi.Close()
+	if err := multi.ValidateKV(key(maxKey), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("ValidateKV of a max key with duplicates = %v", err)
+	}
+	if err := multi.Set(key(maxKey), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Set of a max key with duplicates = %v", err)
+	}
+	if err := multi.ValidateKV(key(maxKey-20), nil); err != nil {
+		t.Fatalf("ValidateKV with duplicates = %v", err)
+	}
+
+	db.Close()
+	if err := db.ValidateKV(key(1), nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("ValidateKV after Close = %v", err)
+	}
+}
+
+// the state every feature keeps in the file comes back after a close
+func TestLifecycleRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	opts := Options{PageSize: 8192, MasterSlots: 4, ChangeLogRetention: 100}
+	db := &KeyValue{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.SetMeta("schema", []byte("v2")); err != nil {
+		t.Fatalf("SetMeta: %v", err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", rng.Intn(2000)))
+		if rng.Intn(5) == 0 {
+			db.Del(key)
+		} else if err := db.Set(key, bytes.Repeat([]byte{byte(i)}, rng.Intn(300))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := db.SetWithMeta([]byte("meta"), []byte("m"), 0xbeef); err != nil {
+		t.Fatalf("SetWithMeta: %v", err)
+	}
+	if err := db.SetWithTTL([]byte("ttl"), []byte("t"), time.Hour); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	version, err := db.SetVersioned([]byte("versioned"), []byte("a"), 0)
+	if err == nil {
+		version, err = db.SetVersioned([]byte("versioned"), []byte("b"), version)
+	}
+	if err != nil {
+		t.Fatalf("SetVersioned: %v", err)
+	}
+	tree, err := db.OpenTree(1)
+	if err != nil {
+		t.Fatalf("OpenTree: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := tree.Set([]byte(fmt.Sprintf("t%03d", i)), []byte("tree")); err != nil {
+			t.Fatalf("Tree.Set: %v", err)
+		}
+	}
+
+	// a snapshot taken while the writes go on
+	scan := func(it *Iter) map[string]string {
+		defer it.Close()
+		m := map[string]string{}
+		for ; it.Valid(); it.Next() {
+			key, val := it.Deref()
+			m[string(key)] = string(val)
+		}
+		return m
+	}
+	var backup bytes.Buffer
+	if err := db.BackupBinary(&backup); err != nil {
+		t.Fatalf("BackupBinary: %v", err)
+	}
+	it := db.Scan(nil, nil)
+	for i := 0; i < 200; i++ {
+		db.Set([]byte(fmt.Sprintf("late%03d", i)), []byte("late"))
+	}
+	snap := scan(it)
+	if _, ok := snap["late000"]; ok {
+		t.Fatal("the snapshot sees a later write")
+	}
+
+	data, treeData := scan(db.Scan(nil, nil)), scan(tree.Scan(nil, nil))
+	sum, err := db.Fingerprint()
+	if err != nil {
+		t.Fatalf("Fingerprint: %v", err)
+	}
+	seq := db.Seq()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// reopened without the options the file keeps
+	db = &KeyValue{Path: path, Options: Options{ChangeLogRetention: 100}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if !db.IsCleanShutdown() {
+		t.Fatal("the close wasn't recorded as clean")
+	}
+	if db.page.size != 8192 || db.page.masters != 4 || db.page.csum != CSUM_CRC32C {
+		t.Fatalf("page size %d, %d master slots, checksum %d",
+			db.page.size, db.page.masters, db.page.csum)
+	}
+	if db.Seq() < seq {
+		t.Fatalf("seq %d, was %d", db.Seq(), seq)
+	}
+	if got, _ := db.Fingerprint(); got != sum {
+		t.Fatal("the fingerprint changed")
+	}
+	if got := scan(db.Scan(nil, nil)); !maps.Equal(got, data) {
+		t.Fatalf("%d keys after reopen, want %d", len(got), len(data))
+	}
+	tree, err = db.OpenTree(1)
+	if err != nil {
+		t.Fatalf("OpenTree: %v", err)
+	}
+	if got := scan(tree.Scan(nil, nil)); !maps.Equal(got, treeData) {
+		t.Fatalf("%d keys in the tree after reopen, want %d", len(got), len(treeData))
+	}
+	if val, ok := db.GetMeta("schema"); !ok || string(val) != "v2" {
+		t.Fatalf("GetMeta = %q, %v", val, ok)
+	}
+	if val, meta, ok := db.GetWithMeta([]byte("meta")); !ok || string(val) != "m" || meta != 0xbeef {
+		t.Fatalf("GetWithMeta = %q, %x, %v", val, meta, ok)
+	}
+	if val, ok := db.Get([]byte("ttl")); !ok || string(val) != "t" {
+		t.Fatalf("Get(ttl) = %q, %v", val, ok)
+	}
+	if val, got, ok := db.GetVersioned([]byte("versioned")); !ok || string(val) != "b" || got != version {
+		t.Fatalf("GetVersioned = %q, %d, %v, want version %d", val, got, ok, version)
+	}
+	changes, last, err := db.ChangesSince(seq - 50)
+	if err != nil || last != db.Seq() || len(changes) != 50 ||
+		string(changes[49].Key) != "late199" {
+		t.Fatalf("ChangesSince = %d changes, %d, %v", len(changes), last, err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// and so does the snapshot backup
+	restored := filepath.Join(dir, "restored.db")
+	if err := RestoreBinary(restored, &backup); err != nil {
+		t.Fatalf("RestoreBinary: %v", err)
+	}
+	rdb := openTestDB(t, restored)
+	defer rdb.Close()
+	if got := scan(rdb.Scan(nil, nil)); !maps.Equal(got, snap) {
+		t.Fatalf("%d keys restored, want %d", len(got), len(snap))
+	}
+}
+
+func TestOpenForeignFile(t *testing.T) {
+	dir := t.TempDir()
+	open := func(path string) error {
+		t.Helper()
+		db := &KeyValue{Path: path}
+		err := db.Open()
+		if err == nil {
+			db.Close()
+		}
+		return err
+	}
+
+	// an empty file is a new database
+	empty := filepath.Join(dir, "empty.db")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(empty); err != nil {
+		t.Fatalf("Open of an empty file: %v", err)
+	}
+
+	valid := filepath.Join(dir, "valid.db")
+	db := openTestDB(t, valid)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	slots := db.page.masters
+	db.Close()
+	if err := open(valid); err != nil {
+		t.Fatalf("Open of a valid file: %v", err)
+	}
+	fi, err := os.Stat(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files of another program, as large as the database or smaller
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int64{fi.Size(), BTREE_PAGE_SIZE, 100} {
+		data := make([]byte, size)
+		rng.Read(data)
+		foreign := filepath.Join(dir, "foreign.db")
+		if err := os.WriteFile(foreign, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := open(foreign)
+		if !errors.Is(err, ErrNotDatabase) || !errors.Is(err, ErrBadSignature) ||
+			errors.Is(err, ErrCorruptMaster) {
+			t.Fatalf("Open of a foreign file of %d bytes = %v", size, err)
+		}
+	}
+
+	// a database with every master damaged
+	fp, err := os.OpenFile(valid, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := 0; slot < slots; slot++ {
+		// the seq, covered by the CRC
+		if _, err := fp.WriteAt([]byte{0xff}, int64(slot*BTREE_PAGE_SIZE+48)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fp.Close()
+	err = open(valid)
+	if !errors.Is(err, ErrCorruptMaster) || !errors.Is(err, ErrChecksum) || errors.Is(err, ErrNotDatabase) {
+		t.Fatalf("Open with every master damaged = %v", err)
+	}
+}
+
+func TestScanPattern(t *testing.T) {
+	db := newTestDB(t)
+	keys := []string{
+		"user:1:profile", "user:1:posts", "user:22:profile", "user::profile",
+		"users:3:profile", "usr:4:profile", "a*b", "axb", "k1", "k2", "k3", "kx",
+	}
+	for _, key := range keys {
+		if err := db.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	scan := func(pattern string) []string {
+		t.Helper()
+		iter, err := db.ScanPattern(pattern)
+		if err != nil {
+			t.Fatalf("ScanPattern(%q): %v", pattern, err)
+		}
+		defer iter.Close()
+		got := []string{}
+		for ; iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			got = append(got, string(key))
+		}
+		return got
+	}
+	cases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"user:*:profile", []string{"user:1:profile", "user:22:profile", "user::profile"}},
+		{"user:?:*", []string{"user:1:posts", "user:1:profile"}},
+		{"*:profile", []string{"user:1:profile", "user:22:profile", "user::profile", "users:3:profile", "usr:4:profile"}},
+		{"k[12]", []string{"k1", "k2"}},
+		{"k[1-3]", []string{"k1", "k2", "k3"}},
+		{"k[!1-3]", []string{"kx"}},
+		{"k[^x]", []string{"k1", "k2", "k3"}},
+		{`a\*b`, []string{"a*b"}},
+		{"a*b", []string{"a*b", "axb"}},
+		{"k1", []string{"k1"}},
+		{"nope*", []string{}},
+	}
+	for _, c := range cases {
+		if got := scan(c.pattern); !slices.Equal(got, c.want) {
+			t.Errorf("ScanPattern(%q) = %q, want %q", c.pattern, got, c.want)
+		}
+	}
+
+	// the literal start bounds the scan
+	for pattern, want := range map[string]string{
+		"user:*:profile": "user:",
+		`a\*b*`:          "a*b",
+		"k[12]":          "k",
+		"*x":             "",
+		"?x":             "",
+	} {
+		prefix, _, err := globCompile(pattern)
+		if err != nil || string(prefix) != want {
+			t.Errorf("globCompile(%q) prefix = %q, %v, want %q", pattern, prefix, err, want)
+		}
+	}
+	iter, err := db.ScanPattern("user:*")
+	if err != nil {
+		t.Fatalf("ScanPattern: %v", err)
+	}
+	if !bytes.Equal(iter.hi, []byte("user;")) {
+		t.Errorf("ScanPattern bound = %q, want %q", iter.hi, "user;")
+	}
+	iter.Close()
+
+	for _, pattern := range []string{"[abc", `k\`, "k[!"} {
+		if _, err := db.ScanPattern(pattern); !errors.Is(err, ErrBadPattern) {
+			t.Errorf("ScanPattern(%q) = %v, want ErrBadPattern", pattern, err)
+		}
+	}
+}
+
+func TestAllStream(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	want := []KV{}
+	for iter := db.Scan(nil, nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		want = append(want, KV{Key: key, Val: val})
+	}
+
+	// the writes after All don't show up in the stream
+	entries, stop := db.All()
+	if err := db.Set([]byte("k00000"), []byte("changed")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := db.Set([]byte("z"), []byte("new")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	got := []KV{}
+	for kv := range entries {
+		got = append(got, kv)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if !slices.EqualFunc(got, want, func(a, b KV) bool {
+		return bytes.Equal(a.Key, b.Key) && bytes.Equal(a.Val, b.Val)
+	}) {
+		t.Fatalf("All streamed %d entries, want %d", len(got), len(want))
+	}
+	if n := snapshotCount(db); n != 0 {
+		t.Fatalf("%d snapshots pinned after the stream", n)
+	}
+
+	// stopping early ends the producer and releases the snapshot
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		entries, stop := db.All()
+		for j := 0; j < 5; j++ {
+			<-entries
+		}
+		if err := stop(); err != nil {
+			t.Fatalf("stop: %v", err)
+		}
+		if err := stop(); err != nil {
+			t.Fatalf("second stop: %v", err)
+		}
+		if _, ok := <-entries; ok {
+			t.Fatal("the channel is open after stop")
+		}
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines after stopping the streams, %d before", n, before)
+	}
+	if n := snapshotCount(db); n != 0 {
+		t.Fatalf("%d snapshots pinned after stopping the streams", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// a closed database streams nothing
+	entries, stop = db.All()
+	if _, ok := <-entries; ok {
+		t.Fatal("All of a closed database streamed an entry")
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+}
+
+func TestChecksumAlgo(t *testing.T) {
+	// the XXH64 reference values
+	for in, want := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	} {
+		if got := xxh64([]byte(in)); got != want {
+			t.Errorf("xxh64(%q) = %x, want %x", in, got, want)
+		}
+	}
+
+	algos := []int{CSUM_CRC32C, CSUM_XXHASH, CSUM_SHA256}
+	for _, algo := range algos {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KeyValue{Path: path, Options: Options{ChecksumAlgo: algo}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		val := make([]byte, BTREE_MAX_VAL_SIZE)
+		for i := 0; i < 50; i++ {
+			val[0] = byte(i)
+			if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), val); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		root := db.tree.root
+		db.Close()
+
+		// verified with the algorithm of the file, whatever the default
+		db = &KeyValue{Path: path, Options: Options{VerifyChecksums: VERIFY_ALWAYS}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open of a file with checksum %d: %v", algo, err)
+		}
+		if db.page.csum != algo || db.tree.nsize() != BTREE_PAGE_SIZE-csumSize(algo) {
+			t.Fatalf("checksum %d, node size %d, want %d", db.page.csum, db.tree.nsize(), algo)
+		}
+		for i := 0; i < 50; i++ {
+			if got, ok := db.Get([]byte(fmt.Sprintf("k%02d", i))); !ok || got[0] != byte(i) {
+				t.Fatalf("Get(k%02d) = %v with checksum %d", i, ok, algo)
+			}
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatalf("Verify with checksum %d: %v", algo, err)
+		}
+		db.Close()
+
+		// a different configured algorithm is refused
+		for _, other := range algos {
+			db = &KeyValue{Path: path, Options: Options{ChecksumAlgo: other}}
+			err := db.Open()
+			if other == algo {
+				if err != nil {
+					t.Fatalf("Open with checksum %d: %v", other, err)
+				}
+				db.Close()
+			} else if !errors.Is(err, ErrChecksumAlgo) {
+				t.Fatalf("Open of a file with checksum %d as %d = %v", algo, other, err)
+			}
+		}
+
+		// a damaged page fails the check
+		fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		if _, err := fp.WriteAt([]byte("X"), int64(root)*BTREE_PAGE_SIZE+HEADER+1); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+		fp.Close()
+		db = &KeyValue{Path: path}
+		if err := db.Open(); !errors.Is(err, ErrChecksum) {
+			t.Fatalf("Open of a damaged file with checksum %d = %v", algo, err)
+		}
+	}
+
+	db := &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{ChecksumAlgo: 99}}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatal("Open with an unknown checksum algorithm succeeded")
+	}
+}
+
+func TestPreSplit(t *testing.T) {
+	scanKeys := func(iter *Iter) []string {
+		t.Helper()
+		defer iter.Close()
+		keys := []string{}
+		for ; iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			keys = append(keys, string(key))
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		return keys
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	boundaries := [][]byte{[]byte("c"), []byte("g"), []byte("m"), []byte("t")}
+	if err := db.PreSplit([][]byte{[]byte("g"), []byte("c")}); err == nil {
+		t.Fatal("PreSplit took unordered boundaries")
+	}
+	if err := db.PreSplit([][]byte{[]byte("c"), {}}); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("PreSplit with an empty boundary = %v", err)
+	}
+	if err := db.PreSplit(boundaries); err != nil {
+		t.Fatalf("PreSplit: %v", err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify of the split tree: %v", err)
+	}
+
+	// the empty leaves read as nothing
+	if _, ok := db.Get([]byte("h")); ok {
+		t.Fatal("Get found a key in the empty tree")
+	}
+	if n := len(scanKeys(db.Scan(nil, nil))); n != 0 {
+		t.Fatalf("Scan of the empty tree = %d keys", n)
+	}
+
+	// the keys land in the leaf of their range, in any order
+	keys := []string{"n", "m", "zz", "a", "f", "c", "b", "s", "h", "t", "g", "d"}
+	for _, key := range keys {
+		if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	root := db.tree.get(db.tree.root)
+	if root.btype() != BNODE_NODE || root.nkeys() != 5 {
+		t.Fatalf("root of %d links, want 5", root.nkeys())
+	}
+	for i, b := range boundaries {
+		if got := root.getKey(uint16(i + 1)); !bytes.Equal(got, b) {
+			t.Fatalf("link %d starts at %q, want %q", i+1, got, b)
+		}
+	}
+	for _, key := range keys {
+		ptr, _, found := db.Locate([]byte(key))
+		want := 0
+		for _, b := range boundaries {
+			if string(b) <= key {
+				want++
+			}
+		}
+		if !found || ptr != root.getPtr(uint16(want)) {
+			t.Fatalf("%s is in page %d, want the leaf of link %d", key, ptr, want)
+		}
+	}
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	if got := scanKeys(db.Scan(nil, nil)); !slices.Equal(got, sorted) {
+		t.Fatalf("Scan = %q, want %q", got, sorted)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := db.PreSplit(boundaries); err == nil {
+		t.Fatal("PreSplit of a tree with keys succeeded")
+	}
+
+	// scans and seeks over the leaves that are still empty
+	db.Close()
+	db = openTestDB(t, filepath.Join(t.TempDir(), "sparse.db"))
+	if err := db.PreSplit(boundaries); err != nil {
+		t.Fatalf("PreSplit: %v", err)
+	}
+	for _, key := range []string{"a", "b", "u", "v"} {
+		if err := db.Set([]byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if got := scanKeys(db.Scan(nil, nil)); !slices.Equal(got, []string{"a", "b", "u", "v"}) {
+		t.Fatalf("Scan = %q", got)
+	}
+	if got := scanKeys(db.Scan([]byte("h"), nil)); !slices.Equal(got, []string{"u", "v"}) {
+		t.Fatalf("Scan from an empty leaf = %q", got)
+	}
+	if got := scanKeys(db.ScanPrefix([]byte("h"))); len(got) != 0 {
+		t.Fatalf("ScanPrefix in an empty leaf = %q", got)
+	}
+	if ptr, idx, found := db.Locate([]byte("h")); found || idx != 0 || ptr == 0 {
+		t.Fatalf("Locate in an empty leaf = %d, %d, %v", ptr, idx, found)
+	}
+	if ok, err := db.Del([]byte("h")); ok || err != nil {
+		t.Fatalf("Del in an empty leaf = %v, %v", ok, err)
+	}
+	for _, key := range []string{"a", "b", "u", "v"} {
+		if ok, err := db.Del([]byte(key)); !ok || err != nil {
+			t.Fatalf("Del(%s) = %v, %v", key, ok, err)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify after the deletes: %v", err)
+	}
+
+	// many boundaries make several levels, the writes keep it valid
+	db.Close()
+	path = filepath.Join(t.TempDir(), "deep.db")
+	db = openTestDB(t, path)
+	boundaries = nil
+	for i := 1; i < 3000; i++ {
+		boundaries = append(boundaries, []byte(fmt.Sprintf("k%05d", i*10)))
+	}
+	if err := db.PreSplit(boundaries); err != nil {
+		t.Fatalf("PreSplit: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	want := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%05d", rng.Intn(30000))
+		if rng.Intn(4) == 0 {
+			db.Del([]byte(key))
+			delete(want, key)
+			continue
+		}
+		if err := db.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		want[key] = key
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	db.Close()
+	db = openTestDB(t, path)
+	defer db.Close()
+	got := scanKeys(db.Scan(nil, nil))
+	wantKeys := []string{}
+	for key := range want {
+		wantKeys = append(wantKeys, key)
+	}
+	slices.Sort(wantKeys)
+	if !slices.Equal(got, wantKeys) {
+		t.Fatalf("Scan found %d keys, want %d", len(got), len(wantKeys))
+	}
+	for key := range want {
+		if _, ok := db.Get([]byte(key)); !ok {
+			t.Fatalf("%s is missing", key)
+		}
+	}
+}
+
+func TestPageBytes(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.PageBytes(0); err == nil {
+		t.Fatal("PageBytes of a new file succeeded")
+	}
+	if err := db.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	master, err := db.PageBytes(0)
+	if err != nil {
+		t.Fatalf("PageBytes(0): %v", err)
+	}
+	if len(master) != db.page.size || !bytes.HasPrefix(master, []byte(DB_SIG)) {
+		t.Fatalf("the master page is %d bytes starting with %q", len(master), master[:16])
+	}
+	root, err := db.PageBytes(db.Root())
+	if err != nil {
+		t.Fatalf("PageBytes(root): %v", err)
+	}
+	if node := (BNode{root}); node.btype() != BNODE_LEAF || string(node.getKey(1)) != "key" {
+		t.Fatalf("the root page isn't the leaf of the key")
+	}
+	// a copy, not the mapping
+	root[HEADER] ^= 0xff
+	if again, _ := db.PageBytes(db.Root()); bytes.Equal(again, root) {
+		t.Fatal("PageBytes returned the mapped page")
+	}
+
+	for _, ptr := range []uint64{db.page.flushed, db.page.flushed + 100, ^uint64(0)} {
+		if _, err := db.PageBytes(ptr); err == nil {
+			t.Fatalf("PageBytes(%d) of %d pages succeeded", ptr, db.page.flushed)
+		}
+	}
+	if err := db.Err(); err != nil {
+		t.Fatalf("Err after the bad pointers: %v", err)
+	}
+	db.Close()
+	if _, err := db.PageBytes(0); !errors.Is(err, ErrClosed) {
+		t.Fatalf("PageBytes after Close = %v", err)
+	}
+}
+
+func TestIORetries(t *testing.T) {
+	// each fsync fails with the errors in turn before it goes through
+	var failures []error
+	syncs := 0
+	fileSync = func(fp *os.File) error {
+		syncs++
+		if len(failures) > 0 {
+			err := failures[0]
+			failures = failures[1:]
+			return err
+		}
+		return fp.Sync()
+	}
+	defer func() { fileSync = (*os.File).Sync }()
+
+	db := newTestDB(t)
+	failures = []error{syscall.EINTR, syscall.EINTR}
+	syncs = 0
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set with EINTR twice: %v", err)
+	}
+	if syncs != 4 { // the pages and the master
+		t.Fatalf("%d fsyncs, want 4", syncs)
+	}
+	failures = []error{syscall.EAGAIN, &os.PathError{Op: "sync", Err: syscall.EINTR}, syscall.EAGAIN}
+	if err := db.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Set with transient errors: %v", err)
+	}
+
+	// past the retries the last error is returned, and the others at once
+	failures = []error{syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN}
+	if err := db.Set([]byte("c"), []byte("3")); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("Set with an EAGAIN past the retries = %v", err)
+	}
+	failures, syncs = []error{syscall.EIO}, 0
+	if err := db.Set([]byte("c"), []byte("3")); !errors.Is(err, syscall.EIO) || syncs != 1 {
+		t.Fatalf("Set with EIO = %v after %d fsyncs", err, syncs)
+	}
+	db.Close()
+
+	// with the retries off EINTR still is
+	db = &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{IORetries: -1}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	failures = []error{syscall.EINTR}
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Set with EINTR and no retries: %v", err)
+	}
+	failures, syncs = []error{syscall.EAGAIN}, 0
+	if err := db.Set([]byte("b"), []byte("2")); !errors.Is(err, syscall.EAGAIN) || syncs != 1 {
+		t.Fatalf("Set with EAGAIN and no retries = %v after %d fsyncs", err, syncs)
+	}
+	db.Close()
+
+	// the retries and their backoff are capped, they hold the write lock
+	var slept []time.Duration
+	ioSleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { ioSleep = time.Sleep }()
+	db = &KeyValue{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{IORetries: 1 << 20}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	failures = make([]error, 100)
+	for i := range failures {
+		failures[i] = syscall.EAGAIN
+	}
+	if err := db.Set([]byte("a"), []byte("1")); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("Set with EAGAIN past the max retries = %v", err)
+	}
+	total := time.Duration(0)
+	for _, d := range slept {
+		if d <= 0 || d > IO_RETRY_MAX_BACKOFF {
+			t.Fatalf("a backoff of %v", d)
+		}
+		total += d
+	}
+	if len(slept) != MAX_IO_RETRIES || total > MAX_IO_RETRIES*IO_RETRY_MAX_BACKOFF {
+		t.Fatalf("%d retries over %v", len(slept), total)
+	}
+	failures = nil
+	db.Close()
+
+	// the mappings of a growing file
+	defer func(size int) { mmapInitSize = size }(mmapInitSize)
+	mmapInitSize = 4 * BTREE_MAX_PAGE_SIZE
+	mmaps := 0
+	mmapCall = func(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+		if mmaps++; mmaps%3 != 0 {
+			return nil, syscall.EINTR
+		}
+		return syscall.Mmap(fd, offset, length, prot, flags)
+	}
+	defer func() { mmapCall = syscall.Mmap }()
+	grown := openTestDB(t, filepath.Join(t.TempDir(), "grown.db"))
+	defer grown.Close()
+	val := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		if err := grown.Set([]byte(fmt.Sprintf("k%04d", i)), val); err != nil {
+			t.Fatalf("Set with EINTR from mmap: %v", err)
+		}
+	}
+	if len(grown.mmap.chunks) < 3 || mmaps != 3*len(grown.mmap.chunks) {
+		t.Fatalf("%d mmap calls for %d chunks", mmaps, len(grown.mmap.chunks))
+	}
+}
+
+func TestSequentialKeys(t *testing.T) {
+	const n = 20000
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint64(nil, uint64(1<<40+3*i))
+	}
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf("v%07d", i))
+	}
+	// the tree pages and the encoded leaves among them
+	pages := func(db *KeyValue) (nodes int, encoded int) {
+		var walk func(ptr uint64)
+		walk = func(ptr uint64) {
+			nodes++
+			if pageGetMapped(db, ptr).btype() == BNODE_LEAF_SEQ {
+				encoded++
+			}
+			node := db.pageGet(ptr)
+			if node.btype() == BNODE_NODE {
+				for i := uint16(0); i < node.nkeys(); i++ {
+					walk(node.getPtr(i))
+				}
+			}
+		}
+		walk(db.tree.root)
+		return nodes, encoded
+	}
+	fill := func(path string, seq bool) *KeyValue {
+		t.Helper()
+		db := &KeyValue{Path: path, Options: Options{SequentialKeys: seq}}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		err := db.Update(func(tx *Tx) error {
+			for i := 0; i < n; i++ {
+				if err := tx.Set(key(i), val(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		return db
+	}
+	check := func(db *KeyValue, skip func(i int) bool) {
+		t.Helper()
+		if err := db.Verify(); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			got, ok := db.Get(key(i))
+			if skip(i) {
+				if ok {
+					t.Fatalf("Get(%d) found a deleted key", i)
+				}
+			} else if !ok || !bytes.Equal(got, val(i)) {
+				t.Fatalf("Get(%d) = %q, %v", i, got, ok)
+			}
+		}
+		iter := db.Scan(nil, nil)
+		defer iter.Close()
+		i := 0
+		for ; iter.Valid(); iter.Next() {
+			for skip(i) {
+				i++
+			}
+			k, v := iter.Deref()
+			if !bytes.Equal(k, key(i)) || !bytes.Equal(v, val(i)) {
+				t.Fatalf("Scan: entry %d is %x", i, k)
+			}
+			i++
+		}
+		for i < n && skip(i) {
+			i++
+		}
+		if err := iter.Err(); err != nil || i != n {
+			t.Fatalf("Scan ended at %d: %v", i, err)
+		}
+	}
+	none := func(int) bool { return false }
+
+	plain := fill(filepath.Join(t.TempDir(), "plain.db"), false)
+	defer plain.Close()
+	plainNodes, plainEncoded := pages(plain)
+	if plainEncoded != 0 {
+		t.Fatalf("%d encoded leaves without the option", plainEncoded)
+	}
+	path := filepath.Join(t.TempDir(), "seq.db")
+	db := fill(path, true)
+	check(db, none)
+	nodes, encoded := pages(db)
+	if encoded == 0 || 3*nodes > 2*plainNodes {
+		t.Fatalf("%d pages (%d encoded), %d without the option", nodes, encoded, plainNodes)
+	}
+
+	// the mode is kept by the file
+	db.Close()
+	db = openTestDB(t, path)
+	defer db.Close()
+	if !db.page.seqKeys || !db.tree.seqKeys {
+		t.Fatal("the reopened file lost the mode")
+	}
+	check(db, none)
+
+	// deletes, updates and keys that don't qualify split the leaves
+	// back into the usual layout where needed
+	odd := func(i int) bool { return i%2 == 1 }
+	err := db.Update(func(tx *Tx) error {
+		for i := 1; i < n; i += 2 {
+			if _, err := tx.Del(key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	check(db, odd)
+	for _, k := range [][]byte{key(n / 2)[:7], append(key(n/3), 0)} {
+		if err := db.Set(k, []byte("other")); err != nil {
+			t.Fatalf("Set(%x): %v", k, err)
+		}
+	}
+	if err := db.Set(key(n/4), val(n/4)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	for _, k := range [][]byte{key(n / 2)[:7], append(key(n/3), 0)} {
+		if got, ok := db.Get(k); !ok || string(got) != "other" {
+			t.Fatalf("Get(%x) = %q, %v", k, got, ok)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		if got, ok := db.Get(key(i)); !ok || !bytes.Equal(got, val(i)) {
+			t.Fatalf("Get(%d) = %q, %v", i, got, ok)
+		}
+	}
+}
+
+func TestCopyPrefix(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 300; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("cfg/v1/%03d", i)), []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := db.SetWithMeta([]byte("cfg/v1/meta"), []byte("m"), 42); err != nil {
+		t.Fatalf("SetWithMeta: %v", err)
+	}
+	if err := db.Set([]byte("other"), []byte("o")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	entries := func(prefix string) map[string]string {
+		out := map[string]string{}
+		iter := db.ScanPrefix([]byte(prefix))
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			key, val := iter.Deref()
+			out[strings.TrimPrefix(string(key), prefix)] = string(val)
+		}
+		return out
+	}
+
+	seq := db.Seq()
+	if n, err := db.CopyPrefix([]byte("cfg/v1/"), []byte("cfg/v2/")); n != 301 || err != nil {
+		t.Fatalf("CopyPrefix = %d, %v", n, err)
+	}
+	if db.Seq() != seq+1 {
+		t.Fatalf("CopyPrefix took %d commits", db.Seq()-seq)
+	}
+	v1, v2 := entries("cfg/v1/"), entries("cfg/v2/")
+	if len(v1) != 301 || !maps.Equal(v1, v2) {
+		t.Fatalf("%d keys copied to %d", len(v1), len(v2))
+	}
+	if _, meta, ok := db.GetWithMeta([]byte("cfg/v2/meta")); !ok || meta != 42 {
+		t.Fatalf("the copy has meta %d", meta)
+	}
+
+	// a destination inside the source copies the keys as they were
+	if n, err := db.CopyPrefix([]byte("cfg/"), []byte("cfg/cfg/")); n != 602 || err != nil {
+		t.Fatalf("CopyPrefix into the source = %d, %v", n, err)
+	}
+	if got := entries("cfg/cfg/"); len(got) != 602 || got["v1/007"] != "val7" || got["v2/meta"] != "m" {
+		t.Fatalf("%d keys under the overlapping prefix", len(got))
+	}
+	if got := entries("cfg/cfg/cfg/"); len(got) != 0 {
+		t.Fatalf("the copy copied %d of its own keys", len(got))
+	}
+	if n, err := db.CopyPrefix([]byte("cfg/v1/"), []byte("cfg/v1/")); n != 301 || err != nil {
+		t.Fatalf("CopyPrefix onto itself = %d, %v", n, err)
+	}
+	if got := entries("cfg/v1/"); !maps.Equal(got, v1) {
+		t.Fatal("CopyPrefix onto itself changed the keys")
+	}
+
+	// a key too large under the new prefix fails the whole copy
+	seq = db.Seq()
+	long := bytes.Repeat([]byte("x"), maxKeySize(db.page.size)-2)
+	if _, err := db.CopyPrefix([]byte("cfg/v1/"), long); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("CopyPrefix to a long prefix = %v", err)
+	}
+	if db.Seq() != seq || len(entries(string(long))) != 0 {
+		t.Fatal("the failed copy wrote keys")
+	}
+	if n, err := db.CopyPrefix([]byte("none/"), []byte("cfg/")); n != 0 || err != nil {
+		t.Fatalf("CopyPrefix of nothing = %d, %v", n, err)
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+	if err := db.Barrier(); err != nil {
+		t.Fatalf("Barrier before any write: %v", err)
+	}
+
+	// the writes that returned before a barrier are on disk after it
+	const n = 300
+	var written atomic.Int64
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v")); err != nil {
+				done <- err
+				return
+			}
+			written.Store(int64(i + 1))
+		}
+		done <- nil
+	}()
+	for checks := 0; checks < 5; checks++ {
+		before := written.Load()
+		if err := db.Barrier(); err != nil {
+			t.Fatalf("Barrier: %v", err)
+		}
+		reader := &KeyValue{Path: path, Options: Options{ReadOnly: true}}
+		if err := reader.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		for i := int64(0); i < before; i++ {
+			if _, ok := reader.Get([]byte(fmt.Sprintf("k%04d", i))); !ok {
+				t.Fatalf("k%04d isn't in the file after the barrier", i)
+			}
+		}
+		reader.Close()
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// a failed commit fails the barrier until the next one
+	fileSync = func(*os.File) error { return errInjected }
+	err := db.Set([]byte("lost"), []byte("v"))
+	fileSync = (*os.File).Sync
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("Set with a failing fsync = %v", err)
+	}
+	if err := db.Barrier(); !errors.Is(err, ErrCommitFailed) {
+		t.Fatalf("Barrier after a failed commit = %v", err)
+	}
+	if err := db.Set([]byte("kept"), []byte("v")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := db.Barrier(); err != nil {
+		t.Fatalf("Barrier after a commit: %v", err)
+	}
+	db.Close()
+	if err := db.Barrier(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Barrier after Close = %v", err)
+	}
+}
+
+func TestMmapStats(t *testing.T) {
+	defer func(size int) { mmapInitSize = size }(mmapInitSize)
+	mmapInitSize = 1 << 20
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+	if stats := db.Stats(); stats.MmapTotalBytes != mmapInitSize || stats.MmapChunkCount != 1 || stats.FileBytes != 0 {
+		t.Fatalf("Stats of an empty file = %+v", stats)
+	}
+
+	// grow the file past the first mapping
+	val := make([]byte, 3000)
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	stats := db.Stats()
+	if stats.FileBytes <= mmapInitSize || int64(stats.FileBytes) != db.DiskSize() {
+		t.Fatalf("Stats: file of %d bytes, %d on disk", stats.FileBytes, db.DiskSize())
+	}
+	// the file grows ahead of the pages in use, the mapping covers those
+	used := int(db.page.flushed) * db.page.size
+	if stats.MmapTotalBytes < used || stats.MmapTotalBytes%mmapInitSize != 0 || stats.MmapChunkCount < 2 {
+		t.Fatalf("Stats: %d bytes in %d chunks for %d bytes in use", stats.MmapTotalBytes, stats.MmapChunkCount, used)
+	}
+	if stats.MmapResidentBytes <= 0 || stats.MmapResidentBytes > stats.MmapTotalBytes {
+		t.Fatalf("Stats: %d resident of %d mapped", stats.MmapResidentBytes, stats.MmapTotalBytes)
+	}
+	db.Close()
+	if stats := db.Stats(); stats != (Stats{}) {
+		t.Fatalf("Stats after Close = %+v", stats)
+	}
+
+	// nothing is mapped without the mmap
+	db = &KeyValue{Path: path, Options: Options{NoMmap: true}}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if got := db.Stats(); got.MmapTotalBytes != 0 || got.MmapChunkCount != 0 || got.FileBytes != stats.FileBytes {
+		t.Fatalf("Stats with NoMmap = %+v", got)
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	for i := 0; i < 3000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("v")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	it := db.Scan(nil, nil)
+	view, ok := db.GetView([]byte("k00001"))
+	if !ok {
+		t.Fatal("GetView found nothing")
+	}
+	reader, ok := db.GetReader([]byte("k00002"))
+	if !ok {
+		t.Fatal("GetReader found nothing")
+	}
+	entries, stop := db.All()
+	<-entries
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// the mapping is gone, the reads fail without touching it
+	if it.Valid() || !errors.Is(it.Err(), ErrClosed) {
+		t.Fatalf("Valid after Close, Err = %v", it.Err())
+	}
+	it.Next()
+	if key, val := it.Deref(); key != nil || val != nil {
+		t.Fatalf("Deref after Close = %q, %q", key, val)
+	}
+	it.Close()
+	if got := view.Bytes(); got != nil {
+		t.Fatalf("View.Bytes after Close = %q", got)
+	}
+	view.Release()
+	if _, err := reader.Read(make([]byte, 8)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Read after Close = %v", err)
+	}
+	reader.Close()
+	for range entries {
+	}
+	if err := stop(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("All after Close = %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package database
+
+import "fmt"
+
+// number of trees a file can hold, including the main tree
+const MAX_TREES = 16
+
+// an independent tree in the same file. it shares the page allocator
+// and the free list with the main tree, and its root is stored in the
+// master page, so every write commits all the trees together.
+// writes to the trees besides the main one are not in the changelog.
+type Tree struct {
+	db *KeyValue
+	id int
+}
+
+// a handle to the tree in slot id, 0 is the main tree used by the
+// KeyValue methods. a tree that was never written to is empty.
+func (db *KeyValue) OpenTree(id int) (*Tree, error) {
+	if id < 0 || id >= MAX_TREES {
+		return nil, fmt.Errorf("OpenTree: id %d out of range [0, %d)", id, MAX_TREES)
+	}
+	return &Tree{db: db, id: id}, nil
+}
+
+// the tree in slot id, extra slots are created on demand
+func treeAt(db *KeyValue, id int) *BTree {
+	if id == 0 {
+		return &db.tree
+	}
+	for len(db.trees) < id {
+		db.trees = append(db.trees, newTree(db, 0))
+	}
+	return &db.trees[id-1]
+}
+
+func newTree(db *KeyValue, root uint64) BTree {
+	return BTree{
+		root:     root,
+		pageSize: db.page.size,
+		reserved: csumSize(db.page.csum),
+		get:      db.pageGet,
+		new:      db.pageNew,
+		del:      db.pageDel,
+		logf:     db.tree.logf,
+		seqKeys:  db.page.seqKeys,
+	}
+}
+
+// the roots of every tree, the main tree first
+func treeRoots(db *KeyValue) []uint64 {
+	roots := []uint64{db.tree.root}
+	for _, tree := range db.trees {
+		roots = append(roots, tree.root)
+	}
+	return roots
+}
+
+func setTreeRoots(db *KeyValue, roots []uint64) {
+	db.tree.root = roots[0]
+	db.trees = db.trees[:0]
+	for _, root := range roots[1:] {
+		db.trees = append(db.trees, newTree(db, root))
+	}
+}
+
+func (t *Tree) Get(key []byte) (val []byte, ok bool) {
+	if t.id == 0 {
+		return t.db.Get(key)
+	}
+	t.db.mu.RLock()
+	defer t.db.mu.RUnlock()
+	defer recoverRead(t.db)
+	if checkOpen(t.db) != nil || checkKey(t.db, key) != nil {
+		return nil, false
+	}
+	if t.id > len(t.db.trees) {
+		return nil, false
+	}
+	val, _, ok = treeGetLive(treeAt(t.db, t.id), key)
+	return readCopy(t.db, val), ok
+}
+
+func (t *Tree) Set(key []byte, val []byte) (err error) {
+	if t.id == 0 {
+		return t.db.Set(key, val)
+	}
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	defer recoverWrite(t.db, txSave(t.db), &err)
+	if err := checkWritable(t.db); err != nil {
+		return err
+	}
+	if err := checkKV(t.db, key, val); err != nil {
+		return err
+	}
+	treeAt(t.db, t.id).Insert(key, val)
+	return flushPages(t.db)
+}
+
+func (t *Tree) Del(key []byte) (deleted bool, err error) {
+	if t.id == 0 {
+		return t.db.Del(key)
+	}
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	defer recoverWrite(t.db, txSave(t.db), &err)
+	if err := checkWritable(t.db); err != nil {
+		return false, err
+	}
+	if err := checkKey(t.db, key); err != nil {
+		return false, err
+	}
+	deleted = treeAt(t.db, t.id).Delete(key)
+	return deleted, flushPages(t.db)
+}
+
+// iterate over a snapshot of the keys in [lo, hi), see KeyValue.Scan
+func (t *Tree) Scan(lo []byte, hi []byte) *Iter {
+	t.db.mu.RLock()
+	defer t.db.mu.RUnlock()
+	if checkOpen(t.db) != nil {
+		return &Iter{iter: &BIter{}}
+	}
+	root := uint64(0)
+	if t.id <= len(t.db.trees) {
+		root = treeAt(t.db, t.id).root
+	}
+	return snapshotScan(t.db, root, lo, hi)
+}
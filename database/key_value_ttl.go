@@ -0,0 +1,130 @@
+package database
+
+import "time"
+
+// expired keys deleted per write by PurgeExpired
+const EXPIRY_BATCH = 1000
+
+// set a key that expires after ttl. an expired key is missing for
+// every read, Get deletes it and so does PurgeExpired or the background
+// sweep set up by Options.ExpirySweep.
+func (db *KeyValue) SetWithTTL(key []byte, val []byte, ttl time.Duration) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	meta := encodeMeta(entryMeta{
+		flags: META_EXPIRES, expires: time.Now().Add(ttl).UnixNano(),
+	})
+	if err := checkMetaKV(db, key, val, meta); err != nil {
+		return err
+	}
+	db.insertMeta(key, val, meta)
+	return flushPages(db)
+}
+
+// delete a key found expired by a read, a failure is logged
+// and leaves it to the next read or the sweep
+func expireKey(db *KeyValue, key []byte) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var err error
+	defer recoverWrite(db, txSave(db), &err)
+	if checkWritable(db) != nil {
+		return
+	}
+	// it may have been set again since
+	_, meta, ok := db.tree.GetMeta(key)
+	if !ok || !metaExpired(meta, time.Now().UnixNano()) {
+		return
+	}
+	db.delete(key)
+	_ = flushPages(db)
+}
+
+// delete every expired key of the main tree, EXPIRY_BATCH keys per
+// write so readers get in between. returns the number deleted.
+func (db *KeyValue) PurgeExpired() (int, error) {
+	total := 0
+	for {
+		n, more, err := purgeBatch(db)
+		total += n
+		if err != nil || !more {
+			return total, err
+		}
+	}
+}
+
+// more is set if it stopped short of the expired keys there may be
+func purgeBatch(db *KeyValue) (n int, more bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return 0, false, err
+	}
+
+	now := time.Now().UnixNano()
+	keys := [][]byte{}
+	for iter := seekFirst(&db.tree); iter.Valid() && len(keys) < EXPIRY_BATCH; iter.Next() {
+		key, _, meta := iter.DerefMeta()
+		if metaExpired(meta, now) {
+			keys = append(keys, append([]byte{}, key...))
+		}
+	}
+	if len(keys) == 0 {
+		return 0, false, nil
+	}
+	more = len(keys) == EXPIRY_BATCH
+	for i, key := range keys {
+		db.delete(key)
+		if dirtyHalf(db) && i+1 < len(keys) {
+			keys, more = keys[:i+1], true // the rest in the next batch
+			break
+		}
+	}
+	if err := flushPages(db); err != nil {
+		return 0, false, err
+	}
+	logger(db).Debugf("purged %d expired keys", len(keys))
+	return len(keys), more, nil
+}
+
+// run PurgeExpired every Options.ExpirySweep until Close
+func sweepStart(db *KeyValue) {
+	if db.Options.ExpirySweep <= 0 || db.Options.ReadOnly {
+		return
+	}
+	db.sweep.mu.Lock()
+	defer db.sweep.mu.Unlock()
+	stop, done := make(chan struct{}), make(chan struct{})
+	db.sweep.stop, db.sweep.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(db.Options.ExpirySweep)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := db.PurgeExpired(); err != nil {
+					logger(db).Warnf("expiry sweep: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// called by Close before it takes the lock the sweep needs
+func sweepStop(db *KeyValue) {
+	db.sweep.mu.Lock()
+	defer db.sweep.mu.Unlock()
+	if db.sweep.stop != nil {
+		close(db.sweep.stop)
+		<-db.sweep.done
+		db.sweep.stop, db.sweep.done = nil, nil
+	}
+}
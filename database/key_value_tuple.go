@@ -0,0 +1,69 @@
+package database
+
+import "bytes"
+
+/*
+A tuple key is its fields one after another, each escaped and ended so
+that the byte order of the keys is the field by field order:
+
+	0x00 in a field     -> 0x00 0xff
+	the end of a field  -> 0x00 0x01
+
+The end sorts before any byte a longer field continues with, and
+before an escaped 0x00, so a field sorts before its extensions and a
+tuple before the tuples it is a prefix of. A field can't contain an
+unescaped 0x00, so the boundaries are unambiguous.
+*/
+
+const (
+	TUPLE_ESC = 0xff // follows a 0x00 that is part of a field
+	TUPLE_END = 0x01 // follows the 0x00 ending a field
+)
+
+// encode the fields into a key that sorts field by field
+func EncodeTuple(fields ...[]byte) []byte {
+	size := 0
+	for _, f := range fields {
+		size += len(f) + bytes.Count(f, []byte{0}) + 2
+	}
+	out := make([]byte, 0, size)
+	for _, f := range fields {
+		for _, b := range f {
+			out = append(out, b)
+			if b == 0 {
+				out = append(out, TUPLE_ESC)
+			}
+		}
+		out = append(out, 0, TUPLE_END)
+	}
+	return out
+}
+
+// split a key made by EncodeTuple back into its fields
+func DecodeTuple(key []byte) ([][]byte, error) {
+	fields := [][]byte{}
+	field := []byte{}
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0 {
+			field = append(field, key[i])
+			continue
+		}
+		if i+1 == len(key) {
+			return nil, ErrBadTuple
+		}
+		i++
+		switch key[i] {
+		case TUPLE_ESC:
+			field = append(field, 0)
+		case TUPLE_END:
+			fields = append(fields, field)
+			field = []byte{}
+		default:
+			return nil, ErrBadTuple
+		}
+	}
+	if len(field) > 0 {
+		return nil, ErrBadTuple // the last field isn't ended
+	}
+	return fields, nil
+}
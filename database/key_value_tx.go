@@ -0,0 +1,318 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// a transaction, updates are buffered in memory until Commit.
+// a writable transaction holds the write lock and a read-only one the
+// read lock, so the db methods must not be called while one is open.
+// only the last write of a key is kept, the writes reach the tree at
+// Commit or Scan, so a key written many times changes it once.
+type Tx struct {
+	db       *KeyValue
+	writable bool
+	done     bool
+	err      error   // a checksum mismatch in a write, only Rollback is left
+	saved    txState // restored on rollback
+	// the writes not applied to the tree yet, in the order of the keys
+	writes map[string]txWrite
+	order  []string
+}
+
+// the last write of a key in a transaction
+type txWrite struct {
+	val     []byte // a copy
+	deleted bool
+}
+
+// the state a failed write goes back to, a failed commit may have
+// advanced it
+type txState struct {
+	roots   []uint64
+	free    uint64
+	flushed uint64
+	seq     uint64
+	held    []heldPages
+	appMeta map[string][]byte // replaced by SetMeta, never changed
+}
+
+func txSave(db *KeyValue) txState {
+	return txState{
+		roots:   treeRoots(db),
+		free:    db.free.head,
+		flushed: db.page.flushed,
+		seq:     db.seq,
+		held:    snapshotSave(db),
+		appMeta: db.appMeta,
+	}
+}
+
+// go back to the saved state and drop the pending updates
+func txRestore(db *KeyValue, saved txState) {
+	setTreeRoots(db, saved.roots)
+	db.free.head = saved.free
+	db.page.flushed = saved.flushed
+	db.seq = saved.seq
+	db.appMeta = saved.appMeta
+	snapshotRestore(db, saved.held)
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = make(map[uint64][]byte)
+	db.page.fresh = make(map[uint64]bool)
+	db.page.recycled = nil
+	allocReset(db)
+	db.changes.pending = nil
+	db.page.stats = FlushStats{}
+}
+
+// start a transaction, must be ended by Commit or Rollback
+func (db *KeyValue) Begin(writable bool) *Tx {
+	if !writable {
+		db.mu.RLock()
+		return &Tx{db: db}
+	}
+	db.mu.Lock()
+	return &Tx{db: db, writable: true, saved: txSave(db)}
+}
+
+func (tx *Tx) Get(key []byte) (val []byte, ok bool) {
+	defer recoverRead(tx.db)
+	if checkOpen(tx.db) != nil || checkKey(tx.db, key) != nil {
+		return nil, false
+	}
+	if w, ok := tx.writes[string(key)]; ok {
+		return readCopy(tx.db, w.val), !w.deleted
+	}
+	val, _, ok = treeGetLive(&tx.db.tree, key)
+	return readCopy(tx.db, val), ok
+}
+
+// iterate over the keys in [lo, hi) including the updates of the
+// transaction, only valid until the next write or the end of it
+func (tx *Tx) Scan(lo []byte, hi []byte) *Iter {
+	if checkOpen(tx.db) != nil {
+		return &Iter{iter: &BIter{}}
+	}
+	if err := tx.apply(); err != nil {
+		return &Iter{iter: &BIter{}, err: err}
+	}
+	return scanTree(tx.db, &tx.db.tree, lo, hi, nil)
+}
+
+func (tx *Tx) Set(key []byte, val []byte) (err error) {
+	defer tx.recover(&err)
+	if err := tx.check(key); err != nil {
+		return err
+	}
+	if err := checkKV(tx.db, key, val); err != nil {
+		return err
+	}
+	tx.buffer(key, txWrite{val: append([]byte{}, val...)})
+	return nil
+}
+
+func (tx *Tx) Del(key []byte) (deleted bool, err error) {
+	defer tx.recover(&err)
+	if err := tx.check(key); err != nil {
+		return false, err
+	}
+	if w, ok := tx.writes[string(key)]; ok {
+		deleted = !w.deleted
+	} else {
+		_, _, deleted = tx.db.tree.GetMeta(key) // expired keys too
+	}
+	tx.buffer(key, txWrite{deleted: true})
+	return deleted, nil
+}
+
+// replace the pending write of the key
+func (tx *Tx) buffer(key []byte, w txWrite) {
+	if tx.writes == nil {
+		tx.writes = map[string]txWrite{}
+	}
+	if _, ok := tx.writes[string(key)]; !ok {
+		tx.order = append(tx.order, string(key))
+	}
+	tx.writes[string(key)] = w
+}
+
+// write the pending writes to the tree
+func (tx *Tx) apply() (err error) {
+	defer tx.recover(&err)
+	for _, key := range tx.order {
+		if w := tx.writes[key]; w.deleted {
+			tx.db.delete([]byte(key))
+		} else {
+			tx.db.insert([]byte(key), w.val)
+		}
+	}
+	tx.writes, tx.order = nil, nil
+	return nil
+}
+
+// a checksum mismatch or too many dirty pages leave the write half
+// applied, so they fail the transaction
+func (tx *Tx) recover(err *error) {
+	if r := recover(); r != nil {
+		*err = writeError(tx.db, r)
+		tx.err = *err
+	}
+}
+
+func (tx *Tx) check(key []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	if err := checkWritable(tx.db); err != nil {
+		return err
+	}
+	return checkKey(tx.db, key)
+}
+
+// persist the updates, nothing is changed if it fails
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if !tx.writable {
+		tx.Rollback()
+		return nil
+	}
+	if tx.err != nil {
+		tx.Rollback()
+		return tx.err
+	}
+	if err := checkOpen(tx.db); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.apply(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := flushPages(tx.db); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.done = true
+	tx.db.mu.Unlock()
+	return nil
+}
+
+// the new pages held in memory by the writes applied to the tree, see
+// Options.MaxDirtyPages. the writes are applied at Scan and Commit, so
+// the ones after the last Scan aren't counted. 0 for a read-only one.
+func (tx *Tx) DirtyPages() int {
+	if !tx.writable || tx.done {
+		return 0
+	}
+	return dirtyPages(tx.db)
+}
+
+// discard the updates
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	if !tx.writable {
+		tx.db.mu.RUnlock()
+		return
+	}
+	txRestore(tx.db, tx.saved)
+	tx.db.mu.Unlock()
+}
+
+// run fn in a writable transaction, committing if it returns nil
+// and rolling back if it returns an error or panics
+func (db *KeyValue) Update(fn func(tx *Tx) error) error {
+	return runTx(db.Begin(true), fn)
+}
+
+// run fn in a read-only transaction
+func (db *KeyValue) View(fn func(tx *Tx) error) error {
+	return runTx(db.Begin(false), fn)
+}
+
+func runTx(tx *Tx, fn func(tx *Tx) error) error {
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// a check of a key for Txn, the key must hold Value, any value if
+// it's nil, or be missing with Absent
+type Condition struct {
+	Key    []byte
+	Value  []byte
+	Absent bool
+}
+
+// a write of Txn, a set unless Delete
+type Op struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+func (c Condition) holds(tx *Tx) bool {
+	val, ok := tx.Get(c.Key)
+	if c.Absent {
+		return !ok
+	}
+	return ok && (c.Value == nil || bytes.Equal(val, c.Value))
+}
+
+// apply onSuccess if all the conditions hold and onFailure if not, in
+// one commit under the write lock, so no write gets in between the
+// checks and the ops. returns whether the conditions held. a failed op
+// leaves the database unchanged.
+func (db *KeyValue) Txn(conds []Condition, onSuccess []Op, onFailure []Op) (ok bool, err error) {
+	err = db.Update(func(tx *Tx) error {
+		if err := checkWritable(db); err != nil {
+			return err
+		}
+		ok = true
+		for _, c := range conds {
+			if !c.holds(tx) {
+				ok = false
+				break
+			}
+		}
+		ops := onSuccess
+		if !ok {
+			ops = onFailure
+		}
+		for _, op := range ops {
+			if op.Delete {
+				_, err = tx.Del(op.Key)
+			} else {
+				err = tx.Set(op.Key, op.Value)
+			}
+			if err != nil {
+				return fmt.Errorf("Txn: %q: %w", op.Key, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
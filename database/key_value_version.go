@@ -0,0 +1,46 @@
+package database
+
+// Get with the version stored by SetVersioned, 0 for a key
+// written by the other setters
+func (db *KeyValue) GetVersioned(key []byte) (val []byte, version uint64, ok bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	if checkOpen(db) != nil || checkKey(db, key) != nil {
+		return nil, 0, false
+	}
+	val, meta, ok := treeGetLive(&db.tree, key)
+	return readCopy(db, val), decodeMeta(meta).version, ok
+}
+
+// write the key only if its version is expectedVersion, 0 means it
+// must not exist. returns the new version, expectedVersion+1, or
+// ErrVersionMismatch. a key written by the other setters has no
+// version, so it can't be replaced this way.
+func (db *KeyValue) SetVersioned(key []byte, val []byte, expectedVersion uint64) (version uint64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverWrite(db, txSave(db), &err)
+	if err := checkWritable(db); err != nil {
+		return 0, err
+	}
+	meta := encodeMeta(entryMeta{flags: META_VERSION, version: expectedVersion + 1})
+	if err := checkMetaKV(db, key, val, meta); err != nil {
+		return 0, err
+	}
+
+	_, stored, ok := treeGetLive(&db.tree, key)
+	current := decodeMeta(stored)
+	switch {
+	case expectedVersion == 0 && ok:
+		return 0, ErrVersionMismatch
+	case expectedVersion != 0 && (!ok || current.flags&META_VERSION == 0 ||
+		current.version != expectedVersion):
+		return 0, ErrVersionMismatch
+	}
+	db.insertMeta(key, val, meta)
+	if err := flushPages(db); err != nil {
+		return 0, err
+	}
+	return expectedVersion + 1, nil
+}
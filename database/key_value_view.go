@@ -0,0 +1,99 @@
+package database
+
+import (
+	"bytes"
+	"io"
+)
+
+/*
+A View is a value read in place from the mapped file. It pins the
+commit it was read at like an iterator does: a write that frees the
+value's page holds it back from the free list instead of waiting, and
+the page is reused only after every View and iterator that could read
+it is released. Until Release the bytes stay valid and unchanged
+whatever is written meanwhile. They must not be modified, and must not
+be used after Release or Close. A View that is never released keeps its
+pages out of the free list, and Shrink and Compact fail until it is.
+
+GetReader streams a View. The values are stored inline in their leaf,
+up to MaxValSize, so the reader saves the copy of Get but the value is
+never more than a page.
+*/
+
+// a value aliasing the mapped file, see GetView
+type View struct {
+	db       *KeyValue
+	seq      uint64
+	val      []byte
+	released bool
+}
+
+// Get without copying the value out of the file. the View must be
+// released, a missing key returns nil, false and pins nothing.
+func (db *KeyValue) GetView(key []byte) (view *View, ok bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverRead(db)
+	if checkOpen(db) != nil || checkKey(db, key) != nil {
+		return nil, false
+	}
+	// the read lock keeps the pages of this commit from being freed
+	val, _, ok := treeGetLive(&db.tree, key)
+	if !ok {
+		return nil, false
+	}
+	snapshotPin(db, db.seq)
+	return &View{db: db, seq: db.seq, val: val}, true
+}
+
+// the value, valid until Release or Close. nil once the database is
+// closed.
+func (v *View) Bytes() []byte {
+	if !snapshotEnter(v.db) {
+		return nil
+	}
+	defer snapshotLeave(v.db)
+	return v.val
+}
+
+// unpin the pages of the value, calling it again does nothing
+func (v *View) Release() {
+	if v.released {
+		return
+	}
+	v.released = true
+	v.val = nil
+	snapshotUnpin(v.db, v.seq)
+}
+
+// a View read through io.Reader, see GetReader
+type viewReader struct {
+	reader *bytes.Reader
+	view   *View
+}
+
+// the value of the key read in place, the pages stay pinned like a
+// View's until Close. a missing key returns nil, false.
+func (db *KeyValue) GetReader(key []byte) (io.ReadCloser, bool) {
+	view, ok := db.GetView(key)
+	if !ok {
+		return nil, false
+	}
+	return &viewReader{reader: bytes.NewReader(view.Bytes()), view: view}, true
+}
+
+// the reads fail with ErrClosed once the database is closed
+func (r *viewReader) Read(p []byte) (int, error) {
+	if !snapshotEnter(r.view.db) {
+		return 0, ErrClosed
+	}
+	defer snapshotLeave(r.view.db)
+	return r.reader.Read(p)
+}
+
+// release the View, the reads after it hit io.EOF
+func (r *viewReader) Close() error {
+	r.reader.Reset(nil)
+	r.view.Release()
+	return nil
+}